@@ -0,0 +1,217 @@
+package drpmesh
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// authNonceTTL is how long an issued auth challenge remains valid
+const authNonceTTL = 30 * time.Second
+
+// NodeHello is sent by a connecting Node; it carries the declaration plus proof of mesh key knowledge.  MeshKey is
+// only sent in cleartext to Nodes which do not issue auth challenges (Node.js), and only if LegacyMeshKeyAuth is set.
+type NodeHello struct {
+	NodeDeclaration
+	MeshKey   string `json:",omitempty"`
+	AuthNonce string `json:",omitempty"`
+	AuthProof string `json:",omitempty"`
+}
+
+// AuthChallenge is returned to a connecting Node which must sign the nonce with the mesh key
+type AuthChallenge struct {
+	Nonce string
+}
+
+// CreateAuthNonce returns a random hex encoded nonce
+func CreateAuthNonce() string {
+	return RandomHex(32)
+}
+
+// ComputeMeshKeyProof returns the HMAC-SHA256 of a nonce bound to a NodeID and domain, keyed with the mesh key
+func ComputeMeshKeyProof(meshKey string, nonce string, nodeID string, domainName string) string {
+	mac := hmac.New(sha256.New, []byte(meshKey))
+	mac.Write([]byte(nonce + "|" + nodeID + "|" + domainName))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// IssueAuthChallenge creates a one-time nonce for a connecting Node.  Only the latest nonce issued to an Endpoint
+// is valid, so a connection can not accumulate outstanding challenges.
+func (dn *Node) IssueAuthChallenge(challengedEndpoint EndpointInterface) AuthChallenge {
+	return AuthChallenge{challengedEndpoint.baseEndpoint().issueAuthNonce()}
+}
+
+// CreateHello returns the hello parameters answering a challenge from a remote Node
+func (dn *Node) CreateHello(challenge *AuthChallenge) *NodeHello {
+	thisNode := dn
+	nodeHello := &NodeHello{}
+	nodeHello.NodeDeclaration = *thisNode.NodeDeclaration
+	if challenge != nil {
+		nodeHello.AuthNonce = challenge.Nonce
+		nodeHello.AuthProof = ComputeMeshKeyProof(thisNode.meshKey, challenge.Nonce, thisNode.NodeID, thisNode.DomainName)
+	} else if thisNode.LegacyMeshKeyAuth {
+		nodeHello.MeshKey = thisNode.meshKey
+	}
+	return nodeHello
+}
+
+// ValidateNodeDeclaration verifies a remote Node's declaration and proof of mesh key knowledge; the proof must answer
+// the challenge issued to the Endpoint the hello arrived on
+func (dn *Node) ValidateNodeDeclaration(nodeHello *NodeHello, sourceEndpoint EndpointInterface) error {
+	thisNode := dn
+
+	// Is the NodeID specified?
+	if nodeHello.NodeID == "" {
+		return errors.New("no NodeID specified")
+	}
+
+	// Do the domains match?
+	if nodeHello.DomainName != thisNode.DomainName {
+		return fmt.Errorf("DomainName doesn't match, local[%s] remote[%s]", thisNode.DomainName, nodeHello.DomainName)
+	}
+
+	// Did this node just connect to itself?
+	if nodeHello.NodeID == thisNode.NodeID {
+		return errors.New("remote NodeID matches local NodeID")
+	}
+
+	// Verify the MeshKey proof
+	if thisNode.meshKey == "" {
+		return errors.New("local node has no MeshKey configured")
+	}
+	if nodeHello.AuthNonce == "" && nodeHello.AuthProof == "" && nodeHello.MeshKey != "" {
+		// Node.js peers send the key itself
+		if !thisNode.LegacyMeshKeyAuth {
+			return errors.New("cleartext MeshKey is not accepted, LegacyMeshKeyAuth is not set")
+		}
+		if !hmac.Equal([]byte(thisNode.meshKey), []byte(nodeHello.MeshKey)) {
+			return errors.New("MeshKey doesn't match")
+		}
+		return nil
+	}
+	if nodeHello.AuthNonce == "" || nodeHello.AuthProof == "" {
+		return errors.New("no MeshKey proof provided")
+	}
+	if !sourceEndpoint.baseEndpoint().consumeAuthNonce(nodeHello.AuthNonce) {
+		return errors.New("auth nonce is unknown or expired")
+	}
+	expectedProof := ComputeMeshKeyProof(thisNode.meshKey, nodeHello.AuthNonce, nodeHello.NodeID, nodeHello.DomainName)
+	if !hmac.Equal([]byte(expectedProof), []byte(nodeHello.AuthProof)) {
+		return errors.New("MeshKey proof doesn't match")
+	}
+
+	return nil
+}
+
+// Hello processes a hello from a remote Node (inbound connection)
+func (dn *Node) Hello(params *CmdParams, sourceEndpoint EndpointInterface) interface{} {
+	thisNode := dn
+
+	// A connection authenticates once; its NodeID can not be changed by a later hello
+	if sourceEndpoint.GetID() != nil {
+		return errors.New("endpoint has already authenticated")
+	}
+
+	nodeHello := &NodeHello{}
+	if params != nil {
+		paramsJSON, _ := json.Marshal(params)
+		json.Unmarshal(paramsJSON, nodeHello)
+	}
+
+	validateErr := thisNode.ValidateNodeDeclaration(nodeHello, sourceEndpoint)
+	if validateErr != nil {
+		closeReason := fmt.Sprintf("DRP authentication failed: %s", validateErr)
+		thisNode.Log(fmt.Sprintf("Rejecting declaration from [%s] - %s", nodeHello.NodeID, validateErr), false)
+		sourceEndpoint.Close(CloseCodeAuthFailed, closeReason)
+		return nil
+	}
+
+	if thisNode.IsDuplicateNodeID(&nodeHello.NodeDeclaration, sourceEndpoint) {
+		thisNode.Log(fmt.Sprintf("Rejecting declaration from [%s] - NodeID is already in use", nodeHello.NodeID), false)
+		sourceEndpoint.Close(CloseCodeDuplicateNodeID, fmt.Sprintf("NodeID [%s] is already in use", nodeHello.NodeID))
+		return nil
+	}
+
+	thisNode.Log(fmt.Sprintf("Remote node client sent Hello [%s]", nodeHello.NodeID), true)
+
+	remoteNodeID := nodeHello.NodeID
+	sourceEndpoint.SetID(remoteNodeID)
+	thisNode.ApplyNodeEndpointMethods(sourceEndpoint)
+	if !thisNode.keepNodeEndpoint(remoteNodeID, sourceEndpoint) {
+		thisNode.Log(fmt.Sprintf("Rejecting declaration from [%s] - already connected to it", remoteNodeID), false)
+		sourceEndpoint.Close(CloseCodeRedundantConnection, "already connected")
+		return nil
+	}
+
+	// A Relay fronts Nodes which do not accept connections; so does any non-Registry Node which has not seen the remote Node
+	localNodeIsProxy := false
+	if thisNode.IsRelay() && nodeHello.NodeURL == nil {
+		localNodeIsProxy = true
+	} else if !thisNode.IsRegistry() && !thisNode.TopologyTracker.ValidateNodeID(remoteNodeID) {
+		localNodeIsProxy = true
+	}
+
+	// Process the connection outside of the receive loop; it waits on replies from the remote Node
+	go thisNode.TopologyTracker.ProcessNodeConnect(sourceEndpoint, &nodeHello.NodeDeclaration, localNodeIsProxy)
+
+	return map[string]string{"status": "OK"}
+}
+
+// authenticate answers an auth challenge from the remote Node with a hello and returns an error unless the remote
+// Node accepted it.  Without a challenge the connection is refused, unless LegacyMeshKeyAuth allows sending the
+// mesh key in cleartext.
+func (dc *Client) authenticate() error {
+	thisNode := dc.drpNode
+
+	// Request an auth challenge so we can prove knowledge of the mesh key without sending it
+	var authChallenge *AuthChallenge = nil
+	challengeResponse := dc.SendCmdAwaitTimeout("DRP", "getAuthChallenge", nil, nil, nil, HandshakeTimeout)
+	if challengeResponse != nil && challengeResponse.Status != 0 && challengeResponse.Payload != nil {
+		authChallenge = &AuthChallenge{}
+		err := json.Unmarshal(*challengeResponse.Payload, authChallenge)
+		if err != nil || authChallenge.Nonce == "" {
+			authChallenge = nil
+		}
+	}
+	if authChallenge == nil {
+		if !thisNode.LegacyMeshKeyAuth {
+			return fmt.Errorf("did not receive an auth challenge from %s", dc.wsTarget)
+		}
+		thisNode.Log(fmt.Sprintf("Did not receive an auth challenge from %s, sending legacy MeshKey", dc.wsTarget), false)
+	}
+
+	thisNode.Log("Sending hello...", false)
+	responsePacket := dc.SendCmdAwaitTimeout("DRP", "hello", thisNode.CreateHello(authChallenge), nil, nil, HandshakeTimeout)
+	if responsePacket == nil {
+		return fmt.Errorf("no response to hello from %s", dc.wsTarget)
+	}
+	thisNode.Log(fmt.Sprintf("Received response from hello: %s", string(responsePacket.ToJSON())), true)
+
+	helloResult := &struct {
+		Status string `json:"status"`
+	}{}
+	if responsePacket.Status == 0 || responsePacket.Payload == nil || json.Unmarshal(*responsePacket.Payload, helloResult) != nil || helloResult.Status != "OK" {
+		return fmt.Errorf("hello rejected by %s", dc.wsTarget)
+	}
+	return nil
+}
+
+// ApplyServerEndpointMethods applies the methods a remote Node may call before it has authenticated
+func (dn *Node) ApplyServerEndpointMethods(targetEndpoint EndpointInterface) {
+	thisNode := dn
+
+	targetEndpoint.RegisterMethod("getAuthChallenge", func(params *CmdParams, callingEndpoint EndpointInterface, token *int) interface{} {
+		if callingEndpoint.GetID() != nil {
+			return errors.New("endpoint has already authenticated")
+		}
+		return thisNode.IssueAuthChallenge(callingEndpoint)
+	})
+
+	targetEndpoint.RegisterMethod("hello", func(params *CmdParams, callingEndpoint EndpointInterface, token *int) interface{} {
+		return thisNode.Hello(params, callingEndpoint)
+	})
+}
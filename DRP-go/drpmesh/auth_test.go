@@ -0,0 +1,298 @@
+package drpmesh
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testWebSocketURL returns the websocket URL of a test HTTP server
+func testWebSocketURL(testServer *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(testServer.URL, "http")
+}
+
+// waitFor polls a condition until it holds or the wait expires
+func waitFor(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+	for waitStep := 0; waitStep < 100; waitStep++ {
+		if condition() {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", description)
+}
+
+func TestComputeMeshKeyProof(t *testing.T) {
+	baseProof := ComputeMeshKeyProof("meshkey", "nonce1", "node1", "test.domain")
+	if len(baseProof) != 64 || baseProof != ComputeMeshKeyProof("meshkey", "nonce1", "node1", "test.domain") {
+		t.Fatalf("expected a stable hex encoded SHA-256 HMAC, got %s", baseProof)
+	}
+
+	// Every input is bound into the proof
+	changedProofs := map[string]string{
+		"key":    ComputeMeshKeyProof("otherkey", "nonce1", "node1", "test.domain"),
+		"nonce":  ComputeMeshKeyProof("meshkey", "nonce2", "node1", "test.domain"),
+		"node":   ComputeMeshKeyProof("meshkey", "nonce1", "node2", "test.domain"),
+		"domain": ComputeMeshKeyProof("meshkey", "nonce1", "node1", "other.domain"),
+	}
+	for changedInput, changedProof := range changedProofs {
+		if changedProof == baseProof {
+			t.Fatalf("expected changing the %s to change the proof", changedInput)
+		}
+	}
+}
+
+func TestValidateNodeDeclaration(t *testing.T) {
+	localNodeID := "registry1"
+	thisNode := testNode(t, testNodeOptions("Registry", localNodeID))
+
+	helloEndpoint := &Endpoint{drpNode: thisNode}
+	helloEndpoint.Init()
+
+	// signedHello returns a hello from another Node answering a fresh challenge with the given key
+	signedHello := func(nodeID string, domainName string, meshKey string) *NodeHello {
+		authChallenge := thisNode.IssueAuthChallenge(helloEndpoint)
+		nodeHello := &NodeHello{}
+		nodeHello.NodeID = nodeID
+		nodeHello.DomainName = domainName
+		nodeHello.AuthNonce = authChallenge.Nonce
+		nodeHello.AuthProof = ComputeMeshKeyProof(meshKey, authChallenge.Nonce, nodeID, domainName)
+		return nodeHello
+	}
+
+	validHello := signedHello("provider1", "test.domain", "meshkey")
+	if err := thisNode.ValidateNodeDeclaration(validHello, helloEndpoint); err != nil {
+		t.Fatalf("expected a valid hello to be accepted, got %s", err)
+	}
+	if err := thisNode.ValidateNodeDeclaration(validHello, helloEndpoint); err == nil {
+		t.Fatalf("expected a replayed nonce to be rejected")
+	}
+
+	// Only the latest challenge issued to an Endpoint can be answered
+	supersededHello := signedHello("provider1", "test.domain", "meshkey")
+	latestHello := signedHello("provider1", "test.domain", "meshkey")
+	if err := thisNode.ValidateNodeDeclaration(supersededHello, helloEndpoint); err == nil {
+		t.Fatalf("expected a superseded nonce to be rejected")
+	}
+	if err := thisNode.ValidateNodeDeclaration(latestHello, helloEndpoint); err != nil {
+		t.Fatalf("expected the latest nonce to be accepted, got %s", err)
+	}
+
+	// A nonce issued to one Endpoint can not be answered on another
+	otherEndpoint := &Endpoint{drpNode: thisNode}
+	otherEndpoint.Init()
+	if err := thisNode.ValidateNodeDeclaration(signedHello("provider1", "test.domain", "meshkey"), otherEndpoint); err == nil {
+		t.Fatalf("expected a nonce issued to another Endpoint to be rejected")
+	}
+
+	forgedNonceHello := &NodeHello{}
+	forgedNonceHello.NodeID = "provider1"
+	forgedNonceHello.DomainName = "test.domain"
+	forgedNonceHello.AuthNonce = "unknown"
+	forgedNonceHello.AuthProof = ComputeMeshKeyProof("meshkey", "unknown", "provider1", "test.domain")
+
+	legacyHello := &NodeHello{}
+	legacyHello.NodeID = "provider1"
+	legacyHello.DomainName = "test.domain"
+	legacyHello.MeshKey = "meshkey"
+
+	rejectedHellos := map[string]*NodeHello{
+		"no NodeID":       signedHello("", "test.domain", "meshkey"),
+		"other domain":    signedHello("provider1", "other.domain", "meshkey"),
+		"own NodeID":      signedHello(localNodeID, "test.domain", "meshkey"),
+		"wrong key":       signedHello("provider1", "test.domain", "otherkey"),
+		"no proof":        {NodeDeclaration: NodeDeclaration{NodeID: "provider1", DomainName: "test.domain"}},
+		"unknown nonce":   forgedNonceHello,
+		"cleartext key":   legacyHello,
+		"proof for other": signedHello("provider2", "test.domain", "meshkey"),
+	}
+	// A proof computed for one NodeID can not be presented by another
+	rejectedHellos["proof for other"].NodeID = "provider1"
+	for rejectReason, rejectedHello := range rejectedHellos {
+		if err := thisNode.ValidateNodeDeclaration(rejectedHello, helloEndpoint); err == nil {
+			t.Fatalf("expected hello with %s to be rejected", rejectReason)
+		}
+	}
+
+	// Node.js peers send the mesh key itself; only accepted when enabled
+	thisNode.LegacyMeshKeyAuth = true
+	if err := thisNode.ValidateNodeDeclaration(legacyHello, helloEndpoint); err != nil {
+		t.Fatalf("expected a legacy hello to be accepted, got %s", err)
+	}
+	legacyHello.MeshKey = "otherkey"
+	if err := thisNode.ValidateNodeDeclaration(legacyHello, helloEndpoint); err == nil {
+		t.Fatalf("expected a legacy hello with the wrong key to be rejected")
+	}
+}
+
+func TestNodeHandshake(t *testing.T) {
+	registryNodeID := "registry1"
+	registryNode := testNode(t, testNodeOptions("Registry", registryNodeID))
+	registryServer := httptest.NewServer(registryNode)
+	defer registryServer.Close()
+
+	// A Node with the wrong key is refused and its open callback never runs
+	wrongKeyNodeID := "provider2"
+	wrongKeyOptions := testNodeOptions("Provider", wrongKeyNodeID)
+	wrongKeyOptions.HostID = "host2"
+	wrongKeyOptions.MeshKey = "otherkey"
+	wrongKeyNode := testNode(t, wrongKeyOptions)
+	wrongKeyOpened := false
+	wrongKeyCallback := func() { wrongKeyOpened = true }
+	if err := (&Client{}).Connect(testWebSocketURL(registryServer), nil, wrongKeyNode, nil, false, &wrongKeyCallback, nil); err == nil || wrongKeyOpened {
+		t.Fatalf("expected a Node with the wrong key to be refused")
+	}
+
+	// A Node with the right key is accepted and added to the Registry's topology
+	providerNodeID := "provider1"
+	providerOptions := testNodeOptions("Provider", providerNodeID)
+	providerOptions.HostID = "host3"
+	providerNode := testNode(t, providerOptions)
+	providerOpened := false
+	providerCallback := func() { providerOpened = true }
+	if err := (&Client{}).Connect(testWebSocketURL(registryServer), nil, providerNode, nil, false, &providerCallback, nil); err != nil || !providerOpened {
+		t.Fatalf("expected the Node to connect, got %v", err)
+	}
+	waitFor(t, "the Registry to learn the Node", func() bool {
+		return registryNode.TopologyTracker.GetNodeEntry(providerNodeID) != nil
+	})
+	if registryNode.TopologyTracker.GetNodeEntry(wrongKeyNodeID) != nil {
+		t.Fatalf("expected the refused Node not to be learned")
+	}
+}
+
+func TestRepeatedHello(t *testing.T) {
+	registryNode := testNode(t, testNodeOptions("Registry", "registry1"))
+	registryServer := httptest.NewServer(registryNode)
+	defer registryServer.Close()
+	clientConn, _, err := websocket.DefaultDialer.Dial(testWebSocketURL(registryServer), nil)
+	if err != nil {
+		t.Fatalf("could not connect test websocket: %s", err)
+	}
+	defer clientConn.Close()
+
+	// sendHandshakeCmd sends a DRP command and returns its reply, skipping commands the Registry sends once connected
+	cmdToken := 0
+	sendHandshakeCmd := func(methodName string, cmdParams interface{}) *ReplyIn {
+		t.Helper()
+		cmdToken++
+		drpServiceName := "DRP"
+		testCmd := &CmdOut{}
+		testCmd.Type = "cmd"
+		testCmd.Token = &cmdToken
+		testCmd.Method = &methodName
+		testCmd.ServiceName = &drpServiceName
+		testCmd.Params = cmdParams
+		if err := clientConn.WriteMessage(websocket.TextMessage, testCmd.ToJSON()); err != nil {
+			t.Fatalf("could not send %s: %s", methodName, err)
+		}
+		for {
+			replyPacket := readTestReply(t, clientConn)
+			if replyPacket.Type == "reply" && replyPacket.Token != nil && *replyPacket.Token == cmdToken {
+				return replyPacket
+			}
+		}
+	}
+	signedHello := func(challengeReply *ReplyIn) *NodeHello {
+		authChallenge := &AuthChallenge{}
+		if challengeReply.Status != 1 || json.Unmarshal(*challengeReply.Payload, authChallenge) != nil {
+			t.Fatalf("expected an auth challenge, got %s", string(challengeReply.ToJSON()))
+		}
+		nodeHello := &NodeHello{}
+		nodeHello.NodeID = "provider1"
+		nodeHello.HostID = "host2"
+		nodeHello.DomainName = "test.domain"
+		nodeHello.NodeRoles = []string{"Provider"}
+		nodeHello.AuthNonce = authChallenge.Nonce
+		nodeHello.AuthProof = ComputeMeshKeyProof("meshkey", authChallenge.Nonce, nodeHello.NodeID, nodeHello.DomainName)
+		return nodeHello
+	}
+
+	// Repeated challenges replace each other rather than accumulating
+	sendHandshakeCmd("getAuthChallenge", nil)
+	validHello := signedHello(sendHandshakeCmd("getAuthChallenge", nil))
+	if helloReply := sendHandshakeCmd("hello", validHello); helloReply.Status != 1 {
+		t.Fatalf("expected the hello to be accepted, got %s", string(helloReply.ToJSON()))
+	}
+
+	// Once authenticated, the connection can not be challenged or authenticated again
+	if challengeReply := sendHandshakeCmd("getAuthChallenge", nil); challengeReply.Status != 0 {
+		t.Fatalf("expected a challenge on an authenticated connection to be refused, got %s", string(challengeReply.ToJSON()))
+	}
+	validHello.NodeID = "provider2"
+	if helloReply := sendHandshakeCmd("hello", validHello); helloReply.Status != 0 {
+		t.Fatalf("expected a second hello to be refused, got %s", string(helloReply.ToJSON()))
+	}
+	if registryNode.TopologyTracker.GetNodeEntry("provider2") != nil || registryNode.GetNodeEndpoint("provider2") != nil {
+		t.Fatalf("expected the second hello not to register another Node")
+	}
+}
+
+func TestNodeHandshakeWithoutChallenge(t *testing.T) {
+	// A Node.js Registry does not issue challenges and checks the cleartext key from the declaration
+	var helloLock sync.Mutex
+	receivedHellos := []map[string]interface{}{}
+	upgrader := websocket.Upgrader{}
+	legacyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wsConn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer wsConn.Close()
+		for {
+			_, cmdBytes, err := wsConn.ReadMessage()
+			if err != nil {
+				return
+			}
+			cmdPacket := &Cmd{}
+			json.Unmarshal(cmdBytes, cmdPacket)
+			replyPacket := &ReplyOut{}
+			replyPacket.Type = "reply"
+			replyPacket.Token = cmdPacket.Token
+			switch *cmdPacket.Method {
+			case "hello":
+				helloParams := map[string]interface{}{}
+				paramsJSON, _ := json.Marshal(cmdPacket.Params)
+				json.Unmarshal(paramsJSON, &helloParams)
+				helloLock.Lock()
+				receivedHellos = append(receivedHellos, helloParams)
+				helloLock.Unlock()
+				replyPacket.Status = 1
+				replyPacket.Payload = map[string]string{"status": "OK"}
+			default:
+				replyPacket.Status = 0
+				replyPacket.Payload = "method not found"
+			}
+			wsConn.WriteMessage(websocket.TextMessage, replyPacket.ToJSON())
+		}
+	}))
+	defer legacyServer.Close()
+
+	providerNodeID := "provider1"
+	providerNode := testNode(t, testNodeOptions("Provider", providerNodeID))
+	if err := (&Client{}).Connect(testWebSocketURL(legacyServer), nil, providerNode, nil, false, nil, nil); err == nil {
+		t.Fatalf("expected the connection to be refused without a challenge")
+	}
+	helloLock.Lock()
+	if len(receivedHellos) != 0 {
+		t.Fatalf("expected no hello to be sent without a challenge, got %v", receivedHellos)
+	}
+	helloLock.Unlock()
+
+	providerNode.LegacyMeshKeyAuth = true
+	if err := (&Client{}).Connect(testWebSocketURL(legacyServer), nil, providerNode, nil, false, nil, nil); err != nil {
+		t.Fatalf("expected the legacy connection to succeed, got %s", err)
+	}
+	helloLock.Lock()
+	defer helloLock.Unlock()
+	if len(receivedHellos) != 1 || receivedHellos[0]["MeshKey"] != "meshkey" || receivedHellos[0]["NodeID"] != providerNodeID {
+		t.Fatalf("expected one hello with the cleartext key, got %v", receivedHellos)
+	}
+}
@@ -0,0 +1,296 @@
+package drpmesh
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	wr "github.com/mroth/weightedrand"
+)
+
+// Balancer names accepted by NewBalancer
+const (
+	BalancerWeightedRandom   = "weightedRandom"
+	BalancerRoundRobin       = "roundRobin"
+	BalancerLeastOutstanding = "leastOutstanding"
+	BalancerLowestLatency    = "lowestLatency"
+	BalancerPowerOfTwo       = "powerOfTwo"
+)
+
+// latencySmoothing is the weight given to the newest sample in the moving average latency
+const latencySmoothing = 0.3
+
+// Balancer selects one instance from a list of equally preferred service instances
+type Balancer interface {
+	Name() string
+	Pick(candidateList []*ServiceTableEntry, serviceStats *ServiceStatsTracker) *ServiceTableEntry
+}
+
+// NewBalancer returns a Balancer by name, or nil if the name is not recognized
+func NewBalancer(balancerName string) Balancer {
+	switch balancerName {
+	case BalancerWeightedRandom:
+		return &WeightedRandomBalancer{}
+	case BalancerRoundRobin:
+		return &RoundRobinBalancer{}
+	case BalancerLeastOutstanding:
+		return &LeastOutstandingBalancer{}
+	case BalancerLowestLatency:
+		return &LowestLatencyBalancer{}
+	case BalancerPowerOfTwo:
+		return &PowerOfTwoBalancer{}
+	default:
+		return nil
+	}
+}
+
+// WeightedRandomBalancer picks an instance at random, in proportion to each instance's Weight
+type WeightedRandomBalancer struct{}
+
+// Name returns the name of the Balancer
+func (b *WeightedRandomBalancer) Name() string {
+	return BalancerWeightedRandom
+}
+
+// Pick selects an instance
+func (b *WeightedRandomBalancer) Pick(candidateList []*ServiceTableEntry, serviceStats *ServiceStatsTracker) *ServiceTableEntry {
+	return pickWeightedRandom(candidateList)
+}
+
+// RoundRobinBalancer cycles through instances of each service in InstanceID order
+type RoundRobinBalancer struct {
+	nextIndex map[string]int
+	indexLock sync.Mutex
+}
+
+// Name returns the name of the Balancer
+func (b *RoundRobinBalancer) Name() string {
+	return BalancerRoundRobin
+}
+
+// Pick selects an instance
+func (b *RoundRobinBalancer) Pick(candidateList []*ServiceTableEntry, serviceStats *ServiceStatsTracker) *ServiceTableEntry {
+	if len(candidateList) == 0 {
+		return nil
+	}
+
+	sortedList := append([]*ServiceTableEntry{}, candidateList...)
+	sort.Slice(sortedList, func(i, j int) bool {
+		return *sortedList[i].InstanceID < *sortedList[j].InstanceID
+	})
+
+	b.indexLock.Lock()
+	defer b.indexLock.Unlock()
+	if b.nextIndex == nil {
+		b.nextIndex = make(map[string]int)
+	}
+	serviceName := *sortedList[0].Name
+	pickIndex := b.nextIndex[serviceName] % len(sortedList)
+	b.nextIndex[serviceName] = pickIndex + 1
+
+	return sortedList[pickIndex]
+}
+
+// LeastOutstandingBalancer picks the instance with the fewest requests in flight
+type LeastOutstandingBalancer struct{}
+
+// Name returns the name of the Balancer
+func (b *LeastOutstandingBalancer) Name() string {
+	return BalancerLeastOutstanding
+}
+
+// Pick selects an instance
+func (b *LeastOutstandingBalancer) Pick(candidateList []*ServiceTableEntry, serviceStats *ServiceStatsTracker) *ServiceTableEntry {
+	leastList := []*ServiceTableEntry{}
+	var leastInFlight int64 = -1
+	for _, serviceTableEntry := range candidateList {
+		inFlight := serviceStats.Get(*serviceTableEntry.InstanceID).InFlight
+		if leastInFlight < 0 || inFlight < leastInFlight {
+			leastInFlight = inFlight
+			leastList = []*ServiceTableEntry{serviceTableEntry}
+		} else if inFlight == leastInFlight {
+			leastList = append(leastList, serviceTableEntry)
+		}
+	}
+	return pickWeightedRandom(leastList)
+}
+
+// LowestLatencyBalancer picks the instance with the lowest measured round trip time; unmeasured instances are tried first
+type LowestLatencyBalancer struct{}
+
+// Name returns the name of the Balancer
+func (b *LowestLatencyBalancer) Name() string {
+	return BalancerLowestLatency
+}
+
+// Pick selects an instance
+func (b *LowestLatencyBalancer) Pick(candidateList []*ServiceTableEntry, serviceStats *ServiceStatsTracker) *ServiceTableEntry {
+	unmeasuredList := []*ServiceTableEntry{}
+	var bestServiceEntry *ServiceTableEntry = nil
+	var bestLatency time.Duration = 0
+	for _, serviceTableEntry := range candidateList {
+		instanceStats := serviceStats.Get(*serviceTableEntry.InstanceID)
+		if instanceStats.Completed == 0 {
+			unmeasuredList = append(unmeasuredList, serviceTableEntry)
+			continue
+		}
+		if bestServiceEntry == nil || instanceStats.AvgLatency < bestLatency {
+			bestServiceEntry = serviceTableEntry
+			bestLatency = instanceStats.AvgLatency
+		}
+	}
+	if len(unmeasuredList) > 0 {
+		return pickWeightedRandom(unmeasuredList)
+	}
+	return bestServiceEntry
+}
+
+// PowerOfTwoBalancer picks two instances at random and keeps the one with fewer requests in flight
+type PowerOfTwoBalancer struct{}
+
+// Name returns the name of the Balancer
+func (b *PowerOfTwoBalancer) Name() string {
+	return BalancerPowerOfTwo
+}
+
+// Pick selects an instance
+func (b *PowerOfTwoBalancer) Pick(candidateList []*ServiceTableEntry, serviceStats *ServiceStatsTracker) *ServiceTableEntry {
+	if len(candidateList) < 2 {
+		return pickWeightedRandom(candidateList)
+	}
+
+	firstIndex := rand.Intn(len(candidateList))
+	secondIndex := rand.Intn(len(candidateList) - 1)
+	if secondIndex >= firstIndex {
+		secondIndex++
+	}
+
+	firstEntry := candidateList[firstIndex]
+	secondEntry := candidateList[secondIndex]
+	firstStats := serviceStats.Get(*firstEntry.InstanceID)
+	secondStats := serviceStats.Get(*secondEntry.InstanceID)
+
+	if secondStats.InFlight < firstStats.InFlight || (secondStats.InFlight == firstStats.InFlight && secondStats.AvgLatency < firstStats.AvgLatency) {
+		return secondEntry
+	}
+	return firstEntry
+}
+
+// pickWeightedRandom picks an entry at random, in proportion to each entry's Weight
+func pickWeightedRandom(candidateList []*ServiceTableEntry) *ServiceTableEntry {
+	switch len(candidateList) {
+	case 0:
+		return nil
+	case 1:
+		return candidateList[0]
+	}
+
+	var choices []wr.Choice = []wr.Choice{}
+	for _, serviceTableEntry := range candidateList {
+		choices = append(choices, wr.Choice{Item: serviceTableEntry, Weight: serviceTableEntry.Weight})
+	}
+
+	chooser, err := wr.NewChooser(choices...)
+	if err != nil {
+		// No usable weights; fall back to a uniform pick
+		return candidateList[rand.Intn(len(candidateList))]
+	}
+	return chooser.Pick().(*ServiceTableEntry)
+}
+
+// ServiceInstanceStats holds request statistics for a service instance
+type ServiceInstanceStats struct {
+	InFlight            int64
+	Completed           uint64
+	Failed              uint64
+	ConsecutiveFailures uint64
+	AvgLatency          time.Duration
+}
+
+// ServiceStatsTracker collects per-instance request statistics used by Balancers
+type ServiceStatsTracker struct {
+	instanceStats map[string]*ServiceInstanceStats
+	statsLock     sync.Mutex
+}
+
+// Get returns a copy of the statistics for a service instance
+func (sst *ServiceStatsTracker) Get(serviceInstanceID string) ServiceInstanceStats {
+	sst.statsLock.Lock()
+	defer sst.statsLock.Unlock()
+	if instanceStats, ok := sst.instanceStats[serviceInstanceID]; ok {
+		return *instanceStats
+	}
+	return ServiceInstanceStats{}
+}
+
+// Begin records the start of a request to a service instance and returns the start time
+func (sst *ServiceStatsTracker) Begin(serviceInstanceID string) time.Time {
+	sst.statsLock.Lock()
+	defer sst.statsLock.Unlock()
+	sst.getOrCreate(serviceInstanceID).InFlight++
+	return time.Now()
+}
+
+// End records the completion of a request started with Begin
+func (sst *ServiceStatsTracker) End(serviceInstanceID string, startTime time.Time, failed bool) {
+	requestLatency := time.Since(startTime)
+
+	sst.statsLock.Lock()
+	defer sst.statsLock.Unlock()
+	instanceStats := sst.getOrCreate(serviceInstanceID)
+	if instanceStats.InFlight > 0 {
+		instanceStats.InFlight--
+	}
+	if failed {
+		instanceStats.Failed++
+		instanceStats.ConsecutiveFailures++
+		return
+	}
+	instanceStats.ConsecutiveFailures = 0
+	if instanceStats.Completed == 0 {
+		instanceStats.AvgLatency = requestLatency
+	} else {
+		instanceStats.AvgLatency = time.Duration(latencySmoothing*float64(requestLatency) + (1-latencySmoothing)*float64(instanceStats.AvgLatency))
+	}
+	instanceStats.Completed++
+}
+
+// RecordFailure records a request to a service instance which could not be sent
+func (sst *ServiceStatsTracker) RecordFailure(serviceInstanceID string) {
+	sst.statsLock.Lock()
+	defer sst.statsLock.Unlock()
+	instanceStats := sst.getOrCreate(serviceInstanceID)
+	instanceStats.Failed++
+	instanceStats.ConsecutiveFailures++
+}
+
+// ResetConsecutiveFailures starts the count of consecutive failures of a service instance over, e.g. once it has
+// been ejected for them
+func (sst *ServiceStatsTracker) ResetConsecutiveFailures(serviceInstanceID string) {
+	sst.statsLock.Lock()
+	defer sst.statsLock.Unlock()
+	if instanceStats, ok := sst.instanceStats[serviceInstanceID]; ok {
+		instanceStats.ConsecutiveFailures = 0
+	}
+}
+
+// Remove discards the statistics for a service instance
+func (sst *ServiceStatsTracker) Remove(serviceInstanceID string) {
+	sst.statsLock.Lock()
+	defer sst.statsLock.Unlock()
+	delete(sst.instanceStats, serviceInstanceID)
+}
+
+// getOrCreate returns the statistics for a service instance, creating them if needed; caller must hold statsLock
+func (sst *ServiceStatsTracker) getOrCreate(serviceInstanceID string) *ServiceInstanceStats {
+	if sst.instanceStats == nil {
+		sst.instanceStats = make(map[string]*ServiceInstanceStats)
+	}
+	instanceStats, ok := sst.instanceStats[serviceInstanceID]
+	if !ok {
+		instanceStats = &ServiceInstanceStats{}
+		sst.instanceStats[serviceInstanceID] = instanceStats
+	}
+	return instanceStats
+}
@@ -0,0 +1,286 @@
+package drpmesh
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// testCandidates returns instances of a service with the given weights, named <serviceName>-<index>
+func testCandidates(serviceName string, weightList ...uint) []*ServiceTableEntry {
+	candidateList := []*ServiceTableEntry{}
+	for entryIndex, entryWeight := range weightList {
+		serviceEntry := testServiceEntry(fmt.Sprintf("provider%d", entryIndex), serviceName)
+		instanceID := fmt.Sprintf("%s-%d", serviceName, entryIndex)
+		serviceEntry.InstanceID = &instanceID
+		serviceEntry.Weight = entryWeight
+		candidateList = append(candidateList, serviceEntry)
+	}
+	return candidateList
+}
+
+// countPicks picks from the candidates repeatedly and counts the picks per InstanceID
+func countPicks(balancer Balancer, candidateList []*ServiceTableEntry, serviceStats *ServiceStatsTracker, pickCount int) map[string]int {
+	pickCounts := make(map[string]int)
+	for pickNum := 0; pickNum < pickCount; pickNum++ {
+		if pickedEntry := balancer.Pick(candidateList, serviceStats); pickedEntry != nil {
+			pickCounts[*pickedEntry.InstanceID]++
+		}
+	}
+	return pickCounts
+}
+
+func TestNewBalancer(t *testing.T) {
+	for _, balancerName := range []string{BalancerWeightedRandom, BalancerRoundRobin, BalancerLeastOutstanding, BalancerLowestLatency, BalancerPowerOfTwo} {
+		balancer := NewBalancer(balancerName)
+		if balancer == nil || balancer.Name() != balancerName {
+			t.Errorf("expected a Balancer named [%s], got %v", balancerName, balancer)
+			continue
+		}
+		// Every Balancer copes with no candidates and a single candidate
+		singleList := testCandidates("Worker", 10)
+		if balancer.Pick(nil, &ServiceStatsTracker{}) != nil || balancer.Pick(singleList, &ServiceStatsTracker{}) != singleList[0] {
+			t.Errorf("%s: expected nil for no candidates and the only candidate otherwise", balancerName)
+		}
+	}
+	if NewBalancer("random") != nil {
+		t.Errorf("expected an unknown Balancer name to return nil")
+	}
+}
+
+func TestWeightedRandomBalancer(t *testing.T) {
+	balancer := &WeightedRandomBalancer{}
+
+	// Picks follow the weights
+	pickCounts := countPicks(balancer, testCandidates("Worker", 90, 10), &ServiceStatsTracker{}, 2000)
+	if pickCounts["Worker-0"] < 1600 || pickCounts["Worker-1"] == 0 {
+		t.Errorf("expected roughly 90%% of picks on the heavier instance, got %v", pickCounts)
+	}
+
+	// Without usable weights every instance is still reachable
+	pickCounts = countPicks(balancer, testCandidates("Worker", 0, 0), &ServiceStatsTracker{}, 200)
+	if pickCounts["Worker-0"] == 0 || pickCounts["Worker-1"] == 0 {
+		t.Errorf("expected a uniform pick when all weights are zero, got %v", pickCounts)
+	}
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	balancer := &RoundRobinBalancer{}
+	serviceStats := &ServiceStatsTracker{}
+
+	// Instances are cycled in InstanceID order whatever order they are offered in
+	workerList := testCandidates("Worker", 10, 10, 10)
+	reversedList := []*ServiceTableEntry{workerList[2], workerList[1], workerList[0]}
+	pickOrder := []string{}
+	for pickNum := 0; pickNum < 6; pickNum++ {
+		offeredList := workerList
+		if pickNum%2 == 1 {
+			offeredList = reversedList
+		}
+		pickOrder = append(pickOrder, *balancer.Pick(offeredList, serviceStats).InstanceID)
+	}
+	if fmt.Sprint(pickOrder) != "[Worker-0 Worker-1 Worker-2 Worker-0 Worker-1 Worker-2]" {
+		t.Errorf("expected instances in InstanceID order, got %v", pickOrder)
+	}
+
+	// Each service keeps its own position
+	cacheList := testCandidates("Cache", 10, 10)
+	if *balancer.Pick(cacheList, serviceStats).InstanceID != "Cache-0" || *balancer.Pick(workerList, serviceStats).InstanceID != "Worker-0" {
+		t.Errorf("expected services to be cycled independently")
+	}
+
+	// A shrinking instance list wraps around instead of running off the end
+	if pickedEntry := balancer.Pick(workerList[:1], serviceStats); pickedEntry != workerList[0] {
+		t.Errorf("expected the only remaining instance, got %s", *pickedEntry.InstanceID)
+	}
+}
+
+func TestLeastOutstandingBalancer(t *testing.T) {
+	balancer := &LeastOutstandingBalancer{}
+	serviceStats := &ServiceStatsTracker{}
+	candidateList := testCandidates("Worker", 10, 10, 10)
+
+	serviceStats.Begin("Worker-0")
+	serviceStats.Begin("Worker-0")
+	serviceStats.Begin("Worker-1")
+	if pickCounts := countPicks(balancer, candidateList, serviceStats, 50); pickCounts["Worker-2"] != 50 {
+		t.Fatalf("expected the idle instance every time, got %v", pickCounts)
+	}
+
+	// Ties between the least loaded instances are shared
+	serviceStats.Begin("Worker-2")
+	pickCounts := countPicks(balancer, candidateList, serviceStats, 200)
+	if pickCounts["Worker-0"] != 0 || pickCounts["Worker-1"] == 0 || pickCounts["Worker-2"] == 0 {
+		t.Fatalf("expected picks shared between the two instances with one request in flight, got %v", pickCounts)
+	}
+}
+
+func TestLowestLatencyBalancer(t *testing.T) {
+	balancer := &LowestLatencyBalancer{}
+	serviceStats := &ServiceStatsTracker{}
+	candidateList := testCandidates("Worker", 10, 10, 10)
+
+	// recordLatency records a completed request which took the given time
+	recordLatency := func(serviceInstanceID string, requestLatency time.Duration) {
+		serviceStats.Begin(serviceInstanceID)
+		serviceStats.End(serviceInstanceID, time.Now().Add(-requestLatency), false)
+	}
+
+	// Unmeasured instances are tried before any measured one
+	recordLatency("Worker-0", 50*time.Millisecond)
+	recordLatency("Worker-1", 10*time.Millisecond)
+	if pickCounts := countPicks(balancer, candidateList, serviceStats, 20); pickCounts["Worker-2"] != 20 {
+		t.Fatalf("expected the unmeasured instance to be tried first, got %v", pickCounts)
+	}
+
+	// Once everything is measured the fastest instance wins
+	recordLatency("Worker-2", 30*time.Millisecond)
+	if pickedEntry := balancer.Pick(candidateList, serviceStats); *pickedEntry.InstanceID != "Worker-1" {
+		t.Fatalf("expected the fastest instance, got %s", *pickedEntry.InstanceID)
+	}
+
+	// The moving average follows an instance which slows down
+	for sampleNum := 0; sampleNum < 10; sampleNum++ {
+		recordLatency("Worker-1", 100*time.Millisecond)
+	}
+	if pickedEntry := balancer.Pick(candidateList, serviceStats); *pickedEntry.InstanceID != "Worker-2" {
+		t.Fatalf("expected the instance which is now fastest, got %s", *pickedEntry.InstanceID)
+	}
+}
+
+func TestPowerOfTwoBalancer(t *testing.T) {
+	balancer := &PowerOfTwoBalancer{}
+	serviceStats := &ServiceStatsTracker{}
+
+	// Of two instances the less loaded one always wins
+	pairList := testCandidates("Worker", 10, 10)
+	serviceStats.Begin("Worker-0")
+	if pickCounts := countPicks(balancer, pairList, serviceStats, 50); pickCounts["Worker-1"] != 50 {
+		t.Fatalf("expected the less loaded of two instances every time, got %v", pickCounts)
+	}
+
+	// The most loaded of several instances never wins a comparison, and the others are all reachable
+	candidateList := testCandidates("Worker", 10, 10, 10, 10)
+	serviceStats.Begin("Worker-0")
+	pickCounts := countPicks(balancer, candidateList, serviceStats, 400)
+	if pickCounts["Worker-0"] != 0 || pickCounts["Worker-1"] == 0 || pickCounts["Worker-2"] == 0 || pickCounts["Worker-3"] == 0 {
+		t.Fatalf("expected picks spread over the idle instances only, got %v", pickCounts)
+	}
+
+	// Equal load is broken by latency
+	latencyStats := &ServiceStatsTracker{}
+	latencyStats.End("Worker-0", time.Now().Add(-40*time.Millisecond), false)
+	latencyStats.End("Worker-1", time.Now().Add(-5*time.Millisecond), false)
+	if pickCounts := countPicks(balancer, pairList, latencyStats, 50); pickCounts["Worker-1"] != 50 {
+		t.Fatalf("expected the faster of two equally loaded instances every time, got %v", pickCounts)
+	}
+}
+
+func TestServiceStatsTracker(t *testing.T) {
+	serviceStats := &ServiceStatsTracker{}
+	serviceInstanceID := "Worker-0"
+
+	startTime := serviceStats.Begin(serviceInstanceID)
+	serviceStats.Begin(serviceInstanceID)
+	if instanceStats := serviceStats.Get(serviceInstanceID); instanceStats.InFlight != 2 {
+		t.Fatalf("expected two requests in flight, got %d", instanceStats.InFlight)
+	}
+
+	serviceStats.End(serviceInstanceID, startTime, true)
+	serviceStats.RecordFailure(serviceInstanceID)
+	instanceStats := serviceStats.Get(serviceInstanceID)
+	if instanceStats.InFlight != 1 || instanceStats.Failed != 2 || instanceStats.ConsecutiveFailures != 2 || instanceStats.Completed != 0 {
+		t.Fatalf("expected one in flight and two failures, got %+v", instanceStats)
+	}
+
+	// A success resets the consecutive failures and seeds the latency average
+	serviceStats.End(serviceInstanceID, time.Now().Add(-20*time.Millisecond), false)
+	instanceStats = serviceStats.Get(serviceInstanceID)
+	if instanceStats.InFlight != 0 || instanceStats.ConsecutiveFailures != 0 || instanceStats.Completed != 1 || instanceStats.AvgLatency < 20*time.Millisecond {
+		t.Fatalf("expected one completed request of at least 20ms, got %+v", instanceStats)
+	}
+
+	// Extra completions never push the in flight count below zero
+	serviceStats.End(serviceInstanceID, time.Now(), false)
+	if instanceStats = serviceStats.Get(serviceInstanceID); instanceStats.InFlight != 0 || instanceStats.AvgLatency >= 20*time.Millisecond {
+		t.Fatalf("expected no requests in flight and a lower average, got %+v", instanceStats)
+	}
+
+	serviceStats.Remove(serviceInstanceID)
+	if instanceStats = serviceStats.Get(serviceInstanceID); instanceStats != (ServiceInstanceStats{}) {
+		t.Fatalf("expected removed statistics to be empty, got %+v", instanceStats)
+	}
+}
+
+func TestServiceBalancerSelection(t *testing.T) {
+	localNodeID := "registry1"
+	serviceName := "Worker"
+	thisNode := testNode(t, testNodeOptions("Registry", localNodeID))
+	thisTopologyTracker := thisNode.TopologyTracker
+	addTestProvider(thisTopologyTracker, "provider1", "zone1", serviceName)
+	addTestProvider(thisTopologyTracker, "provider2", "zone1", serviceName)
+
+	// A Balancer set for the service is used for every lookup
+	thisTopologyTracker.SetServiceBalancer(serviceName, &RoundRobinBalancer{})
+	if thisTopologyTracker.GetServiceBalancer(&serviceName).Name() != BalancerRoundRobin {
+		t.Fatalf("expected the service Balancer to be returned")
+	}
+	pickOrder := []string{}
+	for pickNum := 0; pickNum < 4; pickNum++ {
+		pickOrder = append(pickOrder, *thisTopologyTracker.FindInstanceOfService(&serviceName, nil, nil, nil, nil).NodeID)
+	}
+	if fmt.Sprint(pickOrder) != "[provider1 provider2 provider1 provider2]" {
+		t.Fatalf("expected the service Balancer to alternate between instances, got %v", pickOrder)
+	}
+
+	// A Balancer passed with the call overrides the service Balancer
+	thisTopologyTracker.ServiceStats.Begin("provider1-Worker")
+	for pickNum := 0; pickNum < 10; pickNum++ {
+		if pickedEntry := thisTopologyTracker.FindInstanceOfServiceWithBalancer(&serviceName, nil, nil, nil, nil, &LeastOutstandingBalancer{}); *pickedEntry.NodeID != "provider2" {
+			t.Fatalf("expected the per call Balancer to avoid the busy instance, got %s", *pickedEntry.NodeID)
+		}
+	}
+
+	// Clearing the service Balancer restores the default
+	thisTopologyTracker.SetServiceBalancer(serviceName, nil)
+	if thisTopologyTracker.GetServiceBalancer(&serviceName).Name() != BalancerWeightedRandom {
+		t.Fatalf("expected the default Balancer once the service Balancer is cleared")
+	}
+}
+
+// decliningBalancer is a Balancer which never picks an instance
+type decliningBalancer struct{}
+
+// Name returns the name of the Balancer
+func (db *decliningBalancer) Name() string {
+	return "declining"
+}
+
+// Pick returns no instance
+func (db *decliningBalancer) Pick(candidateList []*ServiceTableEntry, serviceStats *ServiceStatsTracker) *ServiceTableEntry {
+	return nil
+}
+
+func TestBalancerPicksNothing(t *testing.T) {
+	thisNode := testNode(t, testNodeOptions("Registry", "registry1"))
+	thisTopologyTracker := thisNode.TopologyTracker
+	thisNode.AddService(&Service{ServiceName: "Local", Type: "Local", Priority: 10, Weight: 10, Zone: "zone1", Scope: "zone", Dependencies: []string{}, Streams: []string{}, Status: ServiceStatusReady})
+	addTestProvider(thisTopologyTracker, "provider1", "zone1", "Remote")
+	addTestProvider(thisTopologyTracker, "provider2", "zone1", "Remote")
+
+	// A Balancer which declines to pick leaves no match for local and remote instances alike
+	for _, serviceName := range []string{"Local", "Remote"} {
+		checkName := serviceName
+		if pickedEntry := thisTopologyTracker.FindInstanceOfServiceWithBalancer(&checkName, nil, nil, nil, nil, &decliningBalancer{}); pickedEntry != nil {
+			t.Fatalf("expected no %s instance, got %s", serviceName, *pickedEntry.InstanceID)
+		}
+		execParams := ServiceCmd_ExecParams{}
+		execParams.SetBalancer(&decliningBalancer{})
+		if cmdResult := thisNode.ServiceCmd(serviceName, "work", &CmdParams{}, execParams); cmdResult != nil {
+			t.Fatalf("expected no result for %s, got %v", serviceName, cmdResult)
+		}
+	}
+	if nodeInstance := thisTopologyTracker.findNodeInstance("Remote", "provider1", nil, &decliningBalancer{}); nodeInstance != nil {
+		t.Fatalf("expected no instance on provider1, got %s", *nodeInstance.InstanceID)
+	}
+}
@@ -3,7 +3,6 @@ package drpmesh
 import (
 	"crypto/tls"
 	"fmt"
-	"log"
 
 	"github.com/gorilla/websocket"
 )
@@ -15,8 +14,9 @@ type Client struct {
 	proxy    string
 }
 
-// Connect makes an outbound connection to a Node
-func (dc *Client) Connect(wsTarget string, proxy *string, drpNode *Node, endpointID *string, retryOnClose bool, openCallback *func(), closeCallback *func()) {
+// Connect makes an outbound connection to a Node and authenticates; openCallback only runs if the remote Node
+// accepted the hello
+func (dc *Client) Connect(wsTarget string, proxy *string, drpNode *Node, endpointID *string, retryOnClose bool, openCallback *func(), closeCallback *func()) error {
 	dc.Init()
 	dc.wsConn = nil
 	dc.wsTarget = wsTarget
@@ -32,8 +32,9 @@ func (dc *Client) Connect(wsTarget string, proxy *string, drpNode *Node, endpoin
 
 	// Bypass web proxy
 	var dialer = websocket.Dialer{
-		Subprotocols: []string{"drp"},
-		Proxy:        nil,
+		Subprotocols:     []string{"drp"},
+		Proxy:            nil,
+		HandshakeTimeout: HandshakeTimeout,
 	}
 
 	// Disable TLS Checking - need to address before production!
@@ -42,31 +43,25 @@ func (dc *Client) Connect(wsTarget string, proxy *string, drpNode *Node, endpoin
 	//w, _, err := websocket.DefaultDialer.Dial(w.wsTarget, nil)
 	w, _, err := dialer.Dial(dc.wsTarget, nil)
 	if err != nil {
-		log.Fatal("dial:", err)
+		dc.drpNode.Log(fmt.Sprintf("Could not connect to %s: %s", dc.wsTarget, err), false)
+		return err
 	}
-	//defer w.Close()
 
 	drpNode.ApplyNodeEndpointMethods(dc)
 
 	dc.StartListening(w)
-	//fmt.Printf("%+v\n", responsePacket)
 
-	w.SetCloseHandler(func(code int, text string) error {
-		if closeCallback != nil {
-			(*closeCallback)()
-		}
-		return nil
-	})
-
-	dc.drpNode.Log("Sending hello...", false)
-	//responsePacket := dc.SendCmdAwait("DRP", "hello", &CmdParams{"userAgent": "go", "user": "Gopher", "pass": "supersecret"})
-	responsePacket := dc.SendCmdAwait("DRP", "hello", dc.drpNode.NodeDeclaration, nil, nil)
-	dc.drpNode.Log("Received response from hello", false)
-	dc.drpNode.Log(string(responsePacket.ToJSON()), false)
+	authErr := dc.authenticate()
+	if authErr != nil {
+		dc.drpNode.Log(fmt.Sprintf("Could not authenticate to %s: %s", dc.wsTarget, authErr), false)
+		dc.Close(CloseCodeAuthFailed, authErr.Error())
+		return authErr
+	}
 
 	if openCallback != nil {
 		(*openCallback)()
 	}
+	return nil
 }
 
 // RetryConnection implements retry logic
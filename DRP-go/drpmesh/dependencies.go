@@ -0,0 +1,206 @@
+package drpmesh
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DependencyGraph describes which services depend on which across the mesh
+type DependencyGraph struct {
+	Dependencies map[string][]string
+	Missing      map[string][]string
+	Cycles       [][]string
+}
+
+// watchDependencies re-evaluates local service readiness whenever a service table entry changes
+func (dn *Node) watchDependencies() {
+	thisNode := dn
+	thisNode.TopologyTracker.Subscribe(TopologyEventFilter{Type: "service"}, func(topologyEvent TopologyEvent) {
+		if topologyEvent.ServiceEntry == nil || topologyEvent.ServiceEntry.Name == nil {
+			return
+		}
+		if thisNode.isDependency(*topologyEvent.ServiceEntry.Name) {
+			thisNode.EvaluateDependencies()
+		}
+	})
+}
+
+// isDependency tells whether or not a local service depends on the named service.  Dependencies are fixed once a
+// service is added, so listing the services under servicesLock is enough.
+func (dn *Node) isDependency(serviceName string) bool {
+	for _, serviceObj := range dn.listLocalServices() {
+		for _, dependencyName := range serviceObj.Dependencies {
+			if dependencyName == serviceName {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setDesiredStatus records the status requested for a local service and returns the status to advertise, which
+// is Pending while a Ready service has unmet dependencies
+func (dn *Node) setDesiredStatus(serviceObj *Service, desiredStatus int) int {
+	dn.dependencyLock.Lock()
+	dn.desiredServiceStatus[serviceObj.InstanceID] = desiredStatus
+	dn.dependencyLock.Unlock()
+
+	if desiredStatus != ServiceStatusReady {
+		return desiredStatus
+	}
+	if missingDependencies := dn.GetMissingDependencies(serviceObj); len(missingDependencies) > 0 {
+		dn.Log(fmt.Sprintf("Holding service [%s] pending, waiting on dependencies [%s]", serviceObj.ServiceName, strings.Join(missingDependencies, ",")), false)
+		return ServiceStatusPending
+	}
+	return desiredStatus
+}
+
+// GetMissingDependencies returns the dependencies of a service without a ready instance reachable from its zone.
+// Other zones are reachable as the zone preferences allow, so only through ZoneAny if it is listed.  Ejected
+// instances and those with an open circuit do not count; unlike a call, readiness does not fall back to them.
+func (dn *Node) GetMissingDependencies(serviceObj *Service) []string {
+	thisNode := dn
+	missingDependencies := []string{}
+	for _, dependencyName := range serviceObj.Dependencies {
+		checkName := dependencyName
+		// Use a stateless Balancer so checking readiness does not disturb round robin order
+		if serviceSelection, _ := thisNode.TopologyTracker.selectInstanceOfService(&checkName, nil, &serviceObj.Zone, nil, nil, &WeightedRandomBalancer{}, nil, false); serviceSelection == nil {
+			missingDependencies = append(missingDependencies, dependencyName)
+		}
+	}
+	return missingDependencies
+}
+
+// EvaluateDependencies flips local services between Pending and Ready as their dependencies come and go.  It runs
+// on service table changes, ejections and zone preference changes, and with the WatchDog since ejections and open
+// circuits expire without an event.
+func (dn *Node) EvaluateDependencies() {
+	thisNode := dn
+
+	// Decide on status changes first; updateServiceInstance issues topology events which call back into this function.
+	// The local services are listed before taking dependencyLock so it is never held along with servicesLock.
+	statusChanges := make(map[string]int)
+	localServices := thisNode.listLocalServices()
+	thisNode.dependencyLock.Lock()
+	serviceList := []*Service{}
+	for _, serviceObj := range localServices {
+		if len(serviceObj.Dependencies) > 0 && thisNode.desiredServiceStatus[serviceObj.InstanceID] == ServiceStatusReady {
+			serviceList = append(serviceList, serviceObj)
+		}
+	}
+	thisNode.dependencyLock.Unlock()
+
+	for _, serviceObj := range serviceList {
+		newStatus := ServiceStatusReady
+		if missingDependencies := thisNode.GetMissingDependencies(serviceObj); len(missingDependencies) > 0 {
+			newStatus = ServiceStatusPending
+		}
+		if newStatus != serviceObj.GetStatus() {
+			statusChanges[serviceObj.InstanceID] = newStatus
+		}
+	}
+
+	for serviceInstanceID, newStatus := range statusChanges {
+		thisNode.Log(fmt.Sprintf("Dependencies for service instance [%s] changed, status now %s", serviceInstanceID, ServiceStatusName(newStatus)), false)
+		thisNode.updateServiceInstance(serviceInstanceID, func(serviceObj *Service) {
+			serviceObj.Status = newStatus
+		})
+	}
+}
+
+// GetDependencyGraph builds the service dependency graph from the Service table, listing dependencies with no
+// instances in the mesh and any dependency cycles
+func (tt *TopologyTracker) GetDependencyGraph() DependencyGraph {
+	dependencyGraph := DependencyGraph{make(map[string][]string), make(map[string][]string), [][]string{}}
+
+	// Merge the dependencies declared by every instance of each service
+	dependencySets := make(map[string]map[string]bool)
+	for _, serviceTableEntry := range tt.Snapshot().ServiceTable {
+		if serviceTableEntry.Name == nil {
+			continue
+		}
+		if _, ok := dependencySets[*serviceTableEntry.Name]; !ok {
+			dependencySets[*serviceTableEntry.Name] = make(map[string]bool)
+		}
+		for _, dependencyName := range serviceTableEntry.Dependencies {
+			dependencySets[*serviceTableEntry.Name][dependencyName] = true
+		}
+	}
+
+	for serviceName, dependencySet := range dependencySets {
+		dependencyList := GetKeys(dependencySet)
+		sort.Strings(dependencyList)
+		dependencyGraph.Dependencies[serviceName] = dependencyList
+		for _, dependencyName := range dependencyList {
+			if _, ok := dependencySets[dependencyName]; !ok {
+				dependencyGraph.Missing[serviceName] = append(dependencyGraph.Missing[serviceName], dependencyName)
+			}
+		}
+	}
+
+	dependencyGraph.Cycles = findDependencyCycles(dependencyGraph.Dependencies)
+	return dependencyGraph
+}
+
+// findDependencyCycles returns each dependency cycle once, starting from its lowest service name
+func findDependencyCycles(dependencies map[string][]string) [][]string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	visitState := make(map[string]int)
+	pathStack := []string{}
+	foundCycles := make(map[string][]string)
+
+	var visitService func(serviceName string)
+	visitService = func(serviceName string) {
+		visitState[serviceName] = visiting
+		pathStack = append(pathStack, serviceName)
+		for _, dependencyName := range dependencies[serviceName] {
+			switch visitState[dependencyName] {
+			case unvisited:
+				visitService(dependencyName)
+			case visiting:
+				// Back edge; the cycle is the path from the dependency to here
+				for stackIndex := len(pathStack) - 1; stackIndex >= 0; stackIndex-- {
+					if pathStack[stackIndex] == dependencyName {
+						thisCycle := rotateCycle(append([]string{}, pathStack[stackIndex:]...))
+						foundCycles[strings.Join(thisCycle, ">")] = thisCycle
+						break
+					}
+				}
+			}
+		}
+		pathStack = pathStack[:len(pathStack)-1]
+		visitState[serviceName] = visited
+	}
+
+	serviceNames := GetKeys(dependencies)
+	sort.Strings(serviceNames)
+	for _, serviceName := range serviceNames {
+		if visitState[serviceName] == unvisited {
+			visitService(serviceName)
+		}
+	}
+
+	cycleKeys := GetKeys(foundCycles)
+	sort.Strings(cycleKeys)
+	cycleList := [][]string{}
+	for _, cycleKey := range cycleKeys {
+		cycleList = append(cycleList, foundCycles[cycleKey])
+	}
+	return cycleList
+}
+
+// rotateCycle rotates a cycle so it starts with its lowest service name
+func rotateCycle(thisCycle []string) []string {
+	lowestIndex := 0
+	for cycleIndex, serviceName := range thisCycle {
+		if serviceName < thisCycle[lowestIndex] {
+			lowestIndex = cycleIndex
+		}
+	}
+	return append(thisCycle[lowestIndex:], thisCycle[:lowestIndex]...)
+}
@@ -0,0 +1,144 @@
+package drpmesh
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDependencyGating(t *testing.T) {
+	localNodeID := "registry1"
+	thisNode := testNode(t, testNodeOptions("Registry", localNodeID))
+	thisTopologyTracker := thisNode.TopologyTracker
+
+	// A Ready service is held pending until its dependency appears
+	webInstanceID := thisNode.AddService(&Service{ServiceName: "Web", Type: "Web", Priority: 10, Weight: 10, Zone: "zone1", Scope: "zone", Dependencies: []string{"Database"}, Streams: []string{}, Status: ServiceStatusReady})
+	if serviceStatus := thisNode.Services[webInstanceID].Status; serviceStatus != ServiceStatusPending {
+		t.Fatalf("expected Web to be Pending, got %s", ServiceStatusName(serviceStatus))
+	}
+
+	providerNodeID := "provider1"
+	nodeEntry := testNodeEntry(providerNodeID)
+	serviceEntry := testServiceEntry(providerNodeID, "Database")
+	thisTopologyTracker.ProcessPacket(TopologyPacket{providerNodeID, "add", "node", providerNodeID, *nodeEntry.Scope, *nodeEntry.Zone, nodeEntry.ToJSON(), 0}, providerNodeID, false)
+	thisTopologyTracker.ProcessPacket(TopologyPacket{providerNodeID, "add", "service", *serviceEntry.InstanceID, *serviceEntry.Scope, *serviceEntry.Zone, serviceEntry.ToJSON(), 0}, providerNodeID, false)
+	if serviceStatus := thisNode.Services[webInstanceID].Status; serviceStatus != ServiceStatusReady {
+		t.Fatalf("expected Web to be Ready once Database is available, got %s", ServiceStatusName(serviceStatus))
+	}
+
+	// Losing the dependency puts the service back to Pending
+	thisTopologyTracker.ProcessPacket(TopologyPacket{providerNodeID, "delete", "service", *serviceEntry.InstanceID, *serviceEntry.Scope, *serviceEntry.Zone, serviceEntry.ToJSON(), 0}, providerNodeID, false)
+	if serviceStatus := thisNode.Services[webInstanceID].Status; serviceStatus != ServiceStatusPending {
+		t.Fatalf("expected Web to be Pending after Database left, got %s", ServiceStatusName(serviceStatus))
+	}
+
+	// Services depending on each other are reported as a cycle
+	cycleEntry := testServiceEntry(providerNodeID, "Cache")
+	cycleEntry.Dependencies = []string{"Web"}
+	thisTopologyTracker.ProcessPacket(TopologyPacket{providerNodeID, "add", "service", *cycleEntry.InstanceID, *cycleEntry.Scope, *cycleEntry.Zone, cycleEntry.ToJSON(), 0}, providerNodeID, false)
+	thisNode.RemoveService("Web")
+	thisNode.AddService(&Service{ServiceName: "Web", Type: "Web", Priority: 10, Weight: 10, Zone: "zone1", Scope: "zone", Dependencies: []string{"Database", "Cache"}, Streams: []string{}, Status: ServiceStatusReady})
+
+	dependencyGraph := thisTopologyTracker.GetDependencyGraph()
+	if len(dependencyGraph.Missing["Web"]) != 1 || dependencyGraph.Missing["Web"][0] != "Database" {
+		t.Fatalf("expected Database to be missing for Web, got %v", dependencyGraph.Missing)
+	}
+	if len(dependencyGraph.Cycles) != 1 || fmt.Sprint(dependencyGraph.Cycles[0]) != "[Cache Web]" {
+		t.Fatalf("expected one Cache/Web cycle, got %v", dependencyGraph.Cycles)
+	}
+}
+
+func TestDependencyAvailability(t *testing.T) {
+	thisNode := testNode(t, testNodeOptions("Registry", "registry1"))
+	thisTopologyTracker := thisNode.TopologyTracker
+	databaseEntry := addTestProvider(thisTopologyTracker, "provider1", "zone1", "Database")[0]
+	databaseInstanceID := *databaseEntry.InstanceID
+	webInstanceID := thisNode.AddService(&Service{ServiceName: "Web", Type: "Web", Priority: 10, Weight: 10, Zone: "zone1", Scope: "zone", Dependencies: []string{"Database"}, Streams: []string{}, Status: ServiceStatusReady})
+
+	// expectStatus checks the advertised status of Web
+	expectStatus := func(description string, wantStatus int) {
+		t.Helper()
+		if webStatus := thisNode.GetLocalService(webInstanceID).GetStatus(); webStatus != wantStatus {
+			t.Fatalf("expected Web to be %s %s, got %s", ServiceStatusName(wantStatus), description, ServiceStatusName(webStatus))
+		}
+		if webEntry := thisTopologyTracker.GetServiceEntry(webInstanceID); webEntry == nil || webEntry.Status != wantStatus {
+			t.Fatalf("expected the Web table entry to be %s %s", ServiceStatusName(wantStatus), description)
+		}
+	}
+	expectStatus("with Database available", ServiceStatusReady)
+
+	// An ejected dependency is not available, even though calls would fall back to it
+	thisTopologyTracker.Outliers.SetOutlierPolicy("Database", &OutlierPolicy{1, 0, 0, 50 * time.Millisecond, time.Second, 100})
+	thisTopologyTracker.ServiceStats.RecordFailure(databaseInstanceID)
+	thisTopologyTracker.recordCallOutcome("Database", databaseInstanceID)
+	if !thisTopologyTracker.Outliers.IsEjected(databaseInstanceID) {
+		t.Fatalf("expected Database to be ejected")
+	}
+	expectStatus("while Database is ejected", ServiceStatusPending)
+	if thisTopologyTracker.FindInstanceOfService(databaseEntry.Name, nil, nil, nil, nil) == nil {
+		t.Fatalf("expected calls to still fall back to the ejected instance")
+	}
+
+	// Ejections expire without an event; the WatchDog pass picks it up
+	time.Sleep(100 * time.Millisecond)
+	thisNode.EvaluateDependencies()
+	expectStatus("once the ejection expired", ServiceStatusReady)
+
+	// So does an open circuit
+	thisTopologyTracker.CircuitBreakers.SetPolicy("Database", &CircuitBreakerPolicy{1, time.Minute, 1})
+	thisTopologyTracker.CircuitBreakers.Record("Database", databaseInstanceID, false)
+	thisNode.EvaluateDependencies()
+	expectStatus("while the circuit is open", ServiceStatusPending)
+	thisTopologyTracker.CircuitBreakers.Remove(databaseInstanceID)
+	thisNode.EvaluateDependencies()
+	expectStatus("once the circuit closed", ServiceStatusReady)
+
+	// A dependency in another zone is only reachable through the ZoneAny fallback
+	thisTopologyTracker.ProcessPacket(TopologyPacket{"provider1", "delete", "service", databaseInstanceID, *databaseEntry.Scope, *databaseEntry.Zone, databaseEntry.ToJSON(), 0}, "provider1", false)
+	expectStatus("without Database", ServiceStatusPending)
+	addTestProvider(thisTopologyTracker, "provider2", "zone2")
+	zone2Name := "zone2"
+	globalScope := "global"
+	zone2Entry := testServiceEntry("provider2", "Database")
+	zone2Entry.Zone = &zone2Name
+	zone2Entry.Scope = &globalScope
+	thisTopologyTracker.ProcessPacket(TopologyPacket{"provider2", "add", "service", *zone2Entry.InstanceID, globalScope, zone2Name, zone2Entry.ToJSON(), 0}, "provider2", false)
+	expectStatus("with a global Database in zone2", ServiceStatusReady)
+	thisTopologyTracker.SetZonePreferences([]string{"zone3"})
+	expectStatus("once ZoneAny is no longer a fallback", ServiceStatusPending)
+	thisTopologyTracker.SetZonePreferences(nil)
+	expectStatus("once the default fallback is restored", ServiceStatusReady)
+	thisTopologyTracker.SetCrossZoneFallback("Database", false)
+	expectStatus("once Database may not leave its zone", ServiceStatusPending)
+}
+
+func TestDependencyConcurrentServices(t *testing.T) {
+	thisNode := testNode(t, testNodeOptions("Registry", "registry1"))
+	thisTopologyTracker := thisNode.TopologyTracker
+
+	// Services come and go while dependency events are evaluated
+	var workerGroup sync.WaitGroup
+	for workerNum := 0; workerNum < 4; workerNum++ {
+		workerGroup.Add(1)
+		go func(workerNum int) {
+			defer workerGroup.Done()
+			for changeNum := 0; changeNum < 20; changeNum++ {
+				if workerNum%2 == 0 {
+					serviceName := fmt.Sprintf("Web%d", workerNum)
+					thisNode.AddService(&Service{ServiceName: serviceName, Type: "Web", Priority: 10, Weight: 10, Zone: "zone1", Scope: "zone", Dependencies: []string{"Database"}, Streams: []string{}, Status: ServiceStatusReady})
+					thisNode.RemoveService(serviceName)
+				} else {
+					addTestProvider(thisTopologyTracker, "provider1", "zone1", "Database")
+					databaseEntry := testServiceEntry("provider1", "Database")
+					thisTopologyTracker.ProcessPacket(TopologyPacket{"provider1", "delete", "service", *databaseEntry.InstanceID, *databaseEntry.Scope, *databaseEntry.Zone, databaseEntry.ToJSON(), 0}, "provider1", false)
+				}
+			}
+		}(workerNum)
+	}
+	workerGroup.Wait()
+
+	if len(thisNode.GetLocalInstanceIDs("Web0")) != 0 || len(thisNode.GetLocalInstanceIDs("Web2")) != 0 {
+		t.Fatalf("expected the added services to be removed")
+	}
+}
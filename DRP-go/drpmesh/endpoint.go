@@ -3,10 +3,22 @@ package drpmesh
 import (
 	"encoding/json"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// Close codes sent when a Node terminates a connection
+const (
+	CloseCodeAuthFailed          = 4001
+	CloseCodeDuplicateNodeID     = 4002
+	CloseCodeRedundantConnection = 4003
+)
+
+// HandshakeTimeout is how long a connecting Node waits for each step of authentication
+const HandshakeTimeout = 10 * time.Second
+
 // ConnectionStats provides latency and uptime stats
 type ConnectionStats struct {
 	pingTimeMs    int
@@ -26,6 +38,7 @@ type EndpointAuthInfo struct {
 // EndpointInterface declares the set of functions that should be implemented for any Endpoint object
 type EndpointInterface interface {
 	GetID() *string
+	SetID(string)
 	GetType() string
 	GetToken() int
 	AddReplyHandler() int
@@ -34,11 +47,14 @@ type EndpointInterface interface {
 	SendPacketBytes([]byte)
 	SendCmd(string, string, interface{}, *int, *RouteOptions, *string)
 	SendCmdAwait(string, string, interface{}, *RouteOptions, *string) *ReplyIn
+	SendCmdAwaitTimeout(string, string, interface{}, *RouteOptions, *string, time.Duration) *ReplyIn
 	IsServer() bool
 	ConnectionStats() ConnectionStats
 	GetEndpointCmds() map[string]EndpointMethod
 	IsReady() bool
 	IsConnecting() bool
+	Close(int, string)
+	baseEndpoint() *Endpoint
 }
 
 // Endpoint - DRP endpoint
@@ -51,10 +67,18 @@ type Endpoint struct {
 	AuthInfo          EndpointAuthInfo
 	ReplyHandlerQueue map[int](chan *ReplyIn)
 	TokenNum          int
-	Subscriptions     interface{}
+	replyLock         sync.Mutex
+	repliesClosed     bool
+	isServer          bool
+	Subscriptions     map[int]*Subscriber
 	openCallback      *func()
 	closeCallback     *func()
 	closeChan         chan bool
+	sendLock          sync.Mutex
+	subscriptionLock  sync.Mutex
+	authNonce         string
+	authNonceIssued   time.Time
+	authLock          sync.Mutex
 
 	//sendChan chan interface{}
 }
@@ -63,6 +87,7 @@ type Endpoint struct {
 func (e *Endpoint) Init() {
 	e.EndpointCmds = make(map[string]EndpointMethod)
 	e.ReplyHandlerQueue = make(map[int](chan *ReplyIn))
+	e.Subscriptions = make(map[int]*Subscriber)
 	e.closeChan = make(chan bool)
 	//e.sendChan = make(chan interface{}, 100)
 	e.TokenNum = 1
@@ -73,6 +98,36 @@ func (e *Endpoint) GetID() *string {
 	return e.EndpointID
 }
 
+// SetID sets the ID of the Endpoint
+func (e *Endpoint) SetID(endpointID string) {
+	e.EndpointID = &endpointID
+}
+
+// baseEndpoint returns the underlying Endpoint, used to compare Endpoints wrapped by other types
+func (e *Endpoint) baseEndpoint() *Endpoint {
+	return e
+}
+
+// issueAuthNonce creates a one-time nonce for the Endpoint, replacing any nonce issued to it earlier
+func (e *Endpoint) issueAuthNonce() string {
+	e.authLock.Lock()
+	defer e.authLock.Unlock()
+	e.authNonce = CreateAuthNonce()
+	e.authNonceIssued = time.Now()
+	return e.authNonce
+}
+
+// consumeAuthNonce tells whether a nonce is the unexpired one issued to the Endpoint; the nonce cannot be reused
+func (e *Endpoint) consumeAuthNonce(nonce string) bool {
+	e.authLock.Lock()
+	defer e.authLock.Unlock()
+	if e.authNonce == "" || e.authNonce != nonce {
+		return false
+	}
+	e.authNonce = ""
+	return time.Since(e.authNonceIssued) <= authNonceTTL
+}
+
 // GetType returns the type of the Endpoint
 func (e *Endpoint) GetType() string {
 	return e.EndpointType
@@ -80,6 +135,13 @@ func (e *Endpoint) GetType() string {
 
 // GetToken returns the next token to be used for the Endpoint
 func (e *Endpoint) GetToken() int {
+	e.replyLock.Lock()
+	defer e.replyLock.Unlock()
+	return e.nextToken()
+}
+
+// nextToken returns the next token; caller must hold replyLock
+func (e *Endpoint) nextToken() int {
 	//returnToken := strconv.Itoa(e.TokenNum)
 	returnToken := e.TokenNum
 	e.TokenNum++
@@ -88,15 +150,48 @@ func (e *Endpoint) GetToken() int {
 
 // AddReplyHandler is used to track responses for a command
 func (e *Endpoint) AddReplyHandler() int {
-	replyToken := e.GetToken()
-	e.ReplyHandlerQueue[replyToken] = make(chan *ReplyIn)
+	replyToken, _ := e.addReplyHandler()
 	return replyToken
 }
 
+// addReplyHandler tracks responses for a command and returns the token along with the channel the first response
+// is delivered on.  The channel is closed without a response if the connection is lost.
+func (e *Endpoint) addReplyHandler() (int, chan *ReplyIn) {
+	e.replyLock.Lock()
+	defer e.replyLock.Unlock()
+	replyToken := e.nextToken()
+	replyChan := make(chan *ReplyIn, 1)
+	if e.repliesClosed {
+		close(replyChan)
+		return replyToken, replyChan
+	}
+	e.ReplyHandlerQueue[replyToken] = replyChan
+	return replyToken, replyChan
+}
+
+// isClosed tells whether or not the Endpoint's connection has been lost
+func (e *Endpoint) isClosed() bool {
+	e.replyLock.Lock()
+	defer e.replyLock.Unlock()
+	return e.repliesClosed
+}
+
 // DeleteReplyHandler removes a reply handler
 func (e *Endpoint) DeleteReplyHandler(handlerToken int) {
+	e.replyLock.Lock()
+	defer e.replyLock.Unlock()
 	delete(e.ReplyHandlerQueue, handlerToken)
-	return
+}
+
+// closeReplyHandlers releases every caller awaiting a response once the connection is lost
+func (e *Endpoint) closeReplyHandlers() {
+	e.replyLock.Lock()
+	defer e.replyLock.Unlock()
+	e.repliesClosed = true
+	for handlerToken, replyChan := range e.ReplyHandlerQueue {
+		close(replyChan)
+		delete(e.ReplyHandlerQueue, handlerToken)
+	}
 }
 
 // RegisterMethod adds a command that is allowed to be executed by the remote Endpoint
@@ -106,8 +201,10 @@ func (e *Endpoint) RegisterMethod(methodName string, method EndpointMethod) {
 
 // SendPacketBytes abstracts sending functions from the communication channel functions
 func (e *Endpoint) SendPacketBytes(drpPacketBytes []byte) {
-	// This function listend to e.sendChan and sends commands
+	// Packets may be sent from any receive loop (e.g. topology relays); the websocket allows one writer at a time
+	e.sendLock.Lock()
 	wsSendErr := e.wsConn.WriteMessage(websocket.TextMessage, drpPacketBytes)
+	e.sendLock.Unlock()
 	if wsSendErr != nil {
 		e.drpNode.Log(fmt.Sprint("error writing message to WS channel:", wsSendErr), false)
 		//return wsSendErr
@@ -132,17 +229,35 @@ func (e *Endpoint) SendCmd(serviceName string, methodName string, cmdParams inte
 
 // SendCmdAwait sends a command to a remote Endpoint and awaits a response
 func (e *Endpoint) SendCmdAwait(serviceName string, cmdName string, cmdParams interface{}, routeOptions *RouteOptions, serviceInstanceID *string) *ReplyIn {
-	replyToken := e.AddReplyHandler()
+	return e.SendCmdAwaitTimeout(serviceName, cmdName, cmdParams, routeOptions, serviceInstanceID, 0)
+}
+
+// SendCmdAwaitTimeout sends a command to a remote Endpoint and awaits a response.  It returns nil if the connection
+// is lost or no response arrives within the timeout; a timeout of 0 waits until the connection is lost.
+func (e *Endpoint) SendCmdAwaitTimeout(serviceName string, cmdName string, cmdParams interface{}, routeOptions *RouteOptions, serviceInstanceID *string, timeout time.Duration) *ReplyIn {
+	replyToken, replyChan := e.addReplyHandler()
+	defer e.DeleteReplyHandler(replyToken)
 	e.SendCmd(serviceName, cmdName, cmdParams, &replyToken, routeOptions, serviceInstanceID)
-	responseData := <-e.ReplyHandlerQueue[replyToken]
 
-	return responseData
+	if timeout <= 0 {
+		return <-replyChan
+	}
+	timeoutTimer := time.NewTimer(timeout)
+	defer timeoutTimer.Stop()
+	select {
+	case responseData := <-replyChan:
+		return responseData
+	case <-timeoutTimer.C:
+		e.drpNode.Log(fmt.Sprintf("Timed out after %s waiting for %s/%s", timeout, serviceName, cmdName), true)
+		return nil
+	}
 }
 
 // SendReply returns data to a remote Endpoint which originally executed a command
-func (e *Endpoint) SendReply(replyToken *int, returnStatus int, returnPayload interface{}) {
+func (e *Endpoint) SendReply(replyToken *int, returnStatus int, returnPayload interface{}, routeOptions *RouteOptions) {
 	replyCmd := &ReplyOut{}
 	replyCmd.Type = "reply"
+	replyCmd.RouteOptions = routeOptions
 	replyCmd.Token = replyToken
 	replyCmd.Status = returnStatus
 	replyCmd.Payload = returnPayload
@@ -153,6 +268,21 @@ func (e *Endpoint) SendReply(replyToken *int, returnStatus int, returnPayload in
 	//e.sendChan <- *replyCmd
 }
 
+// sendStreamReply sends a reply on a stream opened by the remote side, returning an error if the write fails
+func (e *Endpoint) sendStreamReply(streamToken int, returnStatus int, returnPayload interface{}) error {
+	replyCmd := &ReplyOut{}
+	replyCmd.Type = "reply"
+	replyCmd.Token = &streamToken
+	replyCmd.Status = returnStatus
+	replyCmd.Payload = returnPayload
+	if e.wsConn == nil {
+		return fmt.Errorf("endpoint is not connected")
+	}
+	e.sendLock.Lock()
+	defer e.sendLock.Unlock()
+	return e.wsConn.WriteMessage(websocket.TextMessage, replyCmd.ToJSON())
+}
+
 // ProcessCmd processes an inbound packet as a Cmd
 func (e *Endpoint) ProcessCmd(msgIn *Cmd) {
 	execParams := &ServiceCmd_ExecParams{}
@@ -164,20 +294,78 @@ func (e *Endpoint) ProcessCmd(msgIn *Cmd) {
 	}
 	execParams.targetServiceInstanceID = msgIn.ServiceInstanceID
 	execParams.callingEndpoint = e
+	execParams.sendOnly = msgIn.Token == nil
+
+	if msgIn.ServiceName == nil || msgIn.Method == nil {
+		return
+	}
+
+	// Nodes connecting to this one may only call the DRP authentication methods until they have sent a valid hello
+	if e.isServer && e.EndpointID == nil && *msgIn.ServiceName != "DRP" {
+		if msgIn.Token != nil {
+			e.SendReply(msgIn.Token, 0, "endpoint has not authenticated", nil)
+		}
+		return
+	}
+
+	if msgIn.LabelSelector != nil {
+		labelSelector, err := ParseLabelSelector(*msgIn.LabelSelector)
+		if err != nil {
+			if msgIn.Token != nil {
+				e.SendReply(msgIn.Token, 0, err.Error(), nil)
+			}
+			return
+		}
+		execParams.labelSelector = labelSelector
+	}
 
 	cmdResults := make(map[string]interface{})
 	cmdResults["status"] = 1
 	cmdResults["output"] = e.drpNode.ServiceCmd(*msgIn.ServiceName, *msgIn.Method, msgIn.Params, *execParams)
-	e.SendReply(msgIn.Token, cmdResults["status"].(int), cmdResults["output"])
+
+	// No token means the caller is not expecting a response
+	if msgIn.Token == nil {
+		return
+	}
+
+	// Methods report failures by returning an error, which is sent back as a failed reply carrying its message
+	if cmdErr, isErr := cmdResults["output"].(error); isErr {
+		cmdResults["status"] = 0
+		cmdResults["output"] = cmdErr.Error()
+	}
+
+	// If the command was routed to us, route the reply back to the source
+	var replyRouteOptions *RouteOptions = nil
+	if msgIn.RouteOptions != nil && msgIn.RouteOptions.TgtNodeID != nil && *msgIn.RouteOptions.TgtNodeID == e.drpNode.NodeID {
+		replyRouteOptions = &RouteOptions{&e.drpNode.NodeID, msgIn.RouteOptions.SrcNodeID, []string{}}
+	}
+	e.SendReply(msgIn.Token, cmdResults["status"].(int), cmdResults["output"], replyRouteOptions)
 }
 
 // ProcessReply processes an inbound packet as a Reply
 func (e *Endpoint) ProcessReply(msgIn *ReplyIn) {
-	e.ReplyHandlerQueue[*msgIn.Token] <- msgIn
+	if msgIn.Token == nil {
+		return
+	}
+
+	e.replyLock.Lock()
+	replyHandler, ok := e.ReplyHandlerQueue[*msgIn.Token]
+	if ok {
+		// Callers await the first response only; later stream replies are dropped rather than blocking the receive loop
+		select {
+		case replyHandler <- msgIn:
+		default:
+		}
+
+		// If the receive is complete, delete handler
+		if msgIn.Status < 2 {
+			delete(e.ReplyHandlerQueue, *msgIn.Token)
+		}
+	}
+	e.replyLock.Unlock()
 
-	// If the receive is complete, delete handler
-	if msgIn.Status < 2 {
-		e.DeleteReplyHandler(*msgIn.Token)
+	if !ok {
+		e.drpNode.Log(fmt.Sprintf("Received reply for unknown token [%d]", *msgIn.Token), true)
 	}
 }
 
@@ -276,6 +464,7 @@ func (e *Endpoint) RelayPacket(packetIn *PacketIn) {
 			packetIn.Params,
 			packetIn.ServiceName,
 			packetIn.ServiceInstanceID,
+			packetIn.LabelSelector,
 		}
 		packetBytesOut = cmdPacket.ToJSON()
 	case "reply":
@@ -315,7 +504,17 @@ func (e *Endpoint) OpenHandler() {
 
 // CloseHandler specifies actions to be taken after a connection is closed
 func (e *Endpoint) CloseHandler(code int, text string) error {
-	e.closeChan <- true
+	switch code {
+	case CloseCodeAuthFailed, CloseCodeDuplicateNodeID:
+		e.drpNode.Log(fmt.Sprintf("Connection rejected by remote Node: %s", text), false)
+	}
+	if e.closeCallback != nil {
+		(*e.closeCallback)()
+	}
+	select {
+	case e.closeChan <- true:
+	default:
+	}
 	return nil
 }
 
@@ -334,6 +533,8 @@ func (e *Endpoint) StartListening(wsConn *websocket.Conn) {
 			_, p, err := e.wsConn.ReadMessage()
 			if err != nil {
 				e.drpNode.Log(fmt.Sprintf("Could not read from wsConn: %s", err), true)
+				e.closeReplyHandlers()
+				e.terminateStreamSubscriptions()
 				break
 			} else {
 				// Need to update this so the receive loop isn't tied up processing inbound commands
@@ -343,9 +544,47 @@ func (e *Endpoint) StartListening(wsConn *websocket.Conn) {
 	}()
 }
 
+// addStreamSubscription tracks a Subscriber feeding a stream opened by the remote side of this Endpoint
+func (e *Endpoint) addStreamSubscription(streamToken int, subscription *Subscriber) {
+	e.subscriptionLock.Lock()
+	defer e.subscriptionLock.Unlock()
+	if e.Subscriptions == nil {
+		e.Subscriptions = make(map[int]*Subscriber)
+	}
+	e.Subscriptions[streamToken] = subscription
+}
+
+// removeStreamSubscription stops tracking the Subscriber feeding a stream and returns it, or nil if there is none
+func (e *Endpoint) removeStreamSubscription(streamToken int) *Subscriber {
+	e.subscriptionLock.Lock()
+	defer e.subscriptionLock.Unlock()
+	subscription, ok := e.Subscriptions[streamToken]
+	if !ok {
+		return nil
+	}
+	delete(e.Subscriptions, streamToken)
+	return subscription
+}
+
+// terminateStreamSubscriptions terminates every Subscriber feeding a stream on this Endpoint
+func (e *Endpoint) terminateStreamSubscriptions() {
+	e.subscriptionLock.Lock()
+	subscriptionList := make([]*Subscriber, 0, len(e.Subscriptions))
+	for streamToken, subscription := range e.Subscriptions {
+		subscriptionList = append(subscriptionList, subscription)
+		delete(e.Subscriptions, streamToken)
+	}
+	e.subscriptionLock.Unlock()
+
+	for _, subscription := range subscriptionList {
+		e.drpNode.SubscriptionManager.UnregisterSubscription(subscription)
+		subscription.Terminate()
+	}
+}
+
 // IsServer tells whether or not this endpoint is the server side of the connection
 func (e *Endpoint) IsServer() bool {
-	return false
+	return e.isServer
 }
 
 // PingTime TO DO - IMPLEMENT
@@ -370,6 +609,16 @@ func (e *Endpoint) IsConnecting() bool {
 	return false
 }
 
+// Close terminates the Endpoint's socket connection, sending a close code and reason to the peer
+func (e *Endpoint) Close(closeCode int, closeReason string) {
+	if e.wsConn == nil {
+		return
+	}
+	closeMessage := websocket.FormatCloseMessage(closeCode, closeReason)
+	e.wsConn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+	e.wsConn.Close()
+}
+
 // ConnectionStats returns uptime and latency info
 func (e *Endpoint) ConnectionStats() ConnectionStats {
 	return ConnectionStats{
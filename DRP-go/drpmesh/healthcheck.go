@@ -0,0 +1,262 @@
+package drpmesh
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultHealthCheckInterval is how often a Registry probes the service instances of its directly connected Nodes
+const DefaultHealthCheckInterval = 15 * time.Second
+
+// DefaultHealthCheckTimeout is how long a health check may take before it counts as a failure
+const DefaultHealthCheckTimeout = 5 * time.Second
+
+// DefaultHealthCheckFailThreshold is how many consecutive failures mark an instance unhealthy
+const DefaultHealthCheckFailThreshold = 3
+
+// DefaultHealthCheckPassThreshold is how many consecutive successes restore an unhealthy instance
+const DefaultHealthCheckPassThreshold = 2
+
+// instanceHealth tracks consecutive health check results for a service instance
+type instanceHealth struct {
+	failures  int
+	successes int
+}
+
+// StartHealthChecks periodically probes service instances which declare a health check.  Calling it again
+// replaces the running loop.
+func (tt *TopologyTracker) StartHealthChecks(checkInterval time.Duration) {
+	tt.StopHealthChecks()
+
+	stopChan := make(chan bool)
+	tt.healthCheckLock.Lock()
+	tt.healthCheckStop = stopChan
+	tt.healthCheckLock.Unlock()
+
+	go func() {
+		checkTicker := time.NewTicker(checkInterval)
+		defer checkTicker.Stop()
+		for {
+			select {
+			case <-checkTicker.C:
+				tt.RunHealthChecks()
+			case <-stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// StopHealthChecks stops the health check loop if it is running
+func (tt *TopologyTracker) StopHealthChecks() {
+	tt.healthCheckLock.Lock()
+	defer tt.healthCheckLock.Unlock()
+	if tt.healthCheckStop != nil {
+		close(tt.healthCheckStop)
+		tt.healthCheckStop = nil
+	}
+}
+
+// RunHealthChecks probes every instance this Node is responsible for checking and returns the probe result per
+// instance.  A Registry checks the local Node's services and those of Nodes connected directly to it.
+func (tt *TopologyTracker) RunHealthChecks() map[string]bool {
+	thisTopologyTracker := tt
+	thisNode := thisTopologyTracker.drpNode
+
+	checkList := []*ServiceTableEntry{}
+	for serviceInstanceID, serviceTableEntry := range thisTopologyTracker.Snapshot().ServiceTable {
+		if serviceTableEntry.HealthCheck == "" || (serviceTableEntry.Status != ServiceStatusReady && serviceTableEntry.Status != ServiceStatusUnhealthy) {
+			continue
+		}
+		if *serviceTableEntry.NodeID != thisNode.NodeID && derefString(serviceTableEntry.LearnedFrom) != *serviceTableEntry.NodeID {
+			continue
+		}
+		if !thisTopologyTracker.IsVerified("service", serviceInstanceID) {
+			continue
+		}
+		checkList = append(checkList, serviceTableEntry)
+	}
+
+	// Forget instances which are no longer checked
+	thisTopologyTracker.healthCheckLock.Lock()
+	checkedInstances := make(map[string]*instanceHealth)
+	for _, serviceTableEntry := range checkList {
+		if healthState, ok := thisTopologyTracker.healthStates[*serviceTableEntry.InstanceID]; ok {
+			checkedInstances[*serviceTableEntry.InstanceID] = healthState
+		}
+	}
+	thisTopologyTracker.healthStates = checkedInstances
+	thisTopologyTracker.healthCheckLock.Unlock()
+
+	checkResults := make(map[string]bool)
+	var resultLock sync.Mutex
+	var checkWait sync.WaitGroup
+	for _, serviceTableEntry := range checkList {
+		checkWait.Add(1)
+		go func(serviceTableEntry *ServiceTableEntry) {
+			defer checkWait.Done()
+			checkPassed := thisTopologyTracker.checkServiceHealth(serviceTableEntry)
+			resultLock.Lock()
+			checkResults[*serviceTableEntry.InstanceID] = checkPassed
+			resultLock.Unlock()
+		}(serviceTableEntry)
+	}
+	checkWait.Wait()
+
+	return checkResults
+}
+
+// CheckServiceHealth probes a service instance once, marking it unhealthy or restoring it once the thresholds are
+// reached, and returns whether or not the probe passed
+func (tt *TopologyTracker) CheckServiceHealth(serviceInstanceID string) bool {
+	serviceTableEntry := tt.GetServiceEntry(serviceInstanceID)
+	if serviceTableEntry == nil || serviceTableEntry.HealthCheck == "" {
+		return false
+	}
+	return tt.checkServiceHealth(serviceTableEntry)
+}
+
+// checkServiceHealth runs the health check method of an instance and records the result
+func (tt *TopologyTracker) checkServiceHealth(serviceTableEntry *ServiceTableEntry) bool {
+	thisTopologyTracker := tt
+	thisNode := thisTopologyTracker.drpNode
+
+	cmdResult, errorCode := thisTopologyTracker.runHealthProbe(serviceTableEntry)
+	if errorCode == CallErrorTimeout {
+		thisNode.Log(fmt.Sprintf("Health check of service [%s] instance [%s] timed out", *serviceTableEntry.Name, *serviceTableEntry.InstanceID), true)
+	}
+	checkPassed := errorCode == "" && healthCheckPassed(cmdResult)
+
+	thisTopologyTracker.recordHealthResult(serviceTableEntry, checkPassed)
+	return checkPassed
+}
+
+// runHealthProbe calls the health check method of an instance, giving up after HealthCheckTimeout.  Only the
+// local Node's instances and those of directly connected Nodes are checked, so remote probes go straight to the
+// Node's Endpoint and stop waiting in SendCmdAwaitTimeout.  Local methods cannot be interrupted, so the probe only
+// stops waiting on them.
+func (tt *TopologyTracker) runHealthProbe(serviceTableEntry *ServiceTableEntry) (interface{}, string) {
+	thisTopologyTracker := tt
+	thisNode := thisTopologyTracker.drpNode
+
+	if *serviceTableEntry.NodeID != thisNode.NodeID {
+		nodeEndpoint := thisNode.GetNodeEndpoint(*serviceTableEntry.NodeID)
+		if nodeEndpoint == nil {
+			return nil, CallErrorUnreachable
+		}
+		probeReply := nodeEndpoint.SendCmdAwaitTimeout(*serviceTableEntry.Name, serviceTableEntry.HealthCheck, &CmdParams{}, nil, serviceTableEntry.InstanceID, thisTopologyTracker.HealthCheckTimeout)
+		if probeReply == nil {
+			if nodeEndpoint.baseEndpoint().isClosed() {
+				return nil, CallErrorUnreachable
+			}
+			return nil, CallErrorTimeout
+		}
+		if probeReply.Status == 0 {
+			return probeReply.Payload, CallErrorFailed
+		}
+		return probeReply.Payload, ""
+	}
+
+	execParams := ServiceCmd_ExecParams{}
+	execParams.targetServiceInstanceID = serviceTableEntry.InstanceID
+	if thisTopologyTracker.HealthCheckTimeout <= 0 {
+		return thisNode.serviceCmdAttempt(*serviceTableEntry.Name, serviceTableEntry.HealthCheck, &CmdParams{}, &execParams, 0)
+	}
+
+	type probeResult struct {
+		cmdResult interface{}
+		errorCode string
+	}
+	resultChan := make(chan probeResult, 1)
+	go func() {
+		cmdResult, errorCode := thisNode.serviceCmdAttempt(*serviceTableEntry.Name, serviceTableEntry.HealthCheck, &CmdParams{}, &execParams, 0)
+		resultChan <- probeResult{cmdResult, errorCode}
+	}()
+
+	timeoutTimer := time.NewTimer(thisTopologyTracker.HealthCheckTimeout)
+	defer timeoutTimer.Stop()
+	select {
+	case probeOutcome := <-resultChan:
+		return probeOutcome.cmdResult, probeOutcome.errorCode
+	case <-timeoutTimer.C:
+		return nil, CallErrorTimeout
+	}
+}
+
+// recordHealthResult counts consecutive results and flips the instance status when a threshold is reached
+func (tt *TopologyTracker) recordHealthResult(serviceTableEntry *ServiceTableEntry, checkPassed bool) {
+	thisTopologyTracker := tt
+	thisNode := thisTopologyTracker.drpNode
+	serviceInstanceID := *serviceTableEntry.InstanceID
+
+	thisTopologyTracker.healthCheckLock.Lock()
+	healthState, ok := thisTopologyTracker.healthStates[serviceInstanceID]
+	if !ok {
+		healthState = &instanceHealth{}
+		thisTopologyTracker.healthStates[serviceInstanceID] = healthState
+	}
+	newStatus := serviceTableEntry.Status
+	if checkPassed {
+		healthState.failures = 0
+		healthState.successes++
+		if serviceTableEntry.Status == ServiceStatusUnhealthy && healthState.successes >= thisTopologyTracker.HealthCheckPassThreshold {
+			newStatus = ServiceStatusReady
+		}
+	} else {
+		healthState.successes = 0
+		healthState.failures++
+		if serviceTableEntry.Status == ServiceStatusReady && healthState.failures >= thisTopologyTracker.HealthCheckFailThreshold {
+			newStatus = ServiceStatusUnhealthy
+		}
+	}
+	thisTopologyTracker.healthCheckLock.Unlock()
+
+	if newStatus == serviceTableEntry.Status {
+		return
+	}
+
+	// Only change the status if the provider has not changed it since the check started
+	currentEntry := thisTopologyTracker.GetServiceEntry(serviceInstanceID)
+	if currentEntry == nil || currentEntry.Status != serviceTableEntry.Status {
+		return
+	}
+
+	thisNode.Log(fmt.Sprintf("Health check marked service [%s] instance [%s] %s", *currentEntry.Name, serviceInstanceID, ServiceStatusName(newStatus)), false)
+
+	// Issue the update from this Node at the provider's sequence; it is applied as a status override and the
+	// provider's next advertisement supersedes it.  Local services are ours to sequence.
+	currentEntry.Status = newStatus
+	if *currentEntry.NodeID == thisNode.NodeID {
+		currentEntry.Sequence = thisTopologyTracker.NextSequence()
+	}
+	healthUpdatePacket := TopologyPacket{thisNode.NodeID, "update", "service", serviceInstanceID, *currentEntry.Scope, *currentEntry.Zone, currentEntry.ToJSON(), currentEntry.Sequence}
+	thisTopologyTracker.ProcessPacket(healthUpdatePacket, thisNode.NodeID, thisNode.IsRegistry())
+}
+
+// healthCheckPassed interprets the result of a health check method; methods should return true when healthy.
+// Remote results are decoded first so a value counts the same whether the instance is local or remote: nil, false
+// and errors fail and anything else passes.
+func healthCheckPassed(cmdResult interface{}) bool {
+	if resultJSON, ok := cmdResult.(*json.RawMessage); ok {
+		if resultJSON == nil {
+			return false
+		}
+		var decodedResult interface{}
+		if err := json.Unmarshal(*resultJSON, &decodedResult); err != nil {
+			return false
+		}
+		cmdResult = decodedResult
+	}
+	switch resultValue := cmdResult.(type) {
+	case nil:
+		return false
+	case bool:
+		return resultValue
+	case error:
+		return false
+	default:
+		return true
+	}
+}
@@ -0,0 +1,205 @@
+package drpmesh
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testPeerNode connects a peer Node directly to the Node over a test websocket.  answerCmd returns the reply
+// payload for each command the peer receives; a false second result leaves the command unanswered.
+func testPeerNode(t *testing.T, thisNode *Node, peerNodeID string, answerCmd func(cmdPacket *PacketIn) (interface{}, bool)) *Endpoint {
+	peerEndpoint, peerConn := testEndpointPair(t, thisNode, peerNodeID)
+	thisNode.setNodeEndpoint(peerNodeID, peerEndpoint)
+	go func() {
+		for {
+			_, cmdBytes, err := peerConn.ReadMessage()
+			if err != nil {
+				return
+			}
+			cmdPacket := &PacketIn{}
+			if json.Unmarshal(cmdBytes, cmdPacket) != nil || cmdPacket.Type != "cmd" {
+				continue
+			}
+			replyPayload, sendReply := answerCmd(cmdPacket)
+			if !sendReply {
+				continue
+			}
+			replyPacket := &ReplyOut{}
+			replyPacket.Type = "reply"
+			replyPacket.Token = cmdPacket.Token
+			replyPacket.Status = 1
+			replyPacket.Payload = replyPayload
+			peerConn.WriteMessage(websocket.TextMessage, replyPacket.ToJSON())
+		}
+	}()
+	return peerEndpoint
+}
+
+// pendingReplyCount returns the number of reply handlers waiting on an Endpoint
+func pendingReplyCount(thisEndpoint *Endpoint) int {
+	thisEndpoint.replyLock.Lock()
+	defer thisEndpoint.replyLock.Unlock()
+	return len(thisEndpoint.ReplyHandlerQueue)
+}
+
+func TestHealthChecks(t *testing.T) {
+	localNodeID := "registry1"
+	thisNode := testNode(t, testNodeOptions("Registry", localNodeID))
+	thisTopologyTracker := thisNode.TopologyTracker
+
+	serviceHealthy := false
+	clientCmds := map[string]EndpointMethod{
+		"health": func(params *CmdParams, callingEndpoint EndpointInterface, token *int) interface{} {
+			return serviceHealthy
+		},
+	}
+	instanceID := thisNode.AddService(&Service{ServiceName: "Web", Type: "Web", Priority: 10, Weight: 10, Zone: "zone1", Scope: "zone", Dependencies: []string{}, Streams: []string{}, Status: ServiceStatusReady, ClientCmds: clientCmds, HealthCheck: "health"})
+
+	// Failures below the threshold leave the instance selectable
+	for checkCount := 1; checkCount <= DefaultHealthCheckFailThreshold; checkCount++ {
+		if checkResults := thisTopologyTracker.RunHealthChecks(); len(checkResults) != 1 || checkResults[instanceID] {
+			t.Fatalf("expected one failed check, got %v", checkResults)
+		}
+		expectedStatus := ServiceStatusReady
+		if checkCount == DefaultHealthCheckFailThreshold {
+			expectedStatus = ServiceStatusUnhealthy
+		}
+		if serviceStatus := thisTopologyTracker.GetServiceEntry(instanceID).Status; serviceStatus != expectedStatus {
+			t.Fatalf("expected %s after %d failures, got %s", ServiceStatusName(expectedStatus), checkCount, ServiceStatusName(serviceStatus))
+		}
+	}
+	serviceName := "Web"
+	if serviceEntry := thisTopologyTracker.FindInstanceOfService(&serviceName, nil, nil, nil, nil); serviceEntry != nil {
+		t.Fatalf("expected unhealthy instance not to be selected")
+	}
+
+	// Consecutive successes restore it
+	serviceHealthy = true
+	for checkCount := 1; checkCount <= DefaultHealthCheckPassThreshold; checkCount++ {
+		thisTopologyTracker.RunHealthChecks()
+	}
+	if serviceStatus := thisTopologyTracker.GetServiceEntry(instanceID).Status; serviceStatus != ServiceStatusReady {
+		t.Fatalf("expected instance to be restored, got %s", ServiceStatusName(serviceStatus))
+	}
+}
+
+func TestHealthCheckResults(t *testing.T) {
+	// A value counts the same whether a local method returned it or it arrived from a remote instance
+	for _, checkCase := range []struct {
+		cmdResult  interface{}
+		wantPassed bool
+	}{
+		{true, true},
+		{false, false},
+		{nil, false},
+		{"ok", true},
+		{1, true},
+		{errors.New("unhealthy"), false},
+	} {
+		resultJSON, _ := json.Marshal(checkCase.cmdResult)
+		if _, isError := checkCase.cmdResult.(error); isError {
+			resultJSON = []byte("null")
+		}
+		remoteResult := json.RawMessage(resultJSON)
+		if gotPassed := healthCheckPassed(checkCase.cmdResult); gotPassed != checkCase.wantPassed {
+			t.Errorf("expected local result %#v to pass: %v", checkCase.cmdResult, checkCase.wantPassed)
+		}
+		if gotPassed := healthCheckPassed(&remoteResult); gotPassed != checkCase.wantPassed {
+			t.Errorf("expected remote result %s to pass: %v", string(resultJSON), checkCase.wantPassed)
+		}
+	}
+	if healthCheckPassed((*json.RawMessage)(nil)) {
+		t.Errorf("expected a missing remote result to fail")
+	}
+}
+
+func TestHealthCheckRemoteProbes(t *testing.T) {
+	thisNode := testNode(t, testNodeOptions("Registry", "registry1"))
+	thisTopologyTracker := thisNode.TopologyTracker
+	thisTopologyTracker.HealthCheckTimeout = 100 * time.Millisecond
+
+	// provider1 is connected directly and advertises a health check on its Worker
+	providerEntry := addTestProvider(thisTopologyTracker, "provider1", "zone1", "Worker")[0]
+	providerEntry.HealthCheck = "health"
+	thisTopologyTracker.ProcessPacket(TopologyPacket{"provider1", "update", "service", *providerEntry.InstanceID, *providerEntry.Scope, *providerEntry.Zone, providerEntry.ToJSON(), 0}, "provider1", false)
+
+	// The provider answers health checks with the current reply, or not at all when it is nil
+	var replyLock sync.Mutex
+	var healthReply interface{} = "ok"
+	providerEndpoint := testPeerNode(t, thisNode, "provider1", func(cmdPacket *PacketIn) (interface{}, bool) {
+		replyLock.Lock()
+		defer replyLock.Unlock()
+		return healthReply, healthReply != nil
+	})
+	setHealthReply := func(replyPayload interface{}) {
+		replyLock.Lock()
+		healthReply = replyPayload
+		replyLock.Unlock()
+	}
+
+	// A string reply passes, as it would from a local method
+	if checkResults := thisTopologyTracker.RunHealthChecks(); len(checkResults) != 1 || !checkResults[*providerEntry.InstanceID] {
+		t.Fatalf("expected the remote check to pass, got %v", checkResults)
+	}
+
+	// A wedged provider fails the check within the timeout and leaves no reply handler behind
+	setHealthReply(nil)
+	for checkCount := 1; checkCount <= DefaultHealthCheckFailThreshold; checkCount++ {
+		checkStart := time.Now()
+		if checkResults := thisTopologyTracker.RunHealthChecks(); checkResults[*providerEntry.InstanceID] {
+			t.Fatalf("expected the wedged check to fail, got %v", checkResults)
+		}
+		if checkTime := time.Since(checkStart); checkTime > time.Second {
+			t.Fatalf("expected the check to give up after the timeout, took %s", checkTime)
+		}
+		if replyCount := pendingReplyCount(providerEndpoint); replyCount != 0 {
+			t.Fatalf("expected timed out probes to remove their reply handlers, %d remain", replyCount)
+		}
+	}
+	if serviceStatus := thisTopologyTracker.GetServiceEntry(*providerEntry.InstanceID).Status; serviceStatus != ServiceStatusUnhealthy {
+		t.Fatalf("expected the wedged instance to be unhealthy, got %s", ServiceStatusName(serviceStatus))
+	}
+
+	// A false reply keeps it unhealthy, then true replies restore it
+	setHealthReply(false)
+	if checkResults := thisTopologyTracker.RunHealthChecks(); checkResults[*providerEntry.InstanceID] {
+		t.Fatalf("expected a false reply to fail, got %v", checkResults)
+	}
+	setHealthReply(true)
+	for checkCount := 1; checkCount <= DefaultHealthCheckPassThreshold; checkCount++ {
+		thisTopologyTracker.RunHealthChecks()
+	}
+	if serviceStatus := thisTopologyTracker.GetServiceEntry(*providerEntry.InstanceID).Status; serviceStatus != ServiceStatusReady {
+		t.Fatalf("expected the instance to be restored, got %s", ServiceStatusName(serviceStatus))
+	}
+}
+
+func TestHealthCheckLocalTimeout(t *testing.T) {
+	thisNode := testNode(t, testNodeOptions("Registry", "registry1"))
+	thisTopologyTracker := thisNode.TopologyTracker
+	thisTopologyTracker.HealthCheckTimeout = 50 * time.Millisecond
+
+	releaseChan := make(chan bool)
+	t.Cleanup(func() { close(releaseChan) })
+	clientCmds := map[string]EndpointMethod{
+		"health": func(params *CmdParams, callingEndpoint EndpointInterface, token *int) interface{} {
+			<-releaseChan
+			return true
+		},
+	}
+	instanceID := thisNode.AddService(&Service{ServiceName: "Web", Type: "Web", Priority: 10, Weight: 10, Zone: "zone1", Scope: "zone", Dependencies: []string{}, Streams: []string{}, Status: ServiceStatusReady, ClientCmds: clientCmds, HealthCheck: "health"})
+
+	// A wedged local method fails the check without holding up the others
+	checkStart := time.Now()
+	if checkResults := thisTopologyTracker.RunHealthChecks(); len(checkResults) != 1 || checkResults[instanceID] {
+		t.Fatalf("expected the wedged local check to fail, got %v", checkResults)
+	}
+	if checkTime := time.Since(checkStart); checkTime > time.Second {
+		t.Fatalf("expected the check to give up after the timeout, took %s", checkTime)
+	}
+}
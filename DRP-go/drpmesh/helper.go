@@ -1,6 +1,9 @@
 package drpmesh
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
 	"reflect"
 )
 
@@ -17,3 +20,23 @@ func GetKeys(inputMap interface{}) []string {
 	}
 	return returnKeys
 }
+
+// RandomHex returns a cryptographically random hex string of the given byte length
+func RandomHex(byteCount int) string {
+	randomBytes := make([]byte, byteCount)
+	if _, err := rand.Read(randomBytes); err != nil {
+		panic(fmt.Sprintf("could not read random bytes: %s", err))
+	}
+	return hex.EncodeToString(randomBytes)
+}
+
+// NewUUID returns a random (version 4) UUID string
+func NewUUID() string {
+	uuidBytes := make([]byte, 16)
+	if _, err := rand.Read(uuidBytes); err != nil {
+		panic(fmt.Sprintf("could not read random bytes: %s", err))
+	}
+	uuidBytes[6] = (uuidBytes[6] & 0x0f) | 0x40
+	uuidBytes[8] = (uuidBytes[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuidBytes[0:4], uuidBytes[4:6], uuidBytes[6:8], uuidBytes[8:10], uuidBytes[10:16])
+}
@@ -0,0 +1,98 @@
+package drpmesh
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultNodeID returns a collision-free NodeID made from the hostname and a random UUID
+func DefaultNodeID() string {
+	nodeHostname, _ := os.Hostname()
+	if nodeHostname == "" {
+		return NewUUID()
+	}
+	return fmt.Sprintf("%s-%s", nodeHostname, NewUUID())
+}
+
+// LoadOrCreateNodeID reads a NodeID from a file, generating and persisting a new one if the file does not exist
+func LoadOrCreateNodeID(nodeIDFile string) (string, error) {
+	fileBytes, err := os.ReadFile(nodeIDFile)
+	if err == nil {
+		nodeID := strings.TrimSpace(string(fileBytes))
+		if nodeID == "" {
+			return "", fmt.Errorf("node ID file %s is empty", nodeIDFile)
+		}
+		return nodeID, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", fmt.Errorf("could not read node ID file %s: %s", nodeIDFile, err)
+	}
+
+	// Write to a temp file and rename so a partial write is never read back
+	nodeID := DefaultNodeID()
+	tmpFile := nodeIDFile + ".tmp"
+	if err := os.MkdirAll(filepath.Dir(nodeIDFile), 0755); err != nil {
+		return "", fmt.Errorf("could not create directory for node ID file %s: %s", nodeIDFile, err)
+	}
+	if err := os.WriteFile(tmpFile, []byte(nodeID+"\n"), 0644); err != nil {
+		return "", fmt.Errorf("could not write node ID file %s: %s", nodeIDFile, err)
+	}
+	if err := os.Rename(tmpFile, nodeIDFile); err != nil {
+		return "", fmt.Errorf("could not write node ID file %s: %s", nodeIDFile, err)
+	}
+	return nodeID, nil
+}
+
+// ResolveNodeID returns the explicitly provided NodeID, else the NodeID persisted in nodeIDFile, else a new default
+func ResolveNodeID(nodeID *string, nodeIDFile *string) (string, error) {
+	if nodeID != nil && *nodeID != "" {
+		return *nodeID, nil
+	}
+	if nodeIDFile != nil && *nodeIDFile != "" {
+		return LoadOrCreateNodeID(*nodeIDFile)
+	}
+	return DefaultNodeID(), nil
+}
+
+// IsDuplicateNodeID tells whether a connecting Node claims a NodeID already held by a different live Node.  A live
+// connection in the opposite direction is not a duplicate if the host matches; the two Nodes dialed each other and
+// keepNodeEndpoint picks which connection to keep.
+func (dn *Node) IsDuplicateNodeID(remoteNodeDeclaration *NodeDeclaration, remoteEndpoint EndpointInterface) bool {
+	thisNode := dn
+	remoteNodeID := remoteNodeDeclaration.NodeID
+	existingNodeEntry := thisNode.TopologyTracker.GetNodeEntry(remoteNodeID)
+	hostMatches := existingNodeEntry == nil || existingNodeEntry.HostID == nil || *existingNodeEntry.HostID == remoteNodeDeclaration.HostID
+
+	// Another live connection is already registered under this NodeID
+	existingEndpoint := thisNode.GetNodeEndpoint(remoteNodeID)
+	if existingEndpoint != nil && existingEndpoint.baseEndpoint() != remoteEndpoint.baseEndpoint() && !existingEndpoint.baseEndpoint().isClosed() {
+		if existingEndpoint.IsServer() == remoteEndpoint.IsServer() || !hostMatches {
+			return true
+		}
+	}
+
+	// The NodeTable has a reachable entry for this NodeID from a different host
+	if !hostMatches {
+		if existingNodeEntry.LearnedFrom != nil && *existingNodeEntry.LearnedFrom != remoteNodeID && thisNode.IsConnectedTo(*existingNodeEntry.LearnedFrom) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isKeptMutualConnection tells whether a connection to a Node is the one kept when the two Nodes dial each other at
+// the same time.  Both Nodes keep the connection opened by the lower NodeID.
+func (dn *Node) isKeptMutualConnection(remoteNodeID string, remoteEndpoint EndpointInterface) bool {
+	lowerNodeID := dn.NodeID
+	if remoteNodeID < lowerNodeID {
+		lowerNodeID = remoteNodeID
+	}
+	openingNodeID := dn.NodeID
+	if remoteEndpoint.IsServer() {
+		openingNodeID = remoteNodeID
+	}
+	return openingNodeID == lowerNodeID
+}
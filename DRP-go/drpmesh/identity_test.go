@@ -0,0 +1,118 @@
+package drpmesh
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestNodeIDFile(t *testing.T) {
+	nodeIDFile := filepath.Join(t.TempDir(), "state", "nodeid")
+
+	// The first Node generates and persists an ID which later Nodes reuse
+	nodeOptions := testNodeOptions("Provider", "")
+	nodeOptions.NodeIDFile = nodeIDFile
+	firstNode := testNode(t, nodeOptions)
+	secondNode := testNode(t, nodeOptions)
+	if firstNode.NodeID == "" || firstNode.NodeID != secondNode.NodeID {
+		t.Fatalf("expected the persisted NodeID to be reused, got [%s] and [%s]", firstNode.NodeID, secondNode.NodeID)
+	}
+
+	// An explicit NodeID wins over the file
+	nodeOptions.NodeID = "explicit1"
+	if explicitNode := testNode(t, nodeOptions); explicitNode.NodeID != "explicit1" {
+		t.Fatalf("expected the explicit NodeID, got [%s]", explicitNode.NodeID)
+	}
+
+	// Default IDs are unique
+	if DefaultNodeID() == DefaultNodeID() {
+		t.Fatalf("expected default NodeIDs to differ")
+	}
+
+	// An unreadable ID file is reported instead of panicking
+	nodeOptions = testNodeOptions("Provider", "")
+	nodeOptions.NodeIDFile = t.TempDir()
+	if badNode, err := CreateNode(nodeOptions); err == nil || badNode != nil {
+		t.Fatalf("expected an error for an unreadable NodeID file")
+	}
+}
+
+func TestDuplicateNodeIDRejected(t *testing.T) {
+	registryNode := testNode(t, testNodeOptions("Registry", "registry1"))
+	registryServer := httptest.NewServer(registryNode)
+	defer registryServer.Close()
+
+	firstOptions := testNodeOptions("Provider", "provider1")
+	firstOptions.HostID = "hostA"
+	firstNode := testNode(t, firstOptions)
+	firstClient := &Client{}
+	if err := firstClient.Connect(testWebSocketURL(registryServer), nil, firstNode, nil, false, nil, nil); err != nil {
+		t.Fatalf("expected the first Node to connect, got %s", err)
+	}
+
+	// A second Node claiming the same NodeID is refused while the first is connected
+	secondOptions := testNodeOptions("Provider", "provider1")
+	secondOptions.HostID = "hostB"
+	secondNode := testNode(t, secondOptions)
+	if err := (&Client{}).Connect(testWebSocketURL(registryServer), nil, secondNode, nil, false, nil, nil); err == nil {
+		t.Fatalf("expected the duplicate NodeID to be refused")
+	}
+
+	// Once the first connection is gone the NodeID may be used again
+	firstClient.Close(1000, "done")
+	waitFor(t, "the NodeID to be released", func() bool {
+		return (&Client{}).Connect(testWebSocketURL(registryServer), nil, secondNode, nil, false, nil, nil) == nil
+	})
+}
+
+func TestMutualConnect(t *testing.T) {
+	lowerNode := testNode(t, testNodeOptions("Registry", "registry1"))
+	lowerServer := httptest.NewServer(lowerNode)
+	defer lowerServer.Close()
+	higherOptions := testNodeOptions("Registry", "registry2")
+	higherOptions.HostID = "host2"
+	higherNode := testNode(t, higherOptions)
+	higherServer := httptest.NewServer(higherNode)
+	defer higherServer.Close()
+
+	// dialNode connects one Registry to another and registers the connection, as VerifyNodeConnection does
+	dialNode := func(fromNode *Node, toNodeID string, toServer *httptest.Server) (*Client, error) {
+		nodeClient := &Client{}
+		if err := nodeClient.Connect(testWebSocketURL(toServer), nil, fromNode, &toNodeID, false, nil, nil); err != nil {
+			return nil, err
+		}
+		if !fromNode.keepNodeEndpoint(toNodeID, nodeClient) {
+			t.Fatalf("expected [%s] to keep its connection to [%s]", fromNode.NodeID, toNodeID)
+		}
+		return nodeClient, nil
+	}
+
+	// The higher NodeID dials first, then the lower NodeID dials back before either connection is dropped
+	higherClient, err := dialNode(higherNode, "registry1", lowerServer)
+	if err != nil {
+		t.Fatalf("expected registry2 to connect, got %s", err)
+	}
+	lowerClient, err := dialNode(lowerNode, "registry2", higherServer)
+	if err != nil {
+		t.Fatalf("expected the mutual connection from registry1 to be accepted, got %s", err)
+	}
+
+	// Both Registries keep the connection opened by the lower NodeID
+	waitFor(t, "the redundant connection to close", func() bool {
+		return higherClient.isClosed()
+	})
+	if higherEndpoint := higherNode.GetNodeEndpoint("registry1"); higherEndpoint == nil || !higherEndpoint.IsServer() || higherEndpoint.baseEndpoint().isClosed() {
+		t.Fatalf("expected registry2 to keep the connection opened by registry1")
+	}
+	if lowerEndpoint := lowerNode.GetNodeEndpoint("registry2"); lowerEndpoint == nil || lowerEndpoint.baseEndpoint() != lowerClient.baseEndpoint() {
+		t.Fatalf("expected registry1 to keep its own connection")
+	}
+
+	// Dialing again from the higher NodeID is refused without dropping the kept connection
+	if _, err := dialNode(higherNode, "registry1", lowerServer); err == nil {
+		t.Fatalf("expected a redundant connection from registry2 to be refused")
+	}
+	if lowerClient.isClosed() || lowerNode.GetNodeEndpoint("registry2").baseEndpoint() != lowerClient.baseEndpoint() {
+		t.Fatalf("expected the kept connection to survive the refused one")
+	}
+}
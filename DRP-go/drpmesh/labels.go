@@ -0,0 +1,276 @@
+package drpmesh
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Label selector operators
+const (
+	LabelOpEquals       = "="
+	LabelOpNotEquals    = "!="
+	LabelOpIn           = "in"
+	LabelOpNotIn        = "notin"
+	LabelOpExists       = "exists"
+	LabelOpDoesNotExist = "!"
+)
+
+// LabelRequirement is a single condition on a label value
+type LabelRequirement struct {
+	Key      string
+	Operator string
+	Values   []string
+}
+
+// LabelSelector is a list of requirements which must all be met; an empty selector matches everything
+type LabelSelector []LabelRequirement
+
+// ParseLabelSelector parses a comma separated selector such as "version=2,tier in (gold,silver),gpu!=true,!canary".
+// Negative requirements (!=, notin, !key) also match objects without the label.
+func ParseLabelSelector(selectorText string) (LabelSelector, error) {
+	labelSelector := LabelSelector{}
+
+	// Split on commas outside of parentheses
+	termList := []string{}
+	termStart := 0
+	parenDepth := 0
+	for charIndex, thisChar := range selectorText {
+		switch thisChar {
+		case '(':
+			parenDepth++
+		case ')':
+			parenDepth--
+			if parenDepth < 0 {
+				return nil, fmt.Errorf("unbalanced parentheses in label selector [%s]", selectorText)
+			}
+		case ',':
+			if parenDepth == 0 {
+				termList = append(termList, selectorText[termStart:charIndex])
+				termStart = charIndex + 1
+			}
+		}
+	}
+	if parenDepth != 0 {
+		return nil, fmt.Errorf("unbalanced parentheses in label selector [%s]", selectorText)
+	}
+	termList = append(termList, selectorText[termStart:])
+
+	for _, thisTerm := range termList {
+		thisTerm = strings.TrimSpace(thisTerm)
+		if thisTerm == "" {
+			continue
+		}
+		labelRequirement, err := parseLabelRequirement(thisTerm)
+		if err != nil {
+			return nil, err
+		}
+		labelSelector = append(labelSelector, labelRequirement)
+	}
+	return labelSelector, nil
+}
+
+// parseLabelRequirement parses a single selector term
+func parseLabelRequirement(thisTerm string) (LabelRequirement, error) {
+	labelRequirement := LabelRequirement{}
+
+	if setStart := strings.Index(thisTerm, "("); setStart >= 0 {
+		// Set based requirement, "key in (a,b)" or "key notin (a,b)"
+		if !strings.HasSuffix(thisTerm, ")") {
+			return labelRequirement, fmt.Errorf("invalid label requirement [%s]", thisTerm)
+		}
+		termFields := strings.Fields(thisTerm[:setStart])
+		if len(termFields) != 2 || (termFields[1] != LabelOpIn && termFields[1] != LabelOpNotIn) {
+			return labelRequirement, fmt.Errorf("invalid label requirement [%s]", thisTerm)
+		}
+		labelRequirement.Key = termFields[0]
+		labelRequirement.Operator = termFields[1]
+		for _, thisValue := range strings.Split(thisTerm[setStart+1:len(thisTerm)-1], ",") {
+			if thisValue = strings.TrimSpace(thisValue); thisValue != "" {
+				labelRequirement.Values = append(labelRequirement.Values, thisValue)
+			}
+		}
+		if len(labelRequirement.Values) == 0 {
+			return labelRequirement, fmt.Errorf("empty value set in label requirement [%s]", thisTerm)
+		}
+		return labelRequirement, nil
+	}
+
+	switch {
+	case strings.Contains(thisTerm, "!="):
+		termParts := strings.SplitN(thisTerm, "!=", 2)
+		labelRequirement = LabelRequirement{strings.TrimSpace(termParts[0]), LabelOpNotEquals, []string{strings.TrimSpace(termParts[1])}}
+	case strings.Contains(thisTerm, "=="):
+		termParts := strings.SplitN(thisTerm, "==", 2)
+		labelRequirement = LabelRequirement{strings.TrimSpace(termParts[0]), LabelOpEquals, []string{strings.TrimSpace(termParts[1])}}
+	case strings.Contains(thisTerm, "="):
+		termParts := strings.SplitN(thisTerm, "=", 2)
+		labelRequirement = LabelRequirement{strings.TrimSpace(termParts[0]), LabelOpEquals, []string{strings.TrimSpace(termParts[1])}}
+	case strings.HasPrefix(thisTerm, "!"):
+		labelRequirement = LabelRequirement{strings.TrimSpace(thisTerm[1:]), LabelOpDoesNotExist, nil}
+	default:
+		labelRequirement = LabelRequirement{thisTerm, LabelOpExists, nil}
+	}
+
+	if labelRequirement.Key == "" || strings.ContainsAny(labelRequirement.Key, " \t!=()") {
+		return labelRequirement, fmt.Errorf("invalid label key in requirement [%s]", thisTerm)
+	}
+	return labelRequirement, nil
+}
+
+// Matches tells whether or not a set of labels meets every requirement of the selector
+func (ls LabelSelector) Matches(labels map[string]string) bool {
+	for _, labelRequirement := range ls {
+		if !labelRequirement.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// Matches tells whether or not a set of labels meets the requirement
+func (lr LabelRequirement) Matches(labels map[string]string) bool {
+	labelValue, hasLabel := labels[lr.Key]
+	switch lr.Operator {
+	case LabelOpExists:
+		return hasLabel
+	case LabelOpDoesNotExist:
+		return !hasLabel
+	case LabelOpEquals, LabelOpIn:
+		return hasLabel && lr.hasValue(labelValue)
+	case LabelOpNotEquals, LabelOpNotIn:
+		return !hasLabel || !lr.hasValue(labelValue)
+	default:
+		return false
+	}
+}
+
+// hasValue tells whether or not a value is listed in the requirement
+func (lr LabelRequirement) hasValue(checkValue string) bool {
+	for _, thisValue := range lr.Values {
+		if thisValue == checkValue {
+			return true
+		}
+	}
+	return false
+}
+
+// String formats the selector in the syntax accepted by ParseLabelSelector
+func (ls LabelSelector) String() string {
+	termList := []string{}
+	for _, labelRequirement := range ls {
+		switch labelRequirement.Operator {
+		case LabelOpExists:
+			termList = append(termList, labelRequirement.Key)
+		case LabelOpDoesNotExist:
+			termList = append(termList, "!"+labelRequirement.Key)
+		case LabelOpIn, LabelOpNotIn:
+			termList = append(termList, fmt.Sprintf("%s %s (%s)", labelRequirement.Key, labelRequirement.Operator, strings.Join(labelRequirement.Values, ",")))
+		default:
+			termList = append(termList, fmt.Sprintf("%s%s%s", labelRequirement.Key, labelRequirement.Operator, strings.Join(labelRequirement.Values, ",")))
+		}
+	}
+	return strings.Join(termList, ",")
+}
+
+// cloneLabels returns a copy of a label map
+func cloneLabels(labels map[string]string) map[string]string {
+	if labels == nil {
+		return nil
+	}
+	newLabels := make(map[string]string, len(labels))
+	for labelKey, labelValue := range labels {
+		newLabels[labelKey] = labelValue
+	}
+	return newLabels
+}
+
+// formatLabels returns labels as sorted key=value pairs for logging
+func formatLabels(labels map[string]string) string {
+	labelKeys := GetKeys(labels)
+	sort.Strings(labelKeys)
+	labelPairs := []string{}
+	for _, labelKey := range labelKeys {
+		labelPairs = append(labelPairs, labelKey+"="+labels[labelKey])
+	}
+	return strings.Join(labelPairs, ",")
+}
+
+// getServiceLabels returns the labels a selector is matched against for a service instance: the labels of the
+// hosting Node, overridden by the service's own labels; caller must hold tableLock
+func (tt *TopologyTracker) getServiceLabels(serviceTableEntry *ServiceTableEntry) map[string]string {
+	nodeTableEntry, ok := (*tt.nodeTable)[*serviceTableEntry.NodeID]
+	if !ok || len(nodeTableEntry.Labels) == 0 {
+		return serviceTableEntry.Labels
+	}
+	effectiveLabels := cloneLabels(nodeTableEntry.Labels)
+	for labelKey, labelValue := range serviceTableEntry.Labels {
+		effectiveLabels[labelKey] = labelValue
+	}
+	return effectiveLabels
+}
+
+// findNodeInstance returns a Ready instance of a service on a Node which matches a label selector, chosen by the
+// Balancer among those with the lowest priority; a nil Balancer uses the service's Balancer
+func (tt *TopologyTracker) findNodeInstance(serviceName string, nodeID string, labelSelector LabelSelector, balancer Balancer) *ServiceTableEntry {
+	candidateList := []*ServiceTableEntry{}
+	for _, serviceTableEntry := range tt.FindInstancesOfService(serviceName, nil, labelSelector) {
+		if *serviceTableEntry.NodeID != nodeID || serviceTableEntry.Status != ServiceStatusReady {
+			continue
+		}
+		if len(candidateList) == 0 || serviceTableEntry.Priority < candidateList[0].Priority {
+			candidateList = []*ServiceTableEntry{serviceTableEntry}
+		} else if serviceTableEntry.Priority == candidateList[0].Priority {
+			candidateList = append(candidateList, serviceTableEntry)
+		}
+	}
+	if len(candidateList) == 0 {
+		return nil
+	}
+	if balancer == nil {
+		balancer = tt.GetServiceBalancer(&serviceName)
+	}
+	return balancer.Pick(candidateList, tt.ServiceStats)
+}
+
+// getLabelSelectorParam parses the optional labelSelector parameter of a discovery command
+func getLabelSelectorParam(params *CmdParams) (LabelSelector, error) {
+	selectorText := params.GetString("labelSelector")
+	if selectorText == nil {
+		return nil, nil
+	}
+	return ParseLabelSelector(*selectorText)
+}
+
+// SetLabels replaces the local Node's labels and advertises the change to the mesh
+func (dn *Node) SetLabels(labels map[string]string) {
+	thisNode := dn
+	thisNode.Labels = cloneLabels(labels)
+	thisNode.NodeDeclaration.Labels = thisNode.Labels
+
+	updateNodeEntry := thisNode.TopologyTracker.GetNodeEntry(thisNode.NodeID)
+	if updateNodeEntry == nil {
+		return
+	}
+	updateNodeEntry.Labels = cloneLabels(labels)
+	updateNodeEntry.Sequence = thisNode.TopologyTracker.NextSequence()
+
+	updateNodePacket := TopologyPacket{thisNode.NodeID, "update", "node", thisNode.NodeID, *updateNodeEntry.Scope, *updateNodeEntry.Zone, updateNodeEntry.ToJSON(), updateNodeEntry.Sequence}
+	thisNode.TopologyTracker.ProcessPacket(updateNodePacket, thisNode.NodeID, thisNode.IsRegistry())
+
+	thisNode.Log(fmt.Sprintf("Updated Node labels [%s]", formatLabels(labels)), true)
+}
+
+// SetServiceLabels replaces the labels of every local instance of a Service and advertises the change to the mesh
+func (dn *Node) SetServiceLabels(serviceName string, labels map[string]string) bool {
+	return dn.updateService(serviceName, func(serviceObj *Service) {
+		serviceObj.Labels = cloneLabels(labels)
+	})
+}
+
+// SetInstanceLabels replaces the labels of a local Service instance and advertises the change to the mesh
+func (dn *Node) SetInstanceLabels(serviceInstanceID string, labels map[string]string) bool {
+	return dn.updateServiceInstance(serviceInstanceID, func(serviceObj *Service) {
+		serviceObj.Labels = cloneLabels(labels)
+	})
+}
@@ -0,0 +1,154 @@
+package drpmesh
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestLabelSelectors(t *testing.T) {
+	localNodeID := "registry1"
+	serviceName := "TestService"
+	thisNode := testNode(t, testNodeOptions("Registry", localNodeID))
+	thisTopologyTracker := thisNode.TopologyTracker
+
+	if _, err := ParseLabelSelector("tier in (gold,silver"); err == nil {
+		t.Fatalf("expected unbalanced selector to be rejected")
+	}
+	labelSelector, err := ParseLabelSelector("tier in (gold, silver), version!=1, !canary")
+	if err != nil || len(labelSelector) != 3 || labelSelector.String() != "tier in (gold,silver),version!=1,!canary" {
+		t.Fatalf("unexpected selector %v, err %v", labelSelector, err)
+	}
+
+	// provider2 is a gpu Node; its service inherits the Node label
+	for nodeIndex, serviceLabels := range []map[string]string{{"tier": "gold", "version": "1"}, {"tier": "silver", "version": "2"}, {"tier": "gold", "version": "2", "canary": "true"}} {
+		nodeID := fmt.Sprintf("provider%d", nodeIndex+1)
+		nodeEntry := testNodeEntry(nodeID)
+		if nodeIndex == 1 {
+			nodeEntry.Labels = map[string]string{"gpu": "true"}
+		}
+		serviceEntry := testServiceEntry(nodeID, serviceName)
+		serviceEntry.Labels = serviceLabels
+		thisTopologyTracker.ProcessPacket(TopologyPacket{nodeID, "add", "node", nodeID, *nodeEntry.Scope, *nodeEntry.Zone, nodeEntry.ToJSON(), 0}, nodeID, false)
+		thisTopologyTracker.ProcessPacket(TopologyPacket{nodeID, "add", "service", *serviceEntry.InstanceID, *serviceEntry.Scope, *serviceEntry.Zone, serviceEntry.ToJSON(), 0}, nodeID, false)
+	}
+
+	serviceEntry := thisTopologyTracker.FindInstanceOfService(&serviceName, nil, nil, nil, labelSelector)
+	if serviceEntry == nil || *serviceEntry.NodeID != "provider2" {
+		t.Fatalf("expected provider2 to be the only match, got %v", serviceEntry)
+	}
+
+	gpuSelector, _ := ParseLabelSelector("gpu=true")
+	if serviceEntryList := thisTopologyTracker.FindInstancesOfService(serviceName, nil, gpuSelector); len(serviceEntryList) != 1 || *serviceEntryList[0].NodeID != "provider2" {
+		t.Fatalf("expected the service on the gpu Node, got %d instances", len(serviceEntryList))
+	}
+	if nodeIDList := thisTopologyTracker.ListNodes(nil, gpuSelector); len(nodeIDList) != 1 || nodeIDList[0] != "provider2" {
+		t.Fatalf("expected only provider2 to be listed, got %v", nodeIDList)
+	}
+
+	// Node labels set locally are advertised in the Node table
+	thisNode.SetLabels(map[string]string{"gpu": "false"})
+	gpuSelector, _ = ParseLabelSelector("gpu")
+	if nodeIDList := thisTopologyTracker.ListNodes(nil, gpuSelector); len(nodeIDList) != 2 {
+		t.Fatalf("expected two Nodes with a gpu label, got %v", nodeIDList)
+	}
+}
+
+func TestNodeOptionLabels(t *testing.T) {
+	nodeOptions := testNodeOptions("Registry", "registry1")
+	nodeOptions.Labels = map[string]string{"gpu": "true", "rack": "r1"}
+	thisNode := testNode(t, nodeOptions)
+	nodeOptions.Labels["gpu"] = "false"
+
+	// Labels given at creation are declared and advertised from the start
+	if thisNode.Labels["gpu"] != "true" || thisNode.NodeDeclaration.Labels["rack"] != "r1" {
+		t.Fatalf("expected the Node to keep its own copy of the labels, got %v", thisNode.Labels)
+	}
+	if nodeEntry := thisNode.TopologyTracker.GetNodeEntry("registry1"); nodeEntry == nil || nodeEntry.Labels["gpu"] != "true" {
+		t.Fatalf("expected the labels in the local Node entry, got %v", nodeEntry)
+	}
+	gpuSelector, _ := ParseLabelSelector("gpu=true")
+	if serviceEntryList := thisNode.TopologyTracker.FindInstancesOfService("DRP", nil, gpuSelector); len(serviceEntryList) != 1 {
+		t.Fatalf("expected the local DRP service to inherit the Node labels, got %d instances", len(serviceEntryList))
+	}
+}
+
+func TestLabelSelectorCmd(t *testing.T) {
+	localNodeID := "provider1"
+	thisNode := testNode(t, testNodeOptions("Provider", localNodeID))
+
+	// Two local instances of a service, told apart by a tier label
+	instanceIDs := map[string]string{}
+	for _, tierName := range []string{"gold", "silver"} {
+		instanceTier := tierName
+		clientCmds := map[string]EndpointMethod{
+			"whoami": func(params *CmdParams, callingEndpoint EndpointInterface, token *int) interface{} {
+				return instanceTier
+			},
+		}
+		instanceIDs[tierName] = thisNode.AddService(&Service{ServiceName: "Worker", Type: "Worker", Priority: 10, Weight: 10, Zone: "zone1", Scope: "zone", Dependencies: []string{}, Streams: []string{}, Status: ServiceStatusReady, Labels: map[string]string{"tier": tierName}, ClientCmds: clientCmds})
+	}
+	_, clientConn := testEndpointPair(t, thisNode, "consumer1")
+
+	// sendSelectorCmd calls Worker/whoami with a label selector, optionally routed to a Node
+	cmdToken := 0
+	sendSelectorCmd := func(selectorText string, tgtNodeID *string) *ReplyIn {
+		t.Helper()
+		cmdToken++
+		serviceName := "Worker"
+		methodName := "whoami"
+		selectorCmd := &CmdOut{}
+		selectorCmd.Type = "cmd"
+		selectorCmd.Token = &cmdToken
+		selectorCmd.Method = &methodName
+		selectorCmd.ServiceName = &serviceName
+		selectorCmd.LabelSelector = &selectorText
+		if tgtNodeID != nil {
+			selectorCmd.RouteOptions = &RouteOptions{TgtNodeID: tgtNodeID}
+		}
+		if err := clientConn.WriteMessage(websocket.TextMessage, selectorCmd.ToJSON()); err != nil {
+			t.Fatalf("could not send the command: %s", err)
+		}
+		return readTestReply(t, clientConn)
+	}
+	expectTier := func(replyPacket *ReplyIn, wantTier string) {
+		t.Helper()
+		var gotTier string
+		if replyPacket.Status != 1 || replyPacket.Payload == nil || json.Unmarshal(*replyPacket.Payload, &gotTier) != nil || gotTier != wantTier {
+			t.Fatalf("expected the %s instance to answer, got %s", wantTier, string(replyPacket.ToJSON()))
+		}
+	}
+
+	// The selector limits the instances considered, whether or not the command is routed to a Node
+	for callNum := 0; callNum < 5; callNum++ {
+		expectTier(sendSelectorCmd("tier=silver", nil), "silver")
+		expectTier(sendSelectorCmd("tier!=silver", &localNodeID), "gold")
+	}
+
+	// A selector matching nothing finds no instance, and an invalid one is refused
+	if replyPacket := sendSelectorCmd("tier=bronze", &localNodeID); replyPacket.Payload != nil && string(*replyPacket.Payload) != "null" {
+		t.Fatalf("expected no instance for an unmatched selector, got %s", string(replyPacket.ToJSON()))
+	}
+	if replyPacket := sendSelectorCmd("tier in (gold", nil); replyPacket.Status != 0 {
+		t.Fatalf("expected an invalid selector to be refused, got %s", string(replyPacket.ToJSON()))
+	}
+
+	// On a remote Node target, the matching instance is named so the remote Node runs it
+	remoteEntry := testServiceEntry("provider2", "Worker")
+	remoteEntry.Labels = map[string]string{"tier": "silver"}
+	addTestProvider(thisNode.TopologyTracker, "provider2", "zone1", "Worker")
+	thisNode.TopologyTracker.ProcessPacket(TopologyPacket{"provider2", "update", "service", *remoteEntry.InstanceID, *remoteEntry.Scope, *remoteEntry.Zone, remoteEntry.ToJSON(), 0}, "provider2", false)
+	silverSelector, _ := ParseLabelSelector("tier=silver")
+	if nodeInstance := thisNode.TopologyTracker.findNodeInstance("Worker", "provider2", silverSelector, nil); nodeInstance == nil || *nodeInstance.InstanceID != *remoteEntry.InstanceID {
+		t.Fatalf("expected the silver instance on provider2, got %v", nodeInstance)
+	}
+	goldSelector, _ := ParseLabelSelector("tier=gold")
+	if nodeInstance := thisNode.TopologyTracker.findNodeInstance("Worker", "provider2", goldSelector, nil); nodeInstance != nil {
+		t.Fatalf("expected no gold instance on provider2, got %s", fmt.Sprint(*nodeInstance.InstanceID))
+	}
+	if len(instanceIDs) != 2 {
+		t.Fatalf("expected two local instances, got %v", instanceIDs)
+	}
+}
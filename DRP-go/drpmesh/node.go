@@ -2,61 +2,108 @@ package drpmesh
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"math/rand"
-	"os"
+	"sort"
+	"sync"
 	"time"
 )
 
+// NodeOptions configures a Node created by CreateNode; optional settings left empty are not used
+type NodeOptions struct {
+	NodeRoles         []string
+	HostID            string
+	DomainName        string
+	MeshKey           string
+	Zone              string
+	Scope             string
+	ListeningName     string
+	RelayURL          string
+	WebServerConfig   interface{}
+	DRPRoute          string
+	NodeID            string
+	NodeIDFile        string
+	TopologyStateDir  string
+	Labels            map[string]string
+	LegacyMeshKeyAuth bool
+	Debug             bool
+}
+
+// optionalString returns a pointer to a copy of a string, or nil if it is empty
+func optionalString(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return &value
+}
+
 // CreateNode instantiates and returns a new node
-func CreateNode(nodeRoles []string, hostID string, domainName string, meshKey string, zone string, scope string, listeningName *string, webServerConfig interface{}, drpRoute *string, debug bool) *Node {
-	nodeHostname, _ := os.Hostname()
-	nodePID := os.Getpid()
+func CreateNode(nodeOptions NodeOptions) (*Node, error) {
+	resolvedNodeID, err := ResolveNodeID(optionalString(nodeOptions.NodeID), optionalString(nodeOptions.NodeIDFile))
+	if err != nil {
+		return nil, fmt.Errorf("could not determine NodeID: %s", err)
+	}
+	scope := nodeOptions.Scope
 
 	newNode := &Node{}
-	newNode.NodeRoles = nodeRoles
-	newNode.HostID = hostID
-	newNode.DomainName = domainName
-	newNode.meshKey = meshKey
-	newNode.Zone = zone
+	newNode.NodeRoles = nodeOptions.NodeRoles
+	newNode.HostID = nodeOptions.HostID
+	newNode.DomainName = nodeOptions.DomainName
+	newNode.meshKey = nodeOptions.MeshKey
+	newNode.Zone = nodeOptions.Zone
 	newNode.Scope = &scope
 	newNode.RegistryURL = nil
-	newNode.listeningName = listeningName
-	newNode.webServerConfig = webServerConfig
-	newNode.drpRoute = drpRoute
-	newNode.NodeID = fmt.Sprintf("%s-%d", nodeHostname, nodePID)
-	newNode.Debug = debug
+	newNode.RelayURL = optionalString(nodeOptions.RelayURL)
+	newNode.listeningName = optionalString(nodeOptions.ListeningName)
+	newNode.webServerConfig = nodeOptions.WebServerConfig
+	newNode.drpRoute = optionalString(nodeOptions.DRPRoute)
+	newNode.topologyStateDir = optionalString(nodeOptions.TopologyStateDir)
+	newNode.NodeID = resolvedNodeID
+	newNode.Labels = cloneLabels(nodeOptions.Labels)
+	newNode.LegacyMeshKeyAuth = nodeOptions.LegacyMeshKeyAuth
+	newNode.Debug = nodeOptions.Debug
 	newNode.ConnectedToControlPlane = false
 	newNode.HasConnectedToMesh = false
 	newNode.PacketRelayCount = 0
+	newNode.WatchDogInterval = DefaultWatchDogInterval
+	newNode.TopologyEntryTTL = 0
+	newNode.StickyTTL = DefaultStickyTTL
+	newNode.AntiEntropyInterval = DefaultAntiEntropyInterval
+	newNode.HealthCheckInterval = DefaultHealthCheckInterval
 
-	newNode.NodeDeclaration = &NodeDeclaration{newNode.NodeID, newNode.NodeRoles, newNode.HostID, newNode.listeningName, newNode.DomainName, newNode.meshKey, newNode.Zone, newNode.Scope}
+	newNode.NodeDeclaration = &NodeDeclaration{newNode.NodeID, newNode.NodeRoles, newNode.HostID, newNode.listeningName, newNode.DomainName, newNode.Zone, newNode.Scope, newNode.Labels}
 
 	newNode.NodeEndpoints = make(map[string]EndpointInterface)
 	newNode.ConsumerEndpoints = make(map[string]EndpointInterface)
-	newNode.Services = make(map[string]Service)
+	newNode.Services = make(map[string]*Service)
+	newNode.SubscriptionManager = &SubscriptionManager{}
+	newNode.desiredServiceStatus = make(map[string]int)
 	newNode.TopologyTracker = &TopologyTracker{}
-	newNode.TopologyTracker.Initialize(newNode)
+	if err := newNode.TopologyTracker.Initialize(newNode); err != nil {
+		return nil, err
+	}
+	newNode.watchDependencies()
+	newNode.watchServicePeers()
 
 	var localDRPEndpoint = &Endpoint{}
 	localDRPEndpoint.Init()
 	newNode.ApplyNodeEndpointMethods(localDRPEndpoint)
-	var DRPService = Service{"DRP", newNode, "DRP", "", false, 10, 10, newNode.Zone, "local", []string{}, []string{}, 1, localDRPEndpoint.EndpointCmds, nil}
+	var DRPService = &Service{ServiceName: "DRP", DRPNode: newNode, Type: "DRP", Priority: 10, Weight: 10, Zone: newNode.Zone, Scope: "local", Dependencies: []string{}, Streams: []string{}, Status: ServiceStatusReady, ClientCmds: localDRPEndpoint.EndpointCmds}
 	newNode.AddService(DRPService)
 
-	return newNode
+	return newNode, nil
 }
 
-// NodeDeclaration objects are traded between Node Endpoints, currently used for mesh auth
+// NodeDeclaration objects are traded between Node Endpoints; the mesh key is never included, see NodeHello
 type NodeDeclaration struct {
 	NodeID     string
 	NodeRoles  []string
 	HostID     string
 	NodeURL    *string
 	DomainName string
-	MeshKey    string
 	Zone       string
 	Scope      *string
+	Labels     map[string]string
 }
 
 // Node is the base object for DRP operations; service and endpoints are bound to this
@@ -68,21 +115,35 @@ type Node struct {
 	Zone                    string
 	Scope                   *string
 	RegistryURL             *string
+	RelayURL                *string
 	webServerConfig         interface{}
 	listeningName           *string
 	drpRoute                *string
+	topologyStateDir        *string
 	NodeRoles               []string
+	Labels                  map[string]string
 	NodeDeclaration         *NodeDeclaration
-	Services                map[string]Service
+	Services                map[string]*Service
 	TopicManager            interface{}
+	SubscriptionManager     *SubscriptionManager
 	TopologyTracker         *TopologyTracker
 	NodeEndpoints           map[string]EndpointInterface
+	endpointLock            sync.RWMutex
 	ConsumerEndpoints       map[string]EndpointInterface
 	Debug                   bool
+	LegacyMeshKeyAuth       bool
 	ConnectedToControlPlane bool
 	HasConnectedToMesh      bool
 	PacketRelayCount        uint
+	WatchDogInterval        time.Duration
+	TopologyEntryTTL        time.Duration
+	StickyTTL               time.Duration
+	AntiEntropyInterval     time.Duration
+	HealthCheckInterval     time.Duration
 	onControlPlaneConnect   *func()
+	servicesLock            sync.RWMutex
+	desiredServiceStatus    map[string]int
+	dependencyLock          sync.Mutex
 }
 
 // Log data to console using standard format
@@ -125,18 +186,75 @@ type ServiceCmd_ExecParams struct {
 	useControlPlane         bool
 	sendOnly                bool
 	callingEndpoint         EndpointInterface
+	balancer                Balancer
+	affinityKey             string
+	labelSelector           LabelSelector
+	excludedInstances       map[string]bool
+}
+
+// SetBalancer overrides the Balancer used to choose a service instance for this call
+func (ep *ServiceCmd_ExecParams) SetBalancer(balancer Balancer) {
+	ep.balancer = balancer
+}
+
+// SetAffinityKey pins calls with the same key to the same instance of a Sticky service
+func (ep *ServiceCmd_ExecParams) SetAffinityKey(affinityKey string) {
+	ep.affinityKey = affinityKey
+}
+
+// SetLabelSelector limits the service instances considered for this call to those matching the selector
+func (ep *ServiceCmd_ExecParams) SetLabelSelector(labelSelector LabelSelector) {
+	ep.labelSelector = labelSelector
 }
 
-// ServiceCmd is used to execute a command against a local or remote Service
+// ServiceCmd is used to execute a command against a local or remote Service.  When ServiceCmd chooses the
+// instance, failed attempts are retried on other instances as allowed by the service's RetryPolicy.
 func (dn *Node) ServiceCmd(serviceName string, method string, params interface{}, execParams ServiceCmd_ExecParams) interface{} {
 	thisNode := dn
-	baseErrMsg := "ERROR - "
 
 	// If if no service or command is provided, return null
 	if serviceName == "" || method == "" {
 		return "ServiceCmd: must provide serviceName and method"
 	}
 
+	retryPolicy := thisNode.TopologyTracker.GetRetryPolicy(serviceName)
+
+	// Callers which target a specific Node or instance get a single attempt
+	if execParams.targetNodeID != nil || execParams.targetServiceInstanceID != nil || execParams.sendOnly {
+		cmdResult, _ := thisNode.serviceCmdAttempt(serviceName, method, params, &execParams, retryPolicy.AttemptTimeout)
+		return cmdResult
+	}
+
+	execParams.excludedInstances = make(map[string]bool)
+	retryBackoff := retryPolicy.InitialBackoff
+	var lastResult interface{} = nil
+	for attemptNumber := 1; ; attemptNumber++ {
+		attemptParams := execParams
+		cmdResult, errorCode := thisNode.serviceCmdAttempt(serviceName, method, params, &attemptParams, retryPolicy.AttemptTimeout)
+		if errorCode == CallErrorNoInstance && attemptNumber > 1 {
+			// Every usable instance has been tried
+			return lastResult
+		}
+		lastResult = cmdResult
+		if errorCode == "" || attemptNumber >= retryPolicy.MaxAttempts || !retryPolicy.ShouldRetry(method, errorCode) {
+			return cmdResult
+		}
+
+		thisNode.Log(fmt.Sprintf("Attempt %d of %s/%s on instance [%s] failed (%s), retrying in %s", attemptNumber, serviceName, method, derefString(attemptParams.targetServiceInstanceID), errorCode, retryBackoff), true)
+		if attemptParams.targetServiceInstanceID != nil {
+			execParams.excludedInstances[*attemptParams.targetServiceInstanceID] = true
+		}
+		time.Sleep(retryBackoff)
+		retryBackoff = retryPolicy.nextBackoff(retryBackoff)
+	}
+}
+
+// serviceCmdAttempt makes a single attempt to execute a command, choosing an instance if none is targeted, and
+// returns the result along with a CallError code if the attempt failed
+func (dn *Node) serviceCmdAttempt(serviceName string, method string, params interface{}, execParams *ServiceCmd_ExecParams, attemptTimeout time.Duration) (interface{}, string) {
+	thisNode := dn
+	baseErrMsg := "ERROR - "
+
 	// If no targetNodeID was provided, we need to find a record in the ServiceTable
 	if execParams.targetNodeID == nil {
 
@@ -146,11 +264,11 @@ func (dn *Node) ServiceCmd(serviceName string, method string, params interface{}
 
 		if execParams.targetServiceInstanceID == nil {
 			// Update to use the DRP_TopologyTracker object
-			targetServiceRecord = thisNode.TopologyTracker.FindInstanceOfService(&serviceName, nil, nil, nil)
+			targetServiceRecord = thisNode.TopologyTracker.FindStickyInstanceOfService(serviceName, execParams.getAffinityKey(), thisNode.StickyTTL, execParams.labelSelector, execParams.balancer, execParams.excludedInstances)
 
 			// If no match is found then return null
 			if targetServiceRecord == nil {
-				return nil
+				return nil, CallErrorNoInstance
 			}
 
 			// Assign target Node & Instance IDs
@@ -159,11 +277,11 @@ func (dn *Node) ServiceCmd(serviceName string, method string, params interface{}
 
 			thisNode.Log(fmt.Sprintf("Best instance of service [%s] is [%s] on node [%s]", serviceName, *targetServiceRecord.InstanceID, *targetServiceRecord.NodeID), true)
 		} else {
-			targetServiceRecord = thisNode.TopologyTracker.ServiceTable.GetEntry(*execParams.targetServiceInstanceID).(*ServiceTableEntry)
+			targetServiceRecord = thisNode.TopologyTracker.GetServiceEntry(*execParams.targetServiceInstanceID)
 
 			// If no match is found then return null
 			if targetServiceRecord == nil {
-				return nil
+				return nil, CallErrorNoInstance
 			}
 
 			// Assign target Node
@@ -171,55 +289,83 @@ func (dn *Node) ServiceCmd(serviceName string, method string, params interface{}
 		}
 	}
 
+	// A label selector on a Node target picks the matching instance there, so it applies on remote Nodes too
+	if execParams.targetNodeID != nil && execParams.targetServiceInstanceID == nil && len(execParams.labelSelector) > 0 {
+		targetServiceRecord := thisNode.TopologyTracker.findNodeInstance(serviceName, *execParams.targetNodeID, execParams.labelSelector, execParams.balancer)
+		if targetServiceRecord == nil {
+			return nil, CallErrorNoInstance
+		}
+		execParams.targetServiceInstanceID = targetServiceRecord.InstanceID
+	}
+
 	// We don't have a target NodeID
-	if execParams.targetNodeID == nil || !thisNode.TopologyTracker.NodeTable.HasEntry(*execParams.targetNodeID) {
-		return nil
+	if execParams.targetNodeID == nil || !thisNode.TopologyTracker.ValidateNodeID(*execParams.targetNodeID) {
+		return nil, CallErrorUnreachable
 	}
 
 	// Where is the service?
 	if *execParams.targetNodeID == thisNode.NodeID {
 		// Execute locally
-		var localServiceProvider map[string]EndpointMethod = nil
+		var localMethod EndpointMethod = nil
+		methodFound := false
 		if serviceName == "DRP" && execParams.callingEndpoint != nil {
 			// If the service is DRP and the caller is a remote endpoint, execute from that caller's EndpointCmds
-			localServiceProvider = execParams.callingEndpoint.GetEndpointCmds()
+			localMethod, methodFound = execParams.callingEndpoint.GetEndpointCmds()[method]
 		} else {
-			if _, ok := thisNode.Services[serviceName]; ok {
-				localServiceProvider = thisNode.Services[serviceName].ClientCmds
+			// Dispatch to the requested instance, or the best local instance if none was named
+			var serviceObj *Service = nil
+			if execParams.targetServiceInstanceID != nil {
+				serviceObj = thisNode.GetLocalService(*execParams.targetServiceInstanceID)
+				if serviceObj != nil && serviceObj.ServiceName != serviceName {
+					serviceObj = nil
+				}
+			} else {
+				serviceObj = thisNode.findLocalService(serviceName)
 			}
+			if serviceObj == nil {
+				thisNode.Log(fmt.Sprintf("%s service %s does not exist", baseErrMsg, serviceName), true)
+				return nil, ""
+			}
+			localMethod, methodFound = serviceObj.GetClientCmd(method)
 		}
 
-		if localServiceProvider == nil {
-			thisNode.Log(fmt.Sprintf("%s service %s does not exist", baseErrMsg, serviceName), true)
-			return nil
-		}
-
-		if _, ok := localServiceProvider[method]; !ok {
+		if !methodFound {
 			thisNode.Log(fmt.Sprintf("%s service %s does not have method %s", baseErrMsg, serviceName, method), true)
-			return nil
+			return nil, ""
 		}
 
 		if execParams.sendOnly {
-			localServiceProvider[method](params.(*CmdParams), execParams.callingEndpoint, nil)
-			return nil
+			localMethod(params.(*CmdParams), execParams.callingEndpoint, nil)
+			return nil, ""
 		}
 
-		results := localServiceProvider[method](params.(*CmdParams), execParams.callingEndpoint, nil)
-		return results
+		results := localMethod(params.(*CmdParams), execParams.callingEndpoint, nil)
+		return results, ""
 	}
 
-	// Execute on another Node
+	// Execute on another Node, unless the circuit to the instance is open
+	useCircuitBreaker := execParams.targetServiceInstanceID != nil && !execParams.sendOnly
+	if useCircuitBreaker && !thisNode.TopologyTracker.CircuitBreakers.Acquire(serviceName, *execParams.targetServiceInstanceID) {
+		return fmt.Sprintf("Circuit to service [%s] instance [%s] is open", serviceName, *execParams.targetServiceInstanceID), CallErrorCircuitOpen
+	}
 	routeNodeID := execParams.targetNodeID
 	routeOptions := RouteOptions{}
 
-	if !execParams.useControlPlane {
-		// Make sure either the local Node or remote Node are listening; if not, route via control plane
-		localNodeEntry := thisNode.TopologyTracker.NodeTable.GetEntry(thisNode.NodeID).(*NodeTableEntry)
-		remoteNodeEntry := thisNode.TopologyTracker.NodeTable.GetEntry(*execParams.targetNodeID).(*NodeTableEntry)
-
-		if remoteNodeEntry == nil {
-			return fmt.Sprintf("Tried to contact Node[%s], not in NodeTable", *execParams.targetNodeID)
+	remoteNodeEntry := thisNode.TopologyTracker.GetNodeEntry(*execParams.targetNodeID)
+	if remoteNodeEntry == nil {
+		if useCircuitBreaker {
+			thisNode.TopologyTracker.CircuitBreakers.Record(serviceName, *execParams.targetServiceInstanceID, false)
 		}
+		return fmt.Sprintf("Tried to contact Node[%s], not in NodeTable", *execParams.targetNodeID), CallErrorUnreachable
+	}
+
+	if remoteNodeEntry.UsesProxy() && !thisNode.IsProxyFor(*execParams.targetNodeID) {
+		// The remote Node does not accept connections; send through its Relay
+		routeNodeID = remoteNodeEntry.ProxyNodeID
+		routeOptions = RouteOptions{&thisNode.NodeID, execParams.targetNodeID, []string{}}
+	} else if !execParams.useControlPlane {
+		// Make sure either the local Node or remote Node are listening; if not, route via control plane
+		localNodeEntry := thisNode.TopologyTracker.GetNodeEntry(thisNode.NodeID)
 
 		if localNodeEntry.NodeURL == nil && remoteNodeEntry.NodeURL == nil {
 			// Neither the local node nor the remote node are listening, use control plane
@@ -227,7 +373,7 @@ func (dn *Node) ServiceCmd(serviceName string, method string, params interface{}
 		}
 	}
 
-	if execParams.useControlPlane {
+	if execParams.useControlPlane && !remoteNodeEntry.UsesProxy() {
 		// We want to use to use the control plane instead of connecting directly to the target
 		if thisNode.ConnectedToControlPlane {
 			routeNodeID = thisNode.TopologyTracker.GetNextHop(*execParams.targetNodeID)
@@ -243,16 +389,48 @@ func (dn *Node) ServiceCmd(serviceName string, method string, params interface{}
 	if routeNodeConnection == nil {
 		errMsg := fmt.Sprintf("Could not establish connection from Node[%s] to Node[%s]", thisNode.NodeID, *routeNodeID)
 		thisNode.Log(fmt.Sprintf("ERROR - %s", errMsg), false)
-		return errMsg
+		if execParams.targetServiceInstanceID != nil {
+			thisNode.TopologyTracker.ServiceStats.RecordFailure(*execParams.targetServiceInstanceID)
+			thisNode.TopologyTracker.recordCallOutcome(serviceName, *execParams.targetServiceInstanceID)
+			if useCircuitBreaker {
+				thisNode.TopologyTracker.CircuitBreakers.Record(serviceName, *execParams.targetServiceInstanceID, false)
+			}
+		}
+		return errMsg, CallErrorUnreachable
 	}
 
 	if execParams.sendOnly {
 		routeNodeConnection.SendCmd(serviceName, method, params, nil, &routeOptions, execParams.targetServiceInstanceID)
-		return nil
+		return nil, ""
 	}
 
-	cmdResponse := routeNodeConnection.SendCmdAwait(serviceName, method, params, &routeOptions, execParams.targetServiceInstanceID)
-	return cmdResponse.Payload
+	// Calls have a deadline so a wedged instance is recorded as failing.  DRP control calls may return whole tables
+	// from a busy Registry; they only time out if the DRP service has a RetryPolicy with an AttemptTimeout.
+	if attemptTimeout <= 0 && serviceName != "DRP" {
+		attemptTimeout = thisNode.TopologyTracker.CallTimeout
+	}
+
+	// Collect per-instance statistics for the Balancers
+	if execParams.targetServiceInstanceID == nil {
+		cmdResponse, errorCode := awaitCmdResponse(routeNodeConnection, serviceName, method, params, &routeOptions, nil, attemptTimeout)
+		if cmdResponse == nil {
+			return nil, errorCode
+		}
+		return cmdResponse.Payload, errorCode
+	}
+
+	serviceStats := thisNode.TopologyTracker.ServiceStats
+	requestStart := serviceStats.Begin(*execParams.targetServiceInstanceID)
+	cmdResponse, errorCode := awaitCmdResponse(routeNodeConnection, serviceName, method, params, &routeOptions, execParams.targetServiceInstanceID, attemptTimeout)
+	serviceStats.End(*execParams.targetServiceInstanceID, requestStart, errorCode != "")
+	thisNode.TopologyTracker.recordCallOutcome(serviceName, *execParams.targetServiceInstanceID)
+	if useCircuitBreaker {
+		thisNode.TopologyTracker.CircuitBreakers.Record(serviceName, *execParams.targetServiceInstanceID, errorCode == "")
+	}
+	if cmdResponse == nil {
+		return nil, errorCode
+	}
+	return cmdResponse.Payload, errorCode
 }
 
 // TCPPingResults contains the TCP ping results to a given host and port
@@ -293,7 +471,11 @@ func (dn *Node) RegistryClientHandler(nodeClient *Client) {
 		}
 		registryNodeID := remoteNodeDeclaration.NodeID
 		nodeClient.EndpointID = &registryNodeID
-		thisNode.NodeEndpoints[registryNodeID] = nodeClient
+		if !thisNode.keepNodeEndpoint(registryNodeID, nodeClient) {
+			thisNode.Log(fmt.Sprintf("Closing connection to Registry [%s], it connected to us first", registryNodeID), false)
+			nodeClient.Close(CloseCodeRedundantConnection, "already connected")
+			return
+		}
 	} else {
 		return
 	}
@@ -318,6 +500,12 @@ func (dn *Node) ConnectToRegistry(registryURL string, openCallback *func(), clos
 	newRegistryClient.Connect(registryURL, nil, dn, nil, retryOnClose, &regClientOpenCallback, closeCallback)
 }
 
+// SetRelayURL sets the Relay a Node which does not accept connections registers through; pass an empty string to
+// clear it.  It takes effect the next time the Node connects to the mesh.
+func (dn *Node) SetRelayURL(relayURL string) {
+	dn.RelayURL = optionalString(relayURL)
+}
+
 // ConnectToRegistryByDomain locates a Registry for a given domain
 func (dn *Node) ConnectToRegistryByDomain() {
 	// TO DO - IMPLEMENT
@@ -332,10 +520,26 @@ func (dn *Node) ConnectToOtherRegistries() {
 func (dn *Node) ConnectToMesh(onControlPlaneConnect func()) {
 	thisNode := dn
 	if onControlPlaneConnect != nil {
-		*thisNode.onControlPlaneConnect = onControlPlaneConnect
+		thisNode.onControlPlaneConnect = &onControlPlaneConnect
 	}
+
+	// Start WatchDog on the topology tables
+	if thisNode.WatchDogInterval > 0 {
+		thisNode.TopologyTracker.StartWatchDog(thisNode.WatchDogInterval, thisNode.TopologyEntryTTL)
+	}
+
 	// If this is a Registry, seed the Registry with it's own declaration
 	if thisNode.IsRegistry() {
+		// Periodically repair divergence from other Registries
+		if thisNode.AntiEntropyInterval > 0 {
+			thisNode.TopologyTracker.StartAntiEntropy(thisNode.AntiEntropyInterval)
+		}
+
+		// Probe the services of directly connected Nodes
+		if thisNode.HealthCheckInterval > 0 {
+			thisNode.TopologyTracker.StartHealthChecks(thisNode.HealthCheckInterval)
+		}
+
 		if thisNode.DomainName != "" {
 			// A domain name was provided; attempt to cluster with other registry hosts
 			thisNode.Log(fmt.Sprintf("This node is a Registry for %s, attempting to contact other Registry nodes", thisNode.DomainName), false)
@@ -345,7 +549,10 @@ func (dn *Node) ConnectToMesh(onControlPlaneConnect func()) {
 			(*thisNode.onControlPlaneConnect)()
 		}
 	} else {
-		if thisNode.RegistryURL != nil {
+		if thisNode.listeningName == nil && thisNode.RelayURL != nil {
+			// This Node does not accept connections; register with the mesh through a Relay
+			thisNode.ConnectToRegistry(*thisNode.RelayURL, nil, nil)
+		} else if thisNode.RegistryURL != nil {
 			// A specific Registry URL was provided
 			thisNode.ConnectToRegistry(*thisNode.RegistryURL, nil, nil)
 		} else if thisNode.DomainName != "" {
@@ -362,15 +569,18 @@ func (dn *Node) ConnectToMesh(onControlPlaneConnect func()) {
 func (dn *Node) ConnectToNode(targetNodeID string, targetURL string) {
 	thisNode := dn
 	// Initiate Node Connection
-	targetEndpoint := thisNode.NodeEndpoints[targetNodeID]
+	targetEndpoint := thisNode.GetNodeEndpoint(targetNodeID)
 	if targetEndpoint != nil && targetEndpoint.IsConnecting() {
 		// We already have this NodeEndpoint registered and the wsConn is opening or open
 		thisNode.Log(fmt.Sprintf("Received back request, already have NodeEndpoints[%s]", targetNodeID), true)
 	} else {
 		thisNode.Log(fmt.Sprintf("Received back request, connecting to [%s] @ %s", targetNodeID, targetURL), true)
 		thisNodeEndpoint := &Client{}
-		thisNode.NodeEndpoints[targetNodeID] = thisNodeEndpoint
-		thisNodeEndpoint.Connect(targetURL, nil, dn, &targetNodeID, false, nil, nil)
+		thisNode.setNodeEndpoint(targetNodeID, thisNodeEndpoint)
+		connectErr := thisNodeEndpoint.Connect(targetURL, nil, dn, &targetNodeID, false, nil, nil)
+		if connectErr != nil {
+			thisNode.removeNodeEndpoint(targetNodeID, thisNodeEndpoint)
+		}
 	}
 }
 
@@ -383,38 +593,404 @@ func (dn *Node) ConnectToBroker(wsTarget string, proxy *string) *Client {
 }
 */
 
-// AddService registers a new Service object to the local Node
-func (dn *Node) AddService(serviceObj Service) {
+// AddService registers a Service with the local Node and returns its instance ID, or an empty string if its OnStart
+// hook refused to start it.  The Service stays live; later changes should go through Node and Service methods.  A
+// Node may host several instances of the same service, each with its own priority and weight.
+func (dn *Node) AddService(serviceObj *Service) string {
 	thisNode := dn
 
-	newInstanceID := fmt.Sprintf("%s-%s-%d", dn.NodeID, serviceObj.ServiceName, rand.Intn(9999))
+	if serviceObj.InstanceID != "" && thisNode.GetLocalService(serviceObj.InstanceID) == serviceObj {
+		thisNode.Log(fmt.Sprintf("Service [%s] instance [%s] is already registered", serviceObj.ServiceName, serviceObj.InstanceID), true)
+		return serviceObj.InstanceID
+	}
+
+	newInstanceID := fmt.Sprintf("%s-%s-%s", dn.NodeID, serviceObj.ServiceName, RandomHex(4))
+
+	serviceObj.serviceLock.Lock()
 	serviceObj.InstanceID = newInstanceID
+	serviceObj.DRPNode = thisNode
+	serviceObj.serviceLock.Unlock()
+
+	if serviceObj.OnStart != nil {
+		if err := serviceObj.OnStart(serviceObj); err != nil {
+			thisNode.Log(fmt.Sprintf("Could not start service [%s]: %s", serviceObj.ServiceName, err), false)
+			return ""
+		}
+	}
+
+	desiredStatus := serviceObj.GetStatus()
+	effectiveStatus := thisNode.setDesiredStatus(serviceObj, desiredStatus)
+
+	serviceObj.serviceLock.Lock()
+	serviceObj.Status = effectiveStatus
+	newServiceEntry := serviceObj.getTableEntry()
+	newServiceEntry.Sequence = thisNode.TopologyTracker.NextSequence()
+	serviceObj.serviceLock.Unlock()
+
+	thisNode.servicesLock.Lock()
+	thisNode.Services[newInstanceID] = serviceObj
+	thisNode.servicesLock.Unlock()
 
-	thisNode.Services[serviceObj.ServiceName] = serviceObj
-
-	newServiceEntry := ServiceTableEntry{}
-	newServiceEntry.NodeID = &thisNode.NodeID
-	newServiceEntry.ProxyNodeID = nil
-	newServiceEntry.Scope = &serviceObj.Scope
-	newServiceEntry.Zone = &serviceObj.Zone
-	newServiceEntry.LearnedFrom = nil
-	newServiceEntry.LastModified = nil
-	newServiceEntry.Name = &serviceObj.ServiceName
-	newServiceEntry.Type = &serviceObj.Type
-	newServiceEntry.InstanceID = &serviceObj.InstanceID
-	newServiceEntry.Sticky = serviceObj.Sticky
-	newServiceEntry.Priority = serviceObj.Priority
-	newServiceEntry.Weight = serviceObj.Weight
-	newServiceEntry.Dependencies = serviceObj.Dependencies
-	newServiceEntry.Streams = serviceObj.Streams
-	newServiceEntry.Status = serviceObj.Status
-
-	addServicePacket := TopologyPacket{thisNode.NodeID, "add", "service", *newServiceEntry.InstanceID, *newServiceEntry.Scope, *newServiceEntry.Zone, newServiceEntry.ToJSON()}
+	addServicePacket := TopologyPacket{thisNode.NodeID, "add", "service", *newServiceEntry.InstanceID, *newServiceEntry.Scope, *newServiceEntry.Zone, newServiceEntry.ToJSON(), newServiceEntry.Sequence}
 	thisNode.TopologyTracker.ProcessPacket(addServicePacket, thisNode.NodeID, false)
+
+	return newInstanceID
+}
+
+// GetLocalService returns a Service instance hosted by the local Node, or nil if it is not found
+func (dn *Node) GetLocalService(serviceInstanceID string) *Service {
+	dn.servicesLock.RLock()
+	defer dn.servicesLock.RUnlock()
+	return dn.Services[serviceInstanceID]
+}
+
+// GetLocalInstanceIDs returns the instance IDs of a service hosted by the local Node, in sorted order
+func (dn *Node) GetLocalInstanceIDs(serviceName string) []string {
+	dn.servicesLock.RLock()
+	defer dn.servicesLock.RUnlock()
+	instanceIDList := []string{}
+	for serviceInstanceID, serviceObj := range dn.Services {
+		if serviceObj.ServiceName == serviceName {
+			instanceIDList = append(instanceIDList, serviceInstanceID)
+		}
+	}
+	sort.Strings(instanceIDList)
+	return instanceIDList
+}
+
+// listLocalServices returns the Service instances hosted by the local Node
+func (dn *Node) listLocalServices() []*Service {
+	dn.servicesLock.RLock()
+	defer dn.servicesLock.RUnlock()
+	serviceList := []*Service{}
+	for _, serviceObj := range dn.Services {
+		serviceList = append(serviceList, serviceObj)
+	}
+	return serviceList
+}
+
+// findLocalService returns the local instance of a service which should handle a command that did not name an
+// instance: the Ready instance with the lowest priority, or any instance if none are Ready
+func (dn *Node) findLocalService(serviceName string) *Service {
+	var bestServiceObj *Service = nil
+	var bestServiceEntry ServiceTableEntry
+	for _, serviceInstanceID := range dn.GetLocalInstanceIDs(serviceName) {
+		serviceObj := dn.GetLocalService(serviceInstanceID)
+		if serviceObj == nil {
+			continue
+		}
+		serviceEntry := serviceObj.GetTableEntry()
+		if bestServiceObj == nil {
+			bestServiceObj, bestServiceEntry = serviceObj, serviceEntry
+			continue
+		}
+		if bestServiceEntry.Status != ServiceStatusReady && serviceEntry.Status == ServiceStatusReady {
+			bestServiceObj, bestServiceEntry = serviceObj, serviceEntry
+			continue
+		}
+		if bestServiceEntry.Status == serviceEntry.Status && serviceEntry.Priority < bestServiceEntry.Priority {
+			bestServiceObj, bestServiceEntry = serviceObj, serviceEntry
+		}
+	}
+	return bestServiceObj
+}
+
+// Subscribe attaches a Subscriber to a stream offered by a local Service and registers it with the
+// SubscriptionManager so it is torn down when the Service is removed
+func (dn *Node) Subscribe(subscription *Subscriber) bool {
+	thisNode := dn
+	serviceObj := thisNode.findLocalService(subscription.ServiceName)
+	if serviceObj == nil {
+		thisNode.Log(fmt.Sprintf("Could not subscribe to [%s/%s], service not found on local Node", subscription.ServiceName, subscription.TopicName), true)
+		return false
+	}
+	topicSource := serviceObj.GetTopic(subscription.TopicName)
+	if topicSource == nil {
+		thisNode.Log(fmt.Sprintf("Could not subscribe to [%s/%s], service does not offer stream", subscription.ServiceName, subscription.TopicName), true)
+		return false
+	}
+	thisNode.SubscriptionManager.RegisterSubscription(subscription)
+	topicSource.AddSubscription(subscription)
+	return true
+}
+
+// subscribeEndpoint subscribes a remote Endpoint to a local stream; messages are sent as replies to the Endpoint's
+// stream token and the stream is closed with a final reply when the subscription is terminated
+func (dn *Node) subscribeEndpoint(params *CmdParams, callingEndpoint EndpointInterface) bool {
+	thisNode := dn
+	serviceName := params.GetString("serviceName")
+	topicName := params.GetString("topicName")
+	streamToken := params.GetInt("streamToken")
+	if serviceName == nil || topicName == nil || streamToken == nil {
+		return false
+	}
+	scope := "local"
+	if scopeParam := params.GetString("scope"); scopeParam != nil {
+		scope = *scopeParam
+	}
+
+	// Only allow if the scope is local or this Node is a Broker
+	if scope != "local" && !thisNode.IsBroker() {
+		return false
+	}
+
+	subscriberEndpoint := callingEndpoint.baseEndpoint()
+	replyToken := *streamToken
+	sendFunction := func(message interface{}) error {
+		return subscriberEndpoint.sendStreamReply(replyToken, 2, message)
+	}
+	closeFunction := func() {
+		subscriberEndpoint.removeStreamSubscription(replyToken)
+		subscriberEndpoint.sendStreamReply(replyToken, 0, "subscription terminated")
+	}
+	thisSubscription := NewSubscriber(*serviceName, *topicName, scope, sendFunction, closeFunction)
+	if !thisNode.Subscribe(thisSubscription) {
+		return false
+	}
+	subscriberEndpoint.addStreamSubscription(replyToken, thisSubscription)
+	return true
+}
+
+// RemoveService unregisters every instance of a Service from the local Node and withdraws them from the mesh
+func (dn *Node) RemoveService(serviceName string) bool {
+	thisNode := dn
+
+	// The DRP service carries the Node's own control plane methods
+	if serviceName == "DRP" {
+		thisNode.Log("Could not remove service [DRP], it is required by the local Node", true)
+		return false
+	}
+
+	instanceIDList := thisNode.GetLocalInstanceIDs(serviceName)
+	if len(instanceIDList) == 0 {
+		thisNode.Log(fmt.Sprintf("Could not remove service [%s], not found on local Node", serviceName), true)
+		return false
+	}
+	for _, serviceInstanceID := range instanceIDList {
+		thisNode.RemoveServiceInstance(serviceInstanceID)
+	}
+	return true
+}
+
+// RemoveServiceInstance unregisters a Service instance from the local Node, withdraws it from the mesh and runs its
+// OnStop hook
+func (dn *Node) RemoveServiceInstance(serviceInstanceID string) bool {
+	thisNode := dn
+
+	// Remove from local service list
+	thisNode.servicesLock.Lock()
+	serviceObj, ok := thisNode.Services[serviceInstanceID]
+	if !ok {
+		thisNode.servicesLock.Unlock()
+		thisNode.Log(fmt.Sprintf("Could not remove service instance [%s], not found on local Node", serviceInstanceID), true)
+		return false
+	}
+	if serviceObj.ServiceName == "DRP" {
+		thisNode.servicesLock.Unlock()
+		thisNode.Log(fmt.Sprintf("Could not remove service instance [%s], the DRP service is required by the local Node", serviceInstanceID), true)
+		return false
+	}
+	delete(thisNode.Services, serviceInstanceID)
+	thisNode.servicesLock.Unlock()
+
+	serviceName := serviceObj.ServiceName
+	thisNode.dependencyLock.Lock()
+	delete(thisNode.desiredServiceStatus, serviceInstanceID)
+	thisNode.dependencyLock.Unlock()
+
+	// Terminate subscriptions to streams offered by this instance, then any left for the service once no instances
+	// are left
+	terminatedCount := serviceObj.terminateTopics(thisNode.SubscriptionManager)
+	if len(thisNode.GetLocalInstanceIDs(serviceName)) == 0 {
+		terminatedCount += thisNode.SubscriptionManager.TerminateServiceSubscriptions(serviceName)
+	}
+	if terminatedCount > 0 {
+		thisNode.Log(fmt.Sprintf("Terminated %d subscriptions to service [%s]", terminatedCount, serviceName), true)
+	}
+
+	// Issue a delete topology packet; ProcessPacket will relay it to connected Nodes
+	deleteServiceEntry := serviceObj.GetTableEntry()
+	deleteServiceEntry.Sequence = thisNode.TopologyTracker.NextSequence()
+
+	deleteServicePacket := TopologyPacket{thisNode.NodeID, "delete", "service", *deleteServiceEntry.InstanceID, *deleteServiceEntry.Scope, *deleteServiceEntry.Zone, deleteServiceEntry.ToJSON(), deleteServiceEntry.Sequence}
+	thisNode.TopologyTracker.ProcessPacket(deleteServicePacket, thisNode.NodeID, false)
+
+	if serviceObj.OnStop != nil {
+		serviceObj.OnStop(serviceObj)
+	}
+
+	thisNode.Log(fmt.Sprintf("Removed service [%s] instance [%s]", serviceName, serviceInstanceID), true)
+	return true
 }
 
-// RemoveService TO DO - IMPLEMENT
-func (dn *Node) RemoveService() {}
+// SetServiceStatus changes the status of every local instance of a Service and advertises the change to the mesh
+func (dn *Node) SetServiceStatus(serviceName string, status int) bool {
+	return dn.updateEachInstance(serviceName, func(serviceInstanceID string) bool {
+		return dn.SetInstanceStatus(serviceInstanceID, status)
+	})
+}
+
+// SetInstanceStatus changes the status of a local Service instance and advertises the change to the mesh; a Ready
+// instance is held in Pending until its dependencies are met
+func (dn *Node) SetInstanceStatus(serviceInstanceID string, status int) bool {
+	serviceObj := dn.GetLocalService(serviceInstanceID)
+	if serviceObj == nil {
+		dn.Log(fmt.Sprintf("Could not update service instance [%s], not found on local Node", serviceInstanceID), true)
+		return false
+	}
+	effectiveStatus := dn.setDesiredStatus(serviceObj, status)
+	return dn.updateServiceInstance(serviceInstanceID, func(serviceObj *Service) {
+		serviceObj.Status = effectiveStatus
+	})
+}
+
+// SetServicePriority changes the priority of every local instance of a Service and advertises the change to the mesh
+func (dn *Node) SetServicePriority(serviceName string, priority uint) bool {
+	return dn.updateService(serviceName, func(serviceObj *Service) {
+		serviceObj.Priority = priority
+	})
+}
+
+// SetInstancePriority changes the priority of a local Service instance and advertises the change to the mesh
+func (dn *Node) SetInstancePriority(serviceInstanceID string, priority uint) bool {
+	return dn.updateServiceInstance(serviceInstanceID, func(serviceObj *Service) {
+		serviceObj.Priority = priority
+	})
+}
+
+// SetServiceWeight changes the weight of every local instance of a Service and advertises the change to the mesh
+func (dn *Node) SetServiceWeight(serviceName string, weight uint) bool {
+	return dn.updateService(serviceName, func(serviceObj *Service) {
+		serviceObj.Weight = weight
+	})
+}
+
+// SetInstanceWeight changes the weight of a local Service instance and advertises the change to the mesh
+func (dn *Node) SetInstanceWeight(serviceInstanceID string, weight uint) bool {
+	return dn.updateServiceInstance(serviceInstanceID, func(serviceObj *Service) {
+		serviceObj.Weight = weight
+	})
+}
+
+// updateService applies a change to every local instance of a Service and issues topology updates
+func (dn *Node) updateService(serviceName string, applyChange func(*Service)) bool {
+	return dn.updateEachInstance(serviceName, func(serviceInstanceID string) bool {
+		return dn.updateServiceInstance(serviceInstanceID, applyChange)
+	})
+}
+
+// updateEachInstance calls an update for every local instance of a Service and tells whether or not any were found
+func (dn *Node) updateEachInstance(serviceName string, updateInstance func(string) bool) bool {
+	instanceIDList := dn.GetLocalInstanceIDs(serviceName)
+	if len(instanceIDList) == 0 {
+		dn.Log(fmt.Sprintf("Could not update service [%s], not found on local Node", serviceName), true)
+		return false
+	}
+	for _, serviceInstanceID := range instanceIDList {
+		updateInstance(serviceInstanceID)
+	}
+	return true
+}
+
+// updateServiceInstance applies a change to a local Service instance and issues a topology update
+func (dn *Node) updateServiceInstance(serviceInstanceID string, applyChange func(*Service)) bool {
+	thisNode := dn
+
+	serviceObj := thisNode.GetLocalService(serviceInstanceID)
+	if serviceObj == nil {
+		thisNode.Log(fmt.Sprintf("Could not update service instance [%s], not found on local Node", serviceInstanceID), true)
+		return false
+	}
+
+	// Take the sequence while holding the lock so sequences follow the order of the changes.  The packets may be
+	// processed out of order, but the tracker and its peers drop an update older than the entry they hold, so the
+	// last change wins.
+	serviceObj.serviceLock.Lock()
+	applyChange(serviceObj)
+	updateServiceEntry := serviceObj.getTableEntry()
+	updateServiceEntry.Sequence = thisNode.TopologyTracker.NextSequence()
+	serviceObj.serviceLock.Unlock()
+
+	updateServicePacket := TopologyPacket{thisNode.NodeID, "update", "service", *updateServiceEntry.InstanceID, *updateServiceEntry.Scope, *updateServiceEntry.Zone, updateServiceEntry.ToJSON(), updateServiceEntry.Sequence}
+	thisNode.TopologyTracker.ProcessPacket(updateServicePacket, thisNode.NodeID, false)
+
+	thisNode.Log(fmt.Sprintf("Updated service [%s] instance [%s] status[%s] priority[%d] weight[%d]", serviceObj.ServiceName, serviceInstanceID, ServiceStatusName(updateServiceEntry.Status), updateServiceEntry.Priority, updateServiceEntry.Weight), true)
+	return true
+}
+
+// TopologyUpdate processes a topology packet relayed by a connected Node
+func (dn *Node) TopologyUpdate(params *CmdParams, srcEndpoint EndpointInterface) interface{} {
+	thisNode := dn
+
+	if params == nil || srcEndpoint.GetID() == nil {
+		return nil
+	}
+
+	topologyPacket := TopologyPacket{}
+	paramsJSON, _ := json.Marshal(params)
+	err := json.Unmarshal(paramsJSON, &topologyPacket)
+	if err != nil {
+		thisNode.Log(fmt.Sprintf("TopologyUpdate Payload unmarshal error: %s", err), false)
+		return nil
+	}
+
+	thisNode.TopologyTracker.ProcessPacket(topologyPacket, *srcEndpoint.GetID(), false)
+	return nil
+}
+
+// TopologyNode is a Node table entry along with the Node's client connections and services
+type TopologyNode struct {
+	NodeTableEntry
+	NodeClients     map[string]interface{}
+	ConsumerClients map[string]interface{}
+	Services        map[string]interface{}
+}
+
+// GetTopology queries every Node in the NodeTable for its client connections and services
+func (dn *Node) GetTopology(callingEndpoint EndpointInterface) map[string]*TopologyNode {
+	thisNode := dn
+	topologyObj := make(map[string]*TopologyNode)
+	topologyLock := sync.Mutex{}
+	waitGroup := sync.WaitGroup{}
+
+	// Get topology per node
+	getTopologyInfoFromNode := func(nodeTableEntry *NodeTableEntry) {
+		defer waitGroup.Done()
+
+		topologyNode := &TopologyNode{}
+		topologyNode.NodeTableEntry = *nodeTableEntry
+
+		execParams := ServiceCmd_ExecParams{}
+		execParams.targetNodeID = nodeTableEntry.NodeID
+		execParams.useControlPlane = true
+		execParams.callingEndpoint = callingEndpoint
+
+		nodeClientConnections := struct {
+			NodeClients     map[string]interface{} `json:"nodeClients"`
+			ConsumerClients map[string]interface{} `json:"consumerClients"`
+		}{}
+		clientConnectionsJSON, _ := json.Marshal(thisNode.ServiceCmd("DRP", "listClientConnections", &CmdParams{}, execParams))
+		json.Unmarshal(clientConnectionsJSON, &nodeClientConnections)
+		topologyNode.NodeClients = nodeClientConnections.NodeClients
+		topologyNode.ConsumerClients = nodeClientConnections.ConsumerClients
+
+		servicesJSON, _ := json.Marshal(thisNode.ServiceCmd("DRP", "getLocalServiceDefinitions", &CmdParams{}, execParams))
+		json.Unmarshal(servicesJSON, &topologyNode.Services)
+
+		topologyLock.Lock()
+		topologyObj[*nodeTableEntry.NodeID] = topologyNode
+		topologyLock.Unlock()
+	}
+
+	// Get topology from all nodes
+	for _, nodeTableEntry := range thisNode.TopologyTracker.Snapshot().NodeTable {
+		waitGroup.Add(1)
+		go getTopologyInfoFromNode(nodeTableEntry)
+	}
+	waitGroup.Wait()
+
+	return topologyObj
+}
 
 // ApplyGenericEndpointMethods applies a mandatory set of methods to an Endpoint
 // TO DO - REGISTER METHODS AS FUNCTIONS ARE PORTED
@@ -444,6 +1020,53 @@ func (dn *Node) ApplyGenericEndpointMethods(targetEndpoint EndpointInterface) {
 		return thisNode.TopologyTracker.GetRegistry(&reqNodeID)
 	})
 
+	targetEndpoint.RegisterMethod("getRegistryDelta", func(params *CmdParams, callingEndpoint EndpointInterface, token *int) interface{} {
+		var reqNodeID string = ""
+		var sinceEpoch string = ""
+		var sinceVersion uint64 = 0
+		if params != nil {
+			if valueJSON := (*params)["reqNodeID"]; valueJSON != nil {
+				json.Unmarshal(*valueJSON, &reqNodeID)
+			}
+			if valueJSON := (*params)["epoch"]; valueJSON != nil {
+				json.Unmarshal(*valueJSON, &sinceEpoch)
+			}
+			if valueJSON := (*params)["version"]; valueJSON != nil {
+				json.Unmarshal(*valueJSON, &sinceVersion)
+			}
+		}
+		return thisNode.TopologyTracker.GetRegistryDelta(&reqNodeID, sinceEpoch, sinceVersion)
+	})
+
+	targetEndpoint.RegisterMethod("getTopologyDigest", func(params *CmdParams, callingEndpoint EndpointInterface, token *int) interface{} {
+		remoteZone := params.GetString("zone")
+		if remoteZone == nil {
+			return nil
+		}
+		return thisNode.TopologyTracker.GetTopologyDigest(*remoteZone)
+	})
+
+	targetEndpoint.RegisterMethod("getTopologyDigestBucket", func(params *CmdParams, callingEndpoint EndpointInterface, token *int) interface{} {
+		remoteZone := params.GetString("zone")
+		bucketKey := params.GetString("bucket")
+		if remoteZone == nil || bucketKey == nil {
+			return nil
+		}
+		return thisNode.TopologyTracker.GetTopologyDigestBucket(*remoteZone, *bucketKey)
+	})
+
+	targetEndpoint.RegisterMethod("getOpenCircuits", func(params *CmdParams, callingEndpoint EndpointInterface, token *int) interface{} {
+		return thisNode.TopologyTracker.CircuitBreakers.ListOpen()
+	})
+
+	targetEndpoint.RegisterMethod("getEjectedInstances", func(params *CmdParams, callingEndpoint EndpointInterface, token *int) interface{} {
+		return thisNode.TopologyTracker.Outliers.ListEjected()
+	})
+
+	targetEndpoint.RegisterMethod("getDependencyGraph", func(params *CmdParams, callingEndpoint EndpointInterface, token *int) interface{} {
+		return thisNode.TopologyTracker.GetDependencyGraph()
+	})
+
 	targetEndpoint.RegisterMethod("getServiceDefinition", func(params *CmdParams, callingEndpoint EndpointInterface, token *int) interface{} {
 		var serviceName string = ""
 		if params != nil {
@@ -453,7 +1076,11 @@ func (dn *Node) ApplyGenericEndpointMethods(targetEndpoint EndpointInterface) {
 			}
 		}
 		//realServiceName := serviceName
-		return thisNode.Services[serviceName].GetDefinition()
+		serviceObj := thisNode.findLocalService(serviceName)
+		if serviceObj == nil {
+			return nil
+		}
+		return serviceObj.GetDefinition()
 	})
 	/*
 		targetEndpoint.RegisterMethod("getServiceDefinitions", async function (...args) {
@@ -461,14 +1088,7 @@ func (dn *Node) ApplyGenericEndpointMethods(targetEndpoint EndpointInterface) {
 		});
 	*/
 	targetEndpoint.RegisterMethod("getLocalServiceDefinitions", func(params *CmdParams, callingEndpoint EndpointInterface, token *int) interface{} {
-		var serviceName *string = nil
-		if params != nil {
-			valueJSON := (*params)["serviceName"]
-			if valueJSON != nil {
-				json.Unmarshal(*valueJSON, serviceName)
-			}
-		}
-		var clientConnectionData = thisNode.GetLocalServiceDefinitions(serviceName)
+		var clientConnectionData = thisNode.GetLocalServiceDefinitions(params.GetString("serviceName"))
 		return clientConnectionData
 	})
 
@@ -485,11 +1105,20 @@ func (dn *Node) ApplyGenericEndpointMethods(targetEndpoint EndpointInterface) {
 		targetEndpoint.RegisterMethod("sendToTopic", function (params, srcEndpoint, token) {
 			thisNode.TopicManager.SendToTopic(params.topicName, params.topicData);
 		});
-
-		targetEndpoint.RegisterMethod("getTopology", async function (...args) {
-			return await thisNode.GetTopology(...args);
-		});
 	*/
+	targetEndpoint.RegisterMethod("getTopology", func(params *CmdParams, callingEndpoint EndpointInterface, token *int) interface{} {
+		// Render the local topology tables as a graph if a format was requested
+		topologyFormat := params.GetString("format")
+		if topologyFormat == nil {
+			return thisNode.GetTopology(callingEndpoint)
+		}
+		topologyExport, err := thisNode.TopologyTracker.ExportTopology(*topologyFormat, params.GetString("zoneName"))
+		if err != nil {
+			return err
+		}
+		return topologyExport
+	})
+
 	targetEndpoint.RegisterMethod("listClientConnections", func(params *CmdParams, callingEndpoint EndpointInterface, token *int) interface{} {
 		var clientConnectionData = thisNode.ListClientConnections()
 		return clientConnectionData
@@ -498,41 +1127,81 @@ func (dn *Node) ApplyGenericEndpointMethods(targetEndpoint EndpointInterface) {
 		targetEndpoint.RegisterMethod("tcpPing", async (...args) => {
 			return thisNode.TCPPing(...args);
 		});
+	*/
+	targetEndpoint.RegisterMethod("findInstanceOfService", func(params *CmdParams, callingEndpoint EndpointInterface, token *int) interface{} {
+		labelSelector, err := getLabelSelectorParam(params)
+		if err != nil {
+			return err
+		}
+		return thisNode.TopologyTracker.FindInstanceOfService(params.GetString("serviceName"), params.GetString("serviceType"), params.GetString("zone"), nil, labelSelector)
+	})
 
-		targetEndpoint.RegisterMethod("findInstanceOfService", async (params) => {
-			return thisNode.TopologyTracker.FindInstanceOfService(params.serviceName, params.serviceType, params.zone);
-		});
+	targetEndpoint.RegisterMethod("selectInstanceOfService", func(params *CmdParams, callingEndpoint EndpointInterface, token *int) interface{} {
+		labelSelector, err := getLabelSelectorParam(params)
+		if err != nil {
+			return err
+		}
+		return thisNode.TopologyTracker.SelectInstanceOfService(params.GetString("serviceName"), params.GetString("serviceType"), params.GetString("zone"), nil, labelSelector, nil)
+	})
 
-		targetEndpoint.RegisterMethod("listServices", async (params) => {
-			return thisNode.TopologyTracker.ListServices(params.serviceName, params.serviceType, params.zone);
-		});
+	targetEndpoint.RegisterMethod("findInstancesOfService", func(params *CmdParams, callingEndpoint EndpointInterface, token *int) interface{} {
+		serviceName := params.GetString("serviceName")
+		if serviceName == nil {
+			return nil
+		}
+		labelSelector, err := getLabelSelectorParam(params)
+		if err != nil {
+			return err
+		}
+		return thisNode.TopologyTracker.FindInstancesOfService(*serviceName, params.GetString("zoneName"), labelSelector)
+	})
 
-		targetEndpoint.RegisterMethod("subscribe", async function (params, srcEndpoint, token) {
-			// Only allow if the scope is local or this Node is a Broker
-			if (params.scope !== "local" && !thisNode.IsBroker()) return null;
-
-			let sendFunction = async (message) => {
-				// Returns send status; error if not null
-				return await srcEndpoint.SendReply(params.streamToken, 2, message);
-			};
-			let sendFailCallback = async (sendFailMsg) => {
-				// Failed to send; may have already disconnected, take no further action
-			};
-			let thisSubscription = new DRP_Subscriber(params.topicName, params.scope, params.filter, sendFunction, sendFailCallback);
-			srcEndpoint.Subscriptions[params.streamToken] = thisSubscription;
-			return await thisNode.Subscribe(thisSubscription);
-		});
+	targetEndpoint.RegisterMethod("listNodes", func(params *CmdParams, callingEndpoint EndpointInterface, token *int) interface{} {
+		labelSelector, err := getLabelSelectorParam(params)
+		if err != nil {
+			return err
+		}
+		return thisNode.TopologyTracker.ListNodes(params.GetString("zoneName"), labelSelector)
+	})
 
-		targetEndpoint.RegisterMethod("unsubscribe", async function (params, srcEndpoint, token) {
-			let response = false;
-			let thisSubscription = srcEndpoint.Subscriptions[params.streamToken];
-			if (thisSubscription) {
-				thisSubscription.Terminate();
-				thisNode.SubscriptionManager.Subscribers.delete(thisSubscription);
-				response = true;
-			}
-			return response;
-		});
+	targetEndpoint.RegisterMethod("listServices", func(params *CmdParams, callingEndpoint EndpointInterface, token *int) interface{} {
+		labelSelector, err := getLabelSelectorParam(params)
+		if err != nil {
+			return err
+		}
+		return thisNode.TopologyTracker.ListServices(params.GetString("zoneName"), labelSelector)
+	})
+
+	targetEndpoint.RegisterMethod("listZones", func(params *CmdParams, callingEndpoint EndpointInterface, token *int) interface{} {
+		return thisNode.TopologyTracker.ListZones()
+	})
+
+	targetEndpoint.RegisterMethod("getServicesWithProviders", func(params *CmdParams, callingEndpoint EndpointInterface, token *int) interface{} {
+		return thisNode.TopologyTracker.GetServicesWithProviders(params.GetString("zoneName"))
+	})
+
+	targetEndpoint.RegisterMethod("getStreamsWithProviders", func(params *CmdParams, callingEndpoint EndpointInterface, token *int) interface{} {
+		return thisNode.TopologyTracker.GetStreamsWithProviders(params.GetString("zoneName"))
+	})
+
+	targetEndpoint.RegisterMethod("subscribe", func(params *CmdParams, callingEndpoint EndpointInterface, token *int) interface{} {
+		return thisNode.subscribeEndpoint(params, callingEndpoint)
+	})
+
+	targetEndpoint.RegisterMethod("unsubscribe", func(params *CmdParams, callingEndpoint EndpointInterface, token *int) interface{} {
+		streamToken := params.GetInt("streamToken")
+		if streamToken == nil {
+			return false
+		}
+		thisSubscription := callingEndpoint.baseEndpoint().removeStreamSubscription(*streamToken)
+		if thisSubscription == nil {
+			return false
+		}
+		thisNode.SubscriptionManager.UnregisterSubscription(thisSubscription)
+		thisSubscription.Terminate()
+		return true
+	})
+	/*
 
 		targetEndpoint.RegisterMethod("refreshSwaggerRouter", async function (params, srcEndpoint, token) {
 			let serviceName = null;
@@ -567,25 +1236,28 @@ func (dn *Node) ApplyNodeEndpointMethods(targetEndpoint EndpointInterface) {
 	thisNode := dn
 
 	thisNode.ApplyGenericEndpointMethods(targetEndpoint)
-	/*
-		targetEndpoint.RegisterMethod("topologyUpdate", async function (...args) {
-			return thisNode.TopologyUpdate(...args);
-		});
-	*/
+
+	targetEndpoint.RegisterMethod("topologyUpdate", func(params *CmdParams, callingEndpoint EndpointInterface, token *int) interface{} {
+		return thisNode.TopologyUpdate(params, callingEndpoint)
+	})
+
 	targetEndpoint.RegisterMethod("connectToNode", func(params *CmdParams, callingEndpoint EndpointInterface, token *int) interface{} {
-		var targetNodeID *string = nil
-		var targetURL *string = nil
+		var targetNodeID string = ""
+		var targetURL string = ""
 		if params != nil {
 			targetNodeIDJSON := (*params)["targetNodeID"]
 			if targetNodeIDJSON != nil {
-				json.Unmarshal(*targetNodeIDJSON, targetNodeID)
+				json.Unmarshal(*targetNodeIDJSON, &targetNodeID)
 			}
 			targetURLJSON := (*params)["targetURL"]
 			if targetURLJSON != nil {
-				json.Unmarshal(*targetURLJSON, targetURL)
+				json.Unmarshal(*targetURLJSON, &targetURL)
 			}
 		}
-		thisNode.ConnectToNode(*targetNodeID, *targetURL)
+		if targetNodeID == "" || targetURL == "" {
+			return errors.New("targetNodeID and targetURL are required")
+		}
+		thisNode.ConnectToNode(targetNodeID, targetURL)
 		return nil
 	})
 	/*
@@ -635,10 +1307,81 @@ func (dn *Node) IsBroker() bool {
 	return false
 }
 
+// IsRelay tells whether or not the local Node holds the Relay role
+func (dn *Node) IsRelay() bool {
+	for _, a := range dn.NodeRoles {
+		if a == "Relay" {
+			return true
+		}
+	}
+	return false
+}
+
+// IsProxyFor tells whether or not the local Node is the Relay for another Node
+func (dn *Node) IsProxyFor(checkNodeID string) bool {
+	checkNodeEntry := dn.TopologyTracker.GetNodeEntry(checkNodeID)
+	return checkNodeEntry != nil && checkNodeEntry.UsesProxy() && *checkNodeEntry.ProxyNodeID == dn.NodeID
+}
+
 // IsConnectedTo tells whether or not the local Node is directly connected to another Node
 func (dn *Node) IsConnectedTo(checkNodeID string) bool {
-	_, ok := dn.NodeEndpoints[checkNodeID]
-	return ok
+	return dn.GetNodeEndpoint(checkNodeID) != nil
+}
+
+// GetNodeEndpoint returns the Endpoint of a directly connected Node, or nil if there is none
+func (dn *Node) GetNodeEndpoint(nodeID string) EndpointInterface {
+	dn.endpointLock.RLock()
+	defer dn.endpointLock.RUnlock()
+	return dn.NodeEndpoints[nodeID]
+}
+
+// setNodeEndpoint registers the Endpoint of a directly connected Node, replacing any other
+func (dn *Node) setNodeEndpoint(nodeID string, nodeEndpoint EndpointInterface) {
+	dn.endpointLock.Lock()
+	defer dn.endpointLock.Unlock()
+	dn.NodeEndpoints[nodeID] = nodeEndpoint
+}
+
+// keepNodeEndpoint registers the Endpoint of a directly connected Node, unless a live connection in the opposite
+// direction is the one to keep.  Returns false if nodeEndpoint is redundant; otherwise the connection it replaces is
+// closed.
+func (dn *Node) keepNodeEndpoint(nodeID string, nodeEndpoint EndpointInterface) bool {
+	dn.endpointLock.Lock()
+	existingEndpoint, ok := dn.NodeEndpoints[nodeID]
+	isMutual := ok && existingEndpoint.baseEndpoint() != nodeEndpoint.baseEndpoint() && existingEndpoint.IsServer() != nodeEndpoint.IsServer() && !existingEndpoint.baseEndpoint().isClosed()
+	if isMutual && !dn.isKeptMutualConnection(nodeID, nodeEndpoint) {
+		dn.endpointLock.Unlock()
+		return false
+	}
+	dn.NodeEndpoints[nodeID] = nodeEndpoint
+	dn.endpointLock.Unlock()
+
+	if isMutual {
+		existingEndpoint.Close(CloseCodeRedundantConnection, "replaced by the connection opened by the lower NodeID")
+	}
+	return true
+}
+
+// removeNodeEndpoint unregisters the Endpoint of a Node if it is still the registered one
+func (dn *Node) removeNodeEndpoint(nodeID string, nodeEndpoint EndpointInterface) {
+	dn.endpointLock.Lock()
+	defer dn.endpointLock.Unlock()
+	registeredEndpoint, ok := dn.NodeEndpoints[nodeID]
+	if ok && registeredEndpoint.baseEndpoint() == nodeEndpoint.baseEndpoint() {
+		delete(dn.NodeEndpoints, nodeID)
+	}
+}
+
+// listNodeEndpoints returns a copy of the Endpoints of directly connected Nodes, safe to range over while
+// connections come and go
+func (dn *Node) listNodeEndpoints() map[string]EndpointInterface {
+	dn.endpointLock.RLock()
+	defer dn.endpointLock.RUnlock()
+	endpointMap := make(map[string]EndpointInterface, len(dn.NodeEndpoints))
+	for nodeID, nodeEndpoint := range dn.NodeEndpoints {
+		endpointMap[nodeID] = nodeEndpoint
+	}
+	return endpointMap
 }
 
 // ListClientConnections tells whether or not the local Node hold the Broker role
@@ -649,7 +1392,7 @@ func (dn *Node) ListClientConnections() map[string]map[string]interface{} {
 	nodeClientConnections["consumerClients"] = make(map[string]interface{})
 
 	// Loop over Node Endpoints
-	for nodeID, thisEndpoint := range dn.NodeEndpoints {
+	for nodeID, thisEndpoint := range dn.listNodeEndpoints() {
 		if thisEndpoint.IsServer() {
 			nodeClientConnections["nodeClients"][nodeID] = thisEndpoint.ConnectionStats()
 		}
@@ -667,10 +1410,15 @@ func (dn *Node) ListClientConnections() map[string]map[string]interface{} {
 func (dn *Node) GetLocalServiceDefinitions(checkServiceName *string) map[string]ServiceDefinition {
 	serviceDefinitions := make(map[string]ServiceDefinition)
 
-	for serviceName, localServiceObj := range dn.Services {
+	for _, localServiceObj := range dn.listLocalServices() {
+		serviceName := localServiceObj.ServiceName
 		if serviceName == "DRP" || checkServiceName != nil && *checkServiceName != serviceName {
 			continue
 		}
+		if _, ok := serviceDefinitions[serviceName]; ok {
+			// Instances of the same service share a definition
+			continue
+		}
 		serviceDefinition := localServiceObj.GetDefinition()
 		serviceDefinitions[serviceName] = serviceDefinition
 	}
@@ -683,12 +1431,18 @@ func (dn *Node) VerifyNodeConnection(remoteNodeID string) EndpointInterface {
 
 	thisNode := dn
 
-	thisNodeEntry := thisNode.TopologyTracker.NodeTable.GetEntry(remoteNodeID).(*NodeTableEntry)
+	thisNodeEntry := thisNode.TopologyTracker.GetNodeEntry(remoteNodeID)
 	if thisNodeEntry == nil {
 		return nil
 	}
 
-	thisNodeEndpoint := thisNode.NodeEndpoints[remoteNodeID]
+	thisNodeEndpoint := thisNode.GetNodeEndpoint(remoteNodeID)
+
+	// Proxied Nodes do not accept connections; use the connection to their Relay instead
+	if thisNodeEndpoint == nil && thisNodeEntry.UsesProxy() && *thisNodeEntry.ProxyNodeID != thisNode.NodeID {
+		thisNode.Log(fmt.Sprintf("Node [%s] is proxied by Relay [%s]", remoteNodeID, *thisNodeEntry.ProxyNodeID), true)
+		return thisNode.VerifyNodeConnection(*thisNodeEntry.ProxyNodeID)
+	}
 
 	// Is the remote node listening?  If so, try to connect
 	if thisNodeEndpoint == nil && thisNodeEntry.NodeURL != nil {
@@ -697,26 +1451,20 @@ func (dn *Node) VerifyNodeConnection(remoteNodeID string) EndpointInterface {
 		// We have a target URL, wait a few seconds for connection to initiate
 		thisNode.Log(fmt.Sprintf("Connecting to Node [%s] @ '%s'", remoteNodeID, *targetNodeURL), true)
 
-		thisNodeEndpoint := &Client{}
-		thisNodeEndpoint.Connect(*targetNodeURL, nil, dn, &remoteNodeID, false, nil, nil)
-
-		thisNode.NodeEndpoints[remoteNodeID] = thisNodeEndpoint
-
-		for i := 0; i < 50; i++ {
-
-			// Are we still trying?
-			if thisNodeEndpoint.IsConnecting() {
-				// Yes - wait
-				time.Sleep(100 * time.Millisecond)
+		newClient := &Client{}
+		connectErr := newClient.Connect(*targetNodeURL, nil, dn, &remoteNodeID, false, nil, nil)
+		if connectErr == nil {
+			if thisNode.keepNodeEndpoint(remoteNodeID, newClient) {
+				thisNodeEndpoint = newClient
 			} else {
-				// No - break the for loop
-				break
+				newClient.Close(CloseCodeRedundantConnection, "already connected")
+				thisNodeEndpoint = thisNode.GetNodeEndpoint(remoteNodeID)
 			}
 		}
 	}
 
 	// If this node is listening, try sending a back connection request to the remote node via the registry
-	if (thisNodeEndpoint != nil || !thisNodeEndpoint.IsReady()) && thisNode.listeningName != nil {
+	if (thisNodeEndpoint == nil || !thisNodeEndpoint.IsReady()) && thisNode.listeningName != nil {
 
 		thisNode.Log("Sending back request...", true)
 		// Let's try having the Provider call us; send command through Registry
@@ -724,7 +1472,11 @@ func (dn *Node) VerifyNodeConnection(remoteNodeID string) EndpointInterface {
 		// Get next hop
 		nextHopNodeID := thisNode.TopologyTracker.GetNextHop(remoteNodeID)
 
+		nextHopEndpoint := EndpointInterface(nil)
 		if nextHopNodeID != nil {
+			nextHopEndpoint = thisNode.GetNodeEndpoint(*nextHopNodeID)
+		}
+		if nextHopEndpoint != nil {
 			// Found the next hop
 			thisNode.Log(fmt.Sprintf("Sending back request to %s, relaying to [%s]", remoteNodeID, *nextHopNodeID), true)
 			routeOptions := RouteOptions{
@@ -735,7 +1487,7 @@ func (dn *Node) VerifyNodeConnection(remoteNodeID string) EndpointInterface {
 			cmdParams := make(map[string]string)
 			cmdParams["targetNodeID"] = thisNode.NodeID
 			cmdParams["targetURL"] = *thisNode.listeningName
-			thisNode.NodeEndpoints[*nextHopNodeID].SendCmd("DRP", "connectToNode", cmdParams, nil, &routeOptions, nil)
+			nextHopEndpoint.SendCmd("DRP", "connectToNode", cmdParams, nil, &routeOptions, nil)
 		} else {
 			// Could not find the next hop
 			thisNode.Log(fmt.Sprintf("Could not find next hop to [%s]", remoteNodeID), false)
@@ -746,8 +1498,8 @@ func (dn *Node) VerifyNodeConnection(remoteNodeID string) EndpointInterface {
 		for i := 0; i < 50; i++ {
 
 			// Are we still trying?
-			newEndpoint, ok := thisNode.NodeEndpoints[remoteNodeID]
-			if !ok || !newEndpoint.IsReady() {
+			newEndpoint := thisNode.GetNodeEndpoint(remoteNodeID)
+			if newEndpoint == nil || !newEndpoint.IsReady() {
 				// Yes - wait
 				time.Sleep(100 * time.Millisecond)
 			} else {
@@ -758,15 +1510,15 @@ func (dn *Node) VerifyNodeConnection(remoteNodeID string) EndpointInterface {
 		}
 
 		// If still not successful, delete DRP_NodeClient
-		newEndpoint, ok := thisNode.NodeEndpoints[remoteNodeID]
-		if !ok || !newEndpoint.IsReady() {
+		newEndpoint := thisNode.GetNodeEndpoint(remoteNodeID)
+		if newEndpoint == nil || !newEndpoint.IsReady() {
 			thisNode.Log(fmt.Sprintf("Could not open connection to Node [%s]", remoteNodeID), true)
-			if ok {
-				delete(thisNode.NodeEndpoints, remoteNodeID)
+			if newEndpoint != nil {
+				thisNode.removeNodeEndpoint(remoteNodeID, newEndpoint)
 			}
 			//throw new Error(`Could not get connection to Provider ${remoteNodeID}`);
 		} else {
-			thisNodeEndpoint = thisNode.NodeEndpoints[remoteNodeID]
+			thisNodeEndpoint = newEndpoint
 		}
 	}
 
@@ -0,0 +1,244 @@
+package drpmesh
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestTopologyUpdateInboundAndRelay(t *testing.T) {
+	localNodeID := "registry1"
+	thisNode := testNode(t, testNodeOptions("Registry", localNodeID))
+	thisTopologyTracker := thisNode.TopologyTracker
+
+	// A peer Registry sends updates over a websocket; a directly connected Provider receives relays
+	peerRegistryID := "registry2"
+	peerRegistryEntry := testNodeEntry(peerRegistryID)
+	peerRegistryEntry.Roles = []string{"Registry"}
+	thisTopologyTracker.ProcessPacket(TopologyPacket{peerRegistryID, "add", "node", peerRegistryID, *peerRegistryEntry.Scope, *peerRegistryEntry.Zone, peerRegistryEntry.ToJSON(), 0}, peerRegistryID, true)
+	_, clientConn := testEndpointPair(t, thisNode, peerRegistryID)
+
+	providerNodeID := "provider1"
+	providerEntry := testNodeEntry(providerNodeID)
+	thisTopologyTracker.ProcessPacket(TopologyPacket{providerNodeID, "add", "node", providerNodeID, *providerEntry.Scope, *providerEntry.Zone, providerEntry.ToJSON(), 0}, providerNodeID, false)
+	providerEndpoint := newRecordingEndpoint(thisNode, providerNodeID)
+	thisNode.setNodeEndpoint(providerNodeID, providerEndpoint)
+
+	// sendTopologyUpdate sends a packet the way a Node.js peer does, without a reply token
+	sendTopologyUpdate := func(topologyPacket TopologyPacket) {
+		t.Helper()
+		updateMethod := "topologyUpdate"
+		drpServiceName := "DRP"
+		updateCmd := &CmdOut{}
+		updateCmd.Type = "cmd"
+		updateCmd.Method = &updateMethod
+		updateCmd.ServiceName = &drpServiceName
+		updateCmd.Params = topologyPacket
+		if err := clientConn.WriteMessage(websocket.TextMessage, updateCmd.ToJSON()); err != nil {
+			t.Fatalf("could not send topologyUpdate: %s", err)
+		}
+	}
+
+	// The peer Registry is authoritative for a Provider connected directly to it
+	remoteNodeID := "provider2"
+	remoteNodeEntry := testNodeEntry(remoteNodeID)
+	remoteServiceEntry := testServiceEntry(remoteNodeID, "Worker")
+	remoteInstanceID := *remoteServiceEntry.InstanceID
+
+	sendTopologyUpdate(TopologyPacket{remoteNodeID, "add", "node", remoteNodeID, *remoteNodeEntry.Scope, *remoteNodeEntry.Zone, remoteNodeEntry.ToJSON(), 1})
+	sendTopologyUpdate(TopologyPacket{remoteNodeID, "add", "service", remoteInstanceID, *remoteServiceEntry.Scope, *remoteServiceEntry.Zone, remoteServiceEntry.ToJSON(), 1})
+	waitFor(t, "the remote service to be learned", func() bool {
+		return thisTopologyTracker.GetServiceEntry(remoteInstanceID) != nil
+	})
+	if learnedNodeEntry := thisTopologyTracker.GetNodeEntry(remoteNodeID); learnedNodeEntry == nil || *learnedNodeEntry.LearnedFrom != peerRegistryID {
+		t.Fatalf("expected the remote Node to be learned from the peer Registry, got %v", learnedNodeEntry)
+	}
+
+	// Accepted packets are relayed to the connected Provider in the same wire format; relays go out after the
+	// tables are updated, so collect them until both have arrived
+	relayedPackets := []TopologyPacket{}
+	waitFor(t, "the adds to be relayed", func() bool {
+		relayedPackets = append(relayedPackets, providerEndpoint.topologyPackets()...)
+		return len(relayedPackets) >= 2
+	})
+	if len(relayedPackets) != 2 || relayedPackets[0].Type != "node" || relayedPackets[1].Type != "service" || relayedPackets[1].ID != remoteInstanceID {
+		t.Fatalf("expected the node and service adds to be relayed, got %v", relayedPackets)
+	}
+	relayedJSON, _ := json.Marshal(relayedPackets[1])
+	wirePacket := map[string]interface{}{}
+	json.Unmarshal(relayedJSON, &wirePacket)
+	for _, fieldName := range []string{"originNodeID", "cmd", "type", "id", "scope", "zone", "data"} {
+		if _, ok := wirePacket[fieldName]; !ok {
+			t.Fatalf("expected relayed packet to carry [%s], got %s", fieldName, string(relayedJSON))
+		}
+	}
+
+	// A later update changes the service and is relayed as well
+	remoteServiceEntry.Status = ServiceStatusDraining
+	sendTopologyUpdate(TopologyPacket{remoteNodeID, "update", "service", remoteInstanceID, *remoteServiceEntry.Scope, *remoteServiceEntry.Zone, remoteServiceEntry.ToJSON(), 2})
+	updatePackets := []TopologyPacket{}
+	waitFor(t, "the update to be relayed", func() bool {
+		updatePackets = append(updatePackets, providerEndpoint.topologyPackets()...)
+		return len(updatePackets) >= 1
+	})
+	if thisTopologyTracker.GetServiceEntry(remoteInstanceID).Status != ServiceStatusDraining {
+		t.Fatalf("expected the remote service to be updated")
+	}
+	if len(updatePackets) != 1 || updatePackets[0].Cmd != "update" {
+		t.Fatalf("expected the update to be relayed, got %v", updatePackets)
+	}
+}
+
+// sendTestCmd sends a DRP command over a test websocket and returns the reply
+func sendTestCmd(t *testing.T, clientConn *websocket.Conn, cmdToken int, methodName string, cmdParams map[string]interface{}) *ReplyIn {
+	t.Helper()
+	drpServiceName := "DRP"
+	testCmd := &CmdOut{}
+	testCmd.Type = "cmd"
+	testCmd.Token = &cmdToken
+	testCmd.Method = &methodName
+	testCmd.ServiceName = &drpServiceName
+	testCmd.Params = cmdParams
+	if err := clientConn.WriteMessage(websocket.TextMessage, testCmd.ToJSON()); err != nil {
+		t.Fatalf("could not send %s: %s", methodName, err)
+	}
+	replyPacket := readTestReply(t, clientConn)
+	if replyPacket.Token == nil || *replyPacket.Token != cmdToken || replyPacket.Payload == nil {
+		t.Fatalf("expected a reply to %s, got %s", methodName, string(replyPacket.ToJSON()))
+	}
+	return replyPacket
+}
+
+func TestDiscoveryMethods(t *testing.T) {
+	localNodeID := "registry1"
+	thisNode := testNode(t, testNodeOptions("Registry", localNodeID))
+	addTestProvider(thisNode.TopologyTracker, "provider1", "zone1", "Worker")
+	addTestProvider(thisNode.TopologyTracker, "provider2", "zone2", "Worker", "Cache")
+	_, clientConn := testEndpointPair(t, thisNode, "consumer1")
+
+	// Consumers query a Go Registry with the same method names and parameters as a Node.js one
+	listChecks := []struct {
+		methodName string
+		cmdParams  map[string]interface{}
+		expected   string
+	}{
+		{"listZones", nil, "zone1,zone2"},
+		{"listNodes", map[string]interface{}{"zoneName": "zone2"}, "provider2"},
+		{"listServices", map[string]interface{}{"zoneName": "zone2"}, "Cache,Worker"},
+		{"listServices", nil, "Cache,DRP,Worker"},
+	}
+	for checkNum, listCheck := range listChecks {
+		replyPacket := sendTestCmd(t, clientConn, checkNum+1, listCheck.methodName, listCheck.cmdParams)
+		replyList := []string{}
+		if err := json.Unmarshal(*replyPacket.Payload, &replyList); err != nil {
+			t.Fatalf("%s: could not unmarshal reply %s", listCheck.methodName, string(*replyPacket.Payload))
+		}
+		sort.Strings(replyList)
+		if strings.Join(replyList, ",") != listCheck.expected {
+			t.Errorf("%s %v: expected [%s], got %v", listCheck.methodName, listCheck.cmdParams, listCheck.expected, replyList)
+		}
+	}
+
+	instanceReply := sendTestCmd(t, clientConn, 10, "findInstanceOfService", map[string]interface{}{"serviceName": "Worker", "zone": "zone2"})
+	instanceEntry := &ServiceTableEntry{}
+	json.Unmarshal(*instanceReply.Payload, instanceEntry)
+	if instanceEntry.NodeID == nil || *instanceEntry.NodeID != "provider2" {
+		t.Errorf("expected the zone2 Worker instance, got %s", string(*instanceReply.Payload))
+	}
+
+	instancesReply := sendTestCmd(t, clientConn, 11, "findInstancesOfService", map[string]interface{}{"serviceName": "Worker"})
+	instanceList := []*ServiceTableEntry{}
+	json.Unmarshal(*instancesReply.Payload, &instanceList)
+	if len(instanceList) != 2 {
+		t.Errorf("expected two Worker instances, got %s", string(*instancesReply.Payload))
+	}
+
+	providersReply := sendTestCmd(t, clientConn, 12, "getServicesWithProviders", map[string]interface{}{"zoneName": "zone1"})
+	providerMap := map[string]struct{ Providers []string }{}
+	json.Unmarshal(*providersReply.Payload, &providerMap)
+	if len(providerMap) != 2 || len(providerMap["Worker"].Providers) != 1 || providerMap["Worker"].Providers[0] != "provider1" {
+		t.Errorf("expected the zone1 Worker and DRP providers, got %s", string(*providersReply.Payload))
+	}
+}
+
+func TestMethodErrorReplies(t *testing.T) {
+	thisNode := testNode(t, testNodeOptions("Registry", "registry1"))
+	_, clientConn := testEndpointPair(t, thisNode, "consumer1")
+
+	// Local callers get the error itself
+	badFormat, _ := json.Marshal("svg")
+	localResult := thisNode.ServiceCmd("DRP", "getTopology", &CmdParams{"format": (*json.RawMessage)(&badFormat)}, ServiceCmd_ExecParams{})
+	if _, isErr := localResult.(error); !isErr {
+		t.Fatalf("expected an error for an unknown format, got %v", localResult)
+	}
+
+	// Remote callers get a failed reply carrying the message
+	errorChecks := []struct {
+		methodName string
+		cmdParams  map[string]interface{}
+		expected   string
+	}{
+		{"getTopology", map[string]interface{}{"format": "svg"}, "unknown topology format"},
+		{"listNodes", map[string]interface{}{"labelSelector": "env in (prod"}, "unbalanced parentheses"},
+		{"findInstanceOfService", map[string]interface{}{"serviceName": "DRP", "labelSelector": "env in (prod"}, "unbalanced parentheses"},
+	}
+	for checkNum, errorCheck := range errorChecks {
+		replyPacket := sendTestCmd(t, clientConn, checkNum+1, errorCheck.methodName, errorCheck.cmdParams)
+		replyMessage := ""
+		json.Unmarshal(*replyPacket.Payload, &replyMessage)
+		if replyPacket.Status != 0 || !strings.Contains(replyMessage, errorCheck.expected) {
+			t.Errorf("%s: expected a failed reply containing [%s], got status %d %s", errorCheck.methodName, errorCheck.expected, replyPacket.Status, string(*replyPacket.Payload))
+		}
+	}
+
+	// Successful calls are unaffected
+	mermaidReply := sendTestCmd(t, clientConn, 10, "getTopology", map[string]interface{}{"format": "mermaid"})
+	mermaidText := ""
+	json.Unmarshal(*mermaidReply.Payload, &mermaidText)
+	if mermaidReply.Status != 1 || !strings.HasPrefix(mermaidText, "flowchart LR") {
+		t.Errorf("expected a Mermaid graph, got %s", string(*mermaidReply.Payload))
+	}
+}
+
+func TestConnectToNodeMethod(t *testing.T) {
+	thisNode := testNode(t, testNodeOptions("Provider", "provider1"))
+	_, clientConn := testEndpointPair(t, thisNode, "registry1")
+	targetOptions := testNodeOptions("Provider", "provider2")
+	targetOptions.HostID = "host2"
+	targetNode := testNode(t, targetOptions)
+	targetServer := httptest.NewServer(targetNode)
+	defer targetServer.Close()
+
+	// Back connection requests missing a target are refused rather than dereferenced
+	incompleteParams := []map[string]interface{}{
+		nil,
+		{"targetNodeID": "provider2"},
+		{"targetURL": testWebSocketURL(targetServer)},
+		{"targetNodeID": "", "targetURL": testWebSocketURL(targetServer)},
+	}
+	for checkNum, cmdParams := range incompleteParams {
+		replyPacket := sendTestCmd(t, clientConn, checkNum+1, "connectToNode", cmdParams)
+		if replyPacket.Status != 0 {
+			t.Errorf("expected connectToNode with %v to fail, got %s", cmdParams, string(*replyPacket.Payload))
+		}
+	}
+
+	// A complete request connects to the target Node
+	drpServiceName := "DRP"
+	methodName := "connectToNode"
+	connectCmd := &CmdOut{}
+	connectCmd.Type = "cmd"
+	connectCmd.Method = &methodName
+	connectCmd.ServiceName = &drpServiceName
+	connectCmd.Params = map[string]interface{}{"targetNodeID": "provider2", "targetURL": testWebSocketURL(targetServer)}
+	if err := clientConn.WriteMessage(websocket.TextMessage, connectCmd.ToJSON()); err != nil {
+		t.Fatalf("could not send connectToNode: %s", err)
+	}
+	waitFor(t, "the back connection to provider2", func() bool {
+		return targetNode.GetNodeEndpoint("provider1") != nil
+	})
+}
@@ -0,0 +1,261 @@
+package drpmesh
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// OutlierPolicy controls when a caller stops sending requests to a misbehaving service instance.  An instance is
+// ejected after ConsecutiveErrors failed calls, or when its average latency is more than LatencyFactor times the
+// median of the other instances.  Each ejection lasts twice as long as the previous one, up to MaxEjectionTime, and
+// no more than MaxEjectionPercent of a service's instances are ejected at once.  Zero thresholds disable a check.
+type OutlierPolicy struct {
+	ConsecutiveErrors  uint64
+	LatencyFactor      float64
+	MinRequests        uint64
+	BaseEjectionTime   time.Duration
+	MaxEjectionTime    time.Duration
+	MaxEjectionPercent int
+}
+
+// DefaultCallTimeout is how long a call waits for a reply when its RetryPolicy sets no AttemptTimeout, so calls to a
+// wedged instance end and count as failures against it.  DRP control calls such as getRegistry are exempt.
+const DefaultCallTimeout = 30 * time.Second
+
+// DefaultOutlierPolicy returns the policy used for services without one of their own
+func DefaultOutlierPolicy() OutlierPolicy {
+	return OutlierPolicy{5, 3.0, 10, 30 * time.Second, 5 * time.Minute, 50}
+}
+
+// outlierState tracks the ejections of a service instance
+type outlierState struct {
+	serviceName   string
+	ejectedUntil  time.Time
+	ejectionCount int
+}
+
+// OutlierDetector ejects service instances from selection based on the outcome of calls made by this Node
+type OutlierDetector struct {
+	instanceStates  map[string]*outlierState
+	servicePolicies map[string]OutlierPolicy
+	defaultPolicy   OutlierPolicy
+	detectorLock    sync.Mutex
+
+	// Ready instances of each service, kept until a topology event for the service changes them
+	readyInstances   map[string][]string
+	readyGenerations map[string]uint64
+}
+
+// SetOutlierPolicy sets the ejection policy for a service; nil restores the default
+func (od *OutlierDetector) SetOutlierPolicy(serviceName string, outlierPolicy *OutlierPolicy) {
+	od.detectorLock.Lock()
+	defer od.detectorLock.Unlock()
+	if od.servicePolicies == nil {
+		od.servicePolicies = make(map[string]OutlierPolicy)
+	}
+	if outlierPolicy == nil {
+		delete(od.servicePolicies, serviceName)
+		return
+	}
+	od.servicePolicies[serviceName] = *outlierPolicy
+}
+
+// SetDefaultOutlierPolicy sets the ejection policy for services without one of their own
+func (od *OutlierDetector) SetDefaultOutlierPolicy(outlierPolicy OutlierPolicy) {
+	od.detectorLock.Lock()
+	defer od.detectorLock.Unlock()
+	od.defaultPolicy = outlierPolicy
+}
+
+// GetOutlierPolicy returns the ejection policy for a service
+func (od *OutlierDetector) GetOutlierPolicy(serviceName string) OutlierPolicy {
+	od.detectorLock.Lock()
+	defer od.detectorLock.Unlock()
+	return od.getPolicy(serviceName)
+}
+
+// getPolicy returns the ejection policy for a service; caller must hold detectorLock
+func (od *OutlierDetector) getPolicy(serviceName string) OutlierPolicy {
+	if outlierPolicy, ok := od.servicePolicies[serviceName]; ok {
+		return outlierPolicy
+	}
+	return od.defaultPolicy
+}
+
+// IsEjected tells whether or not a service instance is currently ejected
+func (od *OutlierDetector) IsEjected(serviceInstanceID string) bool {
+	od.detectorLock.Lock()
+	defer od.detectorLock.Unlock()
+	instanceState, ok := od.instanceStates[serviceInstanceID]
+	return ok && time.Now().Before(instanceState.ejectedUntil)
+}
+
+// ListEjected returns the currently ejected instances along with when each ejection ends
+func (od *OutlierDetector) ListEjected() map[string]time.Time {
+	od.detectorLock.Lock()
+	defer od.detectorLock.Unlock()
+	currentTime := time.Now()
+	ejectedList := make(map[string]time.Time)
+	for serviceInstanceID, instanceState := range od.instanceStates {
+		if currentTime.Before(instanceState.ejectedUntil) {
+			ejectedList[serviceInstanceID] = instanceState.ejectedUntil
+		}
+	}
+	return ejectedList
+}
+
+// Remove discards the ejection state of a service instance
+func (od *OutlierDetector) Remove(serviceInstanceID string) {
+	od.detectorLock.Lock()
+	defer od.detectorLock.Unlock()
+	delete(od.instanceStates, serviceInstanceID)
+}
+
+// getReadyInstances returns the cached Ready instances of a service, listing them with listInstances on a miss
+func (od *OutlierDetector) getReadyInstances(serviceName string, listInstances func() []string) []string {
+	od.detectorLock.Lock()
+	if instanceIDList, ok := od.readyInstances[serviceName]; ok {
+		od.detectorLock.Unlock()
+		return instanceIDList
+	}
+	listGeneration := od.readyGenerations[serviceName]
+	od.detectorLock.Unlock()
+
+	instanceIDList := listInstances()
+
+	// Only keep the list if no topology event changed the service while it was listed
+	od.detectorLock.Lock()
+	defer od.detectorLock.Unlock()
+	if od.readyGenerations[serviceName] == listGeneration {
+		if od.readyInstances == nil {
+			od.readyInstances = make(map[string][]string)
+		}
+		od.readyInstances[serviceName] = instanceIDList
+	}
+	return instanceIDList
+}
+
+// forgetInstances drops the cached instances of a service after its Service table entries change
+func (od *OutlierDetector) forgetInstances(serviceName string) {
+	od.detectorLock.Lock()
+	defer od.detectorLock.Unlock()
+	if od.readyGenerations == nil {
+		od.readyGenerations = make(map[string]uint64)
+	}
+	od.readyGenerations[serviceName]++
+	delete(od.readyInstances, serviceName)
+}
+
+// eject removes an instance from selection unless the service is already at its ejection cap, and returns how long
+// the ejection lasts
+func (od *OutlierDetector) eject(serviceName string, serviceInstanceID string, instanceCount int) (time.Duration, bool) {
+	od.detectorLock.Lock()
+	defer od.detectorLock.Unlock()
+
+	if od.instanceStates == nil {
+		od.instanceStates = make(map[string]*outlierState)
+	}
+	outlierPolicy := od.getPolicy(serviceName)
+	currentTime := time.Now()
+
+	instanceState, ok := od.instanceStates[serviceInstanceID]
+	if !ok {
+		instanceState = &outlierState{serviceName, time.Time{}, 0}
+		od.instanceStates[serviceInstanceID] = instanceState
+	}
+	if currentTime.Before(instanceState.ejectedUntil) {
+		return 0, false
+	}
+
+	// Enforce the cap on the fraction of instances ejected at once
+	ejectedCount := 0
+	for _, checkState := range od.instanceStates {
+		if checkState.serviceName == serviceName && currentTime.Before(checkState.ejectedUntil) {
+			ejectedCount++
+		}
+	}
+	if (ejectedCount+1)*100 > outlierPolicy.MaxEjectionPercent*instanceCount {
+		return 0, false
+	}
+
+	// Instances which stayed in service for the maximum ejection time start over at the base ejection time
+	if instanceState.ejectionCount > 0 && currentTime.Sub(instanceState.ejectedUntil) > outlierPolicy.MaxEjectionTime {
+		instanceState.ejectionCount = 0
+	}
+
+	ejectionTime := outlierPolicy.BaseEjectionTime
+	for ejectionIndex := 0; ejectionIndex < instanceState.ejectionCount && ejectionTime < outlierPolicy.MaxEjectionTime; ejectionIndex++ {
+		ejectionTime *= 2
+	}
+	if ejectionTime > outlierPolicy.MaxEjectionTime {
+		ejectionTime = outlierPolicy.MaxEjectionTime
+	}
+	instanceState.ejectionCount++
+	instanceState.ejectedUntil = currentTime.Add(ejectionTime)
+	return ejectionTime, true
+}
+
+// recordCallOutcome checks whether a service instance has become an outlier after a call completes or times out.
+// The other instances are only looked at when a threshold may have been crossed, and come from a cache kept
+// current by topology events.
+func (tt *TopologyTracker) recordCallOutcome(serviceName string, serviceInstanceID string) {
+	thisTopologyTracker := tt
+	thisNode := thisTopologyTracker.drpNode
+
+	outlierPolicy := thisTopologyTracker.Outliers.GetOutlierPolicy(serviceName)
+	instanceStats := thisTopologyTracker.ServiceStats.Get(serviceInstanceID)
+
+	failureThresholdReached := outlierPolicy.ConsecutiveErrors > 0 && instanceStats.ConsecutiveFailures >= outlierPolicy.ConsecutiveErrors
+	latencyCheckDue := outlierPolicy.LatencyFactor > 0 && instanceStats.Completed >= outlierPolicy.MinRequests && instanceStats.Completed > 0
+	if !failureThresholdReached && !latencyCheckDue {
+		return
+	}
+
+	// Compare against the other instances of the service which are in service
+	readyInstanceList := thisTopologyTracker.Outliers.getReadyInstances(serviceName, func() []string {
+		instanceIDList := []string{}
+		for _, serviceTableEntry := range thisTopologyTracker.FindInstancesOfService(serviceName, nil, nil) {
+			if serviceTableEntry.Status == ServiceStatusReady {
+				instanceIDList = append(instanceIDList, *serviceTableEntry.InstanceID)
+			}
+		}
+		return instanceIDList
+	})
+
+	ejectReason := ""
+	if failureThresholdReached {
+		ejectReason = fmt.Sprintf("%d consecutive failures", instanceStats.ConsecutiveFailures)
+	} else {
+		peerLatencies := []time.Duration{}
+		for _, peerInstanceID := range readyInstanceList {
+			if peerInstanceID == serviceInstanceID {
+				continue
+			}
+			peerStats := thisTopologyTracker.ServiceStats.Get(peerInstanceID)
+			if peerStats.Completed >= outlierPolicy.MinRequests && peerStats.Completed > 0 {
+				peerLatencies = append(peerLatencies, peerStats.AvgLatency)
+			}
+		}
+		if len(peerLatencies) > 0 {
+			sort.Slice(peerLatencies, func(i, j int) bool {
+				return peerLatencies[i] < peerLatencies[j]
+			})
+			medianLatency := peerLatencies[len(peerLatencies)/2]
+			if float64(instanceStats.AvgLatency) > outlierPolicy.LatencyFactor*float64(medianLatency) {
+				ejectReason = fmt.Sprintf("average latency %s against median %s", instanceStats.AvgLatency, medianLatency)
+			}
+		}
+	}
+	if ejectReason == "" {
+		return
+	}
+
+	if ejectionTime, ejected := thisTopologyTracker.Outliers.eject(serviceName, serviceInstanceID, len(readyInstanceList)); ejected {
+		// The failures which led to the ejection must not eject the instance again as soon as it returns
+		thisTopologyTracker.ServiceStats.ResetConsecutiveFailures(serviceInstanceID)
+		thisNode.Log(fmt.Sprintf("Ejected service [%s] instance [%s] for %s, %s", serviceName, serviceInstanceID, ejectionTime, ejectReason), false)
+		thisNode.EvaluateDependencies()
+	}
+}
@@ -0,0 +1,178 @@
+package drpmesh
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestOutlierEjection(t *testing.T) {
+	localNodeID := "registry1"
+	serviceName := "TestService"
+	thisNode := testNode(t, testNodeOptions("Registry", localNodeID))
+	thisTopologyTracker := thisNode.TopologyTracker
+
+	instanceIDList := []string{}
+	for nodeIndex := 1; nodeIndex <= 3; nodeIndex++ {
+		nodeID := fmt.Sprintf("provider%d", nodeIndex)
+		nodeEntry := testNodeEntry(nodeID)
+		serviceEntry := testServiceEntry(nodeID, serviceName)
+		thisTopologyTracker.ProcessPacket(TopologyPacket{nodeID, "add", "node", nodeID, *nodeEntry.Scope, *nodeEntry.Zone, nodeEntry.ToJSON(), 0}, nodeID, false)
+		thisTopologyTracker.ProcessPacket(TopologyPacket{nodeID, "add", "service", *serviceEntry.InstanceID, *serviceEntry.Scope, *serviceEntry.Zone, serviceEntry.ToJSON(), 0}, nodeID, false)
+		instanceIDList = append(instanceIDList, *serviceEntry.InstanceID)
+	}
+
+	// Consecutive failures eject the first instance
+	outlierPolicy := DefaultOutlierPolicy()
+	for failCount := uint64(0); failCount < outlierPolicy.ConsecutiveErrors; failCount++ {
+		thisTopologyTracker.ServiceStats.RecordFailure(instanceIDList[0])
+		thisTopologyTracker.recordCallOutcome(serviceName, instanceIDList[0])
+	}
+	if !thisTopologyTracker.Outliers.IsEjected(instanceIDList[0]) {
+		t.Fatalf("expected instance to be ejected after %d failures", outlierPolicy.ConsecutiveErrors)
+	}
+	for pickCount := 0; pickCount < 20; pickCount++ {
+		if serviceEntry := thisTopologyTracker.FindInstanceOfService(&serviceName, nil, nil, nil, nil); serviceEntry == nil || *serviceEntry.InstanceID == instanceIDList[0] {
+			t.Fatalf("expected ejected instance not to be selected, got %v", serviceEntry)
+		}
+	}
+
+	// A second ejection would exceed half of the instances
+	for failCount := uint64(0); failCount < outlierPolicy.ConsecutiveErrors; failCount++ {
+		thisTopologyTracker.ServiceStats.RecordFailure(instanceIDList[1])
+		thisTopologyTracker.recordCallOutcome(serviceName, instanceIDList[1])
+	}
+	if thisTopologyTracker.Outliers.IsEjected(instanceIDList[1]) {
+		t.Fatalf("expected the ejection cap to keep the second instance in service")
+	}
+
+	// Repeated ejections of the same instance last longer each time
+	thisTopologyTracker.Outliers.instanceStates[instanceIDList[0]].ejectedUntil = time.Now()
+	if ejectionTime, ejected := thisTopologyTracker.Outliers.eject(serviceName, instanceIDList[0], 3); !ejected || ejectionTime != 2*outlierPolicy.BaseEjectionTime {
+		t.Fatalf("expected second ejection to last %s, got %s", 2*outlierPolicy.BaseEjectionTime, ejectionTime)
+	}
+}
+
+func TestOutlierEjectionResetsFailures(t *testing.T) {
+	serviceName := "TestService"
+	thisNode := testNode(t, testNodeOptions("Registry", "registry1"))
+	thisTopologyTracker := thisNode.TopologyTracker
+
+	instanceIDList := []string{}
+	for nodeIndex := 1; nodeIndex <= 3; nodeIndex++ {
+		serviceEntryList := addTestProvider(thisTopologyTracker, fmt.Sprintf("provider%d", nodeIndex), "zone1", serviceName)
+		instanceIDList = append(instanceIDList, *serviceEntryList[0].InstanceID)
+	}
+
+	outlierPolicy := DefaultOutlierPolicy()
+	for failCount := uint64(0); failCount < outlierPolicy.ConsecutiveErrors; failCount++ {
+		thisTopologyTracker.ServiceStats.RecordFailure(instanceIDList[0])
+		thisTopologyTracker.recordCallOutcome(serviceName, instanceIDList[0])
+	}
+	if !thisTopologyTracker.Outliers.IsEjected(instanceIDList[0]) {
+		t.Fatalf("expected instance to be ejected after %d failures", outlierPolicy.ConsecutiveErrors)
+	}
+	if consecutiveFailures := thisTopologyTracker.ServiceStats.Get(instanceIDList[0]).ConsecutiveFailures; consecutiveFailures != 0 {
+		t.Fatalf("expected the ejection to reset consecutive failures, got %d", consecutiveFailures)
+	}
+
+	// Once the ejection expires a single failure does not eject the instance again
+	thisTopologyTracker.Outliers.detectorLock.Lock()
+	thisTopologyTracker.Outliers.instanceStates[instanceIDList[0]].ejectedUntil = time.Now()
+	thisTopologyTracker.Outliers.detectorLock.Unlock()
+	thisTopologyTracker.ServiceStats.RecordFailure(instanceIDList[0])
+	thisTopologyTracker.recordCallOutcome(serviceName, instanceIDList[0])
+	if thisTopologyTracker.Outliers.IsEjected(instanceIDList[0]) {
+		t.Fatalf("expected a returning instance to need %d new failures to be ejected again", outlierPolicy.ConsecutiveErrors)
+	}
+}
+
+func TestOutlierCallTimeout(t *testing.T) {
+	serviceName := "Worker"
+	thisNode := testNode(t, testNodeOptions("Registry", "registry1"))
+	thisTopologyTracker := thisNode.TopologyTracker
+	thisTopologyTracker.CallTimeout = 100 * time.Millisecond
+	thisTopologyTracker.CircuitBreakers.SetPolicy(serviceName, &CircuitBreakerPolicy{})
+	thisTopologyTracker.Outliers.SetOutlierPolicy(serviceName, &OutlierPolicy{2, 0, 0, time.Minute, time.Minute, 50})
+
+	// provider1 accepts commands but never answers them
+	wedgedEntry := addTestProvider(thisTopologyTracker, "provider1", "zone1", serviceName)[0]
+	addTestProvider(thisTopologyTracker, "provider2", "zone1", serviceName)
+	wedgedEndpoint := testPeerNode(t, thisNode, "provider1", func(cmdPacket *PacketIn) (interface{}, bool) {
+		return nil, false
+	})
+
+	// Without an AttemptTimeout the calls still end at the CallTimeout and count against the instance
+	for callCount := 1; callCount <= 2; callCount++ {
+		execParams := ServiceCmd_ExecParams{}
+		execParams.targetServiceInstanceID = wedgedEntry.InstanceID
+		callStart := time.Now()
+		if _, errorCode := thisNode.serviceCmdAttempt(serviceName, "work", &CmdParams{}, &execParams, 0); errorCode != CallErrorTimeout {
+			t.Fatalf("expected call %d to time out, got [%s]", callCount, errorCode)
+		}
+		if callTime := time.Since(callStart); callTime > time.Second {
+			t.Fatalf("expected the call to end at the CallTimeout, took %s", callTime)
+		}
+	}
+	if instanceStats := thisTopologyTracker.ServiceStats.Get(*wedgedEntry.InstanceID); instanceStats.Failed != 2 || instanceStats.InFlight != 0 || pendingReplyCount(wedgedEndpoint) != 0 {
+		t.Fatalf("expected two finished failures, got %+v", instanceStats)
+	}
+	if !thisTopologyTracker.Outliers.IsEjected(*wedgedEntry.InstanceID) {
+		t.Fatalf("expected the wedged instance to be ejected after timing out")
+	}
+}
+
+func TestOutlierReadyInstanceCache(t *testing.T) {
+	serviceName := "Worker"
+	thisNode := testNode(t, testNodeOptions("Registry", "registry1"))
+	thisTopologyTracker := thisNode.TopologyTracker
+	serviceEntryList := []*ServiceTableEntry{}
+	for nodeIndex := 1; nodeIndex <= 3; nodeIndex++ {
+		serviceEntryList = append(serviceEntryList, addTestProvider(thisTopologyTracker, fmt.Sprintf("provider%d", nodeIndex), "zone1", serviceName)...)
+	}
+
+	listCount := 0
+	listReady := func() []string {
+		listCount++
+		instanceIDList := []string{}
+		for _, serviceTableEntry := range thisTopologyTracker.FindInstancesOfService(serviceName, nil, nil) {
+			if serviceTableEntry.Status == ServiceStatusReady {
+				instanceIDList = append(instanceIDList, *serviceTableEntry.InstanceID)
+			}
+		}
+		return instanceIDList
+	}
+
+	// Calls which cross no threshold do not look at the other instances
+	thisTopologyTracker.ServiceStats.End(*serviceEntryList[0].InstanceID, thisTopologyTracker.ServiceStats.Begin(*serviceEntryList[0].InstanceID), false)
+	thisTopologyTracker.recordCallOutcome(serviceName, *serviceEntryList[0].InstanceID)
+	if _, ok := thisTopologyTracker.Outliers.readyInstances[serviceName]; ok {
+		t.Fatalf("expected no instance list for a call below the thresholds")
+	}
+
+	// The list is reused until a topology event changes the service
+	for callCount := 0; callCount < 3; callCount++ {
+		if instanceIDList := thisTopologyTracker.Outliers.getReadyInstances(serviceName, listReady); len(instanceIDList) != 3 {
+			t.Fatalf("expected three ready instances, got %v", instanceIDList)
+		}
+	}
+	if listCount != 1 {
+		t.Fatalf("expected the instances to be listed once, listed %d times", listCount)
+	}
+	unhealthyEntry := serviceEntryList[2]
+	unhealthyEntry.Status = ServiceStatusUnhealthy
+	thisTopologyTracker.ProcessPacket(TopologyPacket{"provider3", "update", "service", *unhealthyEntry.InstanceID, *unhealthyEntry.Scope, *unhealthyEntry.Zone, unhealthyEntry.ToJSON(), 0}, "provider3", false)
+	if instanceIDList := thisTopologyTracker.Outliers.getReadyInstances(serviceName, listReady); len(instanceIDList) != 2 || listCount != 2 {
+		t.Fatalf("expected the update to refresh the list to two instances, got %v after %d listings", instanceIDList, listCount)
+	}
+
+	// With two Ready instances the ejection cap of half allows ejecting one
+	outlierPolicy := DefaultOutlierPolicy()
+	for failCount := uint64(0); failCount < outlierPolicy.ConsecutiveErrors; failCount++ {
+		thisTopologyTracker.ServiceStats.RecordFailure(*serviceEntryList[0].InstanceID)
+		thisTopologyTracker.recordCallOutcome(serviceName, *serviceEntryList[0].InstanceID)
+	}
+	if !thisTopologyTracker.Outliers.IsEjected(*serviceEntryList[0].InstanceID) {
+		t.Fatalf("expected the failing instance to be ejected")
+	}
+}
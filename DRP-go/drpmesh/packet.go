@@ -42,22 +42,57 @@ type PacketIn struct {
 	Params            *CmdParams       `json:"params"`
 	ServiceName       *string          `json:"serviceName"`
 	ServiceInstanceID *string          `json:"serviceInstanceID"`
+	LabelSelector     *string          `json:"labelSelector,omitempty"`
 	Status            int              `json:"status"`
 	Payload           *json.RawMessage `json:"payload"`
 }
 
-// Cmd is a DRP packet sent when issuing a command
+// Cmd is a DRP packet sent when issuing a command.  A caller which does not name an instance may limit the
+// instances considered with a label selector, in the syntax accepted by ParseLabelSelector.
 type Cmd struct {
 	BasePacket
 	Method            *string    `json:"method"`
 	Params            *CmdParams `json:"params"`
 	ServiceName       *string    `json:"serviceName"`
 	ServiceInstanceID *string    `json:"serviceInstanceID"`
+	LabelSelector     *string    `json:"labelSelector,omitempty"`
 }
 
 // CmdParams - DRP Cmd parameters
 type CmdParams map[string]*json.RawMessage
 
+// GetString returns a string parameter, or nil if it is missing or not a non-empty string
+func (cp *CmdParams) GetString(paramName string) *string {
+	if cp == nil {
+		return nil
+	}
+	valueJSON := (*cp)[paramName]
+	if valueJSON == nil {
+		return nil
+	}
+	var paramValue string
+	if json.Unmarshal(*valueJSON, &paramValue) != nil || paramValue == "" {
+		return nil
+	}
+	return &paramValue
+}
+
+// GetInt returns an integer parameter, or nil if it is missing or not a number
+func (cp *CmdParams) GetInt(paramName string) *int {
+	if cp == nil {
+		return nil
+	}
+	valueJSON := (*cp)[paramName]
+	if valueJSON == nil {
+		return nil
+	}
+	var paramValue int
+	if json.Unmarshal(*valueJSON, &paramValue) != nil {
+		return nil
+	}
+	return &paramValue
+}
+
 // ToJSON converts the packet to a JSON byte array
 func (dc *Cmd) ToJSON() []byte {
 	buff, _ := json.Marshal(dc)
@@ -71,6 +106,7 @@ type CmdOut struct {
 	Params            interface{} `json:"params"`
 	ServiceName       *string     `json:"serviceName"`
 	ServiceInstanceID *string     `json:"serviceInstanceID"`
+	LabelSelector     *string     `json:"labelSelector,omitempty"`
 }
 
 // ToJSON converts the packet to a JSON byte array
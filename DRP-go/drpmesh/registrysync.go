@@ -0,0 +1,276 @@
+package drpmesh
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// DefaultChangeHistorySize is how many table changes are kept to answer incremental registry requests
+const DefaultChangeHistorySize = 1000
+
+// DefaultSyncPointTTL is how long the sync point of a disconnected Node is kept for an incremental resync
+const DefaultSyncPointTTL = 5 * time.Minute
+
+// RegistryDelta holds the Node and Service table changes since a version the caller already holds.  If Full is
+// set, the tables are a complete dump and the caller should discard what it knows about the sender's version.
+// Versions are only comparable within the same Epoch, which changes whenever the sender restarts.
+type RegistryDelta struct {
+	Epoch           string
+	Version         uint64
+	Full            bool
+	NodeTable       map[string]*NodeTableEntry
+	ServiceTable    map[string]*ServiceTableEntry
+	DeletedNodes    []string
+	DeletedServices []string
+}
+
+// topologyChange is an entry in the table change history
+type topologyChange struct {
+	version   uint64
+	cmd       string
+	entryType string
+	entryID   string
+}
+
+// registrySyncPoint is the Epoch and Version of a remote Node's tables last applied locally.  When the Node
+// disconnects, the entries removed with it are retained so a resync only needs the changes made since.
+type registrySyncPoint struct {
+	epoch           string
+	version         uint64
+	updated         time.Time
+	retainedEntries *TopologySnapshot
+}
+
+// recordChange bumps the table version and appends a change to the history; caller must hold tableLock
+func (tt *TopologyTracker) recordChange(cmd string, entryType string, entryID string) {
+	tt.tableVersion++
+	tt.changeHistory = append(tt.changeHistory, topologyChange{tt.tableVersion, cmd, entryType, entryID})
+	if overflow := len(tt.changeHistory) - tt.ChangeHistorySize; overflow > 0 {
+		tt.changeHistory = append([]topologyChange{}, tt.changeHistory[overflow:]...)
+	}
+}
+
+// GetRegistryDelta returns the table changes since a version, or a full dump if the epoch does not match or the
+// history no longer reaches back that far.  The local Node entry is always included so the caller can restore it
+// after a disconnect.
+func (tt *TopologyTracker) GetRegistryDelta(requestingNodeID *string, sinceEpoch string, sinceVersion uint64) RegistryDelta {
+	thisTopologyTracker := tt
+	thisNode := thisTopologyTracker.drpNode
+
+	tt.tableLock.RLock()
+	defer tt.tableLock.RUnlock()
+
+	registryDelta := RegistryDelta{thisTopologyTracker.registryEpoch, thisTopologyTracker.tableVersion, false, make(map[string]*NodeTableEntry), make(map[string]*ServiceTableEntry), []string{}, []string{}}
+
+	historyStart := thisTopologyTracker.tableVersion + 1
+	if len(thisTopologyTracker.changeHistory) > 0 {
+		historyStart = thisTopologyTracker.changeHistory[0].version
+	}
+	if sinceEpoch != thisTopologyTracker.registryEpoch || sinceVersion+1 < historyStart || sinceVersion > thisTopologyTracker.tableVersion {
+		fullRegistry := thisTopologyTracker.getRegistry(requestingNodeID)
+		registryDelta.Full = true
+		registryDelta.NodeTable = fullRegistry.NodeTable
+		registryDelta.ServiceTable = fullRegistry.ServiceTable
+		return registryDelta
+	}
+
+	// Only the latest change to each entry matters
+	latestChanges := make(map[string]topologyChange)
+	for _, thisChange := range thisTopologyTracker.changeHistory {
+		if thisChange.version > sinceVersion {
+			latestChanges[topologyEntryKey(thisChange.entryType, thisChange.entryID)] = thisChange
+		}
+	}
+
+	for _, thisChange := range latestChanges {
+		if thisChange.cmd == "delete" {
+			if thisChange.entryType == "node" {
+				registryDelta.DeletedNodes = append(registryDelta.DeletedNodes, thisChange.entryID)
+			} else {
+				registryDelta.DeletedServices = append(registryDelta.DeletedServices, thisChange.entryID)
+			}
+			continue
+		}
+		if thisTopologyTracker.isUnverified(thisChange.entryType, thisChange.entryID) {
+			continue
+		}
+		switch thisChange.entryType {
+		case "node":
+			if nodeTableEntry, ok := (*thisTopologyTracker.nodeTable)[thisChange.entryID]; ok && thisTopologyTracker.AdvertiseOutCheckNode(nodeTableEntry, requestingNodeID) {
+				registryDelta.NodeTable[thisChange.entryID] = nodeTableEntry.Clone()
+			}
+		case "service":
+			if serviceTableEntry, ok := (*thisTopologyTracker.serviceTable)[thisChange.entryID]; ok && thisTopologyTracker.AdvertiseOutCheckService(serviceTableEntry, requestingNodeID) {
+				registryDelta.ServiceTable[thisChange.entryID] = serviceTableEntry.Clone()
+			}
+		}
+	}
+
+	if localNodeEntry, ok := (*thisTopologyTracker.nodeTable)[thisNode.NodeID]; ok {
+		registryDelta.NodeTable[thisNode.NodeID] = localNodeEntry.Clone()
+	}
+
+	return registryDelta
+}
+
+// fetchRemoteRegistry requests the changes to a remote Node's tables since the last sync, falling back to a full
+// getRegistry dump if the remote Node does not support incremental requests
+func (tt *TopologyTracker) fetchRemoteRegistry(remoteEndpoint EndpointInterface, remoteNodeID string) *RegistryDelta {
+	thisTopologyTracker := tt
+	thisNode := thisTopologyTracker.drpNode
+
+	thisTopologyTracker.tableLock.RLock()
+	lastSyncPoint := thisTopologyTracker.registrySyncPoints[remoteNodeID]
+	skipDelta := thisTopologyTracker.noRegistryDelta[remoteNodeID]
+	thisTopologyTracker.tableLock.RUnlock()
+
+	if !skipDelta {
+		if time.Since(lastSyncPoint.updated) > thisTopologyTracker.SyncPointTTL {
+			lastSyncPoint = registrySyncPoint{}
+		}
+		deltaParams := map[string]interface{}{"reqNodeID": thisNode.NodeID, "epoch": lastSyncPoint.epoch, "version": lastSyncPoint.version}
+		returnData := remoteEndpoint.SendCmdAwait("DRP", "getRegistryDelta", deltaParams, nil, nil)
+		if returnData != nil && returnData.Payload != nil {
+			registryDelta := &RegistryDelta{}
+			err := json.Unmarshal(*returnData.Payload, registryDelta)
+			if err == nil && registryDelta.Epoch != "" {
+				if !registryDelta.Full {
+					restoreRetainedEntries(registryDelta, lastSyncPoint.retainedEntries)
+				}
+				return registryDelta
+			}
+		}
+
+		// The remote Node does not support incremental requests; go straight to a full dump from now on
+		thisNode.Log(fmt.Sprintf("Node [%s] does not support getRegistryDelta, using getRegistry", remoteNodeID), true)
+		thisTopologyTracker.tableLock.Lock()
+		thisTopologyTracker.noRegistryDelta[remoteNodeID] = true
+		thisTopologyTracker.tableLock.Unlock()
+	}
+
+	returnData := remoteEndpoint.SendCmdAwait("DRP", "getRegistry", map[string]string{"reqNodeID": thisNode.NodeID}, nil, nil)
+	if returnData == nil || returnData.Payload == nil {
+		thisNode.Log(fmt.Sprintf("No registry returned by Node [%s]", remoteNodeID), false)
+		return nil
+	}
+	registryDelta := &RegistryDelta{}
+	registryDelta.Full = true
+	err := json.Unmarshal(*returnData.Payload, registryDelta)
+	if err != nil {
+		thisNode.Log(fmt.Sprintf("ProcessNodeConnect Payload unmarshal error: %s", err), false)
+		return nil
+	}
+	return registryDelta
+}
+
+// syncCmd returns the topology command used to apply an entry from a remote registry; entries we already hold are
+// replaced by an update when the response is incremental
+func (tt *TopologyTracker) syncCmd(remoteRegistry *RegistryDelta, entryType string, entryID string) string {
+	if remoteRegistry.Full {
+		return "add"
+	}
+	if (entryType == "node" && tt.GetNodeEntry(entryID) == nil) || (entryType == "service" && tt.GetServiceEntry(entryID) == nil) {
+		return "add"
+	}
+	return "update"
+}
+
+// applySyncDeletes removes the entries deleted by a remote Node since the last sync, services first
+func (tt *TopologyTracker) applySyncDeletes(remoteRegistry *RegistryDelta, remoteNodeID string) {
+	thisTopologyTracker := tt
+	for _, serviceInstanceID := range remoteRegistry.DeletedServices {
+		if serviceTableEntry := thisTopologyTracker.GetServiceEntry(serviceInstanceID); serviceTableEntry != nil {
+			serviceDeletePacket := TopologyPacket{*serviceTableEntry.NodeID, "delete", "service", serviceInstanceID, *serviceTableEntry.Scope, *serviceTableEntry.Zone, serviceTableEntry.ToJSON(), serviceTableEntry.Sequence}
+			thisTopologyTracker.ProcessPacket(serviceDeletePacket, remoteNodeID, false)
+		}
+	}
+	for _, nodeID := range remoteRegistry.DeletedNodes {
+		if nodeTableEntry := thisTopologyTracker.GetNodeEntry(nodeID); nodeTableEntry != nil {
+			nodeDeletePacket := TopologyPacket{*nodeTableEntry.NodeID, "delete", "node", nodeID, *nodeTableEntry.Scope, *nodeTableEntry.Zone, nodeTableEntry.ToJSON(), nodeTableEntry.Sequence}
+			thisTopologyTracker.ProcessPacket(nodeDeletePacket, remoteNodeID, false)
+		}
+	}
+}
+
+// restoreRetainedEntries adds the entries removed when the remote Node disconnected back into an incremental
+// response, unless the response changes or deletes them.  They are restored as the remote Node advertises them.
+func restoreRetainedEntries(registryDelta *RegistryDelta, retainedEntries *TopologySnapshot) {
+	if retainedEntries == nil {
+		return
+	}
+	deletedEntries := make(map[string]bool)
+	for _, nodeID := range registryDelta.DeletedNodes {
+		deletedEntries[topologyEntryKey("node", nodeID)] = true
+	}
+	for _, serviceInstanceID := range registryDelta.DeletedServices {
+		deletedEntries[topologyEntryKey("service", serviceInstanceID)] = true
+	}
+	for nodeID, nodeTableEntry := range retainedEntries.NodeTable {
+		if _, ok := registryDelta.NodeTable[nodeID]; !ok && !deletedEntries[topologyEntryKey("node", nodeID)] {
+			nodeTableEntry.LearnedFrom = authoritativeSource(nodeTableEntry.TopologyTableEntry)
+			registryDelta.NodeTable[nodeID] = nodeTableEntry
+		}
+	}
+	for serviceInstanceID, serviceTableEntry := range retainedEntries.ServiceTable {
+		if _, ok := registryDelta.ServiceTable[serviceInstanceID]; !ok && !deletedEntries[topologyEntryKey("service", serviceInstanceID)] {
+			serviceTableEntry.LearnedFrom = authoritativeSource(serviceTableEntry.TopologyTableEntry)
+			registryDelta.ServiceTable[serviceInstanceID] = serviceTableEntry
+		}
+	}
+}
+
+// authoritativeSource returns the Node an entry is learned from by the Registry it is connected to: its proxy if
+// it has one, otherwise the Node itself
+func authoritativeSource(baseEntry TopologyTableEntry) *string {
+	if baseEntry.ProxyNodeID != nil && *baseEntry.ProxyNodeID != "" {
+		return cloneString(baseEntry.ProxyNodeID)
+	}
+	return cloneString(baseEntry.NodeID)
+}
+
+// setSyncPoint records the remote Node's tables as applied up to a version
+func (tt *TopologyTracker) setSyncPoint(remoteNodeID string, epoch string, version uint64) {
+	tt.tableLock.Lock()
+	defer tt.tableLock.Unlock()
+	if epoch == "" {
+		delete(tt.registrySyncPoints, remoteNodeID)
+		return
+	}
+	tt.registrySyncPoints[remoteNodeID] = registrySyncPoint{epoch, version, time.Now(), nil}
+}
+
+// retainSyncEntries keeps copies of the entries about to be removed because a Node disconnected, so reconnecting
+// to it only needs the changes made since the last sync
+func (tt *TopologyTracker) retainSyncEntries(remoteNodeID string) {
+	tt.tableLock.Lock()
+	defer tt.tableLock.Unlock()
+	thisSyncPoint, ok := tt.registrySyncPoints[remoteNodeID]
+	if !ok {
+		return
+	}
+	retainedEntries := &TopologySnapshot{make(map[string]*NodeTableEntry), make(map[string]*ServiceTableEntry)}
+	for nodeID, nodeTableEntry := range *tt.nodeTable {
+		if nodeID == remoteNodeID || derefString(nodeTableEntry.LearnedFrom) == remoteNodeID {
+			retainedEntries.NodeTable[nodeID] = nodeTableEntry.Clone()
+		}
+	}
+	for serviceInstanceID, serviceTableEntry := range *tt.serviceTable {
+		// Services are removed along with their Node
+		if retainedEntries.NodeTable[derefString(serviceTableEntry.NodeID)] != nil {
+			retainedEntries.ServiceTable[serviceInstanceID] = serviceTableEntry.Clone()
+		}
+	}
+	thisSyncPoint.updated = time.Now()
+	thisSyncPoint.retainedEntries = retainedEntries
+	tt.registrySyncPoints[remoteNodeID] = thisSyncPoint
+}
+
+// pruneSyncPoints discards sync points older than the TTL; caller must hold tableLock
+func (tt *TopologyTracker) pruneSyncPoints(syncPointTTL time.Duration) {
+	for remoteNodeID, thisSyncPoint := range tt.registrySyncPoints {
+		if time.Since(thisSyncPoint.updated) > syncPointTTL {
+			delete(tt.registrySyncPoints, remoteNodeID)
+		}
+	}
+}
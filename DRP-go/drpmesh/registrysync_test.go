@@ -0,0 +1,214 @@
+package drpmesh
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRegistryDelta(t *testing.T) {
+	localNodeID := "registry1"
+	requestingNodeID := "provider9"
+	thisNode := testNode(t, testNodeOptions("Registry", localNodeID))
+	thisTopologyTracker := thisNode.TopologyTracker
+
+	// An unknown epoch gets a full dump
+	fullDelta := thisTopologyTracker.GetRegistryDelta(&requestingNodeID, "", 0)
+	if !fullDelta.Full || len(fullDelta.NodeTable) != 1 || len(fullDelta.ServiceTable) != 1 {
+		t.Fatalf("expected full dump with the local Node and DRP service, got %+v", fullDelta)
+	}
+
+	nodeID := "provider1"
+	nodeEntry := testNodeEntry(nodeID)
+	keepServiceEntry := testServiceEntry(nodeID, "KeepService")
+	dropServiceEntry := testServiceEntry(nodeID, "DropService")
+	thisTopologyTracker.ProcessPacket(TopologyPacket{nodeID, "add", "node", nodeID, *nodeEntry.Scope, *nodeEntry.Zone, nodeEntry.ToJSON(), 0}, nodeID, false)
+	thisTopologyTracker.ProcessPacket(TopologyPacket{nodeID, "add", "service", *keepServiceEntry.InstanceID, *keepServiceEntry.Scope, *keepServiceEntry.Zone, keepServiceEntry.ToJSON(), 0}, nodeID, false)
+	thisTopologyTracker.ProcessPacket(TopologyPacket{nodeID, "add", "service", *dropServiceEntry.InstanceID, *dropServiceEntry.Scope, *dropServiceEntry.Zone, dropServiceEntry.ToJSON(), 0}, nodeID, false)
+	thisTopologyTracker.ProcessPacket(TopologyPacket{nodeID, "delete", "service", *dropServiceEntry.InstanceID, *dropServiceEntry.Scope, *dropServiceEntry.Zone, dropServiceEntry.ToJSON(), 0}, nodeID, false)
+
+	// Only the changes since the full dump are returned, along with the local Node entry
+	changeDelta := thisTopologyTracker.GetRegistryDelta(&requestingNodeID, fullDelta.Epoch, fullDelta.Version)
+	if changeDelta.Full {
+		t.Fatalf("expected incremental response")
+	}
+	if _, ok := changeDelta.NodeTable[nodeID]; !ok || changeDelta.NodeTable[localNodeID] == nil || len(changeDelta.NodeTable) != 2 {
+		t.Errorf("expected changed Node and local Node, got %v", GetKeys(changeDelta.NodeTable))
+	}
+	if _, ok := changeDelta.ServiceTable[*keepServiceEntry.InstanceID]; !ok || len(changeDelta.ServiceTable) != 1 {
+		t.Errorf("expected only KeepService to be returned, got %v", GetKeys(changeDelta.ServiceTable))
+	}
+	if len(changeDelta.DeletedServices) != 1 || changeDelta.DeletedServices[0] != *dropServiceEntry.InstanceID {
+		t.Errorf("expected DropService to be reported deleted, got %v", changeDelta.DeletedServices)
+	}
+
+	// History which no longer reaches back far enough falls back to a full dump
+	thisTopologyTracker.tableLock.Lock()
+	thisTopologyTracker.ChangeHistorySize = 1
+	thisTopologyTracker.recordChange("update", "node", nodeID)
+	thisTopologyTracker.tableLock.Unlock()
+	if truncatedDelta := thisTopologyTracker.GetRegistryDelta(&requestingNodeID, fullDelta.Epoch, fullDelta.Version); !truncatedDelta.Full {
+		t.Errorf("expected full dump once history is truncated")
+	}
+}
+
+// testSyncedRegistries connects registry1 to registry2, which has a Provider with Worker and Cache services
+func testSyncedRegistries(t *testing.T) (*Node, *Node) {
+	t.Helper()
+	localNode := testNode(t, testNodeOptions("Registry", "registry1"))
+	remoteOptions := testNodeOptions("Registry", "registry2")
+	remoteOptions.HostID = "host2"
+	remoteNode := testNode(t, remoteOptions)
+	// Sequenced entries, so late relays of the initial exchange can not undo later deletes
+	providerEntry := testNodeEntry("provider1")
+	remoteNode.TopologyTracker.ProcessPacket(TopologyPacket{"provider1", "add", "node", "provider1", *providerEntry.Scope, *providerEntry.Zone, providerEntry.ToJSON(), 1}, "provider1", false)
+	for _, serviceName := range []string{"Worker", "Cache"} {
+		serviceEntry := testServiceEntry("provider1", serviceName)
+		remoteNode.TopologyTracker.ProcessPacket(TopologyPacket{"provider1", "add", "service", *serviceEntry.InstanceID, *serviceEntry.Scope, *serviceEntry.Zone, serviceEntry.ToJSON(), 1}, "provider1", false)
+	}
+	remoteServer := httptest.NewServer(remoteNode)
+	t.Cleanup(remoteServer.Close)
+
+	localNode.ConnectToRegistry(testWebSocketURL(remoteServer), nil, nil)
+	waitFor(t, "registry1 to learn the Provider", func() bool {
+		return localNode.TopologyTracker.GetServiceEntry("provider1-Cache") != nil
+	})
+	return localNode, remoteNode
+}
+
+// testReconnect processes a disconnect from registry2 followed by a new connection over the same Endpoint
+func testReconnect(localNode *Node, beforeReconnect func()) {
+	remoteEndpoint := localNode.GetNodeEndpoint("registry2")
+	localNode.TopologyTracker.ProcessNodeDisconnect("registry2")
+	if beforeReconnect != nil {
+		beforeReconnect()
+	}
+	remoteDeclaration := &NodeDeclaration{NodeID: "registry2", NodeRoles: []string{"Registry"}, HostID: "host2", DomainName: "test.domain", Zone: "zone1"}
+	localNode.TopologyTracker.ProcessNodeConnect(remoteEndpoint, remoteDeclaration, false)
+}
+
+func TestRegistrySyncPointRetention(t *testing.T) {
+	localNode, remoteNode := testSyncedRegistries(t)
+	localTopologyTracker := localNode.TopologyTracker
+	remoteTopologyTracker := remoteNode.TopologyTracker
+
+	// unloggedEntry is put straight into registry2's tables, so only a full dump carries it
+	unloggedEntry := testNodeEntry("provider9")
+	addUnlogged := func() {
+		remoteTopologyTracker.tableLock.Lock()
+		remoteTopologyTracker.nodeTable.AddEntry("provider9", unloggedEntry.Clone(), remoteNode.GetTimestamp())
+		remoteTopologyTracker.tableLock.Unlock()
+	}
+
+	// While disconnected, registry2 loses a service and gains a Provider
+	testReconnect(localNode, func() {
+		if localTopologyTracker.GetNodeEntry("provider1") != nil || localTopologyTracker.GetNodeEntry("registry2") != nil {
+			t.Fatalf("expected the entries learned from registry2 to be removed on disconnect")
+		}
+		cacheEntry := testServiceEntry("provider1", "Cache")
+		remoteTopologyTracker.ProcessPacket(TopologyPacket{"provider1", "delete", "service", *cacheEntry.InstanceID, *cacheEntry.Scope, *cacheEntry.Zone, cacheEntry.ToJSON(), 2}, "provider1", false)
+		addTestProvider(remoteTopologyTracker, "provider2", "zone1", "Worker")
+		addUnlogged()
+	})
+
+	// The reconnect is incremental: the retained entries come back alongside the changes
+	if localTopologyTracker.GetNodeEntry("provider9") != nil {
+		t.Fatalf("expected an incremental resync, but got the unlogged entry of a full dump")
+	}
+	for _, nodeID := range []string{"registry2", "provider1", "provider2"} {
+		if nodeEntry := localTopologyTracker.GetNodeEntry(nodeID); nodeEntry == nil || derefString(nodeEntry.LearnedFrom) != "registry2" {
+			t.Fatalf("expected Node [%s] to be learned from registry2, got %v", nodeID, nodeEntry)
+		}
+	}
+	for _, instanceID := range []string{"provider1-Worker", "provider2-Worker"} {
+		if localTopologyTracker.GetServiceEntry(instanceID) == nil {
+			t.Fatalf("expected service [%s] after the resync", instanceID)
+		}
+	}
+	if localTopologyTracker.GetServiceEntry("provider1-Cache") != nil {
+		t.Fatalf("expected the service deleted while disconnected not to be restored")
+	}
+
+	// A sync point older than the TTL is ignored, so the next reconnect is a full dump
+	localTopologyTracker.SyncPointTTL = 50 * time.Millisecond
+	testReconnect(localNode, func() { time.Sleep(100 * time.Millisecond) })
+	if localTopologyTracker.GetNodeEntry("provider9") == nil || localTopologyTracker.GetServiceEntry("provider2-Worker") == nil {
+		t.Fatalf("expected a full dump once the sync point expired")
+	}
+
+	// The WatchDog discards expired sync points
+	time.Sleep(100 * time.Millisecond)
+	localTopologyTracker.WatchDog(0)
+	localTopologyTracker.tableLock.RLock()
+	_, syncPointKept := localTopologyTracker.registrySyncPoints["registry2"]
+	localTopologyTracker.tableLock.RUnlock()
+	if syncPointKept {
+		t.Fatalf("expected the expired sync point to be pruned")
+	}
+}
+
+func TestRegistryDeltaFallback(t *testing.T) {
+	localNode := testNode(t, testNodeOptions("Registry", "registry1"))
+	peerTopologyTracker := testNode(t, testNodeOptions("Registry", "registry2")).TopologyTracker
+	addTestProvider(peerTopologyTracker, "provider1", "zone1", "Worker")
+
+	// registry2 answers like a Node.js Registry, which has no getRegistryDelta
+	peerEndpoint, peerConn := testEndpointPair(t, localNode, "registry2")
+	var methodLock sync.Mutex
+	calledMethods := []string{}
+	go func() {
+		for {
+			_, cmdBytes, err := peerConn.ReadMessage()
+			if err != nil {
+				return
+			}
+			cmdPacket := &PacketIn{}
+			if json.Unmarshal(cmdBytes, cmdPacket) != nil || cmdPacket.Type != "cmd" {
+				continue
+			}
+			methodLock.Lock()
+			calledMethods = append(calledMethods, *cmdPacket.Method)
+			methodLock.Unlock()
+			replyPacket := &ReplyOut{}
+			replyPacket.Type = "reply"
+			replyPacket.Token = cmdPacket.Token
+			if *cmdPacket.Method == "getRegistry" {
+				replyPacket.Status = 1
+				replyPacket.Payload = peerTopologyTracker.GetRegistry(nil)
+			} else {
+				replyPacket.Payload = fmt.Sprintf("method [%s] not found", *cmdPacket.Method)
+			}
+			peerConn.WriteMessage(websocket.TextMessage, replyPacket.ToJSON())
+		}
+	}()
+	takeMethods := func() string {
+		methodLock.Lock()
+		defer methodLock.Unlock()
+		methodList := strings.Join(calledMethods, ",")
+		calledMethods = []string{}
+		return methodList
+	}
+
+	// The first request falls back to a full dump
+	remoteRegistry := localNode.TopologyTracker.fetchRemoteRegistry(peerEndpoint, "registry2")
+	if remoteRegistry == nil || !remoteRegistry.Full || remoteRegistry.ServiceTable["provider1-Worker"] == nil {
+		t.Fatalf("expected a full dump from getRegistry, got %+v", remoteRegistry)
+	}
+	if calledMethods := takeMethods(); calledMethods != "getRegistryDelta,getRegistry" {
+		t.Fatalf("expected one delta request then a full request, got [%s]", calledMethods)
+	}
+
+	// Later requests go straight to the full dump
+	if remoteRegistry := localNode.TopologyTracker.fetchRemoteRegistry(peerEndpoint, "registry2"); remoteRegistry == nil || !remoteRegistry.Full {
+		t.Fatalf("expected a full dump, got %+v", remoteRegistry)
+	}
+	if calledMethods := takeMethods(); calledMethods != "getRegistry" {
+		t.Fatalf("expected only a full request, got [%s]", calledMethods)
+	}
+}
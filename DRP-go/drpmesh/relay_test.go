@@ -0,0 +1,47 @@
+package drpmesh
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRelayRegistersNonListeningNode(t *testing.T) {
+	relayNode := testNode(t, testNodeOptions("Relay", "relay1"))
+	relayServer := httptest.NewServer(relayNode)
+	defer relayServer.Close()
+
+	// A Node without a listening URL registers with the mesh through its Relay
+	providerOptions := testNodeOptions("Provider", "provider1")
+	providerOptions.RelayURL = testWebSocketURL(relayServer)
+	providerNode := testNode(t, providerOptions)
+	providerNode.WatchDogInterval = 0
+	controlPlaneConnected := false
+	providerNode.ConnectToMesh(func() {
+		controlPlaneConnected = true
+	})
+	if !controlPlaneConnected || !providerNode.ConnectedToControlPlane {
+		t.Fatalf("expected the Relay to serve as the Node's control plane")
+	}
+
+	// The Relay advertises the Node as proxied by itself
+	waitFor(t, "the Relay to learn the Node", func() bool {
+		return relayNode.TopologyTracker.GetNodeEntry("provider1") != nil
+	})
+	proxiedEntry := relayNode.TopologyTracker.GetNodeEntry("provider1")
+	if !proxiedEntry.UsesProxy() || *proxiedEntry.ProxyNodeID != "relay1" {
+		t.Fatalf("expected the Node to be proxied by the Relay, got %v", proxiedEntry.ProxyNodeID)
+	}
+	if !relayNode.IsProxyFor("provider1") {
+		t.Fatalf("expected the Relay to be the proxy for the Node")
+	}
+
+	// The Relay URL can be changed and cleared without touching the field
+	providerNode.SetRelayURL("ws://relay2:8080")
+	if providerNode.RelayURL == nil || *providerNode.RelayURL != "ws://relay2:8080" {
+		t.Fatalf("expected the Relay URL to be set")
+	}
+	providerNode.SetRelayURL("")
+	if providerNode.RelayURL != nil {
+		t.Fatalf("expected the Relay URL to be cleared")
+	}
+}
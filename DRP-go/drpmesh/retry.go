@@ -0,0 +1,285 @@
+package drpmesh
+
+import (
+	"sync"
+	"time"
+)
+
+// CallError codes describe why a ServiceCmd attempt failed
+const (
+	CallErrorNoInstance  = "noInstance"
+	CallErrorUnreachable = "unreachable"
+	CallErrorFailed      = "failed"
+	CallErrorTimeout     = "timeout"
+	CallErrorCircuitOpen = "circuitOpen"
+)
+
+// RetryPolicy controls how ServiceCmd retries failed calls on other instances of a service.  Any failure of an
+// idempotent method is retried; other methods are only retried for the listed error codes.  An IdempotentMethods
+// entry of "*" marks every method idempotent.  A zero AttemptTimeout waits for a reply up to the TopologyTracker's
+// CallTimeout, except for calls to the DRP service, which wait unless the DRP service is given an AttemptTimeout.
+type RetryPolicy struct {
+	MaxAttempts       int
+	AttemptTimeout    time.Duration
+	InitialBackoff    time.Duration
+	MaxBackoff        time.Duration
+	BackoffMultiplier float64
+	IdempotentMethods []string
+	RetryOn           []string
+}
+
+// DefaultRetryPolicy returns the policy used for services without one of their own; it only retries calls which
+// were never delivered
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{2, 0, 100 * time.Millisecond, 2 * time.Second, 2.0, []string{}, []string{CallErrorUnreachable, CallErrorCircuitOpen}}
+}
+
+// ShouldRetry tells whether or not a failed attempt of a method may be retried
+func (rp RetryPolicy) ShouldRetry(method string, errorCode string) bool {
+	if errorCode == "" || errorCode == CallErrorNoInstance {
+		return false
+	}
+	for _, idempotentMethod := range rp.IdempotentMethods {
+		if idempotentMethod == "*" || idempotentMethod == method {
+			return true
+		}
+	}
+	for _, retryCode := range rp.RetryOn {
+		if retryCode == errorCode {
+			return true
+		}
+	}
+	return false
+}
+
+// nextBackoff returns the delay before the attempt after one which waited lastBackoff
+func (rp RetryPolicy) nextBackoff(lastBackoff time.Duration) time.Duration {
+	nextBackoff := time.Duration(float64(lastBackoff) * rp.BackoffMultiplier)
+	if nextBackoff > rp.MaxBackoff {
+		nextBackoff = rp.MaxBackoff
+	}
+	return nextBackoff
+}
+
+// SetRetryPolicy sets the retry policy for a service; nil restores the default
+func (tt *TopologyTracker) SetRetryPolicy(serviceName string, retryPolicy *RetryPolicy) {
+	tt.retryPolicyLock.Lock()
+	defer tt.retryPolicyLock.Unlock()
+	if retryPolicy == nil {
+		delete(tt.retryPolicies, serviceName)
+		return
+	}
+	tt.retryPolicies[serviceName] = *retryPolicy
+}
+
+// SetDefaultRetryPolicy sets the retry policy for services without one of their own
+func (tt *TopologyTracker) SetDefaultRetryPolicy(retryPolicy RetryPolicy) {
+	tt.retryPolicyLock.Lock()
+	defer tt.retryPolicyLock.Unlock()
+	tt.defaultRetryPolicy = retryPolicy
+}
+
+// GetRetryPolicy returns the retry policy for a service
+func (tt *TopologyTracker) GetRetryPolicy(serviceName string) RetryPolicy {
+	tt.retryPolicyLock.RLock()
+	defer tt.retryPolicyLock.RUnlock()
+	if retryPolicy, ok := tt.retryPolicies[serviceName]; ok {
+		return retryPolicy
+	}
+	return tt.defaultRetryPolicy
+}
+
+// awaitCmdResponse sends a command and waits for the reply, giving up after the timeout if one is set
+func awaitCmdResponse(routeNodeConnection EndpointInterface, serviceName string, method string, params interface{}, routeOptions *RouteOptions, serviceInstanceID *string, attemptTimeout time.Duration) (*ReplyIn, string) {
+	cmdResponse := routeNodeConnection.SendCmdAwaitTimeout(serviceName, method, params, routeOptions, serviceInstanceID, attemptTimeout)
+	if cmdResponse == nil && attemptTimeout > 0 && !routeNodeConnection.baseEndpoint().isClosed() {
+		return nil, CallErrorTimeout
+	}
+	if cmdResponse == nil || cmdResponse.Status == 0 {
+		return cmdResponse, CallErrorFailed
+	}
+	return cmdResponse, ""
+}
+
+// Circuit breaker states
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "halfOpen"
+)
+
+// CircuitBreakerPolicy controls when calls to a service instance are stopped.  The circuit opens after
+// FailureThreshold consecutive failures; after Cooldown it half-opens and lets HalfOpenRequests trial calls through.
+// A successful trial closes the circuit and a failed one opens it again.  A zero FailureThreshold disables the
+// breaker.
+type CircuitBreakerPolicy struct {
+	FailureThreshold int
+	Cooldown         time.Duration
+	HalfOpenRequests int
+}
+
+// DefaultCircuitBreakerPolicy returns the policy used for services without one of their own
+func DefaultCircuitBreakerPolicy() CircuitBreakerPolicy {
+	return CircuitBreakerPolicy{5, 30 * time.Second, 1}
+}
+
+// circuitState tracks the circuit to a service instance
+type circuitState struct {
+	state            string
+	failures         int
+	openedAt         time.Time
+	trialsInProgress int
+}
+
+// CircuitBreakerTable holds the circuit breakers for the service instances this Node calls
+type CircuitBreakerTable struct {
+	circuits        map[string]*circuitState
+	servicePolicies map[string]CircuitBreakerPolicy
+	defaultPolicy   CircuitBreakerPolicy
+	tableLock       sync.Mutex
+}
+
+// SetPolicy sets the circuit breaker policy for a service; nil restores the default
+func (cbt *CircuitBreakerTable) SetPolicy(serviceName string, breakerPolicy *CircuitBreakerPolicy) {
+	cbt.tableLock.Lock()
+	defer cbt.tableLock.Unlock()
+	if cbt.servicePolicies == nil {
+		cbt.servicePolicies = make(map[string]CircuitBreakerPolicy)
+	}
+	if breakerPolicy == nil {
+		delete(cbt.servicePolicies, serviceName)
+		return
+	}
+	cbt.servicePolicies[serviceName] = *breakerPolicy
+}
+
+// SetDefaultPolicy sets the circuit breaker policy for services without one of their own
+func (cbt *CircuitBreakerTable) SetDefaultPolicy(breakerPolicy CircuitBreakerPolicy) {
+	cbt.tableLock.Lock()
+	defer cbt.tableLock.Unlock()
+	cbt.defaultPolicy = breakerPolicy
+}
+
+// getPolicy returns the circuit breaker policy for a service; caller must hold tableLock
+func (cbt *CircuitBreakerTable) getPolicy(serviceName string) CircuitBreakerPolicy {
+	if breakerPolicy, ok := cbt.servicePolicies[serviceName]; ok {
+		return breakerPolicy
+	}
+	return cbt.defaultPolicy
+}
+
+// getCircuit returns the circuit for an instance, creating a closed one if needed; caller must hold tableLock
+func (cbt *CircuitBreakerTable) getCircuit(serviceInstanceID string) *circuitState {
+	if cbt.circuits == nil {
+		cbt.circuits = make(map[string]*circuitState)
+	}
+	thisCircuit, ok := cbt.circuits[serviceInstanceID]
+	if !ok {
+		thisCircuit = &circuitState{CircuitClosed, 0, time.Time{}, 0}
+		cbt.circuits[serviceInstanceID] = thisCircuit
+	}
+	return thisCircuit
+}
+
+// IsOpen tells whether or not calls to an instance would currently be refused
+func (cbt *CircuitBreakerTable) IsOpen(serviceName string, serviceInstanceID string) bool {
+	cbt.tableLock.Lock()
+	defer cbt.tableLock.Unlock()
+	thisCircuit, ok := cbt.circuits[serviceInstanceID]
+	if !ok {
+		return false
+	}
+	breakerPolicy := cbt.getPolicy(serviceName)
+	switch thisCircuit.state {
+	case CircuitOpen:
+		return time.Since(thisCircuit.openedAt) < breakerPolicy.Cooldown
+	case CircuitHalfOpen:
+		return thisCircuit.trialsInProgress >= breakerPolicy.HalfOpenRequests
+	default:
+		return false
+	}
+}
+
+// Acquire tells whether or not a call to an instance may proceed, half-opening the circuit once the cooldown has
+// passed.  Every acquired call must be followed by Record.
+func (cbt *CircuitBreakerTable) Acquire(serviceName string, serviceInstanceID string) bool {
+	cbt.tableLock.Lock()
+	defer cbt.tableLock.Unlock()
+	breakerPolicy := cbt.getPolicy(serviceName)
+	if breakerPolicy.FailureThreshold <= 0 {
+		return true
+	}
+	thisCircuit := cbt.getCircuit(serviceInstanceID)
+	if thisCircuit.state == CircuitOpen {
+		if time.Since(thisCircuit.openedAt) < breakerPolicy.Cooldown {
+			return false
+		}
+		thisCircuit.state = CircuitHalfOpen
+		thisCircuit.trialsInProgress = 0
+	}
+	if thisCircuit.state == CircuitHalfOpen {
+		if thisCircuit.trialsInProgress >= breakerPolicy.HalfOpenRequests {
+			return false
+		}
+		thisCircuit.trialsInProgress++
+	}
+	return true
+}
+
+// Record updates the circuit to an instance with the outcome of a call
+func (cbt *CircuitBreakerTable) Record(serviceName string, serviceInstanceID string, succeeded bool) {
+	cbt.tableLock.Lock()
+	defer cbt.tableLock.Unlock()
+	breakerPolicy := cbt.getPolicy(serviceName)
+	if breakerPolicy.FailureThreshold <= 0 {
+		return
+	}
+	thisCircuit := cbt.getCircuit(serviceInstanceID)
+	if thisCircuit.trialsInProgress > 0 {
+		thisCircuit.trialsInProgress--
+	}
+
+	if succeeded {
+		thisCircuit.failures = 0
+		if thisCircuit.state == CircuitHalfOpen {
+			thisCircuit.state = CircuitClosed
+		}
+		return
+	}
+
+	thisCircuit.failures++
+	if thisCircuit.state == CircuitHalfOpen || thisCircuit.failures >= breakerPolicy.FailureThreshold {
+		thisCircuit.state = CircuitOpen
+		thisCircuit.openedAt = time.Now()
+	}
+}
+
+// GetState returns the state of the circuit to an instance
+func (cbt *CircuitBreakerTable) GetState(serviceInstanceID string) string {
+	cbt.tableLock.Lock()
+	defer cbt.tableLock.Unlock()
+	if thisCircuit, ok := cbt.circuits[serviceInstanceID]; ok {
+		return thisCircuit.state
+	}
+	return CircuitClosed
+}
+
+// ListOpen returns the instances whose circuit is not closed, along with the circuit state
+func (cbt *CircuitBreakerTable) ListOpen() map[string]string {
+	cbt.tableLock.Lock()
+	defer cbt.tableLock.Unlock()
+	openList := make(map[string]string)
+	for serviceInstanceID, thisCircuit := range cbt.circuits {
+		if thisCircuit.state != CircuitClosed {
+			openList[serviceInstanceID] = thisCircuit.state
+		}
+	}
+	return openList
+}
+
+// Remove discards the circuit to a service instance
+func (cbt *CircuitBreakerTable) Remove(serviceInstanceID string) {
+	cbt.tableLock.Lock()
+	defer cbt.tableLock.Unlock()
+	delete(cbt.circuits, serviceInstanceID)
+}
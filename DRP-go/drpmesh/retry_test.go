@@ -0,0 +1,179 @@
+package drpmesh
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakers(t *testing.T) {
+	localNodeID := "registry1"
+	serviceName := "TestService"
+	thisNode := testNode(t, testNodeOptions("Registry", localNodeID))
+	thisTopologyTracker := thisNode.TopologyTracker
+
+	retryPolicy := thisTopologyTracker.GetRetryPolicy(serviceName)
+	if !retryPolicy.ShouldRetry("update", CallErrorUnreachable) || retryPolicy.ShouldRetry("update", CallErrorFailed) {
+		t.Fatalf("expected the default policy to retry only undelivered calls")
+	}
+	retryPolicy.IdempotentMethods = []string{"get"}
+	thisTopologyTracker.SetRetryPolicy(serviceName, &retryPolicy)
+	if !thisTopologyTracker.GetRetryPolicy(serviceName).ShouldRetry("get", CallErrorTimeout) {
+		t.Fatalf("expected idempotent method to be retried after a timeout")
+	}
+
+	instanceIDList := []string{}
+	for nodeIndex := 1; nodeIndex <= 2; nodeIndex++ {
+		nodeID := fmt.Sprintf("provider%d", nodeIndex)
+		nodeEntry := testNodeEntry(nodeID)
+		serviceEntry := testServiceEntry(nodeID, serviceName)
+		thisTopologyTracker.ProcessPacket(TopologyPacket{nodeID, "add", "node", nodeID, *nodeEntry.Scope, *nodeEntry.Zone, nodeEntry.ToJSON(), 0}, nodeID, false)
+		thisTopologyTracker.ProcessPacket(TopologyPacket{nodeID, "add", "service", *serviceEntry.InstanceID, *serviceEntry.Scope, *serviceEntry.Zone, serviceEntry.ToJSON(), 0}, nodeID, false)
+		instanceIDList = append(instanceIDList, *serviceEntry.InstanceID)
+	}
+
+	// Retries skip instances which already failed the call
+	excludedInstances := map[string]bool{instanceIDList[0]: true}
+	for pickCount := 0; pickCount < 10; pickCount++ {
+		if serviceEntry := thisTopologyTracker.FindStickyInstanceOfService(serviceName, "", 0, nil, nil, excludedInstances); serviceEntry == nil || *serviceEntry.InstanceID != instanceIDList[1] {
+			t.Fatalf("expected the instance which has not failed, got %v", serviceEntry)
+		}
+	}
+
+	// Failures open the circuit, which half-opens after the cooldown
+	thisTopologyTracker.CircuitBreakers.SetPolicy(serviceName, &CircuitBreakerPolicy{2, 50 * time.Millisecond, 1})
+	circuitBreakers := thisTopologyTracker.CircuitBreakers
+	for failCount := 0; failCount < 2; failCount++ {
+		circuitBreakers.Acquire(serviceName, instanceIDList[0])
+		circuitBreakers.Record(serviceName, instanceIDList[0], false)
+	}
+	if circuitBreakers.GetState(instanceIDList[0]) != CircuitOpen || circuitBreakers.Acquire(serviceName, instanceIDList[0]) {
+		t.Fatalf("expected the circuit to be open")
+	}
+	for pickCount := 0; pickCount < 10; pickCount++ {
+		if serviceEntry := thisTopologyTracker.FindInstanceOfService(&serviceName, nil, nil, nil, nil); serviceEntry == nil || *serviceEntry.InstanceID != instanceIDList[1] {
+			t.Fatalf("expected the instance with a closed circuit, got %v", serviceEntry)
+		}
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !circuitBreakers.Acquire(serviceName, instanceIDList[0]) || circuitBreakers.Acquire(serviceName, instanceIDList[0]) {
+		t.Fatalf("expected exactly one trial call once half-open")
+	}
+	circuitBreakers.Record(serviceName, instanceIDList[0], true)
+	if circuitBreakers.GetState(instanceIDList[0]) != CircuitClosed {
+		t.Fatalf("expected a successful trial to close the circuit, got %s", circuitBreakers.GetState(instanceIDList[0]))
+	}
+}
+
+func TestRetryAttemptTimeout(t *testing.T) {
+	serviceName := "Worker"
+	thisNode := testNode(t, testNodeOptions("Registry", "registry1"))
+	thisTopologyTracker := thisNode.TopologyTracker
+
+	// Calls never wait indefinitely by default; the CallTimeout is the only default deadline
+	if defaultTimeout := thisTopologyTracker.GetRetryPolicy(serviceName).AttemptTimeout; defaultTimeout != 0 || thisTopologyTracker.CallTimeout != DefaultCallTimeout || DefaultCallTimeout <= 0 {
+		t.Fatalf("expected calls to default to the CallTimeout, got AttemptTimeout %s and CallTimeout %s", defaultTimeout, thisTopologyTracker.CallTimeout)
+	}
+
+	// provider1 is preferred but never answers; provider2 answers
+	wedgedEntry := addTestProvider(thisTopologyTracker, "provider1", "zone1", serviceName)[0]
+	answeringEntry := addTestProvider(thisTopologyTracker, "provider2", "zone1", serviceName)[0]
+	answeringEntry.Priority = 20
+	thisTopologyTracker.ProcessPacket(TopologyPacket{"provider2", "update", "service", *answeringEntry.InstanceID, *answeringEntry.Scope, *answeringEntry.Zone, answeringEntry.ToJSON(), 0}, "provider2", false)
+	wedgedEndpoint := testPeerNode(t, thisNode, "provider1", func(cmdPacket *PacketIn) (interface{}, bool) {
+		return nil, false
+	})
+	answeringEndpoint := testPeerNode(t, thisNode, "provider2", func(cmdPacket *PacketIn) (interface{}, bool) {
+		return "provider2", true
+	})
+
+	// A timed out attempt is retried on the other instance and leaves no reply handler behind
+	thisTopologyTracker.SetRetryPolicy(serviceName, &RetryPolicy{2, 100 * time.Millisecond, 10 * time.Millisecond, 10 * time.Millisecond, 1, []string{"*"}, []string{}})
+	callStart := time.Now()
+	cmdResult := thisNode.ServiceCmd(serviceName, "work", &CmdParams{}, ServiceCmd_ExecParams{})
+	if cmdPayload, ok := cmdResult.(*json.RawMessage); !ok || cmdPayload == nil || string(*cmdPayload) != `"provider2"` {
+		t.Fatalf("expected provider2 to answer the retry, got %v", cmdResult)
+	}
+	if callTime := time.Since(callStart); callTime > time.Second {
+		t.Fatalf("expected the first attempt to give up after its timeout, took %s", callTime)
+	}
+	if replyCount := pendingReplyCount(wedgedEndpoint) + pendingReplyCount(answeringEndpoint); replyCount != 0 {
+		t.Fatalf("expected no reply handlers to remain, %d remain", replyCount)
+	}
+	if instanceStats := thisTopologyTracker.ServiceStats.Get(*wedgedEntry.InstanceID); instanceStats.ConsecutiveFailures != 1 || instanceStats.InFlight != 0 {
+		t.Fatalf("expected the timed out attempt to count as a failure, got %+v", instanceStats)
+	}
+}
+
+func TestDRPCallTimeout(t *testing.T) {
+	thisNode := testNode(t, testNodeOptions("Registry", "registry1"))
+	thisTopologyTracker := thisNode.TopologyTracker
+	thisTopologyTracker.CallTimeout = 50 * time.Millisecond
+
+	// provider1 is slow to answer DRP control calls
+	addTestProvider(thisTopologyTracker, "provider1", "zone1")
+	testPeerNode(t, thisNode, "provider1", func(cmdPacket *PacketIn) (interface{}, bool) {
+		time.Sleep(200 * time.Millisecond)
+		return "topology", true
+	})
+	callTopology := func() (interface{}, string) {
+		execParams := ServiceCmd_ExecParams{}
+		execParams.targetNodeID = optionalString("provider1")
+		return thisNode.serviceCmdAttempt("DRP", "getTopology", &CmdParams{}, &execParams, thisTopologyTracker.GetRetryPolicy("DRP").AttemptTimeout)
+	}
+
+	// Control calls are not cut off by the CallTimeout
+	if cmdResult, errorCode := callTopology(); errorCode != "" || cmdResult == nil {
+		t.Fatalf("expected the control call to wait for its reply, got %v [%s]", cmdResult, errorCode)
+	}
+
+	// They time out once the DRP service is given an AttemptTimeout
+	thisTopologyTracker.SetRetryPolicy("DRP", &RetryPolicy{1, 50 * time.Millisecond, 0, 0, 1, []string{}, []string{}})
+	if _, errorCode := callTopology(); errorCode != CallErrorTimeout {
+		t.Fatalf("expected the control call to time out, got [%s]", errorCode)
+	}
+}
+
+func TestCircuitBreakerHealthProbes(t *testing.T) {
+	serviceName := "Worker"
+	thisNode := testNode(t, testNodeOptions("Registry", "registry1"))
+	thisTopologyTracker := thisNode.TopologyTracker
+
+	providerEntry := addTestProvider(thisTopologyTracker, "provider1", "zone1", serviceName)[0]
+	providerEntry.HealthCheck = "health"
+	thisTopologyTracker.ProcessPacket(TopologyPacket{"provider1", "update", "service", *providerEntry.InstanceID, *providerEntry.Scope, *providerEntry.Zone, providerEntry.ToJSON(), 0}, "provider1", false)
+	var cmdLock sync.Mutex
+	receivedCmds := []string{}
+	testPeerNode(t, thisNode, "provider1", func(cmdPacket *PacketIn) (interface{}, bool) {
+		cmdLock.Lock()
+		receivedCmds = append(receivedCmds, *cmdPacket.Method)
+		cmdLock.Unlock()
+		return true, true
+	})
+
+	// Open the circuit to the instance
+	thisTopologyTracker.CircuitBreakers.SetPolicy(serviceName, &CircuitBreakerPolicy{1, time.Minute, 1})
+	thisTopologyTracker.CircuitBreakers.Acquire(serviceName, *providerEntry.InstanceID)
+	thisTopologyTracker.CircuitBreakers.Record(serviceName, *providerEntry.InstanceID, false)
+
+	// Calls are refused, but health probes still reach the instance and leave the circuit alone
+	execParams := ServiceCmd_ExecParams{}
+	execParams.targetServiceInstanceID = providerEntry.InstanceID
+	if _, errorCode := thisNode.serviceCmdAttempt(serviceName, "work", &CmdParams{}, &execParams, 0); errorCode != CallErrorCircuitOpen {
+		t.Fatalf("expected the call to be refused by the open circuit, got [%s]", errorCode)
+	}
+	if !thisTopologyTracker.CheckServiceHealth(*providerEntry.InstanceID) {
+		t.Fatalf("expected the health probe to pass through the open circuit")
+	}
+	cmdLock.Lock()
+	defer cmdLock.Unlock()
+	if fmt.Sprint(receivedCmds) != "[health]" {
+		t.Fatalf("expected only the health probe to reach the instance, got %v", receivedCmds)
+	}
+	if circuitState := thisTopologyTracker.CircuitBreakers.GetState(*providerEntry.InstanceID); circuitState != CircuitOpen {
+		t.Fatalf("expected the probe not to change the circuit, got %s", circuitState)
+	}
+}
@@ -0,0 +1,39 @@
+package drpmesh
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// serverUpgrader upgrades inbound HTTP requests to DRP websocket connections
+var serverUpgrader = websocket.Upgrader{
+	Subprotocols: []string{"drp"},
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+// ServeHTTP accepts connections from remote Nodes, so a Node can be passed to http.ListenAndServe or mounted on a
+// mux at the path of its listening URL.  A connection may only request an auth challenge and send a hello until
+// the remote Node has proven knowledge of the mesh key; the Node methods are applied once the hello is accepted.
+func (dn *Node) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	thisNode := dn
+
+	wsConn, err := serverUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		thisNode.Log(fmt.Sprintf("Could not accept connection from %s: %s", r.RemoteAddr, err), false)
+		return
+	}
+
+	newServer := &Endpoint{}
+	newServer.Init()
+	newServer.drpNode = thisNode
+	newServer.EndpointType = "Node"
+	newServer.isServer = true
+	thisNode.ApplyServerEndpointMethods(newServer)
+
+	thisNode.Log(fmt.Sprintf("Accepted connection from %s", r.RemoteAddr), true)
+	newServer.StartListening(wsConn)
+}
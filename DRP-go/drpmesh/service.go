@@ -1,6 +1,44 @@
 package drpmesh
 
-// Service is used to define a DRP service
+import (
+	"sort"
+	"sync"
+)
+
+// Service status values advertised in the ServiceTable; only Ready instances are selected for new work
+const (
+	ServiceStatusDown        = 0
+	ServiceStatusReady       = 1
+	ServiceStatusPending     = 2
+	ServiceStatusDraining    = 3
+	ServiceStatusMaintenance = 4
+	ServiceStatusUnhealthy   = 5
+)
+
+// ServiceStatusName returns the display name of a service status value
+func ServiceStatusName(status int) string {
+	switch status {
+	case ServiceStatusDown:
+		return "down"
+	case ServiceStatusReady:
+		return "ready"
+	case ServiceStatusPending:
+		return "pending"
+	case ServiceStatusDraining:
+		return "draining"
+	case ServiceStatusMaintenance:
+		return "maintenance"
+	case ServiceStatusUnhealthy:
+		return "unhealthy"
+	default:
+		return "unknown"
+	}
+}
+
+// Service is used to define a DRP service.  Services are registered with AddService by pointer and stay live;
+// changes made through Node and Service methods are advertised to the mesh.  OnStart runs before the service is
+// advertised and may refuse to start it, OnStop runs after it is withdrawn, and OnPeerChange runs when another
+// instance of the service is added, updated or removed.
 type Service struct {
 	ServiceName  string
 	DRPNode      *Node
@@ -16,15 +54,138 @@ type Service struct {
 	Status       int
 	ClientCmds   map[string]EndpointMethod
 	Classes      map[string]UMLClass
+	Labels       map[string]string
+	HealthCheck  string
+	OnStart      func(serviceObj *Service) error
+	OnStop       func(serviceObj *Service)
+	OnPeerChange func(serviceObj *Service, topologyEvent TopologyEvent)
+	topics       map[string]*SubscribableSource
+	serviceLock  sync.RWMutex
 }
 
 // AddClass add a new UMLClass to a Service
-func (ds Service) AddClass(newClass UMLClass) {
-	ds.Classes[newClass.Name] = newClass
+func (ds *Service) AddClass(newClass UMLClass) {
+	ds.applyChange(func(serviceObj *Service) {
+		if serviceObj.Classes == nil {
+			serviceObj.Classes = make(map[string]UMLClass)
+		}
+		serviceObj.Classes[newClass.Name] = newClass
+	})
+}
+
+// AddClientCmd adds or replaces a method offered by a Service and republishes its definition, which lists the
+// methods in the Service table entry
+func (ds *Service) AddClientCmd(cmdName string, cmdMethod EndpointMethod) {
+	ds.applyChange(func(serviceObj *Service) {
+		if serviceObj.ClientCmds == nil {
+			serviceObj.ClientCmds = make(map[string]EndpointMethod)
+		}
+		serviceObj.ClientCmds[cmdName] = cmdMethod
+	})
+}
+
+// RemoveClientCmd removes a method offered by a Service and republishes its definition
+func (ds *Service) RemoveClientCmd(cmdName string) {
+	ds.applyChange(func(serviceObj *Service) {
+		delete(serviceObj.ClientCmds, cmdName)
+	})
+}
+
+// GetClientCmd returns a method offered by a Service
+func (ds *Service) GetClientCmd(cmdName string) (EndpointMethod, bool) {
+	ds.serviceLock.RLock()
+	defer ds.serviceLock.RUnlock()
+	cmdMethod, ok := ds.ClientCmds[cmdName]
+	return cmdMethod, ok
+}
+
+// GetTopic returns the source Subscribers attach to for one of the Service's Streams, or nil if the Service does
+// not offer the stream
+func (ds *Service) GetTopic(topicName string) *SubscribableSource {
+	ds.serviceLock.Lock()
+	defer ds.serviceLock.Unlock()
+	offersStream := false
+	for _, streamName := range ds.Streams {
+		if streamName == topicName {
+			offersStream = true
+			break
+		}
+	}
+	if !offersStream {
+		return nil
+	}
+	if ds.topics == nil {
+		ds.topics = make(map[string]*SubscribableSource)
+	}
+	topicSource, ok := ds.topics[topicName]
+	if !ok {
+		topicSource = &SubscribableSource{ServiceName: ds.ServiceName, TopicName: topicName}
+		if ds.DRPNode != nil {
+			topicSource.NodeID = ds.DRPNode.NodeID
+		}
+		ds.topics[topicName] = topicSource
+	}
+	return topicSource
+}
+
+// Publish sends a message to every Subscriber of one of the Service's Streams
+func (ds *Service) Publish(topicName string, message interface{}) {
+	topicSource := ds.GetTopic(topicName)
+	if topicSource == nil {
+		return
+	}
+	topicSource.Send(message)
+}
+
+// terminateTopics terminates every Subscriber attached to the Service's Streams and returns the number removed
+func (ds *Service) terminateTopics(subscriptionManager *SubscriptionManager) int {
+	ds.serviceLock.Lock()
+	topicList := make([]*SubscribableSource, 0, len(ds.topics))
+	for _, topicSource := range ds.topics {
+		topicList = append(topicList, topicSource)
+	}
+	ds.topics = nil
+	ds.serviceLock.Unlock()
+
+	terminatedCount := 0
+	for _, topicSource := range topicList {
+		topicSource.subscriptionLock.Lock()
+		subscriberList := make([]*Subscriber, 0, len(topicSource.Subscriptions))
+		for thisSubscriber := range topicSource.Subscriptions {
+			subscriberList = append(subscriberList, thisSubscriber)
+		}
+		topicSource.subscriptionLock.Unlock()
+
+		for _, thisSubscriber := range subscriberList {
+			subscriptionManager.UnregisterSubscription(thisSubscriber)
+			thisSubscriber.Terminate()
+			terminatedCount++
+		}
+	}
+	return terminatedCount
+}
+
+// applyChange changes a Service, advertising the change to the mesh if the Service is registered
+func (ds *Service) applyChange(changeFunc func(*Service)) {
+	// AddService sets these under serviceLock
+	ds.serviceLock.RLock()
+	drpNode := ds.DRPNode
+	instanceID := ds.InstanceID
+	ds.serviceLock.RUnlock()
+
+	if drpNode != nil && drpNode.GetLocalService(instanceID) == ds {
+		drpNode.updateServiceInstance(instanceID, changeFunc)
+		return
+	}
+	ds.serviceLock.Lock()
+	defer ds.serviceLock.Unlock()
+	changeFunc(ds)
 }
 
 // GetDefinition returns information about this Service for discovery
-func (ds Service) GetDefinition() ServiceDefinition {
+func (ds *Service) GetDefinition() ServiceDefinition {
+	ds.serviceLock.RLock()
+	defer ds.serviceLock.RUnlock()
 	classList := GetKeys(ds.Classes)
 	clientCmdList := GetKeys(ds.ClientCmds)
 	returnDef := ServiceDefinition{
@@ -33,13 +194,52 @@ func (ds Service) GetDefinition() ServiceDefinition {
 		ds.Type,
 		classList,
 		clientCmdList,
-		ds.Streams,
+		cloneStrings(ds.Streams),
 	}
 	return returnDef
 }
 
+// GetTableEntry returns a ServiceTableEntry describing this Service for topology advertisement
+func (ds *Service) GetTableEntry() ServiceTableEntry {
+	ds.serviceLock.RLock()
+	defer ds.serviceLock.RUnlock()
+	return ds.getTableEntry()
+}
+
+// getTableEntry returns a ServiceTableEntry describing this Service; caller must hold serviceLock
+func (ds *Service) getTableEntry() ServiceTableEntry {
+	newServiceEntry := ServiceTableEntry{}
+	newServiceEntry.NodeID = cloneString(&ds.DRPNode.NodeID)
+	newServiceEntry.ProxyNodeID = nil
+	newServiceEntry.Scope = cloneString(&ds.Scope)
+	newServiceEntry.Zone = cloneString(&ds.Zone)
+	newServiceEntry.LearnedFrom = cloneString(&ds.DRPNode.NodeID)
+	newServiceEntry.LastModified = nil
+	newServiceEntry.Name = cloneString(&ds.ServiceName)
+	newServiceEntry.Type = cloneString(&ds.Type)
+	newServiceEntry.InstanceID = cloneString(&ds.InstanceID)
+	newServiceEntry.Sticky = ds.Sticky
+	newServiceEntry.Priority = ds.Priority
+	newServiceEntry.Weight = ds.Weight
+	newServiceEntry.Dependencies = cloneStrings(ds.Dependencies)
+	newServiceEntry.Streams = cloneStrings(ds.Streams)
+	newServiceEntry.Status = ds.Status
+	newServiceEntry.Labels = cloneLabels(ds.Labels)
+	newServiceEntry.HealthCheck = ds.HealthCheck
+	newServiceEntry.ClientCmds = GetKeys(ds.ClientCmds)
+	sort.Strings(newServiceEntry.ClientCmds)
+	return newServiceEntry
+}
+
+// GetStatus returns the status the Service currently advertises
+func (ds *Service) GetStatus() int {
+	ds.serviceLock.RLock()
+	defer ds.serviceLock.RUnlock()
+	return ds.Status
+}
+
 // PeerBroadcast sends a message to service peers
-func (ds Service) PeerBroadcast(method string, params interface{}) {
+func (ds *Service) PeerBroadcast(method string, params interface{}) {
 	// Get list of peer service IDs
 	var peerServiceIDList = ds.DRPNode.TopologyTracker.FindServicePeers(ds.InstanceID)
 	for _, peerServiceID := range peerServiceIDList {
@@ -51,6 +251,26 @@ func (ds Service) PeerBroadcast(method string, params interface{}) {
 	}
 }
 
+// watchServicePeers runs the OnPeerChange hooks of local services when another instance of the service changes
+func (dn *Node) watchServicePeers() {
+	thisNode := dn
+	thisNode.TopologyTracker.Subscribe(TopologyEventFilter{Type: "service"}, func(topologyEvent TopologyEvent) {
+		if topologyEvent.ServiceEntry == nil || topologyEvent.ServiceEntry.Name == nil {
+			return
+		}
+		for _, serviceInstanceID := range thisNode.GetLocalInstanceIDs(*topologyEvent.ServiceEntry.Name) {
+			serviceObj := thisNode.GetLocalService(serviceInstanceID)
+			if serviceObj == nil || serviceInstanceID == topologyEvent.ID || serviceObj.OnPeerChange == nil {
+				continue
+			}
+			if topologyEvent.ServiceEntry.Type != nil && *topologyEvent.ServiceEntry.Type != serviceObj.Type {
+				continue
+			}
+			serviceObj.OnPeerChange(serviceObj, topologyEvent)
+		}
+	})
+}
+
 // ServiceDefinition is used for advertising service definitions
 type ServiceDefinition struct {
 	InstanceID string
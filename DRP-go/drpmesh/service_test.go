@@ -0,0 +1,242 @@
+package drpmesh
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestServiceStatusPriorityWeight(t *testing.T) {
+	localNodeID := "registry1"
+	serviceName := "Worker"
+	thisNode := testNode(t, testNodeOptions("Registry", localNodeID))
+	thisTopologyTracker := thisNode.TopologyTracker
+
+	// A connected Provider receives every change to local services
+	peerNodeID := "provider1"
+	peerNodeEntry := testNodeEntry(peerNodeID)
+	thisTopologyTracker.ProcessPacket(TopologyPacket{peerNodeID, "add", "node", peerNodeID, *peerNodeEntry.Scope, *peerNodeEntry.Zone, peerNodeEntry.ToJSON(), 0}, peerNodeID, false)
+	peerEndpoint := newRecordingEndpoint(thisNode, peerNodeID)
+	thisNode.setNodeEndpoint(peerNodeID, peerEndpoint)
+
+	workerService := &Service{ServiceName: serviceName, Type: serviceName, Priority: 10, Weight: 10, Zone: "zone1", Scope: "zone", Status: ServiceStatusReady}
+	instanceID := thisNode.AddService(workerService)
+	if addPackets := peerEndpoint.topologyPackets(); len(addPackets) != 1 || addPackets[0].Cmd != "add" {
+		t.Fatalf("expected one add packet for the new service, got %v", addPackets)
+	}
+
+	// checkAdvertised verifies the local table and the packet relayed to the peer carry the change
+	lastSequence := thisTopologyTracker.GetServiceEntry(instanceID).Sequence
+	checkAdvertised := func(status int, priority uint, weight uint) {
+		t.Helper()
+		tableEntry := thisTopologyTracker.GetServiceEntry(instanceID)
+		if tableEntry.Status != status || tableEntry.Priority != priority || tableEntry.Weight != weight {
+			t.Fatalf("expected table entry status %d priority %d weight %d, got %d %d %d", status, priority, weight, tableEntry.Status, tableEntry.Priority, tableEntry.Weight)
+		}
+		if tableEntry.Sequence <= lastSequence {
+			t.Fatalf("expected the sequence to advance past %d, got %d", lastSequence, tableEntry.Sequence)
+		}
+		lastSequence = tableEntry.Sequence
+
+		updatePackets := peerEndpoint.topologyPackets()
+		if len(updatePackets) != 1 || updatePackets[0].Cmd != "update" || updatePackets[0].ID != instanceID {
+			t.Fatalf("expected one update packet for the instance, got %v", updatePackets)
+		}
+		relayedEntry := &ServiceTableEntry{}
+		json.Unmarshal(updatePackets[0].Data, relayedEntry)
+		if relayedEntry.Status != status || relayedEntry.Priority != priority || relayedEntry.Weight != weight {
+			t.Fatalf("expected relayed status %d priority %d weight %d, got %d %d %d", status, priority, weight, relayedEntry.Status, relayedEntry.Priority, relayedEntry.Weight)
+		}
+	}
+
+	// Draining instances are advertised but not selected for new work
+	if !thisNode.SetServiceStatus(serviceName, ServiceStatusDraining) {
+		t.Fatalf("expected the status change to succeed")
+	}
+	checkAdvertised(ServiceStatusDraining, 10, 10)
+	if selectedEntry := thisTopologyTracker.FindInstanceOfService(&serviceName, nil, nil, nil, nil); selectedEntry != nil {
+		t.Fatalf("expected no instance to be selected while draining, got %s", *selectedEntry.InstanceID)
+	}
+
+	thisNode.SetServicePriority(serviceName, 5)
+	checkAdvertised(ServiceStatusDraining, 5, 10)
+	thisNode.SetServiceWeight(serviceName, 30)
+	checkAdvertised(ServiceStatusDraining, 5, 30)
+
+	thisNode.SetInstanceStatus(instanceID, ServiceStatusReady)
+	checkAdvertised(ServiceStatusReady, 5, 30)
+	if selectedEntry := thisTopologyTracker.FindInstanceOfService(&serviceName, nil, nil, nil, nil); selectedEntry == nil || *selectedEntry.InstanceID != instanceID {
+		t.Fatalf("expected the instance to be selected once ready again, got %v", selectedEntry)
+	}
+
+	// Unknown services are refused without advertising anything
+	if thisNode.SetServiceStatus("Missing", ServiceStatusReady) || thisNode.SetServiceWeight("Missing", 1) {
+		t.Fatalf("expected changes to an unknown service to fail")
+	}
+	if strayPackets := peerEndpoint.topologyPackets(); len(strayPackets) != 0 {
+		t.Fatalf("expected no packets for an unknown service, got %v", strayPackets)
+	}
+}
+
+func TestLocalServiceInstances(t *testing.T) {
+	localNodeID := "registry1"
+	serviceName := "Shard"
+	thisNode := testNode(t, testNodeOptions("Registry", localNodeID))
+	thisTopologyTracker := thisNode.TopologyTracker
+
+	shardCmds := func(shardName string) map[string]EndpointMethod {
+		return map[string]EndpointMethod{
+			"whoami": func(params *CmdParams, callingEndpoint EndpointInterface, token *int) interface{} {
+				return shardName
+			},
+		}
+	}
+	firstInstanceID := thisNode.AddService(&Service{ServiceName: serviceName, Type: serviceName, Priority: 10, Weight: 10, Zone: "zone1", Scope: "zone", Dependencies: []string{}, Streams: []string{}, Status: ServiceStatusReady, ClientCmds: shardCmds("first")})
+	secondInstanceID := thisNode.AddService(&Service{ServiceName: serviceName, Type: serviceName, Priority: 20, Weight: 10, Zone: "zone1", Scope: "zone", Dependencies: []string{}, Streams: []string{}, Status: ServiceStatusReady, ClientCmds: shardCmds("second")})
+	if len(thisNode.GetLocalInstanceIDs(serviceName)) != 2 || len(thisTopologyTracker.FindInstancesOfService(serviceName, nil, nil)) != 2 {
+		t.Fatalf("expected two local instances of %s", serviceName)
+	}
+
+	// Commands go to the requested instance, or the lowest priority one if none is named
+	execParams := ServiceCmd_ExecParams{}
+	execParams.targetServiceInstanceID = &secondInstanceID
+	if cmdResult := thisNode.ServiceCmd(serviceName, "whoami", &CmdParams{}, execParams); cmdResult != "second" {
+		t.Fatalf("expected the requested instance to answer, got %v", cmdResult)
+	}
+	if cmdResult := thisNode.ServiceCmd(serviceName, "whoami", &CmdParams{}, ServiceCmd_ExecParams{}); cmdResult != "first" {
+		t.Fatalf("expected the lower priority instance to answer, got %v", cmdResult)
+	}
+
+	// Per-instance priority changes which local instance is selected
+	thisNode.SetInstancePriority(secondInstanceID, 5)
+	if serviceEntry := thisTopologyTracker.FindInstanceOfService(&serviceName, nil, nil, nil, nil); serviceEntry == nil || *serviceEntry.InstanceID != secondInstanceID {
+		t.Fatalf("expected the reprioritized instance, got %v", serviceEntry)
+	}
+
+	// Removing one instance leaves the other in place
+	thisNode.RemoveServiceInstance(secondInstanceID)
+	if serviceEntry := thisTopologyTracker.FindInstanceOfService(&serviceName, nil, nil, nil, nil); serviceEntry == nil || *serviceEntry.InstanceID != firstInstanceID {
+		t.Fatalf("expected the remaining instance, got %v", serviceEntry)
+	}
+}
+
+func TestServiceLifecycle(t *testing.T) {
+	localNodeID := "registry1"
+	serviceName := "Worker"
+	thisNode := testNode(t, testNodeOptions("Registry", localNodeID))
+	thisTopologyTracker := thisNode.TopologyTracker
+
+	// A service whose OnStart hook fails is never advertised
+	refusedService := &Service{ServiceName: serviceName, Type: serviceName, Priority: 10, Weight: 10, Zone: "zone1", Scope: "zone", Status: ServiceStatusReady}
+	refusedService.OnStart = func(serviceObj *Service) error {
+		return fmt.Errorf("not configured")
+	}
+	if instanceID := thisNode.AddService(refusedService); instanceID != "" || len(thisTopologyTracker.FindInstancesOfService(serviceName, nil, nil)) != 0 {
+		t.Fatalf("expected the refused service not to be registered")
+	}
+
+	var hookLock sync.Mutex
+	hookCalls := []string{}
+	recordHook := func(hookCall string) {
+		hookLock.Lock()
+		hookCalls = append(hookCalls, hookCall)
+		hookLock.Unlock()
+	}
+	workerService := &Service{ServiceName: serviceName, Type: serviceName, Priority: 10, Weight: 10, Zone: "zone1", Scope: "zone", Status: ServiceStatusReady}
+	workerService.OnStart = func(serviceObj *Service) error {
+		recordHook("start")
+		return nil
+	}
+	workerService.OnStop = func(serviceObj *Service) {
+		recordHook("stop")
+	}
+	workerService.OnPeerChange = func(serviceObj *Service, topologyEvent TopologyEvent) {
+		recordHook(topologyEvent.Cmd + " " + topologyEvent.ID)
+	}
+	instanceID := thisNode.AddService(workerService)
+
+	// Peers coming and going run the OnPeerChange hook
+	providerNodeID := "provider1"
+	nodeEntry := testNodeEntry(providerNodeID)
+	serviceEntry := testServiceEntry(providerNodeID, serviceName)
+	thisTopologyTracker.ProcessPacket(TopologyPacket{providerNodeID, "add", "node", providerNodeID, *nodeEntry.Scope, *nodeEntry.Zone, nodeEntry.ToJSON(), 0}, providerNodeID, false)
+	thisTopologyTracker.ProcessPacket(TopologyPacket{providerNodeID, "add", "service", *serviceEntry.InstanceID, *serviceEntry.Scope, *serviceEntry.Zone, serviceEntry.ToJSON(), 0}, providerNodeID, false)
+
+	// Commands added at runtime are callable and republished, including while calls are in flight
+	var cmdWait sync.WaitGroup
+	for cmdIndex := 0; cmdIndex < 10; cmdIndex++ {
+		cmdWait.Add(2)
+		cmdName := fmt.Sprintf("cmd%d", cmdIndex)
+		go func() {
+			defer cmdWait.Done()
+			workerService.AddClientCmd(cmdName, func(params *CmdParams, callingEndpoint EndpointInterface, token *int) interface{} {
+				return cmdName
+			})
+		}()
+		go func() {
+			defer cmdWait.Done()
+			execParams := ServiceCmd_ExecParams{}
+			execParams.targetServiceInstanceID = &instanceID
+			thisNode.ServiceCmd(serviceName, "cmd0", &CmdParams{}, execParams)
+		}()
+	}
+	cmdWait.Wait()
+	execParams := ServiceCmd_ExecParams{}
+	execParams.targetServiceInstanceID = &instanceID
+	if cmdResult := thisNode.ServiceCmd(serviceName, "cmd9", &CmdParams{}, execParams); cmdResult != "cmd9" {
+		t.Fatalf("expected the added command to answer, got %v", cmdResult)
+	}
+	if serviceDefinitions := thisNode.GetLocalServiceDefinitions(&serviceName); len(serviceDefinitions[serviceName].ClientCmds) != 10 {
+		t.Fatalf("expected ten published commands, got %v", serviceDefinitions[serviceName].ClientCmds)
+	}
+	// The Service table entry lists the commands once the concurrent updates settle, whatever order they were
+	// processed in
+	expectedCmds := "[cmd0 cmd1 cmd2 cmd3 cmd4 cmd5 cmd6 cmd7 cmd8 cmd9]"
+	if advertisedEntry := thisTopologyTracker.GetServiceEntry(instanceID); fmt.Sprint(advertisedEntry.ClientCmds) != expectedCmds {
+		t.Fatalf("expected the table entry to list %s, got %v", expectedCmds, advertisedEntry.ClientCmds)
+	}
+	workerService.RemoveClientCmd("cmd9")
+	if _, ok := thisNode.GetLocalService(instanceID).GetClientCmd("cmd9"); ok {
+		t.Fatalf("expected the removed command to be gone")
+	}
+	advertisedEntry := thisTopologyTracker.GetServiceEntry(instanceID)
+	if fmt.Sprint(advertisedEntry.ClientCmds) != "[cmd0 cmd1 cmd2 cmd3 cmd4 cmd5 cmd6 cmd7 cmd8]" {
+		t.Fatalf("expected the removed command to be withdrawn from the table entry, got %v", advertisedEntry.ClientCmds)
+	}
+
+	// Other Nodes learn the command list from the advertised entry
+	relayedEntry := &ServiceTableEntry{}
+	if err := json.Unmarshal(advertisedEntry.ToJSON(), relayedEntry); err != nil || fmt.Sprint(relayedEntry.ClientCmds) != fmt.Sprint(advertisedEntry.ClientCmds) {
+		t.Fatalf("expected the command list to survive JSON, got %v (%v)", relayedEntry.ClientCmds, err)
+	}
+
+	thisNode.RemoveServiceInstance(instanceID)
+	hookLock.Lock()
+	defer hookLock.Unlock()
+	expectedCalls := fmt.Sprint([]string{"start", "add " + *serviceEntry.InstanceID, "stop"})
+	if fmt.Sprint(hookCalls) != expectedCalls {
+		t.Fatalf("expected hook calls %s, got %v", expectedCalls, hookCalls)
+	}
+}
+
+func TestServiceChangeDuringAddService(t *testing.T) {
+	thisNode := testNode(t, testNodeOptions("Registry", "registry1"))
+	workerService := &Service{ServiceName: "Worker", Type: "Worker", Priority: 10, Weight: 10, Zone: "zone1", Scope: "zone", Status: ServiceStatusReady}
+
+	// Methods may be added while another goroutine registers the Service
+	var changeGroup sync.WaitGroup
+	changeGroup.Add(1)
+	go func() {
+		defer changeGroup.Done()
+		workerService.AddClientCmd("work", func(params *CmdParams, callingEndpoint EndpointInterface, token *int) interface{} {
+			return nil
+		})
+	}()
+	instanceID := thisNode.AddService(workerService)
+	changeGroup.Wait()
+
+	if _, ok := workerService.GetClientCmd("work"); !ok || instanceID == "" {
+		t.Fatalf("expected the method added during registration to be kept")
+	}
+}
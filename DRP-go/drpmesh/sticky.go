@@ -0,0 +1,141 @@
+package drpmesh
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultStickyTTL is how long a caller stays pinned to an instance of a Sticky service after its last call
+const DefaultStickyTTL = 10 * time.Minute
+
+// stickyBinding pins an affinity key to a service instance
+type stickyBinding struct {
+	serviceInstanceID string
+	expires           time.Time
+}
+
+// StickyTable tracks which service instance each caller of a Sticky service is pinned to
+type StickyTable struct {
+	bindings  map[string]*stickyBinding
+	tableLock sync.Mutex
+}
+
+// stickyKey returns the binding key for a service and affinity key
+func stickyKey(serviceName string, affinityKey string) string {
+	return serviceName + "|" + affinityKey
+}
+
+// Get returns the pinned instance ID for a caller, or nil if there is no unexpired binding
+func (st *StickyTable) Get(serviceName string, affinityKey string) *string {
+	st.tableLock.Lock()
+	defer st.tableLock.Unlock()
+
+	thisBinding, ok := st.bindings[stickyKey(serviceName, affinityKey)]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(thisBinding.expires) {
+		delete(st.bindings, stickyKey(serviceName, affinityKey))
+		return nil
+	}
+	serviceInstanceID := thisBinding.serviceInstanceID
+	return &serviceInstanceID
+}
+
+// Set pins a caller to a service instance, or refreshes an existing binding
+func (st *StickyTable) Set(serviceName string, affinityKey string, serviceInstanceID string, stickyTTL time.Duration) {
+	st.tableLock.Lock()
+	defer st.tableLock.Unlock()
+
+	if st.bindings == nil {
+		st.bindings = make(map[string]*stickyBinding)
+	}
+
+	// Purge expired bindings
+	currentTime := time.Now()
+	for checkKey, checkBinding := range st.bindings {
+		if currentTime.After(checkBinding.expires) {
+			delete(st.bindings, checkKey)
+		}
+	}
+
+	st.bindings[stickyKey(serviceName, affinityKey)] = &stickyBinding{serviceInstanceID, currentTime.Add(stickyTTL)}
+}
+
+// Remove deletes the binding for a caller
+func (st *StickyTable) Remove(serviceName string, affinityKey string) {
+	st.tableLock.Lock()
+	defer st.tableLock.Unlock()
+	delete(st.bindings, stickyKey(serviceName, affinityKey))
+}
+
+// RemoveInstance deletes all bindings to a service instance so callers are re-pinned on their next call
+func (st *StickyTable) RemoveInstance(serviceInstanceID string) {
+	st.tableLock.Lock()
+	defer st.tableLock.Unlock()
+	for checkKey, checkBinding := range st.bindings {
+		if checkBinding.serviceInstanceID == serviceInstanceID {
+			delete(st.bindings, checkKey)
+		}
+	}
+}
+
+// FindStickyInstanceOfService returns the instance a caller is pinned to; otherwise it finds the best instance and,
+// if the service is Sticky, pins the caller to it.  An empty affinity key disables pinning.
+func (tt *TopologyTracker) FindStickyInstanceOfService(serviceName string, affinityKey string, stickyTTL time.Duration, labelSelector LabelSelector, balancer Balancer, excludedInstances map[string]bool) *ServiceTableEntry {
+	thisTopologyTracker := tt
+
+	if affinityKey != "" {
+		pinnedInstanceID := thisTopologyTracker.StickyTable.Get(serviceName, affinityKey)
+		if pinnedInstanceID != nil {
+			// The pinned instance must still pass the same checks as any instance selected for the call
+			zoneTiers := thisTopologyTracker.getZoneTiers(&serviceName, thisTopologyTracker.drpNode.Zone)
+			var pinnedEntry *ServiceTableEntry = nil
+			thisTopologyTracker.tableLock.RLock()
+			checkEntry := thisTopologyTracker.serviceTable.GetEntry(*pinnedInstanceID).(*ServiceTableEntry)
+			if checkEntry != nil && checkEntry.Sticky {
+				if entryTier, _ := thisTopologyTracker.candidateTier(checkEntry, &serviceName, nil, nil, labelSelector, zoneTiers, excludedInstances, false); entryTier >= 0 {
+					pinnedEntry = checkEntry.Clone()
+				}
+			}
+			thisTopologyTracker.tableLock.RUnlock()
+			if pinnedEntry != nil {
+				thisTopologyTracker.StickyTable.Set(serviceName, affinityKey, *pinnedInstanceID, stickyTTL)
+				return pinnedEntry
+			}
+
+			// The pinned instance is gone or no longer usable; pick a new one
+			thisTopologyTracker.StickyTable.Remove(serviceName, affinityKey)
+		}
+	}
+
+	var bestServiceEntry *ServiceTableEntry = nil
+	if serviceSelection := thisTopologyTracker.selectInstanceExcluding(&serviceName, nil, nil, nil, labelSelector, balancer, excludedInstances); serviceSelection != nil {
+		bestServiceEntry = serviceSelection.ServiceEntry
+	}
+	if bestServiceEntry != nil && bestServiceEntry.Sticky && affinityKey != "" {
+		thisTopologyTracker.drpNode.Log(fmt.Sprintf("Pinned caller [%s] to service [%s] instance [%s]", affinityKey, serviceName, *bestServiceEntry.InstanceID), true)
+		thisTopologyTracker.StickyTable.Set(serviceName, affinityKey, *bestServiceEntry.InstanceID, stickyTTL)
+	}
+
+	return bestServiceEntry
+}
+
+// getAffinityKey returns the key used to pin a caller to a Sticky service instance: an explicit affinity key,
+// the caller's auth credentials or the calling Endpoint, in that order
+func (ep *ServiceCmd_ExecParams) getAffinityKey() string {
+	if ep.affinityKey != "" {
+		return "key:" + ep.affinityKey
+	}
+	if ep.callingEndpoint == nil {
+		return ""
+	}
+	if callerAuthInfo := ep.callingEndpoint.baseEndpoint().AuthInfo; callerAuthInfo.Value != "" {
+		return fmt.Sprintf("user:%s:%s", callerAuthInfo.Type, callerAuthInfo.Value)
+	}
+	if callerID := ep.callingEndpoint.GetID(); callerID != nil {
+		return "endpoint:" + *callerID
+	}
+	return fmt.Sprintf("endpoint:%p", ep.callingEndpoint.baseEndpoint())
+}
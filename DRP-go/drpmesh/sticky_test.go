@@ -0,0 +1,195 @@
+package drpmesh
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStickyTable(t *testing.T) {
+	stickyTable := &StickyTable{}
+
+	stickyTable.Set("Worker", "callerA", "provider1-Worker", time.Minute)
+	stickyTable.Set("Cache", "callerA", "provider1-Cache", time.Minute)
+	if pinnedInstanceID := stickyTable.Get("Worker", "callerA"); pinnedInstanceID == nil || *pinnedInstanceID != "provider1-Worker" {
+		t.Fatalf("expected callerA to be pinned to provider1-Worker, got %v", pinnedInstanceID)
+	}
+	if stickyTable.Get("Worker", "callerB") != nil {
+		t.Fatalf("expected no binding for another caller")
+	}
+
+	// Bindings expire once the TTL passes without a refresh
+	stickyTable.Set("Worker", "callerB", "provider2-Worker", 20*time.Millisecond)
+	time.Sleep(40 * time.Millisecond)
+	if stickyTable.Get("Worker", "callerB") != nil {
+		t.Fatalf("expected the binding to expire")
+	}
+
+	// Removing an instance only drops the bindings to it
+	stickyTable.RemoveInstance("provider1-Worker")
+	if stickyTable.Get("Worker", "callerA") != nil || stickyTable.Get("Cache", "callerA") == nil {
+		t.Fatalf("expected only the binding to the removed instance to be dropped")
+	}
+	stickyTable.Remove("Cache", "callerA")
+	if stickyTable.Get("Cache", "callerA") != nil {
+		t.Fatalf("expected the removed binding to be gone")
+	}
+}
+
+func TestStickyInstanceSelection(t *testing.T) {
+	localNodeID := "registry1"
+	serviceName := "Session"
+	thisNode := testNode(t, testNodeOptions("Registry", localNodeID))
+	thisTopologyTracker := thisNode.TopologyTracker
+	thisTopologyTracker.SetServiceBalancer(serviceName, &RoundRobinBalancer{})
+
+	// Two Providers offer a Sticky service, one of them also offers a service which is not Sticky
+	stickyEntries := map[string]*ServiceTableEntry{}
+	for _, nodeID := range []string{"provider1", "provider2"} {
+		addTestProvider(thisTopologyTracker, nodeID, "zone1", "Stateless")
+		stickyEntry := testServiceEntry(nodeID, serviceName)
+		stickyEntry.Sticky = true
+		thisTopologyTracker.ProcessPacket(TopologyPacket{nodeID, "add", "service", *stickyEntry.InstanceID, *stickyEntry.Scope, *stickyEntry.Zone, stickyEntry.ToJSON(), 1}, nodeID, false)
+		stickyEntries[*stickyEntry.InstanceID] = stickyEntry
+	}
+
+	// findSticky finds the instance for a caller with the default TTL
+	findSticky := func(affinityKey string, excludedInstances map[string]bool) string {
+		t.Helper()
+		serviceEntry := thisTopologyTracker.FindStickyInstanceOfService(serviceName, affinityKey, time.Minute, nil, nil, excludedInstances)
+		if serviceEntry == nil {
+			t.Fatalf("expected an instance for caller [%s]", affinityKey)
+		}
+		return *serviceEntry.InstanceID
+	}
+
+	// Each caller keeps the instance it was first given, even though the Balancer alternates
+	firstInstanceID := findSticky("callerA", nil)
+	secondInstanceID := findSticky("callerB", nil)
+	if firstInstanceID == secondInstanceID {
+		t.Fatalf("expected the round robin Balancer to pin the callers to different instances")
+	}
+	for callNum := 0; callNum < 5; callNum++ {
+		if findSticky("callerA", nil) != firstInstanceID || findSticky("callerB", nil) != secondInstanceID {
+			t.Fatalf("expected each caller to stay on its pinned instance")
+		}
+	}
+
+	// Without an affinity key or for a service which is not Sticky nothing is pinned
+	findSticky("", nil)
+	if thisTopologyTracker.StickyTable.Get(serviceName, "") != nil {
+		t.Fatalf("expected no binding without an affinity key")
+	}
+	if statelessEntry := thisTopologyTracker.FindStickyInstanceOfService("Stateless", "callerA", time.Minute, nil, nil, nil); statelessEntry == nil || thisTopologyTracker.StickyTable.Get("Stateless", "callerA") != nil {
+		t.Fatalf("expected a Stateless instance without a binding")
+	}
+
+	// A caller whose instance is excluded, e.g. by a retry, is re-pinned to another instance
+	if repinnedInstanceID := findSticky("callerB", map[string]bool{secondInstanceID: true}); repinnedInstanceID != firstInstanceID {
+		t.Fatalf("expected callerB to move to %s, got %s", firstInstanceID, repinnedInstanceID)
+	}
+	if findSticky("callerB", nil) != firstInstanceID {
+		t.Fatalf("expected callerB to stay on its new instance")
+	}
+
+	// A draining instance is left for a ready one
+	drainingEntry := stickyEntries[firstInstanceID]
+	drainingEntry.Status = ServiceStatusDraining
+	thisTopologyTracker.ProcessPacket(TopologyPacket{*drainingEntry.NodeID, "update", "service", firstInstanceID, *drainingEntry.Scope, *drainingEntry.Zone, drainingEntry.ToJSON(), 2}, *drainingEntry.NodeID, false)
+	if findSticky("callerA", nil) != secondInstanceID {
+		t.Fatalf("expected callerA to leave the draining instance")
+	}
+
+	// Callers are re-pinned transparently when their instance leaves the ServiceTable
+	leavingEntry := stickyEntries[secondInstanceID]
+	thisTopologyTracker.ProcessPacket(TopologyPacket{*leavingEntry.NodeID, "delete", "service", secondInstanceID, *leavingEntry.Scope, *leavingEntry.Zone, leavingEntry.ToJSON(), 2}, *leavingEntry.NodeID, false)
+	if thisTopologyTracker.StickyTable.Get(serviceName, "callerA") != nil {
+		t.Fatalf("expected bindings to the removed instance to be dropped")
+	}
+	drainingEntry.Status = ServiceStatusReady
+	thisTopologyTracker.ProcessPacket(TopologyPacket{*drainingEntry.NodeID, "update", "service", firstInstanceID, *drainingEntry.Scope, *drainingEntry.Zone, drainingEntry.ToJSON(), 3}, *drainingEntry.NodeID, false)
+	if findSticky("callerA", nil) != firstInstanceID {
+		t.Fatalf("expected callerA to be re-pinned to the remaining instance")
+	}
+}
+
+func TestStickyPinnedInstanceFilter(t *testing.T) {
+	serviceName := "Session"
+	thisNode := testNode(t, testNodeOptions("Registry", "registry1"))
+	thisTopologyTracker := thisNode.TopologyTracker
+	thisTopologyTracker.SetZonePreferences([]string{"zone2"})
+
+	// A Sticky service is offered in the local zone and in a fallback zone
+	stickyEntries := map[string]*ServiceTableEntry{}
+	for nodeID, zoneName := range map[string]string{"provider1": "zone1", "provider2": "zone2"} {
+		addTestProvider(thisTopologyTracker, nodeID, zoneName)
+		stickyEntry := testServiceEntry(nodeID, serviceName)
+		stickyEntry.Sticky = true
+		stickyEntry.Zone = &zoneName
+		thisTopologyTracker.ProcessPacket(TopologyPacket{nodeID, "add", "service", *stickyEntry.InstanceID, *stickyEntry.Scope, zoneName, stickyEntry.ToJSON(), 1}, nodeID, false)
+		stickyEntries[zoneName] = stickyEntry
+	}
+	localInstanceID := *stickyEntries["zone1"].InstanceID
+	remoteInstanceID := *stickyEntries["zone2"].InstanceID
+
+	// findSticky finds the instance for a caller with the default TTL
+	findSticky := func(affinityKey string, excludedInstances map[string]bool) string {
+		t.Helper()
+		serviceEntry := thisTopologyTracker.FindStickyInstanceOfService(serviceName, affinityKey, time.Minute, nil, nil, excludedInstances)
+		if serviceEntry == nil {
+			t.Fatalf("expected an instance for caller [%s]", affinityKey)
+		}
+		return *serviceEntry.InstanceID
+	}
+
+	// A caller pinned in the fallback zone leaves it once the service may not cross zones
+	if findSticky("callerA", map[string]bool{localInstanceID: true}) != remoteInstanceID {
+		t.Fatalf("expected callerA to be pinned to the fallback zone")
+	}
+	thisTopologyTracker.SetCrossZoneFallback(serviceName, false)
+	if findSticky("callerA", nil) != localInstanceID {
+		t.Fatalf("expected callerA to leave the instance outside its zone")
+	}
+	thisTopologyTracker.SetCrossZoneFallback(serviceName, true)
+
+	// A caller pinned to an entry which is no longer verified, e.g. restored from disk, is re-pinned
+	if findSticky("callerB", map[string]bool{localInstanceID: true}) != remoteInstanceID {
+		t.Fatalf("expected callerB to be pinned to the fallback zone")
+	}
+	thisTopologyTracker.tableLock.Lock()
+	thisTopologyTracker.unverifiedEntries[topologyEntryKey("service", remoteInstanceID)] = true
+	thisTopologyTracker.tableLock.Unlock()
+	if findSticky("callerB", nil) != localInstanceID {
+		t.Fatalf("expected callerB to leave the unverified instance")
+	}
+}
+
+func TestStickyAffinityKey(t *testing.T) {
+	thisNode := testNode(t, testNodeOptions("Provider", "provider1"))
+
+	// An Endpoint without an ID is identified by its address
+	anonymousEndpoint := &Endpoint{drpNode: thisNode}
+	anonymousEndpoint.Init()
+	execParams := ServiceCmd_ExecParams{}
+	if affinityKey := execParams.getAffinityKey(); affinityKey != "" {
+		t.Fatalf("expected no affinity key without a caller, got [%s]", affinityKey)
+	}
+	execParams.callingEndpoint = anonymousEndpoint
+	if affinityKey := execParams.getAffinityKey(); !strings.HasPrefix(affinityKey, "endpoint:0x") {
+		t.Fatalf("expected an address based key, got [%s]", affinityKey)
+	}
+
+	// Then by its ID, then by the user it authenticated as, then by an explicit key
+	anonymousEndpoint.SetID("consumer1")
+	if affinityKey := execParams.getAffinityKey(); affinityKey != "endpoint:consumer1" {
+		t.Fatalf("expected the Endpoint ID as key, got [%s]", affinityKey)
+	}
+	anonymousEndpoint.AuthInfo = EndpointAuthInfo{Type: "token", Value: "alice"}
+	if affinityKey := execParams.getAffinityKey(); affinityKey != "user:token:alice" {
+		t.Fatalf("expected the user as key, got [%s]", affinityKey)
+	}
+	execParams.SetAffinityKey("cart42")
+	if affinityKey := execParams.getAffinityKey(); affinityKey != "key:cart42" {
+		t.Fatalf("expected the explicit key, got [%s]", affinityKey)
+	}
+}
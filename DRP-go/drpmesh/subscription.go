@@ -1,27 +1,138 @@
 package drpmesh
 
+import "sync"
+
 // SubscribableSourceInterface should be implemented by a SubscribableSource
 type SubscribableSourceInterface interface {
-	AddSubscription(Subscriber)
-	RemoveSubscription(Subscriber)
+	AddSubscription(*Subscriber)
+	RemoveSubscription(*Subscriber)
 	Send(interface{})
 }
 
 // SubscribableSource applies attributes to subscribable sources
 type SubscribableSource struct {
-	NodeID        string
-	TopicName     string
-	Subscriptions []Subscriber
+	NodeID           string
+	ServiceName      string
+	TopicName        string
+	Subscriptions    map[*Subscriber]bool
+	subscriptionLock sync.Mutex
+}
+
+// AddSubscription adds a Subscriber to the source
+func (ss *SubscribableSource) AddSubscription(subscription *Subscriber) {
+	ss.subscriptionLock.Lock()
+	if ss.Subscriptions == nil {
+		ss.Subscriptions = make(map[*Subscriber]bool)
+	}
+	ss.Subscriptions[subscription] = true
+	ss.subscriptionLock.Unlock()
+
+	subscription.subscriberLock.Lock()
+	if subscription.subscribedTo == nil {
+		subscription.subscribedTo = make(map[*SubscribableSource]bool)
+	}
+	subscription.subscribedTo[ss] = true
+	subscription.subscriberLock.Unlock()
+}
+
+// RemoveSubscription removes a Subscriber from the source
+func (ss *SubscribableSource) RemoveSubscription(subscription *Subscriber) {
+	subscription.subscriberLock.Lock()
+	delete(subscription.subscribedTo, ss)
+	subscription.subscriberLock.Unlock()
+
+	ss.subscriptionLock.Lock()
+	delete(ss.Subscriptions, subscription)
+	ss.subscriptionLock.Unlock()
+}
+
+// SubscriberCount returns the number of Subscribers attached to the source
+func (ss *SubscribableSource) SubscriberCount() int {
+	ss.subscriptionLock.Lock()
+	defer ss.subscriptionLock.Unlock()
+	return len(ss.Subscriptions)
+}
+
+// Send forwards a message to all Subscribers of the source
+func (ss *SubscribableSource) Send(message interface{}) {
+	ss.subscriptionLock.Lock()
+	subscriberList := make([]*Subscriber, 0, len(ss.Subscriptions))
+	for thisSubscriber := range ss.Subscriptions {
+		subscriberList = append(subscriberList, thisSubscriber)
+	}
+	ss.subscriptionLock.Unlock()
+
+	for _, thisSubscriber := range subscriberList {
+		thisSubscriber.Send(message)
+	}
 }
 
 // Subscriber contains details sent by a process which needs data from a SubscribableSource
-type Subscriber struct{}
+type Subscriber struct {
+	ServiceName    string
+	TopicName      string
+	Scope          string
+	sendFunction   func(interface{}) error
+	closeFunction  func()
+	subscribedTo   map[*SubscribableSource]bool
+	terminated     bool
+	subscriberLock sync.Mutex
+}
+
+// NewSubscriber creates a Subscriber which delivers messages with sendFunction; closeFunction, if set, is called
+// once when the subscription is terminated so the receiving stream can be closed
+func NewSubscriber(serviceName string, topicName string, scope string, sendFunction func(interface{}) error, closeFunction func()) *Subscriber {
+	newSubscriber := &Subscriber{
+		ServiceName:   serviceName,
+		TopicName:     topicName,
+		Scope:         scope,
+		sendFunction:  sendFunction,
+		closeFunction: closeFunction,
+		subscribedTo:  make(map[*SubscribableSource]bool),
+	}
+	return newSubscriber
+}
 
 // Send forwards subscribed data to a Subscriber
-func (s Subscriber) Send(interface{}) {}
+func (s *Subscriber) Send(message interface{}) {
+	if s.sendFunction == nil {
+		return
+	}
+	sendErr := s.sendFunction(message)
+	if sendErr != nil {
+		// Send failed; the remote side may have disconnected
+		s.Terminate()
+	}
+}
+
+// Terminate removes open subscriptions and closes the receiving stream
+func (s *Subscriber) Terminate() {
+	s.subscriberLock.Lock()
+	if s.terminated {
+		s.subscriberLock.Unlock()
+		return
+	}
+	s.terminated = true
+	sourceList := make([]*SubscribableSource, 0, len(s.subscribedTo))
+	for subscriptionTarget := range s.subscribedTo {
+		sourceList = append(sourceList, subscriptionTarget)
+	}
+	s.subscriberLock.Unlock()
 
-// Terminate removes open subscriptions
-func (s Subscriber) Terminate() {}
+	for _, subscriptionTarget := range sourceList {
+		subscriptionTarget.RemoveSubscription(s)
+	}
+	if s.closeFunction != nil {
+		s.closeFunction()
+	}
+}
+
+// IsTerminated tells whether or not the Subscriber has been terminated
+func (s *Subscriber) IsTerminated() bool {
+	s.subscriberLock.Lock()
+	defer s.subscriberLock.Unlock()
+	return s.terminated
+}
 
 // RemoteSubscription is a subscription to a remote source
 type RemoteSubscription struct {
@@ -31,9 +142,49 @@ type RemoteSubscription struct {
 }
 
 // RemoveSubscription removes a local subscription
-func (rs RemoteSubscription) RemoveSubscription(subscription Subscriber) {
-
+func (rs *RemoteSubscription) RemoveSubscription(subscription *Subscriber) {
+	rs.SubscribableSource.RemoveSubscription(subscription)
 }
 
 // SubscriptionManager is used to deduplicate multiple subscriptions from local clients to a remote source
-type SubscriptionManager struct{}
+type SubscriptionManager struct {
+	Subscribers map[*Subscriber]bool
+	managerLock sync.Mutex
+}
+
+// RegisterSubscription tracks a new Subscriber
+func (sm *SubscriptionManager) RegisterSubscription(subscription *Subscriber) {
+	sm.managerLock.Lock()
+	defer sm.managerLock.Unlock()
+	if sm.Subscribers == nil {
+		sm.Subscribers = make(map[*Subscriber]bool)
+	}
+	sm.Subscribers[subscription] = true
+}
+
+// UnregisterSubscription stops tracking a Subscriber
+func (sm *SubscriptionManager) UnregisterSubscription(subscription *Subscriber) {
+	sm.managerLock.Lock()
+	defer sm.managerLock.Unlock()
+	delete(sm.Subscribers, subscription)
+}
+
+// TerminateServiceSubscriptions terminates all Subscribers of a given service and returns the number removed
+func (sm *SubscriptionManager) TerminateServiceSubscriptions(serviceName string) int {
+	sm.managerLock.Lock()
+	subscriberList := []*Subscriber{}
+	for thisSubscriber := range sm.Subscribers {
+		if thisSubscriber.ServiceName != serviceName {
+			continue
+		}
+		subscriberList = append(subscriberList, thisSubscriber)
+		delete(sm.Subscribers, thisSubscriber)
+	}
+	sm.managerLock.Unlock()
+
+	// Terminate outside the lock; close functions send on the subscriber's Endpoint
+	for _, thisSubscriber := range subscriberList {
+		thisSubscriber.Terminate()
+	}
+	return len(subscriberList)
+}
@@ -0,0 +1,156 @@
+package drpmesh
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testEndpointPair connects a client websocket to an Endpoint served by the Node and returns both ends;
+// a non-empty endpointID identifies the client as that Node
+func testEndpointPair(t *testing.T, thisNode *Node, endpointID string) (*Endpoint, *websocket.Conn) {
+	serverEndpointChan := make(chan *Endpoint, 1)
+	upgrader := websocket.Upgrader{}
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wsConn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		serverEndpoint := &Endpoint{drpNode: thisNode}
+		serverEndpoint.Init()
+		if endpointID != "" {
+			serverEndpoint.SetID(endpointID)
+		}
+		thisNode.ApplyNodeEndpointMethods(serverEndpoint)
+		serverEndpoint.StartListening(wsConn)
+		serverEndpointChan <- serverEndpoint
+	}))
+	t.Cleanup(testServer.Close)
+
+	clientConn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(testServer.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("could not connect test websocket: %s", err)
+	}
+	t.Cleanup(func() { clientConn.Close() })
+	return <-serverEndpointChan, clientConn
+}
+
+// readTestReply reads the next reply packet from a test websocket
+func readTestReply(t *testing.T, clientConn *websocket.Conn) *ReplyIn {
+	clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, replyBytes, err := clientConn.ReadMessage()
+	if err != nil {
+		t.Fatalf("could not read reply: %s", err)
+	}
+	replyPacket := &ReplyIn{}
+	if err := json.Unmarshal(replyBytes, replyPacket); err != nil {
+		t.Fatalf("could not unmarshal reply %s: %s", string(replyBytes), err)
+	}
+	return replyPacket
+}
+
+func TestSubscriptionTeardownOnRemoveService(t *testing.T) {
+	localNodeID := "provider1"
+	thisNode := testNode(t, testNodeOptions("Provider", localNodeID))
+
+	feedService := &Service{ServiceName: "Feed", Type: "Feed", Priority: 10, Weight: 10, Zone: "zone1", Scope: "zone", Streams: []string{"prices"}, Status: ServiceStatusReady}
+	thisNode.AddService(feedService)
+
+	var messageLock sync.Mutex
+	receivedMessages := []interface{}{}
+	closeCount := 0
+	thisSubscriber := NewSubscriber("Feed", "prices", "local", func(message interface{}) error {
+		messageLock.Lock()
+		defer messageLock.Unlock()
+		receivedMessages = append(receivedMessages, message)
+		return nil
+	}, func() {
+		messageLock.Lock()
+		defer messageLock.Unlock()
+		closeCount++
+	})
+
+	// Streams the service does not offer can not be subscribed to
+	if thisNode.Subscribe(NewSubscriber("Feed", "volumes", "local", nil, nil)) {
+		t.Fatalf("expected a subscription to an unknown stream to be refused")
+	}
+	if !thisNode.Subscribe(thisSubscriber) {
+		t.Fatalf("expected the subscription to succeed")
+	}
+	feedService.Publish("prices", "tick1")
+
+	// The DRP service can not be removed
+	if thisNode.RemoveService("DRP") || thisNode.findLocalService("DRP") == nil {
+		t.Fatalf("expected removing the DRP service to be refused")
+	}
+
+	if !thisNode.RemoveService("Feed") {
+		t.Fatalf("expected the service to be removed")
+	}
+	feedService.Publish("prices", "tick2")
+
+	messageLock.Lock()
+	defer messageLock.Unlock()
+	if len(receivedMessages) != 1 || receivedMessages[0] != "tick1" {
+		t.Fatalf("expected only the message published before removal, got %v", receivedMessages)
+	}
+	if closeCount != 1 || !thisSubscriber.IsTerminated() {
+		t.Fatalf("expected the subscription to be terminated once, got %d closes", closeCount)
+	}
+	if len(thisNode.SubscriptionManager.Subscribers) != 0 {
+		t.Fatalf("expected no tracked subscribers, got %d", len(thisNode.SubscriptionManager.Subscribers))
+	}
+}
+
+func TestSubscriptionEndpointStream(t *testing.T) {
+	localNodeID := "provider1"
+	thisNode := testNode(t, testNodeOptions("Provider", localNodeID))
+
+	feedService := &Service{ServiceName: "Feed", Type: "Feed", Priority: 10, Weight: 10, Zone: "zone1", Scope: "zone", Streams: []string{"prices"}, Status: ServiceStatusReady}
+	thisNode.AddService(feedService)
+	serverEndpoint, clientConn := testEndpointPair(t, thisNode, "")
+
+	// Subscribe over the websocket, as a remote Node would
+	cmdToken := 1
+	streamToken := 7
+	subscribeMethod := "subscribe"
+	drpServiceName := "DRP"
+	subscribeCmd := &CmdOut{}
+	subscribeCmd.Type = "cmd"
+	subscribeCmd.Token = &cmdToken
+	subscribeCmd.Method = &subscribeMethod
+	subscribeCmd.ServiceName = &drpServiceName
+	subscribeCmd.Params = map[string]interface{}{"serviceName": "Feed", "topicName": "prices", "streamToken": streamToken, "scope": "local"}
+	if err := clientConn.WriteMessage(websocket.TextMessage, subscribeCmd.ToJSON()); err != nil {
+		t.Fatalf("could not send subscribe: %s", err)
+	}
+	subscribeReply := readTestReply(t, clientConn)
+	if *subscribeReply.Token != cmdToken || string(*subscribeReply.Payload) != "true" {
+		t.Fatalf("expected the subscribe command to succeed, got %s", string(subscribeReply.ToJSON()))
+	}
+
+	// Published messages arrive as stream replies
+	feedService.Publish("prices", "tick1")
+	streamReply := readTestReply(t, clientConn)
+	if *streamReply.Token != streamToken || streamReply.Status != 2 || string(*streamReply.Payload) != `"tick1"` {
+		t.Fatalf("expected a stream reply, got %s", string(streamReply.ToJSON()))
+	}
+
+	// Removing the service closes the stream
+	thisNode.RemoveService("Feed")
+	closeReply := readTestReply(t, clientConn)
+	if *closeReply.Token != streamToken || closeReply.Status != 0 {
+		t.Fatalf("expected the stream to be closed, got %s", string(closeReply.ToJSON()))
+	}
+	serverEndpoint.subscriptionLock.Lock()
+	defer serverEndpoint.subscriptionLock.Unlock()
+	if len(serverEndpoint.Subscriptions) != 0 {
+		t.Fatalf("expected the endpoint to stop tracking the stream, got %d", len(serverEndpoint.Subscriptions))
+	}
+}
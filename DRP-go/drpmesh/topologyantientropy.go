@@ -0,0 +1,380 @@
+package drpmesh
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// DefaultAntiEntropyInterval is how often a Registry compares its tables with other connected Registries
+const DefaultAntiEntropyInterval = 30 * time.Second
+
+// DefaultAntiEntropyTimeout is how long to wait for another Registry to answer a digest request
+const DefaultAntiEntropyTimeout = 10 * time.Second
+
+// TopologyDigest maps "type/zone" buckets to a hash of the table entries in each bucket
+type TopologyDigest map[string]string
+
+// antiEntropyEntry is a table entry prepared for comparison with another Registry
+type antiEntropyEntry struct {
+	entryType string
+	entryID   string
+	bucketKey string
+	baseEntry TopologyTableEntry
+	entryHash string
+	entryData []byte
+}
+
+// StartAntiEntropy periodically reconciles the tables with every connected Registry.  Calling it again replaces
+// the running loop.
+func (tt *TopologyTracker) StartAntiEntropy(checkInterval time.Duration) {
+	tt.StopAntiEntropy()
+
+	stopChan := make(chan bool)
+	tt.antiEntropyLock.Lock()
+	tt.antiEntropyStop = stopChan
+	tt.antiEntropyLock.Unlock()
+
+	go func() {
+		checkTicker := time.NewTicker(checkInterval)
+		defer checkTicker.Stop()
+		for {
+			select {
+			case <-checkTicker.C:
+				tt.RunAntiEntropy()
+			case <-stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// StopAntiEntropy stops the anti-entropy loop if it is running
+func (tt *TopologyTracker) StopAntiEntropy() {
+	tt.antiEntropyLock.Lock()
+	defer tt.antiEntropyLock.Unlock()
+	if tt.antiEntropyStop != nil {
+		close(tt.antiEntropyStop)
+		tt.antiEntropyStop = nil
+	}
+}
+
+// RunAntiEntropy reconciles the tables with each connected Registry and returns the number of entries corrected
+// per Registry
+func (tt *TopologyTracker) RunAntiEntropy() map[string]int {
+	thisTopologyTracker := tt
+	thisNode := thisTopologyTracker.drpNode
+
+	correctedCounts := make(map[string]int)
+	if !thisNode.IsRegistry() {
+		return correctedCounts
+	}
+
+	for remoteNodeID, remoteEndpoint := range thisNode.listNodeEndpoints() {
+		remoteNodeEntry := thisTopologyTracker.GetNodeEntry(remoteNodeID)
+		if remoteNodeEntry == nil || !remoteNodeEntry.IsRegistry() {
+			continue
+		}
+		correctedCounts[remoteNodeID] = thisTopologyTracker.ReconcileWithRegistry(remoteNodeID, remoteEndpoint)
+	}
+
+	return correctedCounts
+}
+
+// ReconcileWithRegistry exchanges digests with another Registry, drills down into the buckets which differ and
+// repairs local entries from the remote Registry's copy.  Only entries the remote Registry is authoritative for are
+// added or updated, and only entries learned from it are removed; each Registry pulls from the others, so both
+// sides converge.  Returns the number of entries corrected.
+func (tt *TopologyTracker) ReconcileWithRegistry(remoteNodeID string, remoteEndpoint EndpointInterface) int {
+	thisTopologyTracker := tt
+	thisNode := thisTopologyTracker.drpNode
+
+	remoteNodeEntry := thisTopologyTracker.GetNodeEntry(remoteNodeID)
+	if remoteNodeEntry == nil || remoteNodeEntry.Zone == nil {
+		return 0
+	}
+
+	localEntries := thisTopologyTracker.getAntiEntropyEntries(*remoteNodeEntry.Zone)
+	localDigest := buildTopologyDigest(localEntries)
+
+	remoteDigest := TopologyDigest{}
+	digestParams := map[string]string{"reqNodeID": thisNode.NodeID, "zone": thisNode.Zone}
+	if !thisTopologyTracker.awaitAntiEntropyReply(remoteEndpoint, "getTopologyDigest", digestParams, &remoteDigest) {
+		return 0
+	}
+
+	// Find buckets which differ on either side
+	differingBuckets := make(map[string]bool)
+	for bucketKey, bucketHash := range localDigest {
+		if remoteDigest[bucketKey] != bucketHash {
+			differingBuckets[bucketKey] = true
+		}
+	}
+	for bucketKey, bucketHash := range remoteDigest {
+		if localDigest[bucketKey] != bucketHash {
+			differingBuckets[bucketKey] = true
+		}
+	}
+
+	// Matching buckets confirm the entries learned from the remote Registry are still current
+	confirmedEntries := []*antiEntropyEntry{}
+	for _, localEntry := range localEntries {
+		if !differingBuckets[localEntry.bucketKey] && derefString(localEntry.baseEntry.LearnedFrom) == remoteNodeID {
+			confirmedEntries = append(confirmedEntries, localEntry)
+		}
+	}
+	thisTopologyTracker.markEntriesSeen(confirmedEntries)
+
+	// Node buckets sort first so service adds find their Node entries
+	bucketKeys := GetKeys(differingBuckets)
+	sort.Strings(bucketKeys)
+
+	correctedCount := 0
+	for _, bucketKey := range bucketKeys {
+		remoteBucket := TopologySnapshot{}
+		bucketParams := map[string]string{"reqNodeID": thisNode.NodeID, "zone": thisNode.Zone, "bucket": bucketKey}
+		if !thisTopologyTracker.awaitAntiEntropyReply(remoteEndpoint, "getTopologyDigestBucket", bucketParams, &remoteBucket) {
+			continue
+		}
+		correctedCount += thisTopologyTracker.repairBucket(remoteNodeID, bucketKey, localEntries, collectAntiEntropyEntries(remoteBucket))
+	}
+
+	if correctedCount > 0 {
+		thisNode.Log(fmt.Sprintf("Anti-entropy with Registry [%s] corrected %d entries", remoteNodeID, correctedCount), false)
+	}
+
+	return correctedCount
+}
+
+// GetTopologyDigest returns the digest of entries shared with a Registry in the specified zone
+func (tt *TopologyTracker) GetTopologyDigest(remoteZone string) TopologyDigest {
+	return buildTopologyDigest(tt.getAntiEntropyEntries(remoteZone))
+}
+
+// GetTopologyDigestBucket returns the entries in a digest bucket shared with a Registry in the specified zone
+func (tt *TopologyTracker) GetTopologyDigestBucket(remoteZone string, bucketKey string) TopologySnapshot {
+	thisTopologyTracker := tt
+	bucketSnapshot := TopologySnapshot{make(map[string]*NodeTableEntry), make(map[string]*ServiceTableEntry)}
+
+	sharedSnapshot := thisTopologyTracker.getSharedSnapshot(remoteZone)
+	for nodeID, nodeTableEntry := range sharedSnapshot.NodeTable {
+		if antiEntropyBucketKey("node", nodeTableEntry.TopologyTableEntry) == bucketKey {
+			bucketSnapshot.NodeTable[nodeID] = nodeTableEntry
+		}
+	}
+	for serviceInstanceID, serviceTableEntry := range sharedSnapshot.ServiceTable {
+		if antiEntropyBucketKey("service", serviceTableEntry.TopologyTableEntry) == bucketKey {
+			bucketSnapshot.ServiceTable[serviceInstanceID] = serviceTableEntry
+		}
+	}
+	return bucketSnapshot
+}
+
+// repairBucket applies the remote Registry's copy of a bucket to the local tables and returns the number of entries corrected
+func (tt *TopologyTracker) repairBucket(remoteNodeID string, bucketKey string, localEntries map[string]*antiEntropyEntry, remoteEntries map[string]*antiEntropyEntry) int {
+	thisTopologyTracker := tt
+	thisNode := thisTopologyTracker.drpNode
+	correctedCount := 0
+
+	entryKeys := []string{}
+	for entryKey, remoteEntry := range remoteEntries {
+		if remoteEntry.bucketKey == bucketKey {
+			entryKeys = append(entryKeys, entryKey)
+		}
+	}
+	for entryKey, localEntry := range localEntries {
+		if _, ok := remoteEntries[entryKey]; !ok && localEntry.bucketKey == bucketKey {
+			entryKeys = append(entryKeys, entryKey)
+		}
+	}
+	sort.Strings(entryKeys)
+
+	confirmedEntries := []*antiEntropyEntry{}
+	for _, entryKey := range entryKeys {
+		localEntry := localEntries[entryKey]
+		remoteEntry := remoteEntries[entryKey]
+
+		// Unchanged entries learned from the remote Registry are still current
+		if localEntry != nil && remoteEntry != nil && localEntry.entryHash == remoteEntry.entryHash && derefString(localEntry.baseEntry.LearnedFrom) == remoteNodeID {
+			confirmedEntries = append(confirmedEntries, localEntry)
+			continue
+		}
+
+		repairCmd := ""
+		switch {
+		case localEntry == nil:
+			// Missing locally; add if the remote Registry is authoritative
+			if remoteEntry.isAuthoritative() {
+				repairCmd = "add"
+			}
+		case remoteEntry == nil:
+			// Gone from the remote Registry; remove if we learned it from there
+			if derefString(localEntry.baseEntry.LearnedFrom) == remoteNodeID {
+				repairCmd = "delete"
+			}
+		case localEntry.entryHash != remoteEntry.entryHash:
+			// Changed; take the remote copy if it is authoritative and newer
+			if remoteEntry.isAuthoritative() && (remoteEntry.baseEntry.Sequence > localEntry.baseEntry.Sequence || remoteEntry.baseEntry.Sequence == 0 && derefString(localEntry.baseEntry.LearnedFrom) == remoteNodeID) {
+				repairCmd = "update"
+			}
+		}
+		if repairCmd == "" {
+			continue
+		}
+
+		sourceEntry := remoteEntry
+		if repairCmd == "delete" {
+			sourceEntry = localEntry
+		}
+		repairPacket := TopologyPacket{*sourceEntry.baseEntry.NodeID, repairCmd, sourceEntry.entryType, sourceEntry.entryID, *sourceEntry.baseEntry.Scope, *sourceEntry.baseEntry.Zone, sourceEntry.entryData, sourceEntry.baseEntry.Sequence}
+		thisTopologyTracker.ProcessPacket(repairPacket, remoteNodeID, true)
+
+		// Count the entry if the local table now matches the remote copy
+		currentHash, entryExists := thisTopologyTracker.getEntryHash(sourceEntry.entryType, sourceEntry.entryID)
+		if (repairCmd == "delete" && !entryExists) || (repairCmd != "delete" && entryExists && currentHash == remoteEntry.entryHash) {
+			thisNode.Log(fmt.Sprintf("Anti-entropy with Registry [%s] repaired %s[%s] (%s)", remoteNodeID, sourceEntry.entryType, sourceEntry.entryID, repairCmd), true)
+			correctedCount++
+		}
+	}
+	thisTopologyTracker.markEntriesSeen(confirmedEntries)
+
+	return correctedCount
+}
+
+// awaitAntiEntropyReply sends a command to a Registry and unmarshals the reply; returns false on failure or timeout
+func (tt *TopologyTracker) awaitAntiEntropyReply(remoteEndpoint EndpointInterface, methodName string, cmdParams interface{}, replyObj interface{}) bool {
+	returnData := remoteEndpoint.SendCmdAwaitTimeout("DRP", methodName, cmdParams, nil, nil, tt.AntiEntropyTimeout)
+	if returnData == nil || returnData.Payload == nil {
+		return false
+	}
+	err := json.Unmarshal(*returnData.Payload, replyObj)
+	if err != nil {
+		tt.drpNode.Log(fmt.Sprintf("Anti-entropy %s reply unmarshal error: %s", methodName, err), true)
+		return false
+	}
+	return true
+}
+
+// getSharedSnapshot returns copies of the verified entries which should be held by both the local Registry and a
+// Registry in the specified zone
+func (tt *TopologyTracker) getSharedSnapshot(remoteZone string) TopologySnapshot {
+	thisTopologyTracker := tt
+	localZone := thisTopologyTracker.drpNode.Zone
+
+	tt.tableLock.RLock()
+	defer tt.tableLock.RUnlock()
+
+	sharedSnapshot := TopologySnapshot{make(map[string]*NodeTableEntry), make(map[string]*ServiceTableEntry)}
+	for nodeID, nodeTableEntry := range *thisTopologyTracker.nodeTable {
+		if !thisTopologyTracker.isUnverified("node", nodeID) && nodeTableEntry.isSharedWith(localZone, remoteZone) {
+			sharedSnapshot.NodeTable[nodeID] = nodeTableEntry.Clone()
+		}
+	}
+	for serviceInstanceID, serviceTableEntry := range *thisTopologyTracker.serviceTable {
+		if !thisTopologyTracker.isUnverified("service", serviceInstanceID) && serviceTableEntry.isSharedWith(localZone, remoteZone) {
+			sharedSnapshot.ServiceTable[serviceInstanceID] = serviceTableEntry.Clone()
+		}
+	}
+	return sharedSnapshot
+}
+
+// getAntiEntropyEntries returns the entries shared with a Registry in the specified zone, prepared for comparison
+func (tt *TopologyTracker) getAntiEntropyEntries(remoteZone string) map[string]*antiEntropyEntry {
+	return collectAntiEntropyEntries(tt.getSharedSnapshot(remoteZone))
+}
+
+// getEntryHash returns the content hash of a table entry and whether or not it exists
+func (tt *TopologyTracker) getEntryHash(entryType string, entryID string) (string, bool) {
+	switch entryType {
+	case "node":
+		if nodeTableEntry := tt.GetNodeEntry(entryID); nodeTableEntry != nil {
+			return antiEntropyHash(nodeTableEntry.Clone()), true
+		}
+	case "service":
+		if serviceTableEntry := tt.GetServiceEntry(entryID); serviceTableEntry != nil {
+			return antiEntropyHash(serviceTableEntry.Clone()), true
+		}
+	}
+	return "", false
+}
+
+// isSharedWith tells whether or not Registries in two zones should both hold the entry
+func (tte TopologyTableEntry) isSharedWith(localZone string, remoteZone string) bool {
+	if tte.Scope == nil || tte.Zone == nil || tte.NodeID == nil {
+		return false
+	}
+	switch *tte.Scope {
+	case "global":
+		return true
+	case "zone":
+		return *tte.Zone == localZone && *tte.Zone == remoteZone
+	default:
+		return false
+	}
+}
+
+// isAuthoritative tells whether or not the holder of the entry learned it directly from its Node or proxy
+func (aee *antiEntropyEntry) isAuthoritative() bool {
+	learnedFrom := derefString(aee.baseEntry.LearnedFrom)
+	return learnedFrom == *aee.baseEntry.NodeID || (learnedFrom != "" && learnedFrom == derefString(aee.baseEntry.ProxyNodeID))
+}
+
+// collectAntiEntropyEntries prepares the entries in a snapshot for comparison
+func collectAntiEntropyEntries(topologySnapshot TopologySnapshot) map[string]*antiEntropyEntry {
+	entryMap := make(map[string]*antiEntropyEntry)
+	for nodeID, nodeTableEntry := range topologySnapshot.NodeTable {
+		if !nodeTableEntry.isComplete() {
+			continue
+		}
+		entryMap[topologyEntryKey("node", nodeID)] = &antiEntropyEntry{"node", nodeID, antiEntropyBucketKey("node", nodeTableEntry.TopologyTableEntry), nodeTableEntry.TopologyTableEntry, antiEntropyHash(nodeTableEntry.Clone()), nodeTableEntry.ToJSON()}
+	}
+	for serviceInstanceID, serviceTableEntry := range topologySnapshot.ServiceTable {
+		if !serviceTableEntry.isComplete() {
+			continue
+		}
+		entryMap[topologyEntryKey("service", serviceInstanceID)] = &antiEntropyEntry{"service", serviceInstanceID, antiEntropyBucketKey("service", serviceTableEntry.TopologyTableEntry), serviceTableEntry.TopologyTableEntry, antiEntropyHash(serviceTableEntry.Clone()), serviceTableEntry.ToJSON()}
+	}
+	return entryMap
+}
+
+// buildTopologyDigest hashes the entry hashes in each bucket, in entry ID order
+func buildTopologyDigest(entryMap map[string]*antiEntropyEntry) TopologyDigest {
+	bucketEntryKeys := make(map[string][]string)
+	for entryKey, thisEntry := range entryMap {
+		bucketEntryKeys[thisEntry.bucketKey] = append(bucketEntryKeys[thisEntry.bucketKey], entryKey)
+	}
+
+	topologyDigest := TopologyDigest{}
+	for bucketKey, entryKeys := range bucketEntryKeys {
+		sort.Strings(entryKeys)
+		bucketHash := sha256.New()
+		for _, entryKey := range entryKeys {
+			bucketHash.Write([]byte(entryKey + "=" + entryMap[entryKey].entryHash + "\n"))
+		}
+		topologyDigest[bucketKey] = hex.EncodeToString(bucketHash.Sum(nil))
+	}
+	return topologyDigest
+}
+
+// antiEntropyBucketKey returns the digest bucket for an entry
+func antiEntropyBucketKey(entryType string, baseEntry TopologyTableEntry) string {
+	return entryType + "/" + derefString(baseEntry.Zone)
+}
+
+// antiEntropyHash hashes an entry copy, leaving out the attributes which differ between the Registries holding it
+func antiEntropyHash(entryCopy interface{}) string {
+	switch tableEntry := entryCopy.(type) {
+	case *NodeTableEntry:
+		tableEntry.LearnedFrom = nil
+		tableEntry.LastModified = nil
+	case *ServiceTableEntry:
+		tableEntry.LearnedFrom = nil
+		tableEntry.LastModified = nil
+	}
+	entryBytes, _ := json.Marshal(entryCopy)
+	entryHash := sha256.Sum256(entryBytes)
+	return hex.EncodeToString(entryHash[:])
+}
@@ -0,0 +1,86 @@
+package drpmesh
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAntiEntropyDigestExchange(t *testing.T) {
+	localOptions := testNodeOptions("Registry", "registry1")
+	localNode := testNode(t, localOptions)
+	localTopologyTracker := localNode.TopologyTracker
+	remoteOptions := testNodeOptions("Registry", "registry2")
+	remoteOptions.HostID = "host2"
+	remoteNode := testNode(t, remoteOptions)
+	remoteTopologyTracker := remoteNode.TopologyTracker
+	remoteServer := httptest.NewServer(remoteNode)
+	defer remoteServer.Close()
+
+	// Connect the Registries and let them exchange their tables
+	localNode.ConnectToRegistry(testWebSocketURL(remoteServer), nil, nil)
+	waitFor(t, "the Registries to learn each other", func() bool {
+		return localTopologyTracker.GetNodeEntry("registry2") != nil && remoteTopologyTracker.GetNodeEntry("registry1") != nil
+	})
+
+	// The remote Registry gained a Provider and dropped another, but the updates never reached the local Registry
+	providerEntry := testNodeEntry("provider1")
+	workerEntry := testServiceEntry("provider1", "Worker")
+	remoteTopologyTracker.tableLock.Lock()
+	remoteTopologyTracker.nodeTable.AddEntry("provider1", providerEntry.Clone(), remoteNode.GetTimestamp())
+	remoteTopologyTracker.serviceTable.AddEntry(*workerEntry.InstanceID, workerEntry.Clone(), remoteNode.GetTimestamp())
+	remoteTopologyTracker.tableLock.Unlock()
+
+	goneEntry := testServiceEntry("registry2", "Gone")
+	remoteNodeID := "registry2"
+	goneEntry.LearnedFrom = &remoteNodeID
+	localTopologyTracker.tableLock.Lock()
+	localTopologyTracker.serviceTable.AddEntry(*goneEntry.InstanceID, goneEntry, localNode.GetTimestamp())
+	localTopologyTracker.tableLock.Unlock()
+
+	if localTopologyTracker.GetTopologyDigest("zone1")["service/zone1"] == remoteTopologyTracker.GetTopologyDigest("zone1")["service/zone1"] {
+		t.Fatalf("expected the service digests to differ before repair")
+	}
+
+	// The digest exchange over the connection finds and repairs the missing and stale entries
+	correctedCounts := localTopologyTracker.RunAntiEntropy()
+	if correctedCounts["registry2"] != 3 {
+		t.Fatalf("expected three entries corrected from registry2, got %v", correctedCounts)
+	}
+	if localTopologyTracker.GetNodeEntry("provider1") == nil || localTopologyTracker.GetServiceEntry(*workerEntry.InstanceID) == nil {
+		t.Fatalf("expected the missing Provider and its service to be added")
+	}
+	if localTopologyTracker.GetServiceEntry(*goneEntry.InstanceID) != nil {
+		t.Fatalf("expected the entry dropped by registry2 to be removed")
+	}
+	if learnedFrom := localTopologyTracker.GetNodeEntry("provider1").LearnedFrom; learnedFrom == nil || *learnedFrom != "registry2" {
+		t.Fatalf("expected the repaired entry to be learned from registry2, got %v", learnedFrom)
+	}
+	localDigest := localTopologyTracker.GetTopologyDigest("zone1")
+	remoteDigest := remoteTopologyTracker.GetTopologyDigest("zone1")
+	for bucketKey := range remoteDigest {
+		if localDigest[bucketKey] != remoteDigest[bucketKey] {
+			t.Fatalf("expected bucket [%s] to match after repair", bucketKey)
+		}
+	}
+
+	// Once converged nothing more is corrected
+	if correctedCounts := localTopologyTracker.RunAntiEntropy(); correctedCounts["registry2"] != 0 {
+		t.Fatalf("expected nothing to correct, got %v", correctedCounts)
+	}
+
+	// A Registry which never answers does not hold up the exchange
+	silentEndpoint, _ := testEndpointPair(t, localNode, "registry3")
+	silentEntry := testNodeEntry("registry3")
+	silentEntry.Roles = []string{"Registry"}
+	localTopologyTracker.ProcessPacket(TopologyPacket{"registry3", "add", "node", "registry3", *silentEntry.Scope, *silentEntry.Zone, silentEntry.ToJSON(), 1}, "registry3", true)
+	localNode.setNodeEndpoint("registry3", silentEndpoint)
+	localTopologyTracker.AntiEntropyTimeout = 100 * time.Millisecond
+	exchangeStart := time.Now()
+	if correctedCounts := localTopologyTracker.RunAntiEntropy(); correctedCounts["registry3"] != 0 {
+		t.Fatalf("expected nothing corrected from a silent Registry, got %v", correctedCounts)
+	}
+	if time.Since(exchangeStart) > 2*time.Second {
+		t.Fatalf("expected the exchange with a silent Registry to time out")
+	}
+}
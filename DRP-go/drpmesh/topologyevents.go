@@ -0,0 +1,139 @@
+package drpmesh
+
+// TopologyEvent describes a change to the Node or Service table
+type TopologyEvent struct {
+	Cmd          string
+	Type         string
+	ID           string
+	NodeEntry    *NodeTableEntry
+	ServiceEntry *ServiceTableEntry
+}
+
+// TopologyEventFilter limits which events are sent to a subscriber; empty fields match everything.
+// Setting ServiceName or ServiceType only matches service events.
+type TopologyEventFilter struct {
+	Type        string
+	ServiceName string
+	ServiceType string
+	Zone        string
+}
+
+// topologyEventSubscription is a registered event callback
+type topologyEventSubscription struct {
+	filter   TopologyEventFilter
+	callback func(TopologyEvent)
+}
+
+// Matches tells whether or not an event passes the filter
+func (tef TopologyEventFilter) Matches(topologyEvent TopologyEvent) bool {
+	if tef.Type != "" && tef.Type != topologyEvent.Type {
+		return false
+	}
+
+	var entryZone *string = nil
+	switch topologyEvent.Type {
+	case "node":
+		if tef.ServiceName != "" || tef.ServiceType != "" {
+			return false
+		}
+		entryZone = topologyEvent.NodeEntry.Zone
+	case "service":
+		if tef.ServiceName != "" && (topologyEvent.ServiceEntry.Name == nil || *topologyEvent.ServiceEntry.Name != tef.ServiceName) {
+			return false
+		}
+		if tef.ServiceType != "" && (topologyEvent.ServiceEntry.Type == nil || *topologyEvent.ServiceEntry.Type != tef.ServiceType) {
+			return false
+		}
+		entryZone = topologyEvent.ServiceEntry.Zone
+	}
+
+	if tef.Zone != "" && (entryZone == nil || *entryZone != tef.Zone) {
+		return false
+	}
+
+	return true
+}
+
+// Subscribe registers a callback for topology events matching the filter and returns the subscription ID.
+// Callbacks run after the tables are updated, on the goroutine which made the change; they should not block.
+func (tt *TopologyTracker) Subscribe(filter TopologyEventFilter, callback func(TopologyEvent)) int {
+	tt.eventLock.Lock()
+	defer tt.eventLock.Unlock()
+
+	if tt.eventSubscriptions == nil {
+		tt.eventSubscriptions = make(map[int]*topologyEventSubscription)
+	}
+	tt.lastEventSubscriptionID++
+	tt.eventSubscriptions[tt.lastEventSubscriptionID] = &topologyEventSubscription{filter, callback}
+	return tt.lastEventSubscriptionID
+}
+
+// Unsubscribe removes a topology event callback
+func (tt *TopologyTracker) Unsubscribe(subscriptionID int) {
+	tt.eventLock.Lock()
+	defer tt.eventLock.Unlock()
+	delete(tt.eventSubscriptions, subscriptionID)
+}
+
+// queueNodeEvent records a Node table change to be sent once the tables are unlocked; nil entries are ignored.
+// Caller must hold tableLock
+func (tt *TopologyTracker) queueNodeEvent(cmd string, nodeID string, nodeEntry *NodeTableEntry) {
+	if nodeEntry == nil {
+		return
+	}
+	topologyEvent := TopologyEvent{cmd, "node", nodeID, nodeEntry.Clone(), nil}
+	tt.pendingEvents = append(tt.pendingEvents, topologyEvent)
+	tt.recordChange(cmd, "node", nodeID)
+	tt.logChange(topologyEvent)
+}
+
+// queueServiceEvent records a Service table change to be sent once the tables are unlocked; nil entries are ignored.
+// Caller must hold tableLock
+func (tt *TopologyTracker) queueServiceEvent(cmd string, serviceInstanceID string, serviceEntry *ServiceTableEntry) {
+	if serviceEntry == nil {
+		return
+	}
+	topologyEvent := TopologyEvent{cmd, "service", serviceInstanceID, nil, serviceEntry.Clone()}
+	tt.pendingEvents = append(tt.pendingEvents, topologyEvent)
+	tt.recordChange(cmd, "service", serviceInstanceID)
+	tt.logChange(topologyEvent)
+}
+
+// queueEntryEvent records a change to either table entry type; caller must hold tableLock
+func (tt *TopologyTracker) queueEntryEvent(cmd string, entryID string, tableEntry interface{}) {
+	switch thisEntry := tableEntry.(type) {
+	case *NodeTableEntry:
+		tt.queueNodeEvent(cmd, entryID, thisEntry)
+	case *ServiceTableEntry:
+		tt.queueServiceEvent(cmd, entryID, thisEntry)
+	}
+}
+
+// takePendingEvents returns and clears the queued events; caller must hold tableLock
+func (tt *TopologyTracker) takePendingEvents() []TopologyEvent {
+	pendingEvents := tt.pendingEvents
+	tt.pendingEvents = nil
+	return pendingEvents
+}
+
+// sendEvents passes events to matching subscribers; must be called without holding tableLock
+func (tt *TopologyTracker) sendEvents(topologyEvents []TopologyEvent) {
+	if len(topologyEvents) == 0 {
+		return
+	}
+
+	tt.eventLock.RLock()
+	subscriptionList := make([]*topologyEventSubscription, 0, len(tt.eventSubscriptions))
+	for _, thisSubscription := range tt.eventSubscriptions {
+		subscriptionList = append(subscriptionList, thisSubscription)
+	}
+	tt.eventLock.RUnlock()
+
+	for _, topologyEvent := range topologyEvents {
+		for _, thisSubscription := range subscriptionList {
+			if thisSubscription.filter.Matches(topologyEvent) {
+				thisSubscription.callback(topologyEvent)
+			}
+		}
+	}
+}
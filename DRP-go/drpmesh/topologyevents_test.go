@@ -0,0 +1,159 @@
+package drpmesh
+
+import (
+	"sync"
+	"testing"
+)
+
+// testEventRecorder collects the topology events passed to a subscription
+type testEventRecorder struct {
+	eventLock  sync.Mutex
+	eventList  []TopologyEvent
+	tableCheck func(TopologyEvent)
+}
+
+// record stores an event after running the optional table check
+func (ter *testEventRecorder) record(topologyEvent TopologyEvent) {
+	if ter.tableCheck != nil {
+		ter.tableCheck(topologyEvent)
+	}
+	ter.eventLock.Lock()
+	defer ter.eventLock.Unlock()
+	ter.eventList = append(ter.eventList, topologyEvent)
+}
+
+// take returns the recorded events as "cmd type id" strings and clears the record
+func (ter *testEventRecorder) take() []string {
+	ter.eventLock.Lock()
+	defer ter.eventLock.Unlock()
+	eventNames := []string{}
+	for _, topologyEvent := range ter.eventList {
+		eventNames = append(eventNames, topologyEvent.Cmd+" "+topologyEvent.Type+" "+topologyEvent.ID)
+	}
+	ter.eventList = nil
+	return eventNames
+}
+
+func TestTopologyEventSubscriptions(t *testing.T) {
+	localNodeID := "registry1"
+	thisNode := testNode(t, testNodeOptions("Registry", localNodeID))
+	thisTopologyTracker := thisNode.TopologyTracker
+
+	// Callbacks run after the tables are updated, so the tracker can be read from inside them
+	allEvents := &testEventRecorder{}
+	allEvents.tableCheck = func(topologyEvent TopologyEvent) {
+		entryPresent := false
+		switch topologyEvent.Type {
+		case "node":
+			entryPresent = thisTopologyTracker.GetNodeEntry(topologyEvent.ID) != nil
+		case "service":
+			entryPresent = thisTopologyTracker.GetServiceEntry(topologyEvent.ID) != nil
+		}
+		if entryPresent != (topologyEvent.Cmd != "delete") {
+			t.Errorf("event %s %s[%s] fired before the table was updated", topologyEvent.Cmd, topologyEvent.Type, topologyEvent.ID)
+		}
+	}
+	allSubscriptionID := thisTopologyTracker.Subscribe(TopologyEventFilter{}, allEvents.record)
+
+	workerEvents := &testEventRecorder{}
+	thisTopologyTracker.Subscribe(TopologyEventFilter{ServiceName: "Worker"}, workerEvents.record)
+	otherZoneEvents := &testEventRecorder{}
+	thisTopologyTracker.Subscribe(TopologyEventFilter{Zone: "zone2"}, otherZoneEvents.record)
+	nodeEvents := &testEventRecorder{}
+	thisTopologyTracker.Subscribe(TopologyEventFilter{Type: "node"}, nodeEvents.record)
+
+	nodeID := "provider1"
+	nodeEntry := testNodeEntry(nodeID)
+	workerEntry := testServiceEntry(nodeID, "Worker")
+	cacheEntry := testServiceEntry(nodeID, "Cache")
+	thisTopologyTracker.ProcessPacket(TopologyPacket{nodeID, "add", "node", nodeID, *nodeEntry.Scope, *nodeEntry.Zone, nodeEntry.ToJSON(), 1}, nodeID, false)
+	thisTopologyTracker.ProcessPacket(TopologyPacket{nodeID, "add", "service", *workerEntry.InstanceID, *workerEntry.Scope, *workerEntry.Zone, workerEntry.ToJSON(), 1}, nodeID, false)
+	thisTopologyTracker.ProcessPacket(TopologyPacket{nodeID, "add", "service", *cacheEntry.InstanceID, *cacheEntry.Scope, *cacheEntry.Zone, cacheEntry.ToJSON(), 1}, nodeID, false)
+	workerEntry.Status = ServiceStatusDraining
+	thisTopologyTracker.ProcessPacket(TopologyPacket{nodeID, "update", "service", *workerEntry.InstanceID, *workerEntry.Scope, *workerEntry.Zone, workerEntry.ToJSON(), 2}, nodeID, false)
+
+	// Ignored packets do not produce events
+	thisTopologyTracker.ProcessPacket(TopologyPacket{nodeID, "update", "service", "missing", *workerEntry.Scope, *workerEntry.Zone, workerEntry.ToJSON(), 3}, nodeID, false)
+
+	// Deleting the Node removes its services too
+	thisTopologyTracker.ProcessPacket(TopologyPacket{nodeID, "delete", "node", nodeID, *nodeEntry.Scope, *nodeEntry.Zone, nodeEntry.ToJSON(), 2}, nodeID, false)
+
+	expectEvents := func(description string, gotEvents []string, wantEvents ...string) {
+		t.Helper()
+		if len(gotEvents) != len(wantEvents) {
+			t.Fatalf("expected %s events %v, got %v", description, wantEvents, gotEvents)
+		}
+		for eventNum := range wantEvents {
+			if gotEvents[eventNum] != wantEvents[eventNum] {
+				t.Fatalf("expected %s events %v, got %v", description, wantEvents, gotEvents)
+			}
+		}
+	}
+
+	gotAllEvents := allEvents.take()
+	expectEvents("leading", gotAllEvents[:4], "add node provider1", "add service provider1-Worker", "add service provider1-Cache", "update service provider1-Worker")
+	// The cascaded service deletes follow the map order of the table
+	expectEvents("delete", gotAllEvents[4:5], "delete node provider1")
+	if len(gotAllEvents) != 7 {
+		t.Fatalf("expected two cascaded service deletes, got %v", gotAllEvents)
+	}
+	expectEvents("service name filtered", workerEvents.take(), "add service provider1-Worker", "update service provider1-Worker", "delete service provider1-Worker")
+	expectEvents("zone filtered", otherZoneEvents.take())
+	expectEvents("type filtered", nodeEvents.take(), "add node provider1", "delete node provider1")
+
+	// Events carry copies of the entries
+	thisTopologyTracker.ProcessPacket(TopologyPacket{nodeID, "add", "node", "provider2", *nodeEntry.Scope, *nodeEntry.Zone, testNodeEntry("provider2").ToJSON(), 1}, "provider2", false)
+	allEvents.eventLock.Lock()
+	if len(allEvents.eventList) != 1 || allEvents.eventList[0].NodeEntry == nil {
+		t.Fatalf("expected one node event with an entry, got %v", allEvents.eventList)
+	}
+	*allEvents.eventList[0].NodeEntry.Zone = "changed"
+	allEvents.eventLock.Unlock()
+	if *thisTopologyTracker.GetNodeEntry("provider2").Zone != "zone1" {
+		t.Fatalf("expected changes to an event entry not to reach the table")
+	}
+	allEvents.take()
+
+	// Unsubscribed callbacks stop receiving events
+	thisTopologyTracker.Unsubscribe(allSubscriptionID)
+	thisTopologyTracker.ProcessPacket(TopologyPacket{"provider2", "delete", "node", "provider2", *nodeEntry.Scope, *nodeEntry.Zone, testNodeEntry("provider2").ToJSON(), 2}, "provider2", false)
+	expectEvents("unsubscribed", allEvents.take())
+	expectEvents("still subscribed", nodeEvents.take(), "add node provider2", "delete node provider2")
+
+	// Entries that have already gone are skipped rather than queued
+	thisTopologyTracker.tableLock.Lock()
+	thisTopologyTracker.queueNodeEvent("delete", "gone", nil)
+	thisTopologyTracker.queueServiceEvent("delete", "gone", nil)
+	pendingEvents := thisTopologyTracker.takePendingEvents()
+	thisTopologyTracker.tableLock.Unlock()
+	if len(pendingEvents) != 0 {
+		t.Fatalf("expected nil entries to be skipped, got %v", pendingEvents)
+	}
+}
+
+func TestTopologyEventFilter(t *testing.T) {
+	otherZone := "zone2"
+	nodeEvent := TopologyEvent{"add", "node", "provider1", testNodeEntry("provider1"), nil}
+	serviceEntry := testServiceEntry("provider1", "Worker")
+	serviceEntry.Zone = &otherZone
+	serviceEvent := TopologyEvent{"add", "service", "provider1-Worker", nil, serviceEntry}
+
+	filterChecks := []struct {
+		filter       TopologyEventFilter
+		nodeMatch    bool
+		serviceMatch bool
+	}{
+		{TopologyEventFilter{}, true, true},
+		{TopologyEventFilter{Type: "service"}, false, true},
+		{TopologyEventFilter{ServiceName: "Worker"}, false, true},
+		{TopologyEventFilter{ServiceName: "Cache"}, false, false},
+		{TopologyEventFilter{ServiceType: "Worker"}, false, true},
+		{TopologyEventFilter{Zone: "zone1"}, true, false},
+		{TopologyEventFilter{Zone: "zone2", ServiceName: "Worker"}, false, true},
+	}
+	for _, filterCheck := range filterChecks {
+		if filterCheck.filter.Matches(nodeEvent) != filterCheck.nodeMatch || filterCheck.filter.Matches(serviceEvent) != filterCheck.serviceMatch {
+			t.Errorf("filter %+v: expected node match %t and service match %t", filterCheck.filter, filterCheck.nodeMatch, filterCheck.serviceMatch)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package drpmesh
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Topology export formats accepted by ExportTopology
+const (
+	TopologyFormatDOT     = "dot"
+	TopologyFormatMermaid = "mermaid"
+	TopologyFormatJSON    = "json"
+)
+
+// Topology graph edge types
+const (
+	TopologyEdgeLearnedFrom = "learnedFrom"
+	TopologyEdgeProxy       = "proxy"
+	TopologyEdgeHosts       = "hosts"
+)
+
+// TopologyGraphNode is a mesh Node vertex in a TopologyGraph
+type TopologyGraphNode struct {
+	NodeID  string   `json:"nodeID"`
+	Zone    string   `json:"zone"`
+	Scope   string   `json:"scope"`
+	Roles   []string `json:"roles"`
+	NodeURL *string  `json:"nodeURL"`
+}
+
+// TopologyGraphService is a service instance vertex in a TopologyGraph
+type TopologyGraphService struct {
+	InstanceID string `json:"instanceID"`
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	NodeID     string `json:"nodeID"`
+	Zone       string `json:"zone"`
+	Scope      string `json:"scope"`
+	Status     string `json:"status"`
+}
+
+// TopologyGraphEdge is a directed link between two vertices in a TopologyGraph
+type TopologyGraphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Type string `json:"type"`
+}
+
+// TopologyGraph is a renderable view of the Node and Service tables
+type TopologyGraph struct {
+	Nodes    []TopologyGraphNode    `json:"nodes"`
+	Services []TopologyGraphService `json:"services"`
+	Edges    []TopologyGraphEdge    `json:"edges"`
+}
+
+// GetTopologyGraph builds a graph of the Node and Service tables, optionally limited to a zone.  Edges pointing
+// at Nodes outside of the graph are left out.
+func (tt *TopologyTracker) GetTopologyGraph(zoneName *string) *TopologyGraph {
+	thisTopologyTracker := tt
+	snapshot := thisTopologyTracker.Snapshot()
+
+	topologyGraph := &TopologyGraph{[]TopologyGraphNode{}, []TopologyGraphService{}, []TopologyGraphEdge{}}
+	inZone := func(entryZone *string) bool {
+		return zoneName == nil || (entryZone != nil && *entryZone == *zoneName)
+	}
+
+	// Add Nodes
+	includedNodes := make(map[string]*NodeTableEntry)
+	for nodeID, nodeTableEntry := range snapshot.NodeTable {
+		if !inZone(nodeTableEntry.Zone) {
+			continue
+		}
+		includedNodes[nodeID] = nodeTableEntry
+		topologyGraph.Nodes = append(topologyGraph.Nodes, TopologyGraphNode{nodeID, derefString(nodeTableEntry.Zone), derefString(nodeTableEntry.Scope), cloneStrings(nodeTableEntry.Roles), cloneString(nodeTableEntry.NodeURL)})
+	}
+
+	// Add LearnedFrom and proxy edges
+	for nodeID, nodeTableEntry := range includedNodes {
+		if nodeTableEntry.LearnedFrom != nil && *nodeTableEntry.LearnedFrom != nodeID && includedNodes[*nodeTableEntry.LearnedFrom] != nil {
+			topologyGraph.Edges = append(topologyGraph.Edges, TopologyGraphEdge{nodeID, *nodeTableEntry.LearnedFrom, TopologyEdgeLearnedFrom})
+		}
+		if nodeTableEntry.ProxyNodeID != nil && *nodeTableEntry.ProxyNodeID != "" && includedNodes[*nodeTableEntry.ProxyNodeID] != nil {
+			topologyGraph.Edges = append(topologyGraph.Edges, TopologyGraphEdge{nodeID, *nodeTableEntry.ProxyNodeID, TopologyEdgeProxy})
+		}
+	}
+
+	// Add services and the Nodes hosting them
+	for serviceInstanceID, serviceTableEntry := range snapshot.ServiceTable {
+		if serviceTableEntry.NodeID == nil || includedNodes[*serviceTableEntry.NodeID] == nil {
+			continue
+		}
+		topologyGraph.Services = append(topologyGraph.Services, TopologyGraphService{serviceInstanceID, derefString(serviceTableEntry.Name), derefString(serviceTableEntry.Type), *serviceTableEntry.NodeID, derefString(serviceTableEntry.Zone), derefString(serviceTableEntry.Scope), ServiceStatusName(serviceTableEntry.Status)})
+		topologyGraph.Edges = append(topologyGraph.Edges, TopologyGraphEdge{*serviceTableEntry.NodeID, serviceInstanceID, TopologyEdgeHosts})
+	}
+
+	// Sort for stable output
+	sort.Slice(topologyGraph.Nodes, func(i, j int) bool {
+		return topologyGraph.Nodes[i].NodeID < topologyGraph.Nodes[j].NodeID
+	})
+	sort.Slice(topologyGraph.Services, func(i, j int) bool {
+		return topologyGraph.Services[i].InstanceID < topologyGraph.Services[j].InstanceID
+	})
+	sort.Slice(topologyGraph.Edges, func(i, j int) bool {
+		if topologyGraph.Edges[i].From != topologyGraph.Edges[j].From {
+			return topologyGraph.Edges[i].From < topologyGraph.Edges[j].From
+		}
+		if topologyGraph.Edges[i].To != topologyGraph.Edges[j].To {
+			return topologyGraph.Edges[i].To < topologyGraph.Edges[j].To
+		}
+		return topologyGraph.Edges[i].Type < topologyGraph.Edges[j].Type
+	})
+
+	return topologyGraph
+}
+
+// ExportTopology renders the topology graph in the requested format, optionally limited to a zone.  DOT and
+// Mermaid are returned as strings and JSON as a *TopologyGraph.
+func (tt *TopologyTracker) ExportTopology(format string, zoneName *string) (interface{}, error) {
+	topologyGraph := tt.GetTopologyGraph(zoneName)
+	switch strings.ToLower(format) {
+	case TopologyFormatDOT:
+		return topologyGraph.ToDOT(), nil
+	case TopologyFormatMermaid:
+		return topologyGraph.ToMermaid(), nil
+	case TopologyFormatJSON:
+		return topologyGraph, nil
+	default:
+		return nil, fmt.Errorf("unknown topology format [%s]", format)
+	}
+}
+
+// zones returns the sorted list of zones with Nodes in the graph
+func (tg *TopologyGraph) zones() []string {
+	uniqueZoneMap := make(map[string]bool)
+	for _, graphNode := range tg.Nodes {
+		uniqueZoneMap[graphNode.Zone] = true
+	}
+	zoneList := GetKeys(uniqueZoneMap)
+	sort.Strings(zoneList)
+	return zoneList
+}
+
+// nodeZones returns a map of Node IDs to zones
+func (tg *TopologyGraph) nodeZones() map[string]string {
+	nodeZoneMap := make(map[string]string)
+	for _, graphNode := range tg.Nodes {
+		nodeZoneMap[graphNode.NodeID] = graphNode.Zone
+	}
+	return nodeZoneMap
+}
+
+// ToDOT renders the graph in Graphviz DOT format with one cluster per zone
+func (tg *TopologyGraph) ToDOT() string {
+	var sb strings.Builder
+	sb.WriteString("digraph drpmesh {\n")
+	sb.WriteString("\trankdir=LR;\n")
+	sb.WriteString("\tnode [fontname=\"Helvetica\"];\n")
+
+	// Services are drawn in the zone of the Node hosting them
+	nodeZones := tg.nodeZones()
+
+	for zoneIndex, zoneName := range tg.zones() {
+		sb.WriteString(fmt.Sprintf("\tsubgraph cluster_%d {\n", zoneIndex))
+		sb.WriteString(fmt.Sprintf("\t\tlabel=%s;\n", dotQuote("zone: "+zoneName)))
+		for _, graphNode := range tg.Nodes {
+			if graphNode.Zone != zoneName {
+				continue
+			}
+			nodeLabel := graphNode.NodeID
+			if len(graphNode.Roles) > 0 {
+				nodeLabel += "\n" + strings.Join(graphNode.Roles, ",")
+			}
+			sb.WriteString(fmt.Sprintf("\t\t%s [shape=box, label=%s];\n", dotQuote(graphNode.NodeID), dotQuote(nodeLabel)))
+		}
+		for _, graphService := range tg.Services {
+			if nodeZones[graphService.NodeID] != zoneName {
+				continue
+			}
+			serviceLabel := fmt.Sprintf("%s\n%s", graphService.Name, graphService.Status)
+			sb.WriteString(fmt.Sprintf("\t\t%s [shape=ellipse, label=%s];\n", dotQuote(graphService.InstanceID), dotQuote(serviceLabel)))
+		}
+		sb.WriteString("\t}\n")
+	}
+
+	for _, graphEdge := range tg.Edges {
+		edgeStyle := ""
+		switch graphEdge.Type {
+		case TopologyEdgeLearnedFrom:
+			edgeStyle = " [style=dashed, label=\"learnedFrom\"]"
+		case TopologyEdgeProxy:
+			edgeStyle = " [style=bold, label=\"proxy\"]"
+		}
+		sb.WriteString(fmt.Sprintf("\t%s -> %s%s;\n", dotQuote(graphEdge.From), dotQuote(graphEdge.To), edgeStyle))
+	}
+
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+// ToMermaid renders the graph as a Mermaid flowchart with one subgraph per zone
+func (tg *TopologyGraph) ToMermaid() string {
+	var sb strings.Builder
+	sb.WriteString("flowchart LR\n")
+
+	// Services are drawn in the zone of the Node hosting them
+	nodeZones := tg.nodeZones()
+
+	for zoneIndex, zoneName := range tg.zones() {
+		sb.WriteString(fmt.Sprintf("  subgraph zone_%d[%s]\n", zoneIndex, mermaidQuote("zone: "+zoneName)))
+		for _, graphNode := range tg.Nodes {
+			if graphNode.Zone != zoneName {
+				continue
+			}
+			nodeLabel := graphNode.NodeID
+			if len(graphNode.Roles) > 0 {
+				nodeLabel += "<br>" + strings.Join(graphNode.Roles, ",")
+			}
+			sb.WriteString(fmt.Sprintf("    %s[%s]\n", mermaidID("n", graphNode.NodeID), mermaidQuote(nodeLabel)))
+		}
+		for _, graphService := range tg.Services {
+			if nodeZones[graphService.NodeID] != zoneName {
+				continue
+			}
+			serviceLabel := fmt.Sprintf("%s<br>%s", graphService.Name, graphService.Status)
+			sb.WriteString(fmt.Sprintf("    %s([%s])\n", mermaidID("s", graphService.InstanceID), mermaidQuote(serviceLabel)))
+		}
+		sb.WriteString("  end\n")
+	}
+
+	for _, graphEdge := range tg.Edges {
+		switch graphEdge.Type {
+		case TopologyEdgeLearnedFrom:
+			sb.WriteString(fmt.Sprintf("  %s -.->|learnedFrom| %s\n", mermaidID("n", graphEdge.From), mermaidID("n", graphEdge.To)))
+		case TopologyEdgeProxy:
+			sb.WriteString(fmt.Sprintf("  %s ==>|proxy| %s\n", mermaidID("n", graphEdge.From), mermaidID("n", graphEdge.To)))
+		case TopologyEdgeHosts:
+			sb.WriteString(fmt.Sprintf("  %s --> %s\n", mermaidID("n", graphEdge.From), mermaidID("s", graphEdge.To)))
+		}
+	}
+
+	return sb.String()
+}
+
+// dotQuote returns a quoted DOT identifier
+func dotQuote(value string) string {
+	value = strings.ReplaceAll(value, "\\", "\\\\")
+	value = strings.ReplaceAll(value, "\"", "\\\"")
+	value = strings.ReplaceAll(value, "\n", "\\n")
+	return "\"" + value + "\""
+}
+
+// mermaidQuote returns a quoted Mermaid label
+func mermaidQuote(value string) string {
+	return "\"" + strings.ReplaceAll(value, "\"", "#quot;") + "\""
+}
+
+// mermaidID returns a Mermaid-safe vertex ID; IDs are prefixed so Nodes and services cannot collide and
+// other characters are hex escaped so distinct IDs stay distinct
+func mermaidID(prefix string, value string) string {
+	var sb strings.Builder
+	sb.WriteString(prefix + "_")
+	for _, r := range value {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			sb.WriteRune(r)
+		} else {
+			sb.WriteString(fmt.Sprintf("_%x_", r))
+		}
+	}
+	return sb.String()
+}
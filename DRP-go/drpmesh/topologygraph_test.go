@@ -0,0 +1,75 @@
+package drpmesh
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTopologyGraph(t *testing.T) {
+	localNodeID := "registry1"
+	thisNode := testNode(t, testNodeOptions("Registry", localNodeID))
+	thisTopologyTracker := thisNode.TopologyTracker
+	addTestProvider(thisTopologyTracker, "provider1", "zone1", "Worker")
+	addTestProvider(thisTopologyTracker, "provider2", "zone2", "Worker")
+
+	// A Node which was learned through the Registry that also proxies it has two edges between the same Nodes
+	proxiedEntry := testNodeEntry("provider3")
+	proxiedEntry.LearnedFrom = &localNodeID
+	proxiedEntry.ProxyNodeID = &localNodeID
+	thisTopologyTracker.tableLock.Lock()
+	thisTopologyTracker.nodeTable.AddEntry("provider3", proxiedEntry, thisNode.GetTimestamp())
+	thisTopologyTracker.tableLock.Unlock()
+
+	topologyGraph := thisTopologyTracker.GetTopologyGraph(nil)
+	graphNodeIDs := []string{}
+	for _, graphNode := range topologyGraph.Nodes {
+		graphNodeIDs = append(graphNodeIDs, graphNode.NodeID)
+	}
+	if strings.Join(graphNodeIDs, ",") != "provider1,provider2,provider3,registry1" {
+		t.Fatalf("expected the Nodes sorted by ID, got %v", graphNodeIDs)
+	}
+
+	// Edges are sorted by source, target and then type so the output is the same on every call
+	proxiedEdges := []string{}
+	for _, graphEdge := range topologyGraph.Edges {
+		if graphEdge.From == "provider3" {
+			proxiedEdges = append(proxiedEdges, graphEdge.Type)
+		}
+	}
+	if strings.Join(proxiedEdges, ",") != TopologyEdgeLearnedFrom+","+TopologyEdgeProxy {
+		t.Fatalf("expected the learnedFrom edge before the proxy edge, got %v", proxiedEdges)
+	}
+	for exportNum := 0; exportNum < 5; exportNum++ {
+		if thisTopologyTracker.GetTopologyGraph(nil).ToDOT() != topologyGraph.ToDOT() {
+			t.Fatalf("expected repeated exports to be identical")
+		}
+	}
+
+	// Limiting the graph to a zone drops the other Nodes, their services and edges pointing at them
+	zoneName := "zone2"
+	zoneGraph := thisTopologyTracker.GetTopologyGraph(&zoneName)
+	if len(zoneGraph.Nodes) != 1 || zoneGraph.Nodes[0].NodeID != "provider2" || len(zoneGraph.Services) != 1 {
+		t.Fatalf("expected only provider2 and its service, got %v and %v", zoneGraph.Nodes, zoneGraph.Services)
+	}
+	if len(zoneGraph.Edges) != 1 || zoneGraph.Edges[0] != (TopologyGraphEdge{"provider2", "provider2-Worker", TopologyEdgeHosts}) {
+		t.Fatalf("expected only the hosting edge, got %v", zoneGraph.Edges)
+	}
+
+	// Renderers draw one group per zone and every edge
+	dotText := topologyGraph.ToDOT()
+	for _, expectedText := range []string{`label="zone: zone1"`, `label="zone: zone2"`, `"provider1" -> "provider1-Worker";`, `"provider3" -> "registry1" [style=bold, label="proxy"];`} {
+		if !strings.Contains(dotText, expectedText) {
+			t.Errorf("expected DOT output to contain %s:\n%s", expectedText, dotText)
+		}
+	}
+	mermaidText := topologyGraph.ToMermaid()
+	for _, expectedText := range []string{"subgraph zone_1[\"zone: zone2\"]", "n_provider3 -.->|learnedFrom| n_registry1", "n_provider1 --> s_provider1_2d_Worker"} {
+		if !strings.Contains(mermaidText, expectedText) {
+			t.Errorf("expected Mermaid output to contain %s:\n%s", expectedText, mermaidText)
+		}
+	}
+
+	if _, err := thisTopologyTracker.ExportTopology("svg", nil); err == nil {
+		t.Fatalf("expected an unknown format to be rejected")
+	}
+}
@@ -0,0 +1,120 @@
+package drpmesh
+
+import (
+	"fmt"
+	"time"
+)
+
+// DefaultTombstoneTTL is how long the sequence of a deleted entry is kept to reject late adds relayed by other Nodes
+const DefaultTombstoneTTL = 5 * time.Minute
+
+// topologyTombstone records the sequence of a deleted table entry
+type topologyTombstone struct {
+	sequence uint64
+	deleted  time.Time
+}
+
+// NextSequence returns the next sequence number for topology entries originated by this Node.  Sequences are
+// hybrid logical clock values: microseconds since the epoch, bumped past the last value issued so they keep
+// increasing within the same microsecond.  The last value is not persisted, so after a restart ordering relies
+// on the wall clock having moved past the sequences issued before it.
+func (tt *TopologyTracker) NextSequence() uint64 {
+	tt.sequenceLock.Lock()
+	defer tt.sequenceLock.Unlock()
+
+	nextSequence := uint64(time.Now().UnixNano() / int64(time.Microsecond))
+	if nextSequence <= tt.lastSequence {
+		nextSequence = tt.lastSequence + 1
+	}
+	tt.lastSequence = nextSequence
+	return nextSequence
+}
+
+// setEntrySequence stores a packet sequence in a Node or Service table entry which did not carry one
+func setEntrySequence(entryData interface{}, sequence uint64) {
+	if sequence == 0 {
+		return
+	}
+	switch tableEntry := entryData.(type) {
+	case *NodeTableEntry:
+		if tableEntry.Sequence == 0 {
+			tableEntry.Sequence = sequence
+		}
+	case *ServiceTableEntry:
+		if tableEntry.Sequence == 0 {
+			tableEntry.Sequence = sequence
+		}
+	}
+}
+
+// checkSequence tells why a topology packet is stale or a duplicate, or returns an empty string if it should be
+// processed.  A zero sequence comes from a Node without sequence support and is never rejected.  Adds sent
+// directly by the entry's own Node skip the tombstone check so a Node can rejoin after being removed.  Caller
+// must hold tableLock.
+func (tt *TopologyTracker) checkSequence(topologyPacket TopologyPacket, packetSequence uint64, targetTable TopologyTable, fromOrigin bool, packetEntry interface{}) string {
+	if packetSequence == 0 {
+		return ""
+	}
+
+	if !targetTable.HasEntry(topologyPacket.ID) {
+		if topologyPacket.Cmd != "add" || fromOrigin {
+			return ""
+		}
+		thisTombstone, ok := tt.tombstones[topologyEntryKey(topologyPacket.Type, topologyPacket.ID)]
+		if ok && packetSequence <= thisTombstone.sequence {
+			return fmt.Sprintf("entry was deleted at sequence %d", thisTombstone.sequence)
+		}
+		return ""
+	}
+
+	entrySequence := targetTable.GetEntry(topologyPacket.ID).(TopologyTableEntryInterface).GetSequence()
+	if entrySequence == 0 {
+		return ""
+	}
+
+	if packetSequence < entrySequence {
+		return fmt.Sprintf("table entry is at newer sequence %d", entrySequence)
+	}
+	if topologyPacket.Cmd == "update" && packetSequence == entrySequence {
+		if isStatusOverride(topologyPacket, targetTable.GetEntry(topologyPacket.ID), packetEntry) {
+			return ""
+		}
+		return "duplicate update"
+	}
+	return ""
+}
+
+// isStatusOverride tells whether or not a packet is a status change issued by a Node other than the service's own,
+// e.g. a Registry health check.  These keep the provider's sequence so its next advertisement supersedes them.
+func isStatusOverride(topologyPacket TopologyPacket, tableEntry interface{}, packetEntry interface{}) bool {
+	tableServiceEntry, ok := tableEntry.(*ServiceTableEntry)
+	if !ok {
+		return false
+	}
+	packetServiceEntry, ok := packetEntry.(*ServiceTableEntry)
+	if !ok || packetServiceEntry.NodeID == nil {
+		return false
+	}
+	return topologyPacket.OriginNodeID != *packetServiceEntry.NodeID && packetServiceEntry.Status != tableServiceEntry.Status
+}
+
+// recordTombstone remembers the sequence of a deleted entry; caller must hold tableLock
+func (tt *TopologyTracker) recordTombstone(entryType string, entryID string, sequence uint64) {
+	if sequence == 0 {
+		return
+	}
+	tombstoneKey := topologyEntryKey(entryType, entryID)
+	if thisTombstone, ok := tt.tombstones[tombstoneKey]; ok && thisTombstone.sequence > sequence {
+		return
+	}
+	tt.tombstones[tombstoneKey] = &topologyTombstone{sequence, time.Now()}
+}
+
+// pruneTombstones discards tombstones older than the TTL; caller must hold tableLock
+func (tt *TopologyTracker) pruneTombstones(tombstoneTTL time.Duration) {
+	for tombstoneKey, thisTombstone := range tt.tombstones {
+		if time.Since(thisTombstone.deleted) > tombstoneTTL {
+			delete(tt.tombstones, tombstoneKey)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package drpmesh
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextSequence(t *testing.T) {
+	thisNode := testNode(t, testNodeOptions("Provider", "provider1"))
+	thisTopologyTracker := thisNode.TopologyTracker
+
+	// Sequences keep increasing even when issued within the same microsecond
+	lastSequence := thisTopologyTracker.NextSequence()
+	for sequenceNum := 0; sequenceNum < 1000; sequenceNum++ {
+		nextSequence := thisTopologyTracker.NextSequence()
+		if nextSequence <= lastSequence {
+			t.Fatalf("expected sequence %d to be greater than %d", nextSequence, lastSequence)
+		}
+		lastSequence = nextSequence
+	}
+	if lastSequence < uint64(time.Now().Add(-time.Minute).UnixMicro()) {
+		t.Fatalf("expected sequences to follow the wall clock, got %d", lastSequence)
+	}
+}
+
+func TestSynthesizedDeletesLeaveNoTombstone(t *testing.T) {
+	localNodeID := "registry1"
+	thisNode := testNode(t, testNodeOptions("Registry", localNodeID))
+	thisTopologyTracker := thisNode.TopologyTracker
+
+	// advertise relays a Provider connected to a peer Registry and its service at sequence 10
+	providerEntry := testNodeEntry("provider1")
+	providerEntry.Sequence = 10
+	workerEntry := testServiceEntry("provider1", "Worker")
+	workerEntry.Sequence = 10
+	advertise := func(registryNodeID string) {
+		thisTopologyTracker.ProcessPacket(TopologyPacket{"provider1", "add", "node", "provider1", *providerEntry.Scope, *providerEntry.Zone, providerEntry.ToJSON(), 10}, registryNodeID, true)
+		thisTopologyTracker.ProcessPacket(TopologyPacket{"provider1", "add", "service", *workerEntry.InstanceID, *workerEntry.Scope, *workerEntry.Zone, workerEntry.ToJSON(), 10}, registryNodeID, true)
+	}
+
+	for _, registryNodeID := range []string{"registry2", "registry3"} {
+		registryEntry := testNodeEntry(registryNodeID)
+		registryEntry.Roles = []string{"Registry"}
+		thisTopologyTracker.ProcessPacket(TopologyPacket{registryNodeID, "add", "node", registryNodeID, *registryEntry.Scope, *registryEntry.Zone, registryEntry.ToJSON(), 1}, registryNodeID, true)
+	}
+	advertise("registry2")
+	if thisTopologyTracker.GetServiceEntry(*workerEntry.InstanceID) == nil {
+		t.Fatalf("expected the Provider to be learned from registry2")
+	}
+
+	// Losing registry2 removes what was learned from it without leaving tombstones
+	thisTopologyTracker.ProcessNodeDisconnect("registry2")
+	if thisTopologyTracker.GetNodeEntry("provider1") != nil || thisTopologyTracker.GetServiceEntry(*workerEntry.InstanceID) != nil {
+		t.Fatalf("expected the entries learned from registry2 to be removed")
+	}
+	thisTopologyTracker.tableLock.RLock()
+	tombstoneCount := len(thisTopologyTracker.tombstones)
+	thisTopologyTracker.tableLock.RUnlock()
+	if tombstoneCount != 0 {
+		t.Fatalf("expected no tombstones from a disconnect, got %d", tombstoneCount)
+	}
+
+	// The Provider fails over to registry3, which relays it at the same sequence
+	advertise("registry3")
+	if thisTopologyTracker.GetNodeEntry("provider1") == nil || thisTopologyTracker.GetServiceEntry(*workerEntry.InstanceID) == nil {
+		t.Fatalf("expected the failover advertisement to re-add the Provider")
+	}
+
+	// A delete issued by the Provider itself still blocks late relayed adds
+	thisTopologyTracker.ProcessPacket(TopologyPacket{"provider1", "delete", "service", *workerEntry.InstanceID, *workerEntry.Scope, *workerEntry.Zone, workerEntry.ToJSON(), 11}, "provider1", false)
+	thisTopologyTracker.ProcessPacket(TopologyPacket{"provider1", "add", "service", *workerEntry.InstanceID, *workerEntry.Scope, *workerEntry.Zone, workerEntry.ToJSON(), 10}, "registry3", true)
+	if thisTopologyTracker.GetServiceEntry(*workerEntry.InstanceID) != nil {
+		t.Fatalf("expected the origin's delete to block the late add")
+	}
+}
+
+func TestHealthStatusOverrideKeepsSequence(t *testing.T) {
+	localNodeID := "registry1"
+	thisNode := testNode(t, testNodeOptions("Registry", localNodeID))
+	thisTopologyTracker := thisNode.TopologyTracker
+
+	addTestProvider(thisTopologyTracker, "provider1", "zone1")
+	webEntry := testServiceEntry("provider1", "Web")
+	webEntry.Sequence = 10
+	thisTopologyTracker.ProcessPacket(TopologyPacket{"provider1", "add", "service", *webEntry.InstanceID, *webEntry.Scope, *webEntry.Zone, webEntry.ToJSON(), 10}, "provider1", false)
+
+	// Failed checks mark the remote instance unhealthy without touching the provider's sequence
+	for checkCount := 0; checkCount < thisTopologyTracker.HealthCheckFailThreshold; checkCount++ {
+		thisTopologyTracker.recordHealthResult(thisTopologyTracker.GetServiceEntry(*webEntry.InstanceID), false)
+	}
+	checkEntry := thisTopologyTracker.GetServiceEntry(*webEntry.InstanceID)
+	if checkEntry.Status != ServiceStatusUnhealthy || checkEntry.Sequence != 10 {
+		t.Fatalf("expected an unhealthy instance at sequence 10, got %s at %d", ServiceStatusName(checkEntry.Status), checkEntry.Sequence)
+	}
+
+	// A repeated override with the same status is a duplicate; the provider's next advertisement supersedes it
+	webEntry.Status = ServiceStatusUnhealthy
+	thisTopologyTracker.tableLock.RLock()
+	staleReason := thisTopologyTracker.checkSequence(TopologyPacket{localNodeID, "update", "service", *webEntry.InstanceID, *webEntry.Scope, *webEntry.Zone, webEntry.ToJSON(), 10}, 10, *thisTopologyTracker.serviceTable, false, webEntry)
+	thisTopologyTracker.tableLock.RUnlock()
+	if staleReason != "duplicate update" {
+		t.Fatalf("expected a repeated override to be a duplicate, got [%s]", staleReason)
+	}
+	webEntry.Status = ServiceStatusReady
+	webEntry.Sequence = 11
+	thisTopologyTracker.ProcessPacket(TopologyPacket{"provider1", "update", "service", *webEntry.InstanceID, *webEntry.Scope, *webEntry.Zone, webEntry.ToJSON(), 11}, "provider1", false)
+	if checkEntry := thisTopologyTracker.GetServiceEntry(*webEntry.InstanceID); checkEntry.Status != ServiceStatusReady || checkEntry.Sequence != 11 {
+		t.Fatalf("expected the provider's update to apply, got %s at %d", ServiceStatusName(checkEntry.Status), checkEntry.Sequence)
+	}
+
+	// The provider's own updates at an old sequence are still rejected
+	webEntry.Status = ServiceStatusDraining
+	thisTopologyTracker.ProcessPacket(TopologyPacket{"provider1", "update", "service", *webEntry.InstanceID, *webEntry.Scope, *webEntry.Zone, webEntry.ToJSON(), 11}, "provider1", false)
+	if thisTopologyTracker.GetServiceEntry(*webEntry.InstanceID).Status != ServiceStatusReady {
+		t.Fatalf("expected a duplicate provider update to be ignored")
+	}
+}
@@ -0,0 +1,437 @@
+package drpmesh
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Files kept in the topology state directory
+const (
+	topologySnapshotFile = "topology.snapshot.json"
+	topologyLogFile      = "topology.log"
+)
+
+// topologyLogCompactThreshold is the number of logged changes after which a new snapshot is written
+const topologyLogCompactThreshold = 1000
+
+// DefaultUnverifiedGracePeriod is how long entries restored from disk are kept without being confirmed by a live Node
+const DefaultUnverifiedGracePeriod = 2 * time.Minute
+
+// topologyLogRecord is a single change in the topology change log
+type topologyLogRecord struct {
+	Cmd  string          `json:"cmd"`
+	Type string          `json:"type"`
+	ID   string          `json:"id"`
+	Data json.RawMessage `json:"data"`
+}
+
+// TopologyStore persists the Node and Service tables as a snapshot file plus a log of changes since the snapshot.
+// Changes are queued in table order while the tables are locked and written by a background writer, so replay
+// sees them in the order they were applied and the disk is never written from the packet path.
+type TopologyStore struct {
+	stateDir      string
+	logFile       *os.File
+	logCount      int
+	storeLock     sync.Mutex
+	queueLock     sync.Mutex
+	queuedRecords []topologyLogRecord
+	queueSignal   chan bool
+	writerStop    chan bool
+	writerDone    chan bool
+}
+
+// OpenTopologyStore opens (or creates) a topology state directory
+func OpenTopologyStore(stateDir string) (*TopologyStore, error) {
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return nil, fmt.Errorf("could not create topology state directory %s: %s", stateDir, err)
+	}
+	logFile, err := os.OpenFile(filepath.Join(stateDir, topologyLogFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open topology log: %s", err)
+	}
+	return &TopologyStore{stateDir: stateDir, logFile: logFile, queueSignal: make(chan bool, 1)}, nil
+}
+
+// Load returns the persisted tables: the last snapshot with the change log replayed on top
+func (ts *TopologyStore) Load() (TopologySnapshot, error) {
+	ts.storeLock.Lock()
+	defer ts.storeLock.Unlock()
+
+	loadedTables := TopologySnapshot{make(map[string]*NodeTableEntry), make(map[string]*ServiceTableEntry)}
+
+	snapshotBytes, err := os.ReadFile(filepath.Join(ts.stateDir, topologySnapshotFile))
+	if err == nil {
+		if err := json.Unmarshal(snapshotBytes, &loadedTables); err != nil {
+			return loadedTables, fmt.Errorf("could not parse topology snapshot: %s", err)
+		}
+		if loadedTables.NodeTable == nil {
+			loadedTables.NodeTable = make(map[string]*NodeTableEntry)
+		}
+		if loadedTables.ServiceTable == nil {
+			loadedTables.ServiceTable = make(map[string]*ServiceTableEntry)
+		}
+	} else if !os.IsNotExist(err) {
+		return loadedTables, fmt.Errorf("could not read topology snapshot: %s", err)
+	}
+
+	logFile, err := os.Open(filepath.Join(ts.stateDir, topologyLogFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return loadedTables, nil
+		}
+		return loadedTables, fmt.Errorf("could not read topology log: %s", err)
+	}
+	defer logFile.Close()
+
+	logScanner := bufio.NewScanner(logFile)
+	logScanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	ts.logCount = 0
+	for logScanner.Scan() {
+		logRecord := topologyLogRecord{}
+		if json.Unmarshal(logScanner.Bytes(), &logRecord) != nil {
+			// A torn final write; everything before it is still usable
+			continue
+		}
+		ts.logCount++
+		switch logRecord.Type {
+		case "node":
+			if logRecord.Cmd == "delete" {
+				delete(loadedTables.NodeTable, logRecord.ID)
+				continue
+			}
+			nodeEntry := &NodeTableEntry{}
+			if json.Unmarshal(logRecord.Data, nodeEntry) == nil {
+				loadedTables.NodeTable[logRecord.ID] = nodeEntry
+			}
+		case "service":
+			if logRecord.Cmd == "delete" {
+				delete(loadedTables.ServiceTable, logRecord.ID)
+				continue
+			}
+			serviceEntry := &ServiceTableEntry{}
+			if json.Unmarshal(logRecord.Data, serviceEntry) == nil {
+				loadedTables.ServiceTable[logRecord.ID] = serviceEntry
+			}
+		}
+	}
+
+	return loadedTables, logScanner.Err()
+}
+
+// Append writes a change to the log and returns the number of changes logged since the last snapshot
+func (ts *TopologyStore) Append(topologyEvent TopologyEvent) (int, error) {
+	ts.storeLock.Lock()
+	defer ts.storeLock.Unlock()
+	if err := ts.writeRecord(newTopologyLogRecord(topologyEvent)); err != nil {
+		return ts.logCount, err
+	}
+	return ts.logCount, nil
+}
+
+// newTopologyLogRecord converts a table change to a log record
+func newTopologyLogRecord(topologyEvent TopologyEvent) topologyLogRecord {
+	logRecord := topologyLogRecord{topologyEvent.Cmd, topologyEvent.Type, topologyEvent.ID, nil}
+	switch topologyEvent.Type {
+	case "node":
+		logRecord.Data = topologyEvent.NodeEntry.ToJSON()
+	case "service":
+		logRecord.Data = topologyEvent.ServiceEntry.ToJSON()
+	}
+	return logRecord
+}
+
+// writeRecord appends a record to the log file; caller must hold storeLock
+func (ts *TopologyStore) writeRecord(logRecord topologyLogRecord) error {
+	recordBytes, _ := json.Marshal(logRecord)
+	if _, err := ts.logFile.Write(append(recordBytes, '\n')); err != nil {
+		return fmt.Errorf("could not write topology log: %s", err)
+	}
+	ts.logCount++
+	return nil
+}
+
+// Queue adds a change to be written by the background writer.  Call it while holding the lock which orders the
+// changes (the TopologyTracker tableLock) so the log matches the order the tables were updated in.
+func (ts *TopologyStore) Queue(topologyEvent TopologyEvent) {
+	ts.queueLock.Lock()
+	ts.queuedRecords = append(ts.queuedRecords, newTopologyLogRecord(topologyEvent))
+	ts.queueLock.Unlock()
+
+	select {
+	case ts.queueSignal <- true:
+	default:
+	}
+}
+
+// dropQueued discards queued changes which are already part of a snapshot; caller must hold the lock used for Queue
+func (ts *TopologyStore) dropQueued() {
+	ts.queueLock.Lock()
+	defer ts.queueLock.Unlock()
+	ts.queuedRecords = nil
+}
+
+// Flush writes all queued changes to the log and returns the number of changes logged since the last snapshot
+func (ts *TopologyStore) Flush() (int, error) {
+	ts.storeLock.Lock()
+	defer ts.storeLock.Unlock()
+
+	// Taking the queue while holding storeLock keeps batches from being written out of order
+	ts.queueLock.Lock()
+	queuedRecords := ts.queuedRecords
+	ts.queuedRecords = nil
+	ts.queueLock.Unlock()
+
+	for recordNum, logRecord := range queuedRecords {
+		if err := ts.writeRecord(logRecord); err != nil {
+			return ts.logCount, fmt.Errorf("%s, %d queued changes lost", err, len(queuedRecords)-recordNum)
+		}
+	}
+	return ts.logCount, nil
+}
+
+// StartWriter writes queued changes in the background, compacting the log with getSnapshot once it grows past the
+// threshold.  getSnapshot must hold the Queue lock while reading the tables and call dropQueued.
+func (ts *TopologyStore) StartWriter(getSnapshot func() TopologySnapshot, logError func(error)) {
+	ts.writerStop = make(chan bool)
+	ts.writerDone = make(chan bool)
+	go func() {
+		defer close(ts.writerDone)
+		for {
+			select {
+			case <-ts.queueSignal:
+			case <-ts.writerStop:
+				if _, err := ts.Flush(); err != nil {
+					logError(err)
+				}
+				return
+			}
+			logCount, err := ts.Flush()
+			if err != nil {
+				logError(err)
+				continue
+			}
+			if logCount >= topologyLogCompactThreshold {
+				if err := ts.Compact(getSnapshot); err != nil {
+					logError(err)
+				}
+			}
+		}
+	}()
+}
+
+// Compact atomically replaces the snapshot with the current tables and truncates the change log.
+// The tables are read while holding the store lock so no logged change can be lost between the two; changes
+// still queued when they are read are dropped by getSnapshot since the snapshot already includes them.
+func (ts *TopologyStore) Compact(getSnapshot func() TopologySnapshot) error {
+	ts.storeLock.Lock()
+	defer ts.storeLock.Unlock()
+
+	snapshotBytes, err := json.Marshal(getSnapshot())
+	if err != nil {
+		return fmt.Errorf("could not encode topology snapshot: %s", err)
+	}
+
+	// Write to a temp file and rename so a partial write is never read back
+	snapshotPath := filepath.Join(ts.stateDir, topologySnapshotFile)
+	tmpFile := snapshotPath + ".tmp"
+	if err := os.WriteFile(tmpFile, snapshotBytes, 0644); err != nil {
+		return fmt.Errorf("could not write topology snapshot: %s", err)
+	}
+	if err := os.Rename(tmpFile, snapshotPath); err != nil {
+		return fmt.Errorf("could not write topology snapshot: %s", err)
+	}
+
+	if err := ts.logFile.Truncate(0); err != nil {
+		return fmt.Errorf("could not truncate topology log: %s", err)
+	}
+	ts.logCount = 0
+	return nil
+}
+
+// Close stops the background writer, writes any queued changes and closes the change log
+func (ts *TopologyStore) Close() {
+	if ts.writerStop != nil {
+		close(ts.writerStop)
+		<-ts.writerDone
+		ts.writerStop = nil
+	} else {
+		ts.Flush()
+	}
+	ts.storeLock.Lock()
+	defer ts.storeLock.Unlock()
+	ts.logFile.Close()
+}
+
+// isComplete tells whether or not the base attributes other code dereferences are present
+func (tte TopologyTableEntry) isComplete() bool {
+	return tte.NodeID != nil && tte.Scope != nil && tte.Zone != nil && tte.LearnedFrom != nil
+}
+
+// isComplete tells whether or not a restored Service entry has the attributes other code dereferences
+func (ste ServiceTableEntry) isComplete() bool {
+	return ste.TopologyTableEntry.isComplete() && ste.Name != nil && ste.Type != nil && ste.InstanceID != nil
+}
+
+// topologyEntryKey returns the key used to track a Node or Service table entry by type and ID
+func topologyEntryKey(entryType string, entryID string) string {
+	return entryType + "/" + entryID
+}
+
+// EnablePersistence restores the tables from a state directory, marking restored entries unverified, and logs
+// all further changes to it
+func (tt *TopologyTracker) EnablePersistence(stateDir string) error {
+	thisTopologyTracker := tt
+	thisNode := thisTopologyTracker.drpNode
+
+	topologyStore, err := OpenTopologyStore(stateDir)
+	if err != nil {
+		return err
+	}
+
+	loadedTables, err := topologyStore.Load()
+	if err != nil {
+		thisNode.Log(fmt.Sprintf("Could not fully load topology state, continuing with what was read: %s", err), false)
+	}
+
+	thisTopologyTracker.tableLock.Lock()
+	thisTopologyTracker.store = topologyStore
+	thisTopologyTracker.restoredAt = time.Now()
+	restoredCount := 0
+	for nodeID, nodeEntry := range loadedTables.NodeTable {
+		// The local Node advertises itself fresh
+		if nodeID == thisNode.NodeID || thisTopologyTracker.nodeTable.HasEntry(nodeID) || !nodeEntry.isComplete() {
+			continue
+		}
+		(*thisTopologyTracker.nodeTable)[nodeID] = nodeEntry
+		thisTopologyTracker.unverifiedEntries[topologyEntryKey("node", nodeID)] = true
+		restoredCount++
+	}
+	for serviceInstanceID, serviceEntry := range loadedTables.ServiceTable {
+		if !serviceEntry.isComplete() || *serviceEntry.NodeID == thisNode.NodeID || thisTopologyTracker.serviceTable.HasEntry(serviceInstanceID) {
+			continue
+		}
+		(*thisTopologyTracker.serviceTable)[serviceInstanceID] = serviceEntry
+		thisTopologyTracker.unverifiedEntries[topologyEntryKey("service", serviceInstanceID)] = true
+		restoredCount++
+	}
+	thisTopologyTracker.tableLock.Unlock()
+
+	thisNode.Log(fmt.Sprintf("Restored %d unverified topology entries from %s", restoredCount, stateDir), false)
+
+	// Write the restored tables as the new base, then log all further changes in the background
+	if err := topologyStore.Compact(thisTopologyTracker.persistedSnapshot); err != nil {
+		return err
+	}
+	topologyStore.StartWriter(thisTopologyTracker.persistedSnapshot, func(err error) {
+		thisNode.Log(err.Error(), false)
+	})
+
+	return nil
+}
+
+// persistedSnapshot returns the tables for a new snapshot file and drops the queued changes it already includes
+func (tt *TopologyTracker) persistedSnapshot() TopologySnapshot {
+	tt.tableLock.RLock()
+	defer tt.tableLock.RUnlock()
+	tt.store.dropQueued()
+	return tt.snapshotTables()
+}
+
+// ClosePersistence writes any queued changes to the state directory and stops logging further changes
+func (tt *TopologyTracker) ClosePersistence() {
+	tt.tableLock.Lock()
+	topologyStore := tt.store
+	tt.store = nil
+	tt.tableLock.Unlock()
+
+	if topologyStore != nil {
+		topologyStore.Close()
+	}
+}
+
+// logChange queues a table change for the state directory, if persistence is enabled; caller must hold tableLock
+func (tt *TopologyTracker) logChange(topologyEvent TopologyEvent) {
+	if tt.store != nil {
+		tt.store.Queue(topologyEvent)
+	}
+}
+
+// IsVerified tells whether or not a table entry has been confirmed by a live Node since it was restored from disk
+func (tt *TopologyTracker) IsVerified(entryType string, entryID string) bool {
+	tt.tableLock.RLock()
+	defer tt.tableLock.RUnlock()
+	return !tt.unverifiedEntries[topologyEntryKey(entryType, entryID)]
+}
+
+// isUnverified tells whether or not a table entry was restored from disk and not yet confirmed; caller must hold tableLock
+func (tt *TopologyTracker) isUnverified(entryType string, entryID string) bool {
+	return tt.unverifiedEntries[topologyEntryKey(entryType, entryID)]
+}
+
+// ReconcileUnverified removes restored entries contradicted by a newly connected Node.  If the Node is authoritative
+// (a Registry serving a non-Registry), everything it did not confirm is removed; otherwise only entries for the
+// connected Node itself are removed, since it has just advertised all of them.
+func (tt *TopologyTracker) ReconcileUnverified(connectedNodeID string, isAuthoritative bool) {
+	tt.removeUnverified(func(entryNodeID string) bool {
+		return isAuthoritative || entryNodeID == connectedNodeID
+	}, fmt.Sprintf("not confirmed by Node [%s]", connectedNodeID))
+}
+
+// ExpireUnverified removes restored entries which have not been confirmed within the grace period
+func (tt *TopologyTracker) ExpireUnverified(gracePeriod time.Duration) {
+	tt.tableLock.RLock()
+	restoredAt := tt.restoredAt
+	unverifiedCount := len(tt.unverifiedEntries)
+	tt.tableLock.RUnlock()
+
+	if unverifiedCount == 0 || time.Since(restoredAt) < gracePeriod {
+		return
+	}
+	tt.removeUnverified(func(entryNodeID string) bool {
+		return true
+	}, "not confirmed within grace period")
+}
+
+// removeUnverified deletes unverified entries whose NodeID matches; they were never advertised so no deletes are relayed
+func (tt *TopologyTracker) removeUnverified(matchNodeID func(string) bool, removeReason string) {
+	thisTopologyTracker := tt
+	thisNode := thisTopologyTracker.drpNode
+
+	thisTopologyTracker.tableLock.Lock()
+	for checkKey := range thisTopologyTracker.unverifiedEntries {
+		entryType, entryID, _ := strings.Cut(checkKey, "/")
+		switch entryType {
+		case "node":
+			nodeEntry := thisTopologyTracker.nodeTable.GetEntry(entryID).(*NodeTableEntry)
+			if nodeEntry != nil {
+				if !matchNodeID(entryID) {
+					continue
+				}
+				thisNode.Log(fmt.Sprintf("Removing restored Node [%s], %s", entryID, removeReason), true)
+				thisTopologyTracker.queueNodeEvent("delete", entryID, nodeEntry)
+				thisTopologyTracker.nodeTable.DeleteEntry(entryID)
+			}
+		case "service":
+			serviceEntry := thisTopologyTracker.serviceTable.GetEntry(entryID).(*ServiceTableEntry)
+			if serviceEntry != nil {
+				if !matchNodeID(*serviceEntry.NodeID) {
+					continue
+				}
+				thisNode.Log(fmt.Sprintf("Removing restored Service [%s], %s", entryID, removeReason), true)
+				thisTopologyTracker.queueServiceEvent("delete", entryID, serviceEntry)
+				thisTopologyTracker.serviceTable.DeleteEntry(entryID)
+			}
+		}
+		delete(thisTopologyTracker.unverifiedEntries, checkKey)
+	}
+	topologyEvents := thisTopologyTracker.takePendingEvents()
+	thisTopologyTracker.tableLock.Unlock()
+
+	thisTopologyTracker.sendEvents(topologyEvents)
+}
@@ -0,0 +1,185 @@
+package drpmesh
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// testPersistentNode creates a Registry which keeps its topology in stateDir and closes it when the test ends
+func testPersistentNode(t *testing.T, nodeID string, stateDir string) *Node {
+	t.Helper()
+	nodeOptions := testNodeOptions("Registry", nodeID)
+	nodeOptions.TopologyStateDir = stateDir
+	thisNode := testNode(t, nodeOptions)
+	t.Cleanup(thisNode.TopologyTracker.ClosePersistence)
+	return thisNode
+}
+
+func TestTopologyStoreRoundTrip(t *testing.T) {
+	stateDir := t.TempDir()
+	topologyStore, err := OpenTopologyStore(stateDir)
+	if err != nil {
+		t.Fatalf("could not open the topology store: %s", err)
+	}
+	defer topologyStore.Close()
+
+	// The snapshot holds one Node, the log adds a service to it and adds then deletes another
+	nodeEntry := testNodeEntry("provider1")
+	snapshotTables := TopologySnapshot{map[string]*NodeTableEntry{"provider1": nodeEntry}, map[string]*ServiceTableEntry{}}
+	if err := topologyStore.Compact(func() TopologySnapshot { return snapshotTables }); err != nil {
+		t.Fatalf("could not write the snapshot: %s", err)
+	}
+	workerEntry := testServiceEntry("provider1", "Worker")
+	cacheEntry := testServiceEntry("provider1", "Cache")
+	topologyStore.Queue(TopologyEvent{"add", "service", *workerEntry.InstanceID, nil, workerEntry})
+	topologyStore.Queue(TopologyEvent{"add", "service", *cacheEntry.InstanceID, nil, cacheEntry})
+	topologyStore.Queue(TopologyEvent{"delete", "service", *cacheEntry.InstanceID, nil, cacheEntry})
+	if logCount, err := topologyStore.Flush(); err != nil || logCount != 3 {
+		t.Fatalf("expected three logged changes, got %d (%v)", logCount, err)
+	}
+
+	// A torn final write is skipped
+	logFile, _ := os.OpenFile(filepath.Join(stateDir, topologyLogFile), os.O_APPEND|os.O_WRONLY, 0644)
+	logFile.WriteString(`{"cmd":"add","type":"service","id":"torn`)
+	logFile.Close()
+
+	loadedTables, err := topologyStore.Load()
+	if err != nil {
+		t.Fatalf("could not load the topology state: %s", err)
+	}
+	if len(loadedTables.NodeTable) != 1 || loadedTables.NodeTable["provider1"] == nil || *loadedTables.NodeTable["provider1"].HostID != "host-provider1" {
+		t.Fatalf("expected the snapshot Node, got %v", loadedTables.NodeTable)
+	}
+	if len(loadedTables.ServiceTable) != 1 || loadedTables.ServiceTable[*workerEntry.InstanceID] == nil {
+		t.Fatalf("expected only the Worker service after replay, got %v", loadedTables.ServiceTable)
+	}
+
+	// Compacting folds the log into the snapshot
+	if err := topologyStore.Compact(func() TopologySnapshot { return loadedTables }); err != nil {
+		t.Fatalf("could not compact: %s", err)
+	}
+	if logInfo, err := os.Stat(filepath.Join(stateDir, topologyLogFile)); err != nil || logInfo.Size() != 0 {
+		t.Fatalf("expected an empty log after compaction")
+	}
+	if compactedTables, err := topologyStore.Load(); err != nil || len(compactedTables.ServiceTable) != 1 || len(compactedTables.NodeTable) != 1 {
+		t.Fatalf("expected the compacted tables to load unchanged, got %v (%v)", compactedTables, err)
+	}
+}
+
+func TestTopologyPersistenceWarmStart(t *testing.T) {
+	stateDir := t.TempDir()
+	firstNode := testPersistentNode(t, "registry1", stateDir)
+	firstTopologyTracker := firstNode.TopologyTracker
+
+	// Learn two Providers, then lose one of their services
+	addTestProvider(firstTopologyTracker, "provider1", "zone1", "Worker", "Cache")
+	addTestProvider(firstTopologyTracker, "provider2", "zone1", "Worker")
+	cacheEntry := testServiceEntry("provider1", "Cache")
+	firstTopologyTracker.ProcessPacket(TopologyPacket{"provider1", "delete", "service", *cacheEntry.InstanceID, *cacheEntry.Scope, *cacheEntry.Zone, cacheEntry.ToJSON(), 1}, "provider1", false)
+	firstTopologyTracker.ClosePersistence()
+
+	// A restarted Registry restores the learned entries, but not deleted ones
+	restartedNode := testPersistentNode(t, "registry2", stateDir)
+	restartedTopologyTracker := restartedNode.TopologyTracker
+	for _, nodeID := range []string{"provider1", "provider2"} {
+		if restartedTopologyTracker.GetNodeEntry(nodeID) == nil || restartedTopologyTracker.IsVerified("node", nodeID) {
+			t.Fatalf("expected Node [%s] to be restored unverified", nodeID)
+		}
+	}
+	if restartedTopologyTracker.GetServiceEntry(*cacheEntry.InstanceID) != nil {
+		t.Fatalf("expected the deleted service not to be resurrected")
+	}
+	if restartedTopologyTracker.GetServiceEntry("provider1-Worker") == nil || restartedTopologyTracker.IsVerified("service", "provider1-Worker") {
+		t.Fatalf("expected the Worker service to be restored unverified")
+	}
+
+	// Restored entries are not selected until a live Node confirms them
+	workerName := "Worker"
+	if restartedTopologyTracker.FindInstanceOfService(&workerName, nil, nil, nil, nil) != nil {
+		t.Fatalf("expected unverified instances not to be selected")
+	}
+	addTestProvider(restartedTopologyTracker, "provider1", "zone1", "Worker")
+	if !restartedTopologyTracker.IsVerified("node", "provider1") || !restartedTopologyTracker.IsVerified("service", "provider1-Worker") {
+		t.Fatalf("expected the live advertisement to confirm the restored entries")
+	}
+	for selectNum := 0; selectNum < 10; selectNum++ {
+		serviceEntry := restartedTopologyTracker.FindInstanceOfService(&workerName, nil, nil, nil, nil)
+		if serviceEntry == nil || *serviceEntry.InstanceID != "provider1-Worker" {
+			t.Fatalf("expected only the confirmed instance to be selected, got %v", serviceEntry)
+		}
+	}
+
+	// Entries an authoritative Node did not confirm are dropped
+	restartedTopologyTracker.ReconcileUnverified("registry9", true)
+	if restartedTopologyTracker.GetNodeEntry("provider2") != nil || restartedTopologyTracker.GetServiceEntry("provider2-Worker") != nil {
+		t.Fatalf("expected the unconfirmed Provider to be removed")
+	}
+	if restartedTopologyTracker.GetServiceEntry("provider1-Worker") == nil {
+		t.Fatalf("expected the confirmed service to be kept")
+	}
+}
+
+func TestTopologyPersistenceOrdering(t *testing.T) {
+	stateDir := t.TempDir()
+	thisNode := testPersistentNode(t, "registry1", stateDir)
+	thisTopologyTracker := thisNode.TopologyTracker
+
+	for nodeNum := 0; nodeNum < 5; nodeNum++ {
+		addTestProvider(thisTopologyTracker, fmt.Sprintf("provider%d", nodeNum), "zone1")
+	}
+
+	// Concurrent adds and deletes of the same entries must be logged in the order they were applied
+	var workerGroup sync.WaitGroup
+	for workerNum := 0; workerNum < 4; workerNum++ {
+		workerGroup.Add(1)
+		go func(workerNum int) {
+			defer workerGroup.Done()
+			for changeNum := 0; changeNum < 50; changeNum++ {
+				nodeID := fmt.Sprintf("provider%d", changeNum%5)
+				serviceEntry := testServiceEntry(nodeID, "Worker")
+				packetCmd := "add"
+				if (changeNum+workerNum)%2 == 1 {
+					packetCmd = "delete"
+				}
+				thisTopologyTracker.ProcessPacket(TopologyPacket{nodeID, packetCmd, "service", *serviceEntry.InstanceID, *serviceEntry.Scope, *serviceEntry.Zone, serviceEntry.ToJSON(), 0}, nodeID, false)
+			}
+		}(workerNum)
+	}
+	workerGroup.Wait()
+	liveTables := thisTopologyTracker.Snapshot()
+	thisTopologyTracker.ClosePersistence()
+
+	topologyStore, err := OpenTopologyStore(stateDir)
+	if err != nil {
+		t.Fatalf("could not reopen the topology store: %s", err)
+	}
+	defer topologyStore.Close()
+	loadedTables, err := topologyStore.Load()
+	if err != nil {
+		t.Fatalf("could not load the topology state: %s", err)
+	}
+	if len(loadedTables.ServiceTable) != len(liveTables.ServiceTable) {
+		t.Fatalf("expected %d persisted services, got %d", len(liveTables.ServiceTable), len(loadedTables.ServiceTable))
+	}
+	for serviceInstanceID := range liveTables.ServiceTable {
+		if loadedTables.ServiceTable[serviceInstanceID] == nil {
+			t.Fatalf("expected service [%s] to be persisted", serviceInstanceID)
+		}
+	}
+}
+
+func TestTopologyPersistenceError(t *testing.T) {
+	// A state directory which can not be created is reported by CreateNode
+	blockingFile := filepath.Join(t.TempDir(), "not-a-dir")
+	if err := os.WriteFile(blockingFile, []byte{}, 0644); err != nil {
+		t.Fatalf("could not create file: %s", err)
+	}
+	nodeOptions := testNodeOptions("Registry", "registry1")
+	nodeOptions.TopologyStateDir = filepath.Join(blockingFile, "state")
+	if thisNode, err := CreateNode(nodeOptions); err == nil || thisNode != nil {
+		t.Fatalf("expected CreateNode to fail for an unusable state directory")
+	}
+}
@@ -3,25 +3,144 @@ package drpmesh
 import (
 	"encoding/json"
 	"fmt"
-	"math/rand"
 	"strings"
+	"sync"
 	"time"
-
-	wr "github.com/mroth/weightedrand"
 )
 
-// TopologyTracker keeps track of Nodes and Services in the mesh
+// TopologyTracker keeps track of Nodes and Services in the mesh; the tables are only reachable through its methods,
+// which hold tableLock and hand out copies of entries so callers never share state with the tracker
 type TopologyTracker struct {
 	drpNode      *Node
-	NodeTable    *NodeTable
-	ServiceTable *ServiceTable
+	nodeTable    *NodeTable
+	serviceTable *ServiceTable
+	tableLock    sync.RWMutex
+
+	// Topology event subscriptions and events waiting for tableLock to be released
+	eventSubscriptions      map[int]*topologyEventSubscription
+	lastEventSubscriptionID int
+	eventLock               sync.RWMutex
+	pendingEvents           []TopologyEvent
+
+	// Closed to stop the running WatchDog; when each remote entry was last confirmed by the Node it was learned from
+	watchDogStop  chan bool
+	watchDogLock  sync.Mutex
+	entryLastSeen map[string]time.Time
+
+	// Closed to stop the running anti-entropy loop; how long to wait for each reply from another Registry
+	antiEntropyStop    chan bool
+	antiEntropyLock    sync.Mutex
+	AntiEntropyTimeout time.Duration
+
+	// Closed to stop the running health check loop; consecutive results per checked instance
+	healthCheckStop          chan bool
+	healthCheckLock          sync.Mutex
+	healthStates             map[string]*instanceHealth
+	HealthCheckTimeout       time.Duration
+	HealthCheckFailThreshold int
+	HealthCheckPassThreshold int
+
+	// Request statistics and Balancers used to choose between service instances
+	ServiceStats     *ServiceStatsTracker
+	serviceBalancers map[string]Balancer
+	defaultBalancer  Balancer
+	balancerLock     sync.RWMutex
+
+	// Ordered fallback zones and services which must stay in the requested zone
+	zonePreferences     []string
+	noCrossZoneServices map[string]bool
+	zonePolicyLock      sync.RWMutex
+
+	// Instances ejected from selection after failed or slow calls from this Node, and how long calls without an
+	// AttemptTimeout wait
+	Outliers    *OutlierDetector
+	CallTimeout time.Duration
+
+	// Retry policies and circuit breakers for calls made by this Node
+	retryPolicies      map[string]RetryPolicy
+	defaultRetryPolicy RetryPolicy
+	retryPolicyLock    sync.RWMutex
+	CircuitBreakers    *CircuitBreakerTable
+
+	// Callers pinned to instances of Sticky services
+	StickyTable *StickyTable
+
+	// On-disk persistence; entries restored from disk stay unverified until a live Node confirms them
+	store                 *TopologyStore
+	restoredAt            time.Time
+	unverifiedEntries     map[string]bool
+	UnverifiedGracePeriod time.Duration
+
+	// Sequence numbers issued by this Node and tombstones of deleted entries
+	lastSequence uint64
+	sequenceLock sync.Mutex
+	tombstones   map[string]*topologyTombstone
+	TombstoneTTL time.Duration
+
+	// Table version and change history for incremental registry requests, the versions applied from remote Nodes
+	// and the remote Nodes which only answer full getRegistry requests
+	registryEpoch      string
+	tableVersion       uint64
+	changeHistory      []topologyChange
+	ChangeHistorySize  int
+	registrySyncPoints map[string]registrySyncPoint
+	SyncPointTTL       time.Duration
+	noRegistryDelta    map[string]bool
+}
+
+// TopologySnapshot is a point-in-time copy of the Node and Service tables
+type TopologySnapshot struct {
+	NodeTable    map[string]*NodeTableEntry
+	ServiceTable map[string]*ServiceTableEntry
 }
 
-// Initialize creates the node and service tables
-func (tt *TopologyTracker) Initialize(drpNode *Node) {
+// Initialize creates the node and service tables, returning an error if the persisted tables cannot be used
+func (tt *TopologyTracker) Initialize(drpNode *Node) error {
 	tt.drpNode = drpNode
-	tt.NodeTable = &NodeTable{}
-	tt.ServiceTable = &ServiceTable{}
+	tt.nodeTable = &NodeTable{}
+	tt.serviceTable = &ServiceTable{}
+	tt.ServiceStats = &ServiceStatsTracker{}
+	tt.serviceBalancers = make(map[string]Balancer)
+	tt.defaultBalancer = &WeightedRandomBalancer{}
+	tt.zonePreferences = []string{ZoneAny}
+	tt.noCrossZoneServices = make(map[string]bool)
+	tt.StickyTable = &StickyTable{}
+	tt.Outliers = &OutlierDetector{}
+	tt.Outliers.SetDefaultOutlierPolicy(DefaultOutlierPolicy())
+	tt.CallTimeout = DefaultCallTimeout
+	tt.retryPolicies = make(map[string]RetryPolicy)
+	tt.defaultRetryPolicy = DefaultRetryPolicy()
+	tt.CircuitBreakers = &CircuitBreakerTable{}
+	tt.CircuitBreakers.SetDefaultPolicy(DefaultCircuitBreakerPolicy())
+	tt.unverifiedEntries = make(map[string]bool)
+	tt.entryLastSeen = make(map[string]time.Time)
+	tt.UnverifiedGracePeriod = DefaultUnverifiedGracePeriod
+	tt.tombstones = make(map[string]*topologyTombstone)
+	tt.TombstoneTTL = DefaultTombstoneTTL
+	tt.registryEpoch = RandomHex(8)
+	tt.ChangeHistorySize = DefaultChangeHistorySize
+	tt.registrySyncPoints = make(map[string]registrySyncPoint)
+	tt.SyncPointTTL = DefaultSyncPointTTL
+	tt.noRegistryDelta = make(map[string]bool)
+	tt.healthStates = make(map[string]*instanceHealth)
+	tt.AntiEntropyTimeout = DefaultAntiEntropyTimeout
+	tt.HealthCheckTimeout = DefaultHealthCheckTimeout
+	tt.HealthCheckFailThreshold = DefaultHealthCheckFailThreshold
+	tt.HealthCheckPassThreshold = DefaultHealthCheckPassThreshold
+
+	// Discard request statistics and sticky bindings for service instances which leave the mesh, and the cached
+	// instance lists of services which change
+	tt.Subscribe(TopologyEventFilter{Type: "service"}, func(topologyEvent TopologyEvent) {
+		if topologyEvent.ServiceEntry != nil && topologyEvent.ServiceEntry.Name != nil {
+			tt.Outliers.forgetInstances(*topologyEvent.ServiceEntry.Name)
+		}
+		if topologyEvent.Cmd == "delete" {
+			tt.ServiceStats.Remove(topologyEvent.ID)
+			tt.Outliers.Remove(topologyEvent.ID)
+			tt.CircuitBreakers.Remove(topologyEvent.ID)
+			tt.StickyTable.RemoveInstance(topologyEvent.ID)
+		}
+	})
 
 	currentTimestamp := tt.drpNode.GetTimestamp()
 
@@ -35,17 +154,57 @@ func (tt *TopologyTracker) Initialize(drpNode *Node) {
 	newNodeEntry.Roles = tt.drpNode.NodeRoles
 	newNodeEntry.NodeURL = tt.drpNode.listeningName
 	newNodeEntry.HostID = &tt.drpNode.HostID
+	newNodeEntry.Labels = cloneLabels(tt.drpNode.Labels)
+	newNodeEntry.Sequence = tt.NextSequence()
 
-	addNodePacket := TopologyPacket{*newNodeEntry.NodeID, "add", "node", *newNodeEntry.NodeID, *newNodeEntry.Scope, *newNodeEntry.Zone, newNodeEntry.ToJSON()}
+	addNodePacket := TopologyPacket{*newNodeEntry.NodeID, "add", "node", *newNodeEntry.NodeID, *newNodeEntry.Scope, *newNodeEntry.Zone, newNodeEntry.ToJSON(), newNodeEntry.Sequence}
 	tt.ProcessPacket(addNodePacket, tt.drpNode.NodeID, tt.drpNode.IsRegistry())
+
+	// Warm start from the last persisted tables
+	if drpNode.topologyStateDir != nil && *drpNode.topologyStateDir != "" {
+		if err := tt.EnablePersistence(*drpNode.topologyStateDir); err != nil {
+			return fmt.Errorf("could not enable topology persistence: %s", err)
+		}
+	}
+
+	return nil
 }
 
 // ProcessPacket handles DRP topology packets
 func (tt *TopologyTracker) ProcessPacket(topologyPacket TopologyPacket, srcNodeID string, sourceIsRegistry bool) {
+	tt.tableLock.Lock()
+	relayList := tt.processPacket(topologyPacket, srcNodeID, sourceIsRegistry)
+	topologyEvents := tt.takePendingEvents()
+	tt.tableLock.Unlock()
+
+	tt.sendEvents(topologyEvents)
+	tt.sendRelays(relayList)
+}
+
+// sendRelays sends queued topology packets; called outside of the lock so a slow Endpoint does not hold up the tracker
+func (tt *TopologyTracker) sendRelays(relayList []topologyRelay) {
+	for _, thisRelay := range relayList {
+		thisRelay.endpoint.SendCmd("DRP", "topologyUpdate", thisRelay.packet, nil, nil, nil)
+		tt.drpNode.Log(fmt.Sprintf("Relayed topology packet to node: [%s]", thisRelay.targetNodeID), true)
+	}
+}
+
+// topologyRelay is a topology packet queued to be relayed to a connected Node
+type topologyRelay struct {
+	targetNodeID string
+	endpoint     EndpointInterface
+	packet       TopologyPacket
+}
+
+// processPacket applies a topology packet to the tables and returns the relays to send; caller must hold tableLock
+func (tt *TopologyTracker) processPacket(topologyPacket TopologyPacket, srcNodeID string, sourceIsRegistry bool) []topologyRelay {
 	thisTopologyTracker := tt
 	thisNode := thisTopologyTracker.drpNode
 	var targetTable TopologyTable = nil
 
+	// Relays to send, including those from dependent entries
+	relayList := []topologyRelay{}
+
 	// Flag for relaying
 	doRelay := false
 
@@ -54,7 +213,11 @@ func (tt *TopologyTracker) ProcessPacket(topologyPacket TopologyPacket, srcNodeI
 	marshalErr := json.Unmarshal(topologyPacket.Data, topologyPacketData)
 	if marshalErr != nil {
 		thisNode.Log(fmt.Sprintf("error marshalling json: %s", marshalErr), true)
-		return
+		return nil
+	}
+	if !topologyPacketData.isComplete() {
+		thisNode.Log(fmt.Sprintf("Ignoring %s topology packet [%s], entry data is incomplete", topologyPacket.Type, topologyPacket.ID), true)
+		return nil
 	}
 
 	var topologyPacketDataFull interface{} = nil
@@ -64,10 +227,10 @@ func (tt *TopologyTracker) ProcessPacket(topologyPacket TopologyPacket, srcNodeI
 	//var serviceTableEntry *ServiceTableEntry = nil
 
 	// NodeTable entry for the local node (will be null on startup)
-	localNodeEntry := thisTopologyTracker.NodeTable.GetEntry(thisNode.NodeID).(*NodeTableEntry)
+	localNodeEntry := thisTopologyTracker.nodeTable.GetEntry(thisNode.NodeID).(*NodeTableEntry)
 
 	// NodeTable entry for the source node (will be null on startup)
-	sourceNodeEntry := thisTopologyTracker.NodeTable.GetEntry(srcNodeID).(*NodeTableEntry)
+	sourceNodeEntry := thisTopologyTracker.nodeTable.GetEntry(srcNodeID).(*NodeTableEntry)
 
 	// Set the targetTableEntry to null for assignment
 	var targetTableEntry TopologyTableEntryInterface = nil
@@ -75,18 +238,18 @@ func (tt *TopologyTracker) ProcessPacket(topologyPacket TopologyPacket, srcNodeI
 	// Get Base object
 	switch topologyPacket.Type {
 	case "node":
-		targetTable = *thisTopologyTracker.NodeTable
+		targetTable = *thisTopologyTracker.nodeTable
 		nodeTableEntry = targetTable.GetEntry(topologyPacket.ID).(*NodeTableEntry)
 		targetTableEntry = targetTable.GetEntry(topologyPacket.ID).(TopologyTableEntryInterface)
 		break
 	case "service":
-		targetTable = *thisTopologyTracker.ServiceTable
-		nodeTableEntry = thisTopologyTracker.NodeTable.GetEntry(topologyPacket.ID).(*NodeTableEntry)
+		targetTable = *thisTopologyTracker.serviceTable
+		nodeTableEntry = thisTopologyTracker.nodeTable.GetEntry(*topologyPacketData.NodeID).(*NodeTableEntry)
 		//serviceTableEntry = targetTable.GetEntry(topologyPacket.ID).(*ServiceTableEntry)
 		targetTableEntry = targetTable.GetEntry(topologyPacket.ID).(TopologyTableEntryInterface)
 		break
 	default:
-		return
+		return nil
 	}
 
 	// Whatever type it is, store it in topologyPacketDataFull
@@ -94,27 +257,55 @@ func (tt *TopologyTracker) ProcessPacket(topologyPacket TopologyPacket, srcNodeI
 	marshalErr = json.Unmarshal(topologyPacket.Data, topologyPacketDataFull)
 	if marshalErr != nil {
 		thisNode.Log(fmt.Sprintf("error marshalling json: %s", marshalErr), true)
-		return
+		return nil
+	}
+
+	// Discard stale and duplicate packets using the sequence issued by the entry's origin
+	packetSequence := topologyPacket.Sequence
+	if packetSequence == 0 {
+		packetSequence = topologyPacketData.Sequence
+	}
+	setEntrySequence(topologyPacketDataFull, packetSequence)
+	if staleReason := thisTopologyTracker.checkSequence(topologyPacket, packetSequence, targetTable, srcNodeID == *topologyPacketData.NodeID, topologyPacketDataFull); staleReason != "" {
+		thisNode.Log(fmt.Sprintf("Ignoring %s %s[%s] at sequence %d from Node [%s], %s", topologyPacket.Cmd, topologyPacket.Type, topologyPacket.ID, packetSequence, srcNodeID, staleReason), true)
+		return nil
 	}
 
 	// Inbound topology packet; service add, update, delete
 	switch topologyPacket.Cmd {
 	case "add":
 
+		if thisTopologyTracker.isUnverified(topologyPacket.Type, topologyPacket.ID) {
+			// A live advertisement confirms an entry restored from disk; replace it with the live copy
+			thisNode.Log(fmt.Sprintf("Confirmed restored %s table entry [%s]", topologyPacket.Type, topologyPacket.ID), true)
+			delete(thisTopologyTracker.unverifiedEntries, topologyEntryKey(topologyPacket.Type, topologyPacket.ID))
+			setEntryLearnedFrom(topologyPacketDataFull, srcNodeID)
+			targetTable.UpdateEntry(topologyPacket.ID, topologyPacketDataFull, thisNode.GetTimestamp())
+			thisTopologyTracker.queueEntryEvent("update", topologyPacket.ID, topologyPacketDataFull)
+			thisTopologyTracker.markEntrySeen(topologyPacket.Type, topologyPacket.ID)
+			doRelay = true
+			break
+		}
+
 		if targetTable.HasEntry(topologyPacket.ID) {
 			// We already know about this one
 			thisNode.Log(fmt.Sprintf("We've received a topologyPacket for a record we already have: %s[%s]", topologyPacket.Type, topologyPacket.ID), true)
 
+			// A repeat advertisement from the entry's source, e.g. a Registry sync, shows the entry is still current
+			if *topologyPacketData.NodeID == srcNodeID || derefString(targetTableEntry.GetLearnedFrom()) == srcNodeID {
+				thisTopologyTracker.markEntrySeen(topologyPacket.Type, topologyPacket.ID)
+			}
+
 			// If we're a Registry and the learned entry is a Registry, ignore it
 			if localNodeEntry.IsRegistry() && nodeTableEntry.IsRegistry() {
 				thisNode.Log("Ignoring - we learned about this from another registry node", true)
-				return
+				return nil
 			}
 
 			// Someone sent us info about the local node; ignore it
 			if topologyPacketData.NodeID == localNodeEntry.NodeID {
 				thisNode.Log("Ignoring - received packet regarding the local node", true)
-				return
+				return nil
 			}
 
 			// We knew about the entry before, but the node just connected to us
@@ -137,18 +328,18 @@ func (tt *TopologyTracker) ProcessPacket(topologyPacket TopologyPacket, srcNodeI
 						// A non-Registry Node has connected to this non-Registry node.  Do not update LearnedFrom.
 						thisNode.Log("Ignoring - neither the local node nor the sending node are Registries", true)
 					}
-					return
+					return nil
 				}
 			}
 
 			// We are a Registry and learned about a newer route from another Registry; warm handoff?
-			if thisNode.IsRegistry() && (sourceIsRegistry || sourceNodeEntry != nil && sourceNodeEntry.IsRegistry()) && *topologyPacketData.LearnedFrom == *topologyPacketData.NodeID && *nodeTableEntry.LearnedFrom != *nodeTableEntry.NodeID {
+			if thisNode.IsRegistry() && (sourceIsRegistry || sourceNodeEntry != nil && sourceNodeEntry.IsRegistry()) && *topologyPacketData.LearnedFrom == *topologyPacketData.NodeID && nodeTableEntry != nil && derefString(nodeTableEntry.LearnedFrom) != *nodeTableEntry.NodeID {
 				//thisNode.log(`Ignoring ${topologyPacket.type} table entry [${topologyPacket.id}] from Node [${srcNodeID}], not not relayed from an authoritative source`);
 				thisNode.Log(fmt.Sprintf("Updating LearnedFrom for %s [%s] from [%s] to [%s]", topologyPacket.Type, topologyPacket.ID, *targetTableEntry.GetLearnedFrom(), srcNodeID), true)
 				targetTableEntry.SetLearnedFrom(srcNodeID, thisNode.GetTimestamp())
 
 				// We wouldn't want to redistribute to other registries and we wouldn't need to redistribute to other nodes connected to us
-				return
+				return nil
 			}
 
 			// We are not a Registry and Received this from a Registry after failure
@@ -160,25 +351,29 @@ func (tt *TopologyTracker) ProcessPacket(topologyPacket TopologyPacket, srcNodeI
 
 		} else {
 			// If this is a Registry receiving a second hand advertisement about another Registry, ignore it
-			if thisNode.IsRegistry() && topologyPacket.Type == "node" && nodeTableEntry.IsRegistry() && srcNodeID != *topologyPacketData.NodeID {
+			if thisNode.IsRegistry() && topologyPacket.Type == "node" && topologyPacketDataFull.(*NodeTableEntry).IsRegistry() && srcNodeID != *topologyPacketData.NodeID {
 				thisNode.Log("Ignoring - local node is a Registry secondhand advertisement about another Registry", true)
-				return
+				return nil
 			}
 
 			// If this is a Registry and the sender didn't get it from an authoritative source, ignore it
-			if thisNode.IsRegistry() && *topologyPacketData.NodeID != thisNode.NodeID && topologyPacketData.LearnedFrom != topologyPacketData.NodeID && topologyPacketData.LearnedFrom != topologyPacketData.ProxyNodeID {
+			if thisNode.IsRegistry() && *topologyPacketData.NodeID != thisNode.NodeID && derefString(topologyPacketData.LearnedFrom) != *topologyPacketData.NodeID && derefString(topologyPacketData.LearnedFrom) != derefString(topologyPacketData.ProxyNodeID) {
 				thisNode.Log(fmt.Sprintf("Ignoring %s table entry [%s] from Node [%s], not relayed from an authoritative source", topologyPacket.Type, topologyPacket.ID, srcNodeID), true)
-				return
+				return nil
 			}
 
 			// If this is a service entry and we don't have a corresponding node table entry, ignore it
-			if topologyPacket.Type == "service" && thisTopologyTracker.NodeTable.GetEntry(*topologyPacketData.NodeID) == nil {
+			if topologyPacket.Type == "service" && thisTopologyTracker.nodeTable.GetEntry(*topologyPacketData.NodeID) == nil {
 				thisNode.Log(fmt.Sprintf("Ignoring service table entry [%s], no matching node table entry", topologyPacket.ID), true)
-				return
+				return nil
 			}
 
+			// We don't have this one; record who we learned it from, add it and advertise
+			setEntryLearnedFrom(topologyPacketDataFull, srcNodeID)
 			thisNode.Log(fmt.Sprintf("Adding new %s table entry [%s]", topologyPacket.Type, topologyPacket.ID), true)
 			targetTable.AddEntry(topologyPacket.ID, topologyPacketDataFull, thisNode.GetTimestamp())
+			thisTopologyTracker.queueEntryEvent("add", topologyPacket.ID, topologyPacketDataFull)
+			thisTopologyTracker.markEntrySeen(topologyPacket.Type, topologyPacket.ID)
 
 			// Set for relay
 			doRelay = true
@@ -187,10 +382,13 @@ func (tt *TopologyTracker) ProcessPacket(topologyPacket TopologyPacket, srcNodeI
 	case "update":
 		if targetTable.HasEntry(topologyPacket.ID) {
 			targetTable.UpdateEntry(topologyPacket.ID, topologyPacketDataFull, thisNode.GetTimestamp())
+			thisTopologyTracker.queueEntryEvent("update", topologyPacket.ID, topologyPacketDataFull)
+			delete(thisTopologyTracker.unverifiedEntries, topologyEntryKey(topologyPacket.Type, topologyPacket.ID))
+			thisTopologyTracker.markEntrySeen(topologyPacket.Type, topologyPacket.ID)
 			doRelay = true
 		} else {
 			thisNode.Log(fmt.Sprintf("Could not update non-existent %s entry %s", topologyPacket.Type, topologyPacket.ID), true)
-			return
+			return nil
 		}
 		break
 	case "delete":
@@ -198,40 +396,53 @@ func (tt *TopologyTracker) ProcessPacket(topologyPacket TopologyPacket, srcNodeI
 		if topologyPacket.ID == thisNode.NodeID && topologyPacket.Type == "node" {
 			thisNode.Log("This node tried to delete itself.  Why?", true)
 			//console.dir(topologyPacket);
-			return
+			return nil
 		}
 		// Update this rule so that if the table LearnedFrom is another Registry, do not delete or relay!  We are no longer authoritative
-		if targetTable.HasEntry(topologyPacket.ID) && (*topologyPacketData.NodeID == srcNodeID || *topologyPacketData.LearnedFrom == srcNodeID) || thisNode.NodeID == srcNodeID {
+		if targetTable.HasEntry(topologyPacket.ID) && (*topologyPacketData.NodeID == srcNodeID || derefString(topologyPacketData.LearnedFrom) == srcNodeID) || thisNode.NodeID == srcNodeID {
 			doRelay = true
+			if targetTable.HasEntry(topologyPacket.ID) {
+				thisTopologyTracker.queueEntryEvent("delete", topologyPacket.ID, targetTable.GetEntry(topologyPacket.ID))
+
+				// A delete issued by the entry's origin carries a newer sequence than the entry.  Deletes synthesized
+				// from the entry itself (disconnects, cascades, expiry) reuse its sequence and leave no tombstone, so
+				// the entry can still be re-added through another path.
+				if packetSequence > targetTable.GetEntry(topologyPacket.ID).(TopologyTableEntryInterface).GetSequence() {
+					thisTopologyTracker.recordTombstone(topologyPacket.Type, topologyPacket.ID, packetSequence)
+				}
+			}
 			targetTable.DeleteEntry(topologyPacket.ID)
+			delete(thisTopologyTracker.unverifiedEntries, topologyEntryKey(topologyPacket.Type, topologyPacket.ID))
 			if topologyPacket.Type == "node" {
 				// Delete services from this node
-				for serviceInstanceID, thisServiceEntry := range *thisTopologyTracker.ServiceTable {
+				for serviceInstanceID, thisServiceEntry := range *thisTopologyTracker.serviceTable {
 					if *thisServiceEntry.NodeID == topologyPacket.ID || *thisServiceEntry.LearnedFrom == topologyPacket.ID {
 						thisNode.Log(fmt.Sprintf("Removing entries learned from Node[%s] -> Service[%s]", topologyPacket.ID, serviceInstanceID), true)
-						thisTopologyTracker.ServiceTable.DeleteEntry(serviceInstanceID)
+						thisTopologyTracker.queueServiceEvent("delete", serviceInstanceID, thisServiceEntry)
+						thisTopologyTracker.serviceTable.DeleteEntry(serviceInstanceID)
+						delete(thisTopologyTracker.unverifiedEntries, topologyEntryKey("service", serviceInstanceID))
 					}
 				}
 
 				// Remove any dependent Nodes
-				for _, checkNodeEntry := range *thisTopologyTracker.NodeTable {
+				for _, checkNodeEntry := range *thisTopologyTracker.nodeTable {
 					if *checkNodeEntry.LearnedFrom == topologyPacket.ID {
 						// Delete this entry
 						thisNode.Log(fmt.Sprintf("Removing entries learned from Node[%s] -> Node[%s]", topologyPacket.ID, *checkNodeEntry.NodeID), true)
 						var packetDataBytes = checkNodeEntry.ToJSON()
-						nodeDeletePacket := TopologyPacket{*checkNodeEntry.NodeID, "delete", "node", *checkNodeEntry.NodeID, *checkNodeEntry.Scope, *checkNodeEntry.Zone, packetDataBytes}
-						thisTopologyTracker.ProcessPacket(nodeDeletePacket, *checkNodeEntry.NodeID, false)
+						nodeDeletePacket := TopologyPacket{*checkNodeEntry.NodeID, "delete", "node", *checkNodeEntry.NodeID, *checkNodeEntry.Scope, *checkNodeEntry.Zone, packetDataBytes, checkNodeEntry.Sequence}
+						relayList = append(relayList, thisTopologyTracker.processPacket(nodeDeletePacket, *checkNodeEntry.NodeID, false)...)
 					}
 				}
 			}
 		} else {
 			// Ignore delete command
 			thisNode.Log(fmt.Sprintf("Ignoring delete from Node[%s]", srcNodeID), true)
-			return
+			return nil
 		}
 		break
 	default:
-		return
+		return nil
 	}
 
 	// Send to TopicManager
@@ -242,27 +453,69 @@ func (tt *TopologyTracker) ProcessPacket(topologyPacket TopologyPacket, srcNodeI
 
 	if !doRelay {
 		// We don't want to relay the packet we received to anyone
-		return
+		return relayList
 	}
 
-	for targetNodeID, thisEndpoint := range thisTopologyTracker.drpNode.NodeEndpoints {
-		relayPacket := thisTopologyTracker.AdvertiseOutCheck(topologyPacketData, &targetNodeID)
+	for targetNodeID, thisEndpoint := range thisTopologyTracker.drpNode.listNodeEndpoints() {
+		relayPacket := thisTopologyTracker.advertiseOutCheck(topologyPacketData, &targetNodeID)
 
 		if relayPacket {
-			thisEndpoint.SendCmd("DRP", "topologyUpdate", topologyPacket, nil, nil, nil)
-			thisNode.Log(fmt.Sprintf("Relayed topology packet to node: [%s]", targetNodeID), true)
+			relayList = append(relayList, topologyRelay{targetNodeID, thisEndpoint, topologyPacket})
 		} else {
 			if targetNodeID != thisNode.NodeID {
 				//thisNode.log(`Not relaying packet to node[${targetNodeID}], roles ${thisTopologyTracker.NodeTable[targetNodeID].Roles}`);
 			}
 		}
 	}
+
+	return relayList
+}
+
+// ListNodes returns a list of NodeIDs, optionally limited to a zone and to Nodes matching a label selector
+func (tt *TopologyTracker) ListNodes(zoneName *string, labelSelector LabelSelector) []string {
+	tt.tableLock.RLock()
+	defer tt.tableLock.RUnlock()
+
+	nodeIDList := []string{}
+	for checkNodeID, nodeTableEntry := range *tt.nodeTable {
+		if zoneName != nil && (nodeTableEntry.Zone == nil || *nodeTableEntry.Zone != *zoneName) {
+			continue
+		}
+		if labelSelector.Matches(nodeTableEntry.Labels) {
+			nodeIDList = append(nodeIDList, checkNodeID)
+		}
+	}
+	return nodeIDList
 }
 
-// ListServices returns a unique list of service names available for use
-func (tt *TopologyTracker) ListServices() []string {
+// ListZones returns a unique list of zone names with at least one Node
+func (tt *TopologyTracker) ListZones() []string {
+	tt.tableLock.RLock()
+	defer tt.tableLock.RUnlock()
+
+	uniqueZoneMap := make(map[string]bool)
+	for _, nodeTableEntry := range *tt.nodeTable {
+		if nodeTableEntry.Zone != nil {
+			uniqueZoneMap[*nodeTableEntry.Zone] = true
+		}
+	}
+	return GetKeys(uniqueZoneMap)
+}
+
+// ListServices returns a unique list of service names available for use, optionally limited to a zone and to
+// instances matching a label selector
+func (tt *TopologyTracker) ListServices(zoneName *string, labelSelector LabelSelector) []string {
+	tt.tableLock.RLock()
+	defer tt.tableLock.RUnlock()
+
 	uniqueServiceMap := make(map[string]bool)
-	for _, serviceTableEntry := range *tt.ServiceTable {
+	for _, serviceTableEntry := range *tt.serviceTable {
+		if zoneName != nil && (serviceTableEntry.Zone == nil || *serviceTableEntry.Zone != *zoneName) {
+			continue
+		}
+		if !labelSelector.Matches(tt.getServiceLabels(serviceTableEntry)) {
+			continue
+		}
 		if !uniqueServiceMap[*serviceTableEntry.Name] {
 			uniqueServiceMap[*serviceTableEntry.Name] = true
 		}
@@ -275,17 +528,23 @@ func (tt *TopologyTracker) ListServices() []string {
 	return uniqueServiceSlice
 }
 
-// GetServicesWithProviders returns a map of services along with the Providers' NodeIDs (used by PathCmd)
-func (tt *TopologyTracker) GetServicesWithProviders() map[string]*struct {
+// GetServicesWithProviders returns a map of services along with the Providers' NodeIDs (used by PathCmd), optionally limited to a zone
+func (tt *TopologyTracker) GetServicesWithProviders(zoneName *string) map[string]*struct {
 	ServiceName string
 	Providers   []string
 } {
 
+	tt.tableLock.RLock()
+	defer tt.tableLock.RUnlock()
+
 	returnObject := make(map[string]*struct {
 		ServiceName string
 		Providers   []string
 	})
-	for _, serviceTableEntry := range *tt.ServiceTable {
+	for _, serviceTableEntry := range *tt.serviceTable {
+		if zoneName != nil && (serviceTableEntry.Zone == nil || *serviceTableEntry.Zone != *zoneName) {
+			continue
+		}
 		if _, ok := returnObject[*serviceTableEntry.Name]; !ok {
 			returnObject[*serviceTableEntry.Name] = &struct {
 				ServiceName string
@@ -298,8 +557,112 @@ func (tt *TopologyTracker) GetServicesWithProviders() map[string]*struct {
 	return returnObject
 }
 
-// FindInstanceOfService finds the best instance of a service to execute a command
-func (tt *TopologyTracker) FindInstanceOfService(serviceName *string, serviceType *string, zone *string, nodeID *string) *ServiceTableEntry {
+// GetStreamsWithProviders returns a map of stream names along with the Providers' NodeIDs, optionally limited to a zone
+func (tt *TopologyTracker) GetStreamsWithProviders(zoneName *string) map[string][]string {
+	tt.tableLock.RLock()
+	defer tt.tableLock.RUnlock()
+
+	returnObject := make(map[string][]string)
+	for _, serviceTableEntry := range *tt.serviceTable {
+		if zoneName != nil && (serviceTableEntry.Zone == nil || *serviceTableEntry.Zone != *zoneName) {
+			continue
+		}
+		for _, thisStreamName := range serviceTableEntry.Streams {
+			returnObject[thisStreamName] = append(returnObject[thisStreamName], *serviceTableEntry.NodeID)
+		}
+	}
+	return returnObject
+}
+
+// FindInstancesOfService returns copies of all ServiceTable entries for a service, optionally limited to a zone and
+// to instances matching a label selector
+func (tt *TopologyTracker) FindInstancesOfService(serviceName string, zoneName *string, labelSelector LabelSelector) []*ServiceTableEntry {
+	tt.tableLock.RLock()
+	defer tt.tableLock.RUnlock()
+
+	serviceEntryList := []*ServiceTableEntry{}
+	for _, serviceTableEntry := range *tt.serviceTable {
+		if *serviceTableEntry.Name != serviceName {
+			continue
+		}
+		if zoneName != nil && (serviceTableEntry.Zone == nil || *serviceTableEntry.Zone != *zoneName) {
+			continue
+		}
+		if !labelSelector.Matches(tt.getServiceLabels(serviceTableEntry)) {
+			continue
+		}
+		serviceEntryList = append(serviceEntryList, serviceTableEntry.Clone())
+	}
+	return serviceEntryList
+}
+
+// SetServiceBalancer sets the Balancer used to choose between instances of a service; nil restores the default
+func (tt *TopologyTracker) SetServiceBalancer(serviceName string, balancer Balancer) {
+	tt.balancerLock.Lock()
+	defer tt.balancerLock.Unlock()
+	if balancer == nil {
+		delete(tt.serviceBalancers, serviceName)
+		return
+	}
+	tt.serviceBalancers[serviceName] = balancer
+}
+
+// SetDefaultBalancer sets the Balancer used for services without one of their own
+func (tt *TopologyTracker) SetDefaultBalancer(balancer Balancer) {
+	tt.balancerLock.Lock()
+	defer tt.balancerLock.Unlock()
+	if balancer != nil {
+		tt.defaultBalancer = balancer
+	}
+}
+
+// GetServiceBalancer returns the Balancer used to choose between instances of a service
+func (tt *TopologyTracker) GetServiceBalancer(serviceName *string) Balancer {
+	tt.balancerLock.RLock()
+	defer tt.balancerLock.RUnlock()
+	if serviceName != nil {
+		if balancer, ok := tt.serviceBalancers[*serviceName]; ok {
+			return balancer
+		}
+	}
+	return tt.defaultBalancer
+}
+
+// FindInstanceOfService finds the best instance of a service to execute a command; a nil label selector matches
+// every instance
+func (tt *TopologyTracker) FindInstanceOfService(serviceName *string, serviceType *string, zone *string, nodeID *string, labelSelector LabelSelector) *ServiceTableEntry {
+	return tt.FindInstanceOfServiceWithBalancer(serviceName, serviceType, zone, nodeID, labelSelector, nil)
+}
+
+// FindInstanceOfServiceWithBalancer finds the best instance of a service, using the given Balancer to choose
+// between equally preferred instances; a nil Balancer uses the service's Balancer
+func (tt *TopologyTracker) FindInstanceOfServiceWithBalancer(serviceName *string, serviceType *string, zone *string, nodeID *string, labelSelector LabelSelector, balancer Balancer) *ServiceTableEntry {
+	serviceSelection := tt.SelectInstanceOfService(serviceName, serviceType, zone, nodeID, labelSelector, balancer)
+	if serviceSelection == nil {
+		return nil
+	}
+	return serviceSelection.ServiceEntry
+}
+
+// SelectInstanceOfService finds the best instance of a service and reports the zone preference tier it came from.
+// Ejected outliers and instances with an open circuit are only selected if every matching instance is unavailable.
+func (tt *TopologyTracker) SelectInstanceOfService(serviceName *string, serviceType *string, zone *string, nodeID *string, labelSelector LabelSelector, balancer Balancer) *ServiceSelection {
+	return tt.selectInstanceExcluding(serviceName, serviceType, zone, nodeID, labelSelector, balancer, nil)
+}
+
+// selectInstanceExcluding finds the best instance of a service other than the excluded instances
+func (tt *TopologyTracker) selectInstanceExcluding(serviceName *string, serviceType *string, zone *string, nodeID *string, labelSelector LabelSelector, balancer Balancer, excludedInstances map[string]bool) *ServiceSelection {
+	serviceSelection, skippedUnavailable := tt.selectInstanceOfService(serviceName, serviceType, zone, nodeID, labelSelector, balancer, excludedInstances, false)
+	if serviceSelection == nil && skippedUnavailable {
+		tt.drpNode.Log("All matching service instances are ejected or have open circuits, ignoring both", true)
+		serviceSelection, _ = tt.selectInstanceOfService(serviceName, serviceType, zone, nodeID, labelSelector, balancer, excludedInstances, true)
+	}
+	return serviceSelection
+}
+
+// selectInstanceOfService finds the best instance of a service, optionally considering ejected outliers and open
+// circuits, and tells whether or not any such instances were skipped
+func (tt *TopologyTracker) selectInstanceOfService(serviceName *string, serviceType *string, zone *string, nodeID *string, labelSelector LabelSelector, balancer Balancer, excludedInstances map[string]bool, includeUnavailable bool) (*ServiceSelection, bool) {
 	thisTopologyTracker := tt
 	thisNode := thisTopologyTracker.drpNode
 
@@ -311,84 +674,70 @@ func (tt *TopologyTracker) FindInstanceOfService(serviceName *string, serviceTyp
 
 	// If neither a name nor a type is specified, return null
 	if serviceName == nil && serviceType == nil {
-		return nil
+		return nil, false
 	}
 
 	/*
 	* Status MUST be 1 (Ready)
-	* Local zone is better than others (if specified, must match)
+	* Earlier zone preference tier is better than later ones
 	* Lower priority is better
-	* Higher weight is better
+	* Balancer chooses between the rest (weighted random by default)
 	 */
 
+	if balancer == nil {
+		balancer = thisTopologyTracker.GetServiceBalancer(serviceName)
+	}
+	zoneTiers := thisTopologyTracker.getZoneTiers(serviceName, checkZone)
+
+	tt.tableLock.RLock()
+	defer tt.tableLock.RUnlock()
+
 	var bestServiceEntry *ServiceTableEntry = nil
+	bestTier := -1
+	skippedUnavailable := false
 	candidateList := []*ServiceTableEntry{}
+	localCandidateList := []*ServiceTableEntry{}
+	bestLocalTier := -1
 
-	for _, serviceTableEntry := range *tt.ServiceTable {
+	for _, serviceTableEntry := range *tt.serviceTable {
 
-		// Skip if the service isn't ready
-		if serviceTableEntry.Status != 1 {
-			continue
-		}
-
-		// Skip if the service name/type doesn't match
-		if serviceName != nil && *serviceName != *serviceTableEntry.Name {
-			continue
-		}
-		if serviceType != nil && *serviceType != *serviceTableEntry.Type {
-			continue
+		entryTier, isUnavailable := thisTopologyTracker.candidateTier(serviceTableEntry, serviceName, serviceType, nodeID, labelSelector, zoneTiers, excludedInstances, includeUnavailable)
+		if isUnavailable {
+			skippedUnavailable = true
 		}
-
-		// Skip if the node ID doesn't match
-		if nodeID != nil && *nodeID != *serviceTableEntry.NodeID {
+		if entryTier < 0 {
 			continue
 		}
 
-		// If we offer the service locally, select it and continue
+		// Local instances are preferred over remote ones from the same or a later zone tier; keep those from the best
+		// tier with the lowest priority
 		if *serviceTableEntry.NodeID == thisNode.NodeID {
-			return serviceTableEntry
-		}
-
-		// Skip if the zone is specified and doesn't match
-		switch *serviceTableEntry.Scope {
-		case "local":
-			break
-		case "global":
-			break
-		case "zone":
-			if checkZone != *serviceTableEntry.Zone {
-				continue
+			if len(localCandidateList) == 0 || entryTier < bestLocalTier || (entryTier == bestLocalTier && serviceTableEntry.Priority < localCandidateList[0].Priority) {
+				localCandidateList = []*ServiceTableEntry{serviceTableEntry}
+				bestLocalTier = entryTier
+			} else if entryTier == bestLocalTier && serviceTableEntry.Priority == localCandidateList[0].Priority {
+				localCandidateList = append(localCandidateList, serviceTableEntry)
 			}
-			break
-		default:
-			// Unrecognized scope option
-			continue
-		}
-
-		// Delete if we don't have a corresponding Node entry
-		if !thisTopologyTracker.NodeTable.HasEntry(*serviceTableEntry.NodeID) {
-			thisNode.Log(fmt.Sprintf("Deleted service table entry [%s], no matching node table entry", *serviceTableEntry.InstanceID), false)
-			thisTopologyTracker.ServiceTable.DeleteEntry(*serviceTableEntry.InstanceID)
 			continue
 		}
 
 		// If this is the first candidate, set it and go
 		if bestServiceEntry == nil {
 			bestServiceEntry = serviceTableEntry
+			bestTier = entryTier
 			candidateList = []*ServiceTableEntry{bestServiceEntry}
 			continue
 		}
 
 		// Check this against the current bestServiceEntry
 
-		// Better zone?
-		if *bestServiceEntry.Zone != checkZone && *serviceTableEntry.Zone == checkZone {
-			// The service being evaluated is in a better zone
+		// Better zone tier?
+		if entryTier < bestTier {
 			bestServiceEntry = serviceTableEntry
+			bestTier = entryTier
 			candidateList = []*ServiceTableEntry{bestServiceEntry}
 			continue
-		} else if *bestServiceEntry.Zone == checkZone && *serviceTableEntry.Zone != checkZone {
-			// The service being evaluated is in a different zone
+		} else if entryTier > bestTier {
 			continue
 		}
 
@@ -406,55 +755,139 @@ func (tt *TopologyTracker) FindInstanceOfService(serviceName *string, serviceTyp
 			continue
 		}
 
-		// Weighted?
+		// Same Priority; let the Balancer decide
 		if bestServiceEntry.Priority == serviceTableEntry.Priority {
 			candidateList = append(candidateList, serviceTableEntry)
 		}
 	}
 
+	// If we offer the service locally in a tier no worse than the best remote one, let the Balancer choose between the
+	// local instances
+	if len(localCandidateList) > 0 && (bestServiceEntry == nil || bestLocalTier <= bestTier) {
+		// A Balancer which picks nothing leaves no match, as for remote instances
+		localServiceEntry := balancer.Pick(localCandidateList, thisTopologyTracker.ServiceStats)
+		if localServiceEntry == nil {
+			return nil, skippedUnavailable
+		}
+		return &ServiceSelection{localServiceEntry.Clone(), bestLocalTier, zoneTiers[bestLocalTier]}, false
+	}
+
 	// Did we find a match?
 	if len(candidateList) == 1 {
 		// Single match
 	} else if len(candidateList) > 1 {
-		// Multiple matches; select based on weight
+		// Multiple matches; select using the Balancer
+		bestServiceEntry = balancer.Pick(candidateList, thisTopologyTracker.ServiceStats)
+	}
 
-		rand.Seed(time.Now().UTC().UnixNano()) // always seed random!
+	if bestServiceEntry == nil {
+		return nil, skippedUnavailable
+	}
 
-		var choices []wr.Choice = []wr.Choice{}
-		for _, serviceTableEntry := range candidateList {
-			choices = append(choices, wr.Choice{Item: serviceTableEntry, Weight: serviceTableEntry.Weight})
+	serviceSelection := &ServiceSelection{bestServiceEntry.Clone(), bestTier, zoneTiers[bestTier]}
+	if thisNode.Debug {
+		qualifierText := ""
+		if serviceName != nil {
+			qualifierText = fmt.Sprintf("name[%s]", *serviceName)
 		}
-
-		chooser, _ := wr.NewChooser(choices...)
-		bestServiceEntry = chooser.Pick().(*ServiceTableEntry)
-		if thisNode.Debug {
-			qualifierText := ""
-			if serviceName != nil {
-				qualifierText = fmt.Sprintf("name[%s]", *serviceName)
+		if serviceType != nil {
+			if len(qualifierText) != 0 {
+				qualifierText = fmt.Sprintf("%s/", qualifierText)
 			}
-			if serviceType != nil {
-				if len(qualifierText) != 0 {
-					qualifierText = fmt.Sprintf("%s/", qualifierText)
-				}
-				qualifierText = `${qualifierText}type[${serviceType}]`
-			}
-			thisNode.Log(fmt.Sprintf("Need service %s, randomly selected [%s]", qualifierText, *bestServiceEntry.InstanceID), true)
+			qualifierText = fmt.Sprintf("%stype[%s]", qualifierText, *serviceType)
+		}
+		if len(labelSelector) > 0 {
+			qualifierText = fmt.Sprintf("%s labels[%s]", qualifierText, labelSelector)
 		}
+		thisNode.Log(fmt.Sprintf("Need service %s, %s selected %s", qualifierText, balancer.Name(), serviceSelection), true)
+	}
+	return serviceSelection, skippedUnavailable
+}
+
+// candidateTier returns the zone tier of a service instance which may be selected, or -1 if it is filtered out.  The
+// second result tells whether a remote instance was filtered out only because it was ejected or its circuit is open.
+// Caller must hold tableLock.
+func (tt *TopologyTracker) candidateTier(serviceTableEntry *ServiceTableEntry, serviceName *string, serviceType *string, nodeID *string, labelSelector LabelSelector, zoneTiers []string, excludedInstances map[string]bool, includeUnavailable bool) (int, bool) {
+	thisTopologyTracker := tt
+	thisNode := thisTopologyTracker.drpNode
+
+	// Skip if the service isn't ready
+	if serviceTableEntry.Status != ServiceStatusReady {
+		return -1, false
+	}
+
+	// Skip if the service name/type doesn't match
+	if serviceName != nil && *serviceName != *serviceTableEntry.Name {
+		return -1, false
+	}
+	if serviceType != nil && *serviceType != *serviceTableEntry.Type {
+		return -1, false
+	}
+
+	// Skip if the node ID doesn't match
+	if nodeID != nil && *nodeID != *serviceTableEntry.NodeID {
+		return -1, false
+	}
+
+	// Skip if the labels don't match
+	if !labelSelector.Matches(thisTopologyTracker.getServiceLabels(serviceTableEntry)) {
+		return -1, false
+	}
+
+	// Skip entries restored from disk until a live Node confirms them
+	if tt.isUnverified("service", *serviceTableEntry.InstanceID) || tt.isUnverified("node", *serviceTableEntry.NodeID) {
+		return -1, false
+	}
+
+	// Skip instances which already failed this call
+	if excludedInstances[*serviceTableEntry.InstanceID] {
+		return -1, false
+	}
+
+	// Local instances only need to be in a preferred zone
+	if *serviceTableEntry.NodeID == thisNode.NodeID {
+		return getZoneTier(serviceTableEntry, zoneTiers), false
+	}
+
+	// Skip outliers ejected after failed or slow calls and instances with an open circuit
+	if !includeUnavailable && (thisTopologyTracker.Outliers.IsEjected(*serviceTableEntry.InstanceID) || thisTopologyTracker.CircuitBreakers.IsOpen(*serviceTableEntry.Name, *serviceTableEntry.InstanceID)) {
+		return -1, true
+	}
+
+	// Skip unrecognized scopes and zones not in the preference list
+	switch *serviceTableEntry.Scope {
+	case "local", "global", "zone":
+	default:
+		return -1, false
+	}
+	entryTier := getZoneTier(serviceTableEntry, zoneTiers)
+	if entryTier < 0 {
+		return -1, false
+	}
+
+	// Skip if we don't have a corresponding Node entry; StaleEntryCleanup will remove it
+	if !thisTopologyTracker.nodeTable.HasEntry(*serviceTableEntry.NodeID) {
+		thisNode.Log(fmt.Sprintf("Skipped service table entry [%s], no matching node table entry", *serviceTableEntry.InstanceID), true)
+		return -1, false
 	}
 
-	return bestServiceEntry
+	return entryTier, false
 }
 
 // FindServicePeers returns the service peers for a specified instance
 func (tt *TopologyTracker) FindServicePeers(serviceID string) []string {
 	thisTopologyTracker := tt
 	peerServiceIDList := []string{}
-	originServiceTableEntry := thisTopologyTracker.ServiceTable.GetEntry(serviceID).(*ServiceTableEntry)
+
+	tt.tableLock.RLock()
+	defer tt.tableLock.RUnlock()
+
+	originServiceTableEntry := thisTopologyTracker.serviceTable.GetEntry(serviceID).(*ServiceTableEntry)
 	if originServiceTableEntry == nil {
 		return peerServiceIDList
 	}
 
-	for _, serviceTableEntry := range *tt.ServiceTable {
+	for _, serviceTableEntry := range *tt.serviceTable {
 
 		// Skip the instance specified
 		if *serviceTableEntry.InstanceID == serviceID {
@@ -462,7 +895,7 @@ func (tt *TopologyTracker) FindServicePeers(serviceID string) []string {
 		}
 
 		// Skip if the service isn't ready
-		if serviceTableEntry.Status != 1 {
+		if serviceTableEntry.Status != ServiceStatusReady {
 			continue
 		}
 
@@ -500,6 +933,13 @@ func (tt *TopologyTracker) FindServicePeers(serviceID string) []string {
 
 // AdvertiseOutCheck determines whether or not a TopologyTableEntry should be forwarded to given NodeID
 func (tt *TopologyTracker) AdvertiseOutCheck(topologyEntry *TopologyTableEntry, targetNodeID *string) bool {
+	tt.tableLock.RLock()
+	defer tt.tableLock.RUnlock()
+	return tt.advertiseOutCheck(topologyEntry, targetNodeID)
+}
+
+// advertiseOutCheck is AdvertiseOutCheck for callers which already hold tableLock
+func (tt *TopologyTracker) advertiseOutCheck(topologyEntry *TopologyTableEntry, targetNodeID *string) bool {
 
 	thisTopologyTracker := tt
 	thisNode := thisTopologyTracker.drpNode
@@ -512,16 +952,14 @@ func (tt *TopologyTracker) AdvertiseOutCheck(topologyEntry *TopologyTableEntry,
 	advertisedScope := topologyEntry.Scope
 	advertisedZone := topologyEntry.Zone
 
-	localNodeEntry := (*thisTopologyTracker.NodeTable)[localNodeID]
-	targetNodeEntry := (*thisTopologyTracker.NodeTable)[*targetNodeID]
+	localNodeEntry := (*thisTopologyTracker.nodeTable)[localNodeID]
+	targetNodeEntry := (*thisTopologyTracker.nodeTable)[*targetNodeID]
 
 	// We don't recognize the target node; give them everything by default
 	if targetNodeEntry == nil {
 		return true
 	}
 
-	// TODO - Add logic to support Proxied Nodes
-
 	switch *advertisedScope {
 	case "local":
 		// Never advertise local
@@ -551,6 +989,16 @@ func (tt *TopologyTracker) AdvertiseOutCheck(topologyEntry *TopologyTableEntry,
 		return true
 	}
 
+	// Relay entries for Nodes proxied by the local Node; we are their only path into the mesh
+	if topologyEntry.ProxyNodeID != nil && *topologyEntry.ProxyNodeID == localNodeID {
+		return true
+	}
+
+	// Relay mesh entries to the Nodes proxied by the local Node
+	if targetNodeEntry.UsesProxy() && *targetNodeEntry.ProxyNodeID == localNodeID {
+		return true
+	}
+
 	// Only send items for which we are authoritative
 	if localNodeEntry.IsRegistry() {
 		// The local node is a Registry
@@ -590,10 +1038,14 @@ func (tt *TopologyTracker) AdvertiseOutCheckService(serviceTableEntry *ServiceTa
 }
 
 // GetRegistry returns a copy of the local Registry (Node and Service tables)
-func (tt *TopologyTracker) GetRegistry(requestingNodeID *string) struct {
-	NodeTable    map[string]*NodeTableEntry
-	ServiceTable map[string]*ServiceTableEntry
-} {
+func (tt *TopologyTracker) GetRegistry(requestingNodeID *string) TopologySnapshot {
+	tt.tableLock.RLock()
+	defer tt.tableLock.RUnlock()
+	return tt.getRegistry(requestingNodeID)
+}
+
+// getRegistry returns a copy of the local Registry; caller must hold tableLock
+func (tt *TopologyTracker) getRegistry(requestingNodeID *string) TopologySnapshot {
 	thisTopologyTracker := tt
 
 	returnNodeTable := make(map[string]*NodeTableEntry)
@@ -604,75 +1056,148 @@ func (tt *TopologyTracker) GetRegistry(requestingNodeID *string) struct {
 		*requestingNodeID = ""
 	}
 
-	for advertisedNodeID, advertisedNodeEntry := range *thisTopologyTracker.NodeTable {
+	// Entries restored from disk are not advertised until a live Node confirms them
+	for advertisedNodeID, advertisedNodeEntry := range *thisTopologyTracker.nodeTable {
+		if thisTopologyTracker.isUnverified("node", advertisedNodeID) {
+			continue
+		}
 		relayPacket := thisTopologyTracker.AdvertiseOutCheckNode(advertisedNodeEntry, requestingNodeID)
 		if relayPacket {
-			returnNodeTable[advertisedNodeID] = advertisedNodeEntry
+			returnNodeTable[advertisedNodeID] = advertisedNodeEntry.Clone()
 		}
 	}
 
-	for advertisedServiceID, advertisedServiceEntry := range *thisTopologyTracker.ServiceTable {
+	for advertisedServiceID, advertisedServiceEntry := range *thisTopologyTracker.serviceTable {
+		if thisTopologyTracker.isUnverified("service", advertisedServiceID) {
+			continue
+		}
 		relayPacket := thisTopologyTracker.AdvertiseOutCheckService(advertisedServiceEntry, requestingNodeID)
 		if relayPacket {
-			returnServiceTable[advertisedServiceID] = advertisedServiceEntry
+			returnServiceTable[advertisedServiceID] = advertisedServiceEntry.Clone()
 		}
 	}
 
-	returnObj := struct {
-		NodeTable    map[string]*NodeTableEntry
-		ServiceTable map[string]*ServiceTableEntry
-	}{
-		returnNodeTable,
-		returnServiceTable,
+	return TopologySnapshot{returnNodeTable, returnServiceTable}
+}
+
+// Snapshot returns a copy of the full Node and Service tables
+func (tt *TopologyTracker) Snapshot() TopologySnapshot {
+	tt.tableLock.RLock()
+	defer tt.tableLock.RUnlock()
+	return tt.snapshotTables()
+}
+
+// snapshotTables copies the full Node and Service tables; caller must hold tableLock
+func (tt *TopologyTracker) snapshotTables() TopologySnapshot {
+	returnNodeTable := make(map[string]*NodeTableEntry)
+	returnServiceTable := make(map[string]*ServiceTableEntry)
+
+	for nodeID, nodeEntry := range *tt.nodeTable {
+		returnNodeTable[nodeID] = nodeEntry.Clone()
+	}
+	for serviceInstanceID, serviceEntry := range *tt.serviceTable {
+		returnServiceTable[serviceInstanceID] = serviceEntry.Clone()
+	}
+
+	return TopologySnapshot{returnNodeTable, returnServiceTable}
+}
+
+// GetNodeEntry returns a copy of a NodeTable entry, or nil if it does not exist
+func (tt *TopologyTracker) GetNodeEntry(nodeID string) *NodeTableEntry {
+	tt.tableLock.RLock()
+	defer tt.tableLock.RUnlock()
+
+	nodeEntry := tt.nodeTable.GetEntry(nodeID).(*NodeTableEntry)
+	if nodeEntry == nil {
+		return nil
 	}
+	return nodeEntry.Clone()
+}
+
+// GetServiceEntry returns a copy of a ServiceTable entry, or nil if it does not exist
+func (tt *TopologyTracker) GetServiceEntry(serviceInstanceID string) *ServiceTableEntry {
+	tt.tableLock.RLock()
+	defer tt.tableLock.RUnlock()
 
-	return returnObj
+	serviceEntry := tt.serviceTable.GetEntry(serviceInstanceID).(*ServiceTableEntry)
+	if serviceEntry == nil {
+		return nil
+	}
+	return serviceEntry.Clone()
 }
 
 // ProcessNodeConnect executes after connecting to a Node endpoint
 func (tt *TopologyTracker) ProcessNodeConnect(remoteEndpoint EndpointInterface, remoteNodeDeclaration *NodeDeclaration, localNodeIsProxy bool) {
 	thisTopologyTracker := tt
 	thisNode := thisTopologyTracker.drpNode
-	thisNode.Log(fmt.Sprintf("Connection established with Node [%s] (%s)", remoteNodeDeclaration.NodeID, strings.Join(remoteNodeDeclaration.NodeRoles, ",")), false)
-	returnData := remoteEndpoint.SendCmdAwait("DRP", "getRegistry", map[string]string{"reqNodeID": thisNode.NodeID}, nil, nil)
 
-	sourceIsRegistry := false
+	// Reject a second Node claiming a NodeID which is already in use
+	if thisNode.IsDuplicateNodeID(remoteNodeDeclaration, remoteEndpoint) {
+		thisNode.Log(fmt.Sprintf("Rejecting connection from Node [%s], NodeID is already in use", remoteNodeDeclaration.NodeID), false)
+		remoteEndpoint.Close(CloseCodeDuplicateNodeID, fmt.Sprintf("NodeID [%s] is already in use", remoteNodeDeclaration.NodeID))
+		return
+	}
 
-	remoteRegistry := struct {
-		NodeTable    map[string]NodeTableEntry
-		ServiceTable map[string]ServiceTableEntry
-	}{}
+	thisNode.Log(fmt.Sprintf("Connection established with Node [%s] (%s)", remoteNodeDeclaration.NodeID, strings.Join(remoteNodeDeclaration.NodeRoles, ",")), false)
 
-	err := json.Unmarshal(*returnData.Payload, &remoteRegistry)
-	if err != nil {
-		thisNode.Log(fmt.Sprintf("ProcessNodeConnect Payload unmarshal error: %s", err), false)
+	// Request only the changes since we last synced with this Node, if possible
+	remoteRegistry := thisTopologyTracker.fetchRemoteRegistry(remoteEndpoint, remoteNodeDeclaration.NodeID)
+	if remoteRegistry == nil {
 		return
 	}
+	if !remoteRegistry.Full {
+		thisNode.Log(fmt.Sprintf("Resyncing incrementally with Node [%s], %d nodes, %d services changed, %d deleted", remoteNodeDeclaration.NodeID, len(remoteRegistry.NodeTable), len(remoteRegistry.ServiceTable), len(remoteRegistry.DeletedNodes)+len(remoteRegistry.DeletedServices)), false)
+	}
+
+	sourceIsRegistry := false
+	sourceIsRelay := false
 
 	for _, a := range remoteNodeDeclaration.NodeRoles {
 		if a == "Registry" {
 			sourceIsRegistry = true
 		}
+		if a == "Relay" {
+			sourceIsRelay = true
+		}
+	}
+
+	// A non-listening Node registered through a Relay uses it as its control plane
+	if !sourceIsRegistry && sourceIsRelay && thisNode.listeningName == nil && !thisNode.IsRelay() {
+		sourceIsRegistry = true
 	}
 
 	runCleanup := false
 
+	// If the local Node is a proxy, only the remote Node's own entries are advertised as proxied
 	for _, thisNodeEntry := range remoteRegistry.NodeTable {
-		if localNodeIsProxy {
+		if localNodeIsProxy && *thisNodeEntry.NodeID == remoteNodeDeclaration.NodeID {
 			thisNodeEntry.ProxyNodeID = &thisNode.NodeID
 		}
-		nodeAddPacket := TopologyPacket{*thisNodeEntry.NodeID, "add", "node", *thisNodeEntry.NodeID, *thisNodeEntry.Scope, *thisNodeEntry.Zone, thisNodeEntry.ToJSON()}
+		nodeCmd := thisTopologyTracker.syncCmd(remoteRegistry, "node", *thisNodeEntry.NodeID)
+		if nodeCmd == "update" {
+			// Updates replace the whole entry; keep the remote Node as LearnedFrom
+			thisNodeEntry.LearnedFrom = cloneString(remoteEndpoint.GetID())
+		}
+		nodeAddPacket := TopologyPacket{*thisNodeEntry.NodeID, nodeCmd, "node", *thisNodeEntry.NodeID, *thisNodeEntry.Scope, *thisNodeEntry.Zone, thisNodeEntry.ToJSON(), thisNodeEntry.Sequence}
 		thisTopologyTracker.ProcessPacket(nodeAddPacket, *remoteEndpoint.GetID(), false)
 	}
 
 	for _, thisServiceEntry := range remoteRegistry.ServiceTable {
-		if localNodeIsProxy {
-			thisServiceEntry.ProxyNodeID = thisServiceEntry.NodeID
+		if localNodeIsProxy && *thisServiceEntry.NodeID == remoteNodeDeclaration.NodeID {
+			thisServiceEntry.ProxyNodeID = &thisNode.NodeID
+		}
+		serviceCmd := thisTopologyTracker.syncCmd(remoteRegistry, "service", *thisServiceEntry.InstanceID)
+		if serviceCmd == "update" {
+			thisServiceEntry.LearnedFrom = cloneString(remoteEndpoint.GetID())
 		}
-		serviceAddPacket := TopologyPacket{*thisServiceEntry.NodeID, "add", "service", *thisServiceEntry.InstanceID, *thisServiceEntry.Scope, *thisServiceEntry.Zone, thisServiceEntry.ToJSON()}
+		serviceAddPacket := TopologyPacket{*thisServiceEntry.NodeID, serviceCmd, "service", *thisServiceEntry.InstanceID, *thisServiceEntry.Scope, *thisServiceEntry.Zone, thisServiceEntry.ToJSON(), thisServiceEntry.Sequence}
 		thisTopologyTracker.ProcessPacket(serviceAddPacket, *remoteEndpoint.GetID(), false)
 	}
 
+	// Apply deletes from an incremental response
+	thisTopologyTracker.applySyncDeletes(remoteRegistry, *remoteEndpoint.GetID())
+	thisTopologyTracker.setSyncPoint(remoteNodeDeclaration.NodeID, remoteRegistry.Epoch, remoteRegistry.Version)
+
 	// Execute onControlPlaneConnect callback
 	if !thisNode.IsRegistry() && sourceIsRegistry && !thisNode.ConnectedToControlPlane {
 		// We are connected to a Registry
@@ -684,6 +1209,9 @@ func (tt *TopologyTracker) ProcessNodeConnect(remoteEndpoint EndpointInterface,
 		thisNode.HasConnectedToMesh = true
 	}
 
+	// Drop entries restored from disk which the remote Node contradicts
+	thisTopologyTracker.ReconcileUnverified(remoteNodeDeclaration.NodeID, sourceIsRegistry && !thisNode.IsRegistry())
+
 	// Remove any stale entries if we're reconnecting to a new Registry
 	if runCleanup {
 		thisTopologyTracker.StaleEntryCleanup()
@@ -698,8 +1226,8 @@ func (tt *TopologyTracker) ProcessNodeDisconnect(disconnectedNodeID string) {
 	// Remove node; this should trigger an autoremoval of entries learned from it
 
 	// If we are not a Registry and we just disconnected from a Registry, hold off on this process!
-	thisNodeEntry := (*thisTopologyTracker.NodeTable)[thisNode.NodeID]
-	disconnectedNodeEntry := (*thisTopologyTracker.NodeTable)[disconnectedNodeID]
+	thisNodeEntry := thisTopologyTracker.GetNodeEntry(thisNode.NodeID)
+	disconnectedNodeEntry := thisTopologyTracker.GetNodeEntry(disconnectedNodeID)
 
 	if disconnectedNodeEntry == nil {
 		thisNode.Log(fmt.Sprintf("Ran ProcessNodeDisconnect on non-existent Node [%s]", disconnectedNodeID), false)
@@ -721,15 +1249,27 @@ func (tt *TopologyTracker) ProcessNodeDisconnect(disconnectedNodeID string) {
 		// Do not go through with the cleanup process; delete only the disconnected Registry node
 		// for now and we'll run the StaleEntryCleanup when we connect to the next Registry.
 		thisNode.Log(fmt.Sprintf("We disconnected from Registry Node[%s] and have no other Registry connections", disconnectedNodeID), false)
-		thisTopologyTracker.NodeTable.DeleteEntry(disconnectedNodeID)
+		thisTopologyTracker.tableLock.Lock()
+		// The entry may have been removed since it was looked up
+		if lockedNodeEntry := (*thisTopologyTracker.nodeTable)[disconnectedNodeID]; lockedNodeEntry != nil {
+			thisTopologyTracker.queueNodeEvent("delete", disconnectedNodeID, lockedNodeEntry)
+			thisTopologyTracker.nodeTable.DeleteEntry(disconnectedNodeID)
+		}
+		topologyEvents := thisTopologyTracker.takePendingEvents()
+		thisTopologyTracker.tableLock.Unlock()
+		thisTopologyTracker.sendEvents(topologyEvents)
 		thisNode.ConnectedToControlPlane = false
 		return
 	}
 
+	// Entries learned from the disconnected Node are about to be removed; keep them so a reconnect can resync
+	// incrementally
+	thisTopologyTracker.retainSyncEntries(disconnectedNodeID)
+
 	// Issue Node Delete topology commands for the disconnected Node or any entries learned from the disconnected Node
-	for _, checkNodeEntry := range *thisTopologyTracker.NodeTable {
+	for _, checkNodeEntry := range thisTopologyTracker.Snapshot().NodeTable {
 		if *checkNodeEntry.NodeID == disconnectedNodeID || *checkNodeEntry.LearnedFrom == disconnectedNodeID {
-			nodeDeletePacket := TopologyPacket{*thisNodeEntry.NodeID, "delete", "node", *checkNodeEntry.NodeID, *checkNodeEntry.Scope, *checkNodeEntry.Zone, checkNodeEntry.ToJSON()}
+			nodeDeletePacket := TopologyPacket{*thisNodeEntry.NodeID, "delete", "node", *checkNodeEntry.NodeID, *checkNodeEntry.Scope, *checkNodeEntry.Zone, checkNodeEntry.ToJSON(), checkNodeEntry.Sequence}
 			thisTopologyTracker.ProcessPacket(nodeDeletePacket, *checkNodeEntry.NodeID, checkNodeEntry.IsRegistry())
 		}
 	}
@@ -741,7 +1281,7 @@ func (tt *TopologyTracker) ProcessNodeDisconnect(disconnectedNodeID string) {
 
 // GetNextHop return the next hop to communicate with a given Node ID
 func (tt *TopologyTracker) GetNextHop(checkNodeID string) *string {
-	var checkNodeTableEntry = tt.NodeTable.GetEntry(checkNodeID).(*NodeTableEntry)
+	var checkNodeTableEntry = tt.GetNodeEntry(checkNodeID)
 	if checkNodeTableEntry != nil {
 		return checkNodeTableEntry.LearnedFrom
 	}
@@ -750,13 +1290,26 @@ func (tt *TopologyTracker) GetNextHop(checkNodeID string) *string {
 
 // ValidateNodeID tells whether or not a NodeID is present in the NodeTable
 func (tt *TopologyTracker) ValidateNodeID(checkNodeID string) bool {
-	return tt.NodeTable.HasEntry(checkNodeID)
+	tt.tableLock.RLock()
+	defer tt.tableLock.RUnlock()
+	return tt.nodeTable.HasEntry(checkNodeID)
+}
+
+// ValidateServiceInstanceID tells whether or not a service instance is present in the ServiceTable
+func (tt *TopologyTracker) ValidateServiceInstanceID(checkInstanceID string) bool {
+	tt.tableLock.RLock()
+	defer tt.tableLock.RUnlock()
+	return tt.serviceTable.HasEntry(checkInstanceID)
 }
 
 // GetNodeWithURL returns NodeID with a given NodeURL
 func (tt *TopologyTracker) GetNodeWithURL(checkNodeURL string) *string {
 	thisTopologyTracker := tt
-	for thisNodeID, thisNodeEntry := range *thisTopologyTracker.NodeTable {
+
+	tt.tableLock.RLock()
+	defer tt.tableLock.RUnlock()
+
+	for thisNodeID, thisNodeEntry := range *thisTopologyTracker.nodeTable {
 		if thisNodeEntry.NodeURL != nil && *thisNodeEntry.NodeURL == checkNodeURL {
 			return &thisNodeID
 		}
@@ -767,17 +1320,32 @@ func (tt *TopologyTracker) GetNodeWithURL(checkNodeURL string) *string {
 // StaleEntryCleanup removed stale Node and Service entries
 func (tt *TopologyTracker) StaleEntryCleanup() {
 	thisTopologyTracker := tt
-	for _, thisNodeEntry := range *thisTopologyTracker.NodeTable {
-		if thisNodeEntry.ProxyNodeID != nil && thisTopologyTracker.ValidateNodeID(*thisNodeEntry.ProxyNodeID) {
-			thisTopologyTracker.NodeTable.DeleteEntry(*thisNodeEntry.NodeID)
+
+	tt.tableLock.Lock()
+
+	// Purge Node entries where the LearnedFrom or Proxy Node is not present
+	for checkNodeID, thisNodeEntry := range *thisTopologyTracker.nodeTable {
+		if thisNodeEntry.LearnedFrom != nil && thisTopologyTracker.nodeTable.HasEntry(*thisNodeEntry.LearnedFrom) && (thisNodeEntry.ProxyNodeID == nil || thisTopologyTracker.nodeTable.HasEntry(*thisNodeEntry.ProxyNodeID)) {
+			continue
 		}
+		thisTopologyTracker.drpNode.Log(fmt.Sprintf("Purged stale Node [%s], LearnedFrom or Proxy Node not in Node table", checkNodeID), true)
+		thisTopologyTracker.queueNodeEvent("delete", checkNodeID, thisNodeEntry)
+		thisTopologyTracker.nodeTable.DeleteEntry(checkNodeID)
 	}
 
-	for _, thisServiceEntry := range *thisTopologyTracker.ServiceTable {
-		if !thisTopologyTracker.ValidateNodeID(*thisServiceEntry.NodeID) {
-			thisTopologyTracker.ServiceTable.DeleteEntry(*thisServiceEntry.NodeID)
+	// Purge Service entries where the Node is not present
+	for checkServiceID, thisServiceEntry := range *thisTopologyTracker.serviceTable {
+		if !thisTopologyTracker.nodeTable.HasEntry(*thisServiceEntry.NodeID) {
+			thisTopologyTracker.drpNode.Log(fmt.Sprintf("Purged stale Service [%s], Node [%s] not in Node table", checkServiceID, *thisServiceEntry.NodeID), true)
+			thisTopologyTracker.queueServiceEvent("delete", checkServiceID, thisServiceEntry)
+			thisTopologyTracker.serviceTable.DeleteEntry(checkServiceID)
 		}
 	}
+
+	topologyEvents := thisTopologyTracker.takePendingEvents()
+	tt.tableLock.Unlock()
+
+	thisTopologyTracker.sendEvents(topologyEvents)
 }
 
 // ListConnectedRegistryNodes returns a list of connected Registry NodeIDs
@@ -785,7 +1353,10 @@ func (tt *TopologyTracker) ListConnectedRegistryNodes() []string {
 	thisTopologyTracker := tt
 	connectedRegistryList := []string{}
 
-	for checkNodeID, checkNodeEntry := range *thisTopologyTracker.NodeTable {
+	tt.tableLock.RLock()
+	defer tt.tableLock.RUnlock()
+
+	for checkNodeID, checkNodeEntry := range *thisTopologyTracker.nodeTable {
 		if *checkNodeEntry.NodeID != thisTopologyTracker.drpNode.NodeID && checkNodeEntry.IsRegistry() && thisTopologyTracker.drpNode.IsConnectedTo(checkNodeID) {
 			// Remote Node is a Registry and we are connected to it
 			connectedRegistryList = append(connectedRegistryList, checkNodeID)
@@ -799,7 +1370,10 @@ func (tt *TopologyTracker) FindRegistriesInZone(zoneName string) []string {
 	thisTopologyTracker := tt
 	zoneRegistryList := []string{}
 
-	for checkNodeID, checkNodeEntry := range *thisTopologyTracker.NodeTable {
+	tt.tableLock.RLock()
+	defer tt.tableLock.RUnlock()
+
+	for checkNodeID, checkNodeEntry := range *thisTopologyTracker.nodeTable {
 		if checkNodeEntry.IsRegistry() && *checkNodeEntry.Zone == zoneName {
 			// Remote Node is a Registry and we are connected to it
 			zoneRegistryList = append(zoneRegistryList, checkNodeID)
@@ -808,6 +1382,22 @@ func (tt *TopologyTracker) FindRegistriesInZone(zoneName string) []string {
 	return zoneRegistryList
 }
 
+// FindRelaysInZone returns a list of Relay Nodes in a given zone
+func (tt *TopologyTracker) FindRelaysInZone(zoneName string) []string {
+	thisTopologyTracker := tt
+	zoneRelayList := []string{}
+
+	tt.tableLock.RLock()
+	defer tt.tableLock.RUnlock()
+
+	for checkNodeID, checkNodeEntry := range *thisTopologyTracker.nodeTable {
+		if checkNodeEntry.IsRelay() && *checkNodeEntry.Zone == zoneName {
+			zoneRelayList = append(zoneRelayList, checkNodeID)
+		}
+	}
+	return zoneRelayList
+}
+
 // TopologyTable is used for NodeTable and ServiceTable modules
 type TopologyTable interface {
 	HasEntry(string) bool
@@ -822,6 +1412,7 @@ type TopologyTable interface {
 // TopologyTableEntryInterface is used for NodeTableEntry and ServiceTableEntry
 type TopologyTableEntryInterface interface {
 	GetLearnedFrom() *string
+	GetSequence() uint64
 	SetLearnedFrom(string, string)
 	ToJSON() []byte
 }
@@ -835,6 +1426,7 @@ type TopologyTableEntry struct {
 	Zone         *string
 	LearnedFrom  *string
 	LastModified *string
+	Sequence     uint64
 }
 
 // GetLearnedFrom returns the LearnedFrom attribute
@@ -842,18 +1434,71 @@ func (tte TopologyTableEntry) GetLearnedFrom() *string {
 	return tte.LearnedFrom
 }
 
+// GetSequence returns the sequence number issued by the entry's origin
+func (tte TopologyTableEntry) GetSequence() uint64 {
+	return tte.Sequence
+}
+
 // SetLearnedFrom sets the LearnedFrom attribute
 func (tte TopologyTableEntry) SetLearnedFrom(learnedFrom string, lastModified string) {
 	*tte.LearnedFrom = learnedFrom
 	*tte.LastModified = lastModified
 }
 
+// cloneString returns a pointer to a copy of a string
+func cloneString(sourceString *string) *string {
+	if sourceString == nil {
+		return nil
+	}
+	newString := *sourceString
+	return &newString
+}
+
+// derefString returns the value of a string pointer, or an empty string if it is nil
+func derefString(sourceString *string) string {
+	if sourceString == nil {
+		return ""
+	}
+	return *sourceString
+}
+
+// setEntryLearnedFrom sets the LearnedFrom attribute of a Node or Service table entry
+func setEntryLearnedFrom(entryData interface{}, learnedFrom string) {
+	switch tableEntry := entryData.(type) {
+	case *NodeTableEntry:
+		tableEntry.LearnedFrom = &learnedFrom
+	case *ServiceTableEntry:
+		tableEntry.LearnedFrom = &learnedFrom
+	}
+}
+
+// cloneStrings returns a copy of a string slice
+func cloneStrings(sourceStrings []string) []string {
+	if sourceStrings == nil {
+		return nil
+	}
+	return append([]string{}, sourceStrings...)
+}
+
+// cloneBase returns a deep copy of the base entry attributes
+func (tte TopologyTableEntry) cloneBase() TopologyTableEntry {
+	newEntry := tte
+	newEntry.NodeID = cloneString(tte.NodeID)
+	newEntry.ProxyNodeID = cloneString(tte.ProxyNodeID)
+	newEntry.Scope = cloneString(tte.Scope)
+	newEntry.Zone = cloneString(tte.Zone)
+	newEntry.LearnedFrom = cloneString(tte.LearnedFrom)
+	newEntry.LastModified = cloneString(tte.LastModified)
+	return newEntry
+}
+
 // NodeTableEntry provides the details of a Node
 type NodeTableEntry struct {
 	TopologyTableEntry
 	Roles   []string
 	NodeURL *string
 	HostID  *string
+	Labels  map[string]string
 }
 
 // ToJSON converts the NodeTableEntry to JSON
@@ -862,6 +1507,17 @@ func (nte NodeTableEntry) ToJSON() []byte {
 	return entryBytes
 }
 
+// Clone returns a deep copy of the NodeTableEntry
+func (nte NodeTableEntry) Clone() *NodeTableEntry {
+	newEntry := nte
+	newEntry.TopologyTableEntry = nte.cloneBase()
+	newEntry.Roles = cloneStrings(nte.Roles)
+	newEntry.NodeURL = cloneString(nte.NodeURL)
+	newEntry.HostID = cloneString(nte.HostID)
+	newEntry.Labels = cloneLabels(nte.Labels)
+	return &newEntry
+}
+
 // IsRegistry - tells whether a Node topology entry hold the Registry role
 func (nte NodeTableEntry) IsRegistry() bool {
 	for _, a := range nte.Roles {
@@ -882,6 +1538,16 @@ func (nte NodeTableEntry) IsBroker() bool {
 	return false
 }
 
+// IsRelay tells whether a Node topology entry hold the Relay role
+func (nte NodeTableEntry) IsRelay() bool {
+	for _, a := range nte.Roles {
+		if a == "Relay" {
+			return true
+		}
+	}
+	return false
+}
+
 // UsesProxy - tells whether a Node topology entry uses a Proxy
 func (nte NodeTableEntry) UsesProxy() bool {
 	if nte.ProxyNodeID != nil {
@@ -952,6 +1618,9 @@ type ServiceTableEntry struct {
 	Dependencies []string
 	Streams      []string
 	Status       int
+	Labels       map[string]string
+	HealthCheck  string
+	ClientCmds   []string
 }
 
 // ToJSON marshals table entry to JSON
@@ -960,6 +1629,20 @@ func (ste ServiceTableEntry) ToJSON() []byte {
 	return entryBytes
 }
 
+// Clone returns a deep copy of the ServiceTableEntry
+func (ste ServiceTableEntry) Clone() *ServiceTableEntry {
+	newEntry := ste
+	newEntry.TopologyTableEntry = ste.cloneBase()
+	newEntry.Name = cloneString(ste.Name)
+	newEntry.Type = cloneString(ste.Type)
+	newEntry.InstanceID = cloneString(ste.InstanceID)
+	newEntry.Dependencies = cloneStrings(ste.Dependencies)
+	newEntry.Streams = cloneStrings(ste.Streams)
+	newEntry.Labels = cloneLabels(ste.Labels)
+	newEntry.ClientCmds = cloneStrings(ste.ClientCmds)
+	return &newEntry
+}
+
 // ServiceTable is a map of NodeTableEntry objects
 type ServiceTable map[string]*ServiceTableEntry
 
@@ -1019,4 +1702,5 @@ type TopologyPacket struct {
 	Scope        string          `json:"scope"`
 	Zone         string          `json:"zone"`
 	Data         json.RawMessage `json:"data"`
+	Sequence     uint64          `json:"sequence,omitempty"`
 }
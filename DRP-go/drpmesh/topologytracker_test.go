@@ -0,0 +1,383 @@
+package drpmesh
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testNodeOptions returns the options for a Node in zone1 of test.domain
+func testNodeOptions(nodeRole string, nodeID string) NodeOptions {
+	return NodeOptions{
+		NodeRoles:  []string{nodeRole},
+		HostID:     "host1",
+		DomainName: "test.domain",
+		MeshKey:    "meshkey",
+		Zone:       "zone1",
+		Scope:      "zone",
+		NodeID:     nodeID,
+	}
+}
+
+// testNode creates a Node, failing the test if it can not be created
+func testNode(t *testing.T, nodeOptions NodeOptions) *Node {
+	t.Helper()
+	thisNode, err := CreateNode(nodeOptions)
+	if err != nil {
+		t.Fatalf("could not create Node: %s", err)
+	}
+	return thisNode
+}
+
+// testNodeEntry returns a NodeTableEntry for a Node which advertised itself directly
+func testNodeEntry(nodeID string) *NodeTableEntry {
+	scope := "zone"
+	zone := "zone1"
+	hostID := "host-" + nodeID
+	lastModified := "0"
+	nodeEntry := &NodeTableEntry{}
+	nodeEntry.NodeID = &nodeID
+	nodeEntry.Scope = &scope
+	nodeEntry.Zone = &zone
+	nodeEntry.LearnedFrom = &nodeID
+	nodeEntry.LastModified = &lastModified
+	nodeEntry.Roles = []string{"Provider"}
+	nodeEntry.HostID = &hostID
+	return nodeEntry
+}
+
+// testServiceEntry returns a ServiceTableEntry for a service offered by a Node
+func testServiceEntry(nodeID string, serviceName string) *ServiceTableEntry {
+	scope := "zone"
+	zone := "zone1"
+	serviceType := serviceName
+	instanceID := nodeID + "-" + serviceName
+	lastModified := "0"
+	serviceEntry := &ServiceTableEntry{}
+	serviceEntry.NodeID = &nodeID
+	serviceEntry.Scope = &scope
+	serviceEntry.Zone = &zone
+	serviceEntry.LearnedFrom = &nodeID
+	serviceEntry.LastModified = &lastModified
+	serviceEntry.Name = &serviceName
+	serviceEntry.Type = &serviceType
+	serviceEntry.InstanceID = &instanceID
+	serviceEntry.Priority = 10
+	serviceEntry.Weight = 10
+	serviceEntry.Status = ServiceStatusReady
+	serviceEntry.Dependencies = []string{}
+	serviceEntry.Streams = []string{}
+	return serviceEntry
+}
+
+// addTestProvider advertises a directly connected Provider in a zone offering the given services and returns the
+// service entries as advertised
+func addTestProvider(thisTopologyTracker *TopologyTracker, nodeID string, zoneName string, serviceNames ...string) []*ServiceTableEntry {
+	nodeEntry := testNodeEntry(nodeID)
+	nodeEntry.Zone = &zoneName
+	thisTopologyTracker.ProcessPacket(TopologyPacket{nodeID, "add", "node", nodeID, *nodeEntry.Scope, zoneName, nodeEntry.ToJSON(), 0}, nodeID, false)
+
+	serviceEntryList := []*ServiceTableEntry{}
+	for _, serviceName := range serviceNames {
+		serviceEntry := testServiceEntry(nodeID, serviceName)
+		serviceEntry.Zone = &zoneName
+		thisTopologyTracker.ProcessPacket(TopologyPacket{nodeID, "add", "service", *serviceEntry.InstanceID, *serviceEntry.Scope, zoneName, serviceEntry.ToJSON(), 0}, nodeID, false)
+		serviceEntryList = append(serviceEntryList, serviceEntry)
+	}
+	return serviceEntryList
+}
+
+// recordedCmd is a command sent through a recordingEndpoint
+type recordedCmd struct {
+	serviceName string
+	methodName  string
+	cmdParams   interface{}
+}
+
+// recordingEndpoint is an Endpoint which records the commands sent to it instead of writing to a connection
+type recordingEndpoint struct {
+	*Endpoint
+	recordLock  sync.Mutex
+	sentCmdList []recordedCmd
+}
+
+// newRecordingEndpoint returns a recordingEndpoint with the given ID
+func newRecordingEndpoint(thisNode *Node, endpointID string) *recordingEndpoint {
+	newEndpoint := &recordingEndpoint{Endpoint: &Endpoint{drpNode: thisNode}}
+	newEndpoint.Init()
+	newEndpoint.SetID(endpointID)
+	return newEndpoint
+}
+
+// SendCmd records the command
+func (re *recordingEndpoint) SendCmd(serviceName string, methodName string, cmdParams interface{}, token *int, routeOptions *RouteOptions, serviceInstanceID *string) {
+	re.recordLock.Lock()
+	defer re.recordLock.Unlock()
+	re.sentCmdList = append(re.sentCmdList, recordedCmd{serviceName, methodName, cmdParams})
+}
+
+// topologyPackets returns the topology packets sent to the endpoint and clears the record
+func (re *recordingEndpoint) topologyPackets() []TopologyPacket {
+	re.recordLock.Lock()
+	defer re.recordLock.Unlock()
+	packetList := []TopologyPacket{}
+	for _, sentCmd := range re.sentCmdList {
+		if sentCmd.methodName == "topologyUpdate" {
+			packetList = append(packetList, sentCmd.cmdParams.(TopologyPacket))
+		}
+	}
+	re.sentCmdList = nil
+	return packetList
+}
+
+func TestTopologyTrackerConcurrentAccess(t *testing.T) {
+	localNodeID := "registry1"
+	thisNode := testNode(t, testNodeOptions("Registry", localNodeID))
+	thisTopologyTracker := thisNode.TopologyTracker
+
+	writerCount := 8
+	readerCount := 8
+	iterations := 500
+	serviceName := "TestService"
+
+	var waitGroup sync.WaitGroup
+
+	for writerNum := 0; writerNum < writerCount; writerNum++ {
+		waitGroup.Add(1)
+		go func(writerNum int) {
+			defer waitGroup.Done()
+			for i := 0; i < iterations; i++ {
+				nodeID := fmt.Sprintf("node-%d-%d", writerNum, i%10)
+				nodeEntry := testNodeEntry(nodeID)
+				serviceEntry := testServiceEntry(nodeID, serviceName)
+
+				thisTopologyTracker.ProcessPacket(TopologyPacket{nodeID, "add", "node", nodeID, *nodeEntry.Scope, *nodeEntry.Zone, nodeEntry.ToJSON(), nodeEntry.Sequence}, nodeID, false)
+				thisTopologyTracker.ProcessPacket(TopologyPacket{nodeID, "add", "service", *serviceEntry.InstanceID, *serviceEntry.Scope, *serviceEntry.Zone, serviceEntry.ToJSON(), serviceEntry.Sequence}, nodeID, false)
+
+				serviceEntry.Status = ServiceStatusDraining
+				thisTopologyTracker.ProcessPacket(TopologyPacket{nodeID, "update", "service", *serviceEntry.InstanceID, *serviceEntry.Scope, *serviceEntry.Zone, serviceEntry.ToJSON(), serviceEntry.Sequence}, nodeID, false)
+
+				if i%3 == 0 {
+					thisTopologyTracker.ProcessPacket(TopologyPacket{nodeID, "delete", "node", nodeID, *nodeEntry.Scope, *nodeEntry.Zone, nodeEntry.ToJSON(), nodeEntry.Sequence}, nodeID, false)
+				}
+
+				// Connections come and go while updates are relayed to them
+				peerNodeID := fmt.Sprintf("peer-%d", writerNum)
+				if i%2 == 0 {
+					thisNode.setNodeEndpoint(peerNodeID, newRecordingEndpoint(thisNode, peerNodeID))
+				} else if peerEndpoint := thisNode.GetNodeEndpoint(peerNodeID); peerEndpoint != nil {
+					thisNode.removeNodeEndpoint(peerNodeID, peerEndpoint)
+				}
+			}
+
+			// Each writer finishes with an entry nothing else touches
+			finalNodeID := fmt.Sprintf("final-%d", writerNum)
+			finalNodeEntry := testNodeEntry(finalNodeID)
+			finalServiceEntry := testServiceEntry(finalNodeID, serviceName)
+			thisTopologyTracker.ProcessPacket(TopologyPacket{finalNodeID, "add", "node", finalNodeID, *finalNodeEntry.Scope, *finalNodeEntry.Zone, finalNodeEntry.ToJSON(), finalNodeEntry.Sequence}, finalNodeID, false)
+			thisTopologyTracker.ProcessPacket(TopologyPacket{finalNodeID, "add", "service", *finalServiceEntry.InstanceID, *finalServiceEntry.Scope, *finalServiceEntry.Zone, finalServiceEntry.ToJSON(), finalServiceEntry.Sequence}, finalNodeID, false)
+		}(writerNum)
+	}
+
+	for readerNum := 0; readerNum < readerCount; readerNum++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for i := 0; i < iterations; i++ {
+				if serviceEntry := thisTopologyTracker.FindInstanceOfService(&serviceName, nil, nil, nil, nil); serviceEntry != nil {
+					// Returned entries are copies; changing them must not touch the tracker
+					serviceEntry.Status = ServiceStatusDown
+				}
+				registry := thisTopologyTracker.GetRegistry(&localNodeID)
+				for _, nodeEntry := range registry.NodeTable {
+					thisTopologyTracker.GetNextHop(*nodeEntry.NodeID)
+				}
+				thisTopologyTracker.ListServices(nil, nil)
+				thisTopologyTracker.GetServicesWithProviders(nil)
+				thisTopologyTracker.Snapshot()
+				thisTopologyTracker.ValidateNodeID(localNodeID)
+				thisNode.ListClientConnections()
+				thisNode.IsConnectedTo("peer-0")
+			}
+		}()
+	}
+
+	waitGroup.Wait()
+
+	// The local Node and DRP service must survive all of the churn
+	if thisTopologyTracker.GetNodeEntry(localNodeID) == nil {
+		t.Fatalf("local node entry missing after concurrent updates")
+	}
+
+	snapshot := thisTopologyTracker.Snapshot()
+	for writerNum := 0; writerNum < writerCount; writerNum++ {
+		finalNodeID := fmt.Sprintf("final-%d", writerNum)
+		if _, ok := snapshot.NodeTable[finalNodeID]; !ok {
+			t.Errorf("node entry [%s] missing after concurrent updates", finalNodeID)
+		}
+		finalServiceEntry, ok := snapshot.ServiceTable[finalNodeID+"-"+serviceName]
+		if !ok || finalServiceEntry.Status != ServiceStatusReady {
+			t.Errorf("service entry for [%s] missing or not Ready after concurrent updates", finalNodeID)
+		}
+	}
+	remoteServiceCount := 0
+	for _, serviceEntry := range snapshot.ServiceTable {
+		if *serviceEntry.NodeID != localNodeID {
+			remoteServiceCount++
+		}
+	}
+	if remoteServiceCount < writerCount {
+		t.Errorf("expected at least %d remote service entries, got %d", writerCount, remoteServiceCount)
+	}
+	for serviceInstanceID, serviceEntry := range snapshot.ServiceTable {
+		if _, ok := snapshot.NodeTable[*serviceEntry.NodeID]; !ok {
+			t.Errorf("service entry [%s] references missing node [%s]", serviceInstanceID, *serviceEntry.NodeID)
+		}
+		if *serviceEntry.NodeID != localNodeID && !strings.HasPrefix(*serviceEntry.NodeID, "final-") && serviceEntry.Status != ServiceStatusDraining {
+			t.Errorf("service entry [%s] has status [%s], expected Draining", serviceInstanceID, ServiceStatusName(serviceEntry.Status))
+		}
+	}
+}
+
+func TestTopologyTrackerDiscoveryQueries(t *testing.T) {
+	localNodeID := "registry1"
+	thisNode := testNode(t, testNodeOptions("Registry", localNodeID))
+	thisTopologyTracker := thisNode.TopologyTracker
+
+	// A Provider in each zone offers Worker; only the zone1 Provider offers Cache and the events stream
+	streamEntry := testServiceEntry("provider1", "Feed")
+	streamEntry.Streams = []string{"events"}
+	addTestProvider(thisTopologyTracker, "provider1", "zone1", "Worker", "Cache")
+	thisTopologyTracker.ProcessPacket(TopologyPacket{"provider1", "add", "service", *streamEntry.InstanceID, *streamEntry.Scope, *streamEntry.Zone, streamEntry.ToJSON(), 0}, "provider1", false)
+	addTestProvider(thisTopologyTracker, "provider2", "zone2", "Worker")
+	zone2 := "zone2"
+
+	sortedList := func(stringList []string) string {
+		sort.Strings(stringList)
+		return strings.Join(stringList, ",")
+	}
+	queryChecks := map[string][2]string{
+		"ListNodes":                      {sortedList(thisTopologyTracker.ListNodes(nil, nil)), "provider1,provider2,registry1"},
+		"ListNodes in zone2":             {sortedList(thisTopologyTracker.ListNodes(&zone2, nil)), "provider2"},
+		"ListZones":                      {sortedList(thisTopologyTracker.ListZones()), "zone1,zone2"},
+		"ListServices":                   {sortedList(thisTopologyTracker.ListServices(nil, nil)), "Cache,DRP,Feed,Worker"},
+		"ListServices in zone2":          {sortedList(thisTopologyTracker.ListServices(&zone2, nil)), "Worker"},
+		"Worker Providers":               {sortedList(thisTopologyTracker.GetServicesWithProviders(nil)["Worker"].Providers), "provider1,provider2"},
+		"Services with Providers, zone2": {sortedList(GetKeys(thisTopologyTracker.GetServicesWithProviders(&zone2))), "Worker"},
+		"events Providers":               {sortedList(thisTopologyTracker.GetStreamsWithProviders(nil)["events"]), "provider1"},
+		"Streams with Providers, zone2":  {sortedList(GetKeys(thisTopologyTracker.GetStreamsWithProviders(&zone2))), ""},
+	}
+	for queryName, queryCheck := range queryChecks {
+		if queryCheck[0] != queryCheck[1] {
+			t.Errorf("%s: expected [%s], got [%s]", queryName, queryCheck[1], queryCheck[0])
+		}
+	}
+
+	// Instance lookups filter by zone and return copies
+	if workerEntries := thisTopologyTracker.FindInstancesOfService("Worker", nil, nil); len(workerEntries) != 2 {
+		t.Fatalf("expected two Worker instances, got %d", len(workerEntries))
+	}
+	zoneWorkerEntries := thisTopologyTracker.FindInstancesOfService("Worker", &zone2, nil)
+	if len(zoneWorkerEntries) != 1 || *zoneWorkerEntries[0].NodeID != "provider2" {
+		t.Fatalf("expected the zone2 Worker instance, got %v", zoneWorkerEntries)
+	}
+	zoneWorkerEntries[0].Status = ServiceStatusDown
+	if thisTopologyTracker.GetServiceEntry("provider2-Worker").Status != ServiceStatusReady {
+		t.Fatalf("expected changes to a returned instance not to reach the table")
+	}
+
+	// The best instance comes from the requested zone, or the local zone by default; a type alone is enough
+	workerName := "Worker"
+	if workerEntry := thisTopologyTracker.FindInstanceOfService(&workerName, nil, &zone2, nil, nil); workerEntry == nil || *workerEntry.NodeID != "provider2" {
+		t.Fatalf("expected the zone2 Worker instance, got %v", workerEntry)
+	}
+	if workerEntry := thisTopologyTracker.FindInstanceOfService(&workerName, nil, nil, nil, nil); workerEntry == nil || *workerEntry.NodeID != "provider1" {
+		t.Fatalf("expected the local zone Worker instance, got %v", workerEntry)
+	}
+	cacheType := "Cache"
+	if cacheEntry := thisTopologyTracker.FindInstanceOfService(nil, &cacheType, nil, nil, nil); cacheEntry == nil || *cacheEntry.InstanceID != "provider1-Cache" {
+		t.Fatalf("expected the Cache instance found by type, got %v", cacheEntry)
+	}
+	if missingEntry := thisTopologyTracker.FindInstanceOfService(nil, nil, nil, nil, nil); missingEntry != nil {
+		t.Fatalf("expected no instance without a name or type, got %v", missingEntry)
+	}
+}
+
+func TestTopologyTrackerSequenceOrdering(t *testing.T) {
+	localNodeID := "registry1"
+	thisNode := testNode(t, testNodeOptions("Registry", localNodeID))
+	thisTopologyTracker := thisNode.TopologyTracker
+
+	nodeID := "provider1"
+	nodeEntry := testNodeEntry(nodeID)
+	nodeEntry.Sequence = 10
+	serviceEntry := testServiceEntry(nodeID, "TestService")
+	serviceEntry.Sequence = 10
+	serviceInstanceID := *serviceEntry.InstanceID
+
+	sendService := func(cmd string, sequence uint64, status int, srcNodeID string) {
+		serviceEntry.Sequence = sequence
+		serviceEntry.Status = status
+		thisTopologyTracker.ProcessPacket(TopologyPacket{nodeID, cmd, "service", serviceInstanceID, *serviceEntry.Scope, *serviceEntry.Zone, serviceEntry.ToJSON(), sequence}, srcNodeID, false)
+	}
+
+	thisTopologyTracker.ProcessPacket(TopologyPacket{nodeID, "add", "node", nodeID, *nodeEntry.Scope, *nodeEntry.Zone, nodeEntry.ToJSON(), nodeEntry.Sequence}, nodeID, false)
+	sendService("add", 10, ServiceStatusReady, nodeID)
+
+	// A newer update applies; an older update or a duplicate does not
+	sendService("update", 12, ServiceStatusDraining, nodeID)
+	sendService("update", 11, ServiceStatusDown, nodeID)
+	sendService("update", 12, ServiceStatusDown, nodeID)
+	if checkEntry := thisTopologyTracker.GetServiceEntry(serviceInstanceID); checkEntry == nil || checkEntry.Status != ServiceStatusDraining || checkEntry.Sequence != 12 {
+		t.Fatalf("expected service at sequence 12 with status Draining, got %+v", checkEntry)
+	}
+
+	// A delete older than the entry is discarded
+	sendService("delete", 11, ServiceStatusDraining, nodeID)
+	if thisTopologyTracker.GetServiceEntry(serviceInstanceID) == nil {
+		t.Fatalf("stale delete removed service entry")
+	}
+
+	// Once deleted, a late add relayed by another Node does not bring the entry back
+	sendService("delete", 13, ServiceStatusDraining, nodeID)
+	sendService("add", 12, ServiceStatusReady, "relay1")
+	if thisTopologyTracker.GetServiceEntry(serviceInstanceID) != nil {
+		t.Fatalf("late relayed add restored deleted service entry")
+	}
+
+	// The origin itself may advertise the entry again
+	sendService("add", 14, ServiceStatusReady, nodeID)
+	if thisTopologyTracker.GetServiceEntry(serviceInstanceID) == nil {
+		t.Fatalf("origin could not re-add deleted service entry")
+	}
+}
+
+func TestTopologyTrackerIncompletePackets(t *testing.T) {
+	localNodeID := "registry1"
+	thisNode := testNode(t, testNodeOptions("Registry", localNodeID))
+	thisTopologyTracker := thisNode.TopologyTracker
+
+	nodeID := "provider1"
+	nodeEntry := testNodeEntry(nodeID)
+	nodeEntry.Sequence = 10
+	thisTopologyTracker.ProcessPacket(TopologyPacket{nodeID, "add", "node", nodeID, *nodeEntry.Scope, *nodeEntry.Zone, nodeEntry.ToJSON(), nodeEntry.Sequence}, nodeID, false)
+
+	// Packets without a LearnedFrom are ignored rather than dereferenced
+	incompleteEntry := testNodeEntry(nodeID)
+	incompleteEntry.LearnedFrom = nil
+	incompleteEntry.Sequence = 11
+	thisTopologyTracker.ProcessPacket(TopologyPacket{nodeID, "delete", "node", nodeID, *incompleteEntry.Scope, *incompleteEntry.Zone, incompleteEntry.ToJSON(), incompleteEntry.Sequence}, "registry2", true)
+	thisTopologyTracker.ProcessPacket(TopologyPacket{nodeID, "add", "node", nodeID, *incompleteEntry.Scope, *incompleteEntry.Zone, incompleteEntry.ToJSON(), incompleteEntry.Sequence}, "registry2", true)
+	if thisTopologyTracker.GetNodeEntry(nodeID) == nil {
+		t.Fatalf("expected an incomplete delete to be ignored")
+	}
+
+	incompleteService := testServiceEntry(nodeID, "TestService")
+	incompleteService.Scope = nil
+	thisTopologyTracker.ProcessPacket(TopologyPacket{nodeID, "add", "service", *incompleteService.InstanceID, "zone", *incompleteService.Zone, incompleteService.ToJSON(), 1}, nodeID, false)
+	if thisTopologyTracker.GetServiceEntry(*incompleteService.InstanceID) != nil {
+		t.Fatalf("expected an incomplete add to be ignored")
+	}
+}
@@ -0,0 +1,210 @@
+package drpmesh
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DefaultWatchDogInterval is how often the WatchDog checks the topology tables
+const DefaultWatchDogInterval = 60 * time.Second
+
+// StartWatchDog periodically removes stale topology entries; an entryTTL of zero disables aging out entries which
+// have not been confirmed.  Calling it again replaces the running WatchDog.
+func (tt *TopologyTracker) StartWatchDog(checkInterval time.Duration, entryTTL time.Duration) {
+	tt.StopWatchDog()
+
+	stopChan := make(chan bool)
+	tt.watchDogLock.Lock()
+	tt.watchDogStop = stopChan
+	tt.watchDogLock.Unlock()
+
+	go func() {
+		checkTicker := time.NewTicker(checkInterval)
+		defer checkTicker.Stop()
+		for {
+			select {
+			case <-checkTicker.C:
+				tt.WatchDog(entryTTL)
+				// Ejections and open circuits expire without topology events
+				tt.drpNode.EvaluateDependencies()
+			case <-stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// StopWatchDog stops the WatchDog if it is running
+func (tt *TopologyTracker) StopWatchDog() {
+	tt.watchDogLock.Lock()
+	defer tt.watchDogLock.Unlock()
+	if tt.watchDogStop != nil {
+		close(tt.watchDogStop)
+		tt.watchDogStop = nil
+	}
+}
+
+// WatchDog processes disconnects for lost connections, then removes Node entries whose LearnedFrom Node is no
+// longer connected, Service entries whose Node is gone and, if entryTTL is set, entries which have not been
+// confirmed within the TTL.  Entries are confirmed by packets from the Node they were learned from, by Registry
+// sync and anti-entropy, and on every pass for Nodes which are directly connected.  Topology deletes are issued
+// for each removed entry.  Returns the number of entries removed.
+func (tt *TopologyTracker) WatchDog(entryTTL time.Duration) int {
+	thisTopologyTracker := tt
+	thisNode := thisTopologyTracker.drpNode
+
+	// Connections are not removed when they close; clean up after them here
+	for remoteNodeID, remoteEndpoint := range thisNode.listNodeEndpoints() {
+		if remoteEndpoint.baseEndpoint().isClosed() {
+			thisNode.removeNodeEndpoint(remoteNodeID, remoteEndpoint)
+			thisTopologyTracker.ProcessNodeDisconnect(remoteNodeID)
+		}
+	}
+
+	// Skip if we're waiting on re-connection to control plane
+	if !thisNode.IsRegistry() && !thisNode.ConnectedToControlPlane {
+		return 0
+	}
+
+	// Drop entries restored from disk which no live Node has confirmed
+	thisTopologyTracker.ExpireUnverified(thisTopologyTracker.UnverifiedGracePeriod)
+
+	removedCount := 0
+	relayList := []topologyRelay{}
+
+	thisTopologyTracker.tableLock.Lock()
+
+	// Forget deleted entries once late relays can no longer arrive
+	thisTopologyTracker.pruneTombstones(thisTopologyTracker.TombstoneTTL)
+	thisTopologyTracker.pruneSyncPoints(thisTopologyTracker.SyncPointTTL)
+
+	// A live connection keeps the entries of the Node at the other end current
+	thisTopologyTracker.markConnectedEntriesSeen()
+
+	for checkNodeID, checkNodeEntry := range *thisTopologyTracker.nodeTable {
+		// Skip local node and entries restored from disk, which ExpireUnverified handles
+		if checkNodeID == thisNode.NodeID || thisTopologyTracker.isUnverified("node", checkNodeID) {
+			continue
+		}
+
+		removeReason := ""
+		if checkNodeEntry.LearnedFrom == nil || !thisNode.IsConnectedTo(*checkNodeEntry.LearnedFrom) {
+			removeReason = "LearnedFrom Node is not connected"
+		} else if thisTopologyTracker.entryIsExpired("node", checkNodeID, entryTTL) {
+			removeReason = "entry has expired"
+		}
+		if removeReason == "" {
+			continue
+		}
+
+		thisNode.Log(fmt.Sprintf("Watchdog deleting Node [%s], %s", checkNodeID, removeReason), true)
+		nodeDeletePacket := TopologyPacket{thisNode.NodeID, "delete", "node", checkNodeID, *checkNodeEntry.Scope, *checkNodeEntry.Zone, checkNodeEntry.ToJSON(), checkNodeEntry.Sequence}
+		relayList = append(relayList, thisTopologyTracker.processPacket(nodeDeletePacket, thisNode.NodeID, false)...)
+		removedCount++
+	}
+
+	for checkServiceID, checkServiceEntry := range *thisTopologyTracker.serviceTable {
+		// Skip local services and entries restored from disk
+		if *checkServiceEntry.NodeID == thisNode.NodeID || thisTopologyTracker.isUnverified("service", checkServiceID) {
+			continue
+		}
+
+		removeReason := ""
+		if !thisTopologyTracker.nodeTable.HasEntry(*checkServiceEntry.NodeID) {
+			removeReason = fmt.Sprintf("Node [%s] not in Node table", *checkServiceEntry.NodeID)
+		} else if thisTopologyTracker.entryIsExpired("service", checkServiceID, entryTTL) {
+			removeReason = "entry has expired"
+		}
+		if removeReason == "" {
+			continue
+		}
+
+		thisNode.Log(fmt.Sprintf("Watchdog deleting Service [%s], %s", checkServiceID, removeReason), true)
+		serviceDeletePacket := TopologyPacket{thisNode.NodeID, "delete", "service", checkServiceID, *checkServiceEntry.Scope, *checkServiceEntry.Zone, checkServiceEntry.ToJSON(), checkServiceEntry.Sequence}
+		relayList = append(relayList, thisTopologyTracker.processPacket(serviceDeletePacket, thisNode.NodeID, false)...)
+		removedCount++
+	}
+
+	thisTopologyTracker.pruneEntriesSeen()
+
+	topologyEvents := thisTopologyTracker.takePendingEvents()
+	thisTopologyTracker.tableLock.Unlock()
+
+	thisTopologyTracker.sendEvents(topologyEvents)
+	thisTopologyTracker.sendRelays(relayList)
+
+	return removedCount
+}
+
+// entryIsExpired tells whether or not an entry was last confirmed longer ago than the TTL; a zero TTL never
+// expires.  Caller must hold tableLock.
+func (tt *TopologyTracker) entryIsExpired(entryType string, entryID string, entryTTL time.Duration) bool {
+	if entryTTL <= 0 {
+		return false
+	}
+	lastSeen, ok := tt.entryLastSeen[topologyEntryKey(entryType, entryID)]
+	if !ok {
+		// Not tracked yet; start the clock now
+		tt.markEntrySeen(entryType, entryID)
+		return false
+	}
+	return time.Since(lastSeen) > entryTTL
+}
+
+// markEntrySeen records that an entry was confirmed by its source; caller must hold tableLock
+func (tt *TopologyTracker) markEntrySeen(entryType string, entryID string) {
+	tt.entryLastSeen[topologyEntryKey(entryType, entryID)] = time.Now()
+}
+
+// markConnectedEntriesSeen confirms the entries of Nodes which are directly connected and open; caller must hold
+// tableLock
+func (tt *TopologyTracker) markConnectedEntriesSeen() {
+	thisTopologyTracker := tt
+	thisNode := thisTopologyTracker.drpNode
+
+	connectedNodes := make(map[string]bool)
+	for remoteNodeID, remoteEndpoint := range thisNode.listNodeEndpoints() {
+		if !remoteEndpoint.baseEndpoint().isClosed() {
+			connectedNodes[remoteNodeID] = true
+		}
+	}
+
+	for checkNodeID, checkNodeEntry := range *thisTopologyTracker.nodeTable {
+		if connectedNodes[checkNodeID] && derefString(checkNodeEntry.LearnedFrom) == checkNodeID {
+			thisTopologyTracker.markEntrySeen("node", checkNodeID)
+		}
+	}
+	for checkServiceID, checkServiceEntry := range *thisTopologyTracker.serviceTable {
+		if connectedNodes[*checkServiceEntry.NodeID] && derefString(checkServiceEntry.LearnedFrom) == *checkServiceEntry.NodeID {
+			thisTopologyTracker.markEntrySeen("service", checkServiceID)
+		}
+	}
+}
+
+// pruneEntriesSeen forgets confirmation times of entries no longer in the tables; caller must hold tableLock
+func (tt *TopologyTracker) pruneEntriesSeen() {
+	thisTopologyTracker := tt
+	for entryKey := range thisTopologyTracker.entryLastSeen {
+		entryType, entryID, _ := strings.Cut(entryKey, "/")
+		entryExists := false
+		switch entryType {
+		case "node":
+			entryExists = thisTopologyTracker.nodeTable.HasEntry(entryID)
+		case "service":
+			entryExists = thisTopologyTracker.serviceTable.HasEntry(entryID)
+		}
+		if !entryExists {
+			delete(thisTopologyTracker.entryLastSeen, entryKey)
+		}
+	}
+}
+
+// markEntriesSeen records that entries were confirmed by another Node, e.g. by anti-entropy
+func (tt *TopologyTracker) markEntriesSeen(confirmedEntries []*antiEntropyEntry) {
+	tt.tableLock.Lock()
+	defer tt.tableLock.Unlock()
+	for _, confirmedEntry := range confirmedEntries {
+		tt.markEntrySeen(confirmedEntry.entryType, confirmedEntry.entryID)
+	}
+}
@@ -0,0 +1,120 @@
+package drpmesh
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWatchDogEntryTTL(t *testing.T) {
+	localNodeID := "registry1"
+	thisNode := testNode(t, testNodeOptions("Registry", localNodeID))
+	thisTopologyTracker := thisNode.TopologyTracker
+	entryTTL := 100 * time.Millisecond
+
+	// addEntries advertises a Node and its Worker service as received from a connected Node
+	addEntries := func(nodeID string, srcNodeID string, isRegistry bool) *ServiceTableEntry {
+		nodeEntry := testNodeEntry(nodeID)
+		if isRegistry {
+			nodeEntry.Roles = []string{"Registry"}
+		}
+		serviceEntry := testServiceEntry(nodeID, "Worker")
+		thisTopologyTracker.ProcessPacket(TopologyPacket{nodeID, "add", "node", nodeID, *nodeEntry.Scope, *nodeEntry.Zone, nodeEntry.ToJSON(), 1}, srcNodeID, false)
+		thisTopologyTracker.ProcessPacket(TopologyPacket{nodeID, "add", "service", *serviceEntry.InstanceID, *serviceEntry.Scope, *serviceEntry.Zone, serviceEntry.ToJSON(), 1}, srcNodeID, false)
+		return serviceEntry
+	}
+
+	// A directly connected Provider and a peer Registry, which tells us about a Provider connected to it
+	addEntries("provider1", "provider1", false)
+	thisNode.setNodeEndpoint("provider1", newRecordingEndpoint(thisNode, "provider1"))
+	addEntries("registry2", "registry2", true)
+	thisNode.setNodeEndpoint("registry2", newRecordingEndpoint(thisNode, "registry2"))
+	remoteServiceEntry := addEntries("provider2", "registry2", false)
+	if thisTopologyTracker.GetServiceEntry(*remoteServiceEntry.InstanceID) == nil {
+		t.Fatalf("expected the remote service to be learned from the peer Registry")
+	}
+
+	if removedCount := thisTopologyTracker.WatchDog(entryTTL); removedCount != 0 {
+		t.Fatalf("expected fresh entries to be kept, removed %d", removedCount)
+	}
+
+	// Healthy entries are confirmed without being modified; only the remote Node is re-advertised by its source
+	time.Sleep(2 * entryTTL)
+	remoteNodeEntry := testNodeEntry("provider2")
+	thisTopologyTracker.ProcessPacket(TopologyPacket{"provider2", "add", "node", "provider2", *remoteNodeEntry.Scope, *remoteNodeEntry.Zone, remoteNodeEntry.ToJSON(), 1}, "registry2", false)
+
+	if removedCount := thisTopologyTracker.WatchDog(entryTTL); removedCount != 1 {
+		t.Fatalf("expected only the unconfirmed remote service to expire, removed %d", removedCount)
+	}
+	if thisTopologyTracker.GetServiceEntry(*remoteServiceEntry.InstanceID) != nil {
+		t.Fatalf("expected the unconfirmed remote service to be removed")
+	}
+	for _, keptNodeID := range []string{"provider1", "registry2", "provider2"} {
+		if thisTopologyTracker.GetNodeEntry(keptNodeID) == nil {
+			t.Fatalf("expected Node [%s] to be kept", keptNodeID)
+		}
+	}
+	if thisTopologyTracker.GetServiceEntry("provider1-Worker") == nil || thisTopologyTracker.GetServiceEntry("registry2-Worker") == nil {
+		t.Fatalf("expected the services of directly connected Nodes to be kept")
+	}
+
+	// Without a TTL nothing ages out
+	time.Sleep(2 * entryTTL)
+	thisNode.removeNodeEndpoint("provider1", thisNode.GetNodeEndpoint("provider1"))
+	if removedCount := thisTopologyTracker.WatchDog(0); removedCount != 1 || thisTopologyTracker.GetNodeEntry("provider2") == nil {
+		t.Fatalf("expected only the disconnected Provider to be removed, removed %d", removedCount)
+	}
+	if thisTopologyTracker.GetNodeEntry("provider1") != nil || thisTopologyTracker.GetServiceEntry("provider1-Worker") != nil {
+		t.Fatalf("expected the disconnected Provider and its service to be removed")
+	}
+}
+
+func TestWatchDogClosedConnection(t *testing.T) {
+	localNodeID := "registry1"
+	thisNode := testNode(t, testNodeOptions("Registry", localNodeID))
+	thisTopologyTracker := thisNode.TopologyTracker
+
+	providerNodeID := "provider1"
+	serverEndpoint, clientConn := testEndpointPair(t, thisNode, providerNodeID)
+	thisNode.setNodeEndpoint(providerNodeID, serverEndpoint)
+	providerEntry := testNodeEntry(providerNodeID)
+	thisTopologyTracker.ProcessPacket(TopologyPacket{providerNodeID, "add", "node", providerNodeID, *providerEntry.Scope, *providerEntry.Zone, providerEntry.ToJSON(), 1}, providerNodeID, false)
+
+	if thisTopologyTracker.WatchDog(0) != 0 || !thisNode.IsConnectedTo(providerNodeID) {
+		t.Fatalf("expected an open connection to be kept")
+	}
+
+	// The WatchDog processes the disconnect once the connection is lost
+	clientConn.Close()
+	waitFor(t, "the connection to close", serverEndpoint.isClosed)
+	thisTopologyTracker.WatchDog(0)
+	if thisNode.IsConnectedTo(providerNodeID) || thisTopologyTracker.GetNodeEntry(providerNodeID) != nil {
+		t.Fatalf("expected the closed connection and its Node entry to be removed")
+	}
+}
+
+func TestStaleEntryCleanup(t *testing.T) {
+	localNodeID := "registry1"
+	thisNode := testNode(t, testNodeOptions("Registry", localNodeID))
+	thisTopologyTracker := thisNode.TopologyTracker
+
+	// A service whose Node is gone and a Node learned through a Node which is gone
+	orphanServiceEntry := testServiceEntry("provider1", "Worker")
+	orphanNodeEntry := testNodeEntry("provider2")
+	missingNodeID := "registry2"
+	orphanNodeEntry.LearnedFrom = &missingNodeID
+	thisTopologyTracker.tableLock.Lock()
+	thisTopologyTracker.serviceTable.AddEntry(*orphanServiceEntry.InstanceID, orphanServiceEntry, thisNode.GetTimestamp())
+	thisTopologyTracker.nodeTable.AddEntry("provider2", orphanNodeEntry, thisNode.GetTimestamp())
+	thisTopologyTracker.tableLock.Unlock()
+
+	thisTopologyTracker.StaleEntryCleanup()
+	if thisTopologyTracker.GetServiceEntry(*orphanServiceEntry.InstanceID) != nil {
+		t.Fatalf("expected the orphaned service to be removed by instance ID")
+	}
+	if thisTopologyTracker.GetNodeEntry("provider2") != nil {
+		t.Fatalf("expected the Node learned through a missing Node to be removed")
+	}
+	if thisTopologyTracker.GetNodeEntry(localNodeID) == nil || len(thisTopologyTracker.ListServices(nil, nil)) == 0 {
+		t.Fatalf("expected the local Node and its services to be kept")
+	}
+}
@@ -0,0 +1,91 @@
+package drpmesh
+
+import (
+	"fmt"
+)
+
+// ZoneAny matches any zone in a zone preference list
+const ZoneAny = "*"
+
+// ServiceSelection is the result of choosing a service instance, along with the zone preference tier it came from.
+// Tier 0 is the requested (or local) zone; higher tiers are fallbacks from the preference list.
+type ServiceSelection struct {
+	ServiceEntry *ServiceTableEntry
+	Tier         int
+	TierZone     string
+}
+
+// SetZonePreferences sets the ordered list of fallback zones tried after the local zone, e.g. ["us-central", "*"].
+// Zone scoped services are only visible in zones named explicitly; ZoneAny matches local and global services in any
+// zone.  An empty list restores the default of the local zone, then anywhere.
+func (tt *TopologyTracker) SetZonePreferences(zonePreferences []string) {
+	tt.zonePolicyLock.Lock()
+	if len(zonePreferences) == 0 {
+		tt.zonePreferences = []string{ZoneAny}
+	} else {
+		tt.zonePreferences = append([]string{}, zonePreferences...)
+	}
+	tt.zonePolicyLock.Unlock()
+
+	// Dependencies of local services may have come into or gone out of reach
+	tt.drpNode.EvaluateDependencies()
+}
+
+// GetZonePreferences returns the ordered list of fallback zones
+func (tt *TopologyTracker) GetZonePreferences() []string {
+	tt.zonePolicyLock.RLock()
+	defer tt.zonePolicyLock.RUnlock()
+	return append([]string{}, tt.zonePreferences...)
+}
+
+// SetCrossZoneFallback sets whether or not a service may be selected outside the requested zone
+func (tt *TopologyTracker) SetCrossZoneFallback(serviceName string, allowFallback bool) {
+	tt.zonePolicyLock.Lock()
+	if allowFallback {
+		delete(tt.noCrossZoneServices, serviceName)
+	} else {
+		tt.noCrossZoneServices[serviceName] = true
+	}
+	tt.zonePolicyLock.Unlock()
+
+	tt.drpNode.EvaluateDependencies()
+}
+
+// getZoneTiers returns the zones to try in order for a service, starting with the requested zone
+func (tt *TopologyTracker) getZoneTiers(serviceName *string, checkZone string) []string {
+	tt.zonePolicyLock.RLock()
+	defer tt.zonePolicyLock.RUnlock()
+
+	zoneTiers := []string{checkZone}
+	if serviceName != nil && tt.noCrossZoneServices[*serviceName] {
+		return zoneTiers
+	}
+	for _, preferredZone := range tt.zonePreferences {
+		if preferredZone != checkZone {
+			zoneTiers = append(zoneTiers, preferredZone)
+		}
+	}
+	return zoneTiers
+}
+
+// getZoneTier returns the first tier a service entry can be selected from, or -1 if none allows it.  Zone scoped
+// services must be in the tier's zone; ZoneAny only matches local and global services.
+func getZoneTier(serviceTableEntry *ServiceTableEntry, zoneTiers []string) int {
+	for tierIndex, tierZone := range zoneTiers {
+		if tierZone == *serviceTableEntry.Zone {
+			return tierIndex
+		}
+		if tierZone == ZoneAny && *serviceTableEntry.Scope != "zone" {
+			return tierIndex
+		}
+	}
+	return -1
+}
+
+// String describes the selection for logging
+func (ss *ServiceSelection) String() string {
+	if ss == nil || ss.ServiceEntry == nil {
+		return "no instance"
+	}
+	return fmt.Sprintf("instance [%s] from tier %d (%s)", *ss.ServiceEntry.InstanceID, ss.Tier, ss.TierZone)
+}
@@ -0,0 +1,97 @@
+package drpmesh
+
+import (
+	"testing"
+)
+
+func TestZonePreferences(t *testing.T) {
+	localNodeID := "registry1"
+	serviceName := "TestService"
+	thisNode := testNode(t, testNodeOptions("Registry", localNodeID))
+	thisTopologyTracker := thisNode.TopologyTracker
+
+	// Offer the service in zone2 globally and in zone3 as a zone scoped service
+	for _, zoneName := range []string{"zone2", "zone3"} {
+		nodeID := "provider-" + zoneName
+		serviceScope := "global"
+		if zoneName == "zone3" {
+			serviceScope = "zone"
+		}
+		nodeEntry := testNodeEntry(nodeID)
+		nodeEntry.Zone = &zoneName
+		serviceEntry := testServiceEntry(nodeID, serviceName)
+		serviceEntry.Zone = &zoneName
+		serviceEntry.Scope = &serviceScope
+		thisTopologyTracker.ProcessPacket(TopologyPacket{nodeID, "add", "node", nodeID, *nodeEntry.Scope, zoneName, nodeEntry.ToJSON(), 0}, nodeID, false)
+		thisTopologyTracker.ProcessPacket(TopologyPacket{nodeID, "add", "service", *serviceEntry.InstanceID, serviceScope, zoneName, serviceEntry.ToJSON(), 0}, nodeID, false)
+	}
+
+	// By default only the global service outside the local zone is visible
+	serviceSelection := thisTopologyTracker.SelectInstanceOfService(&serviceName, nil, nil, nil, nil, nil)
+	if serviceSelection == nil || *serviceSelection.ServiceEntry.Zone != "zone2" || serviceSelection.Tier != 1 || serviceSelection.TierZone != ZoneAny {
+		t.Fatalf("expected zone2 instance from the ZoneAny tier, got %s", serviceSelection)
+	}
+
+	// Naming zone3 first makes its zone scoped instance preferred
+	thisTopologyTracker.SetZonePreferences([]string{"zone3", ZoneAny})
+	serviceSelection = thisTopologyTracker.SelectInstanceOfService(&serviceName, nil, nil, nil, nil, nil)
+	if serviceSelection == nil || *serviceSelection.ServiceEntry.Zone != "zone3" || serviceSelection.Tier != 1 || serviceSelection.TierZone != "zone3" {
+		t.Fatalf("expected zone3 instance from tier 1, got %s", serviceSelection)
+	}
+
+	// Services which may not leave the local zone find nothing
+	thisTopologyTracker.SetCrossZoneFallback(serviceName, false)
+	if serviceSelection = thisTopologyTracker.SelectInstanceOfService(&serviceName, nil, nil, nil, nil, nil); serviceSelection != nil {
+		t.Fatalf("expected no instance without cross-zone fallback, got %s", serviceSelection)
+	}
+}
+
+func TestZonePreferenceLocalInstances(t *testing.T) {
+	serviceName := "TestService"
+	thisNode := testNode(t, testNodeOptions("Registry", "registry1"))
+	thisTopologyTracker := thisNode.TopologyTracker
+	zone2Name := "zone2"
+	thisTopologyTracker.SetZonePreferences([]string{zone2Name, ZoneAny})
+
+	// The service is offered locally in zone1 and by a Provider in zone2
+	remoteEntry := testServiceEntry("provider2", serviceName)
+	remoteEntry.Zone = &zone2Name
+	addTestProvider(thisTopologyTracker, "provider2", zone2Name)
+	thisTopologyTracker.ProcessPacket(TopologyPacket{"provider2", "add", "service", *remoteEntry.InstanceID, *remoteEntry.Scope, zone2Name, remoteEntry.ToJSON(), 0}, "provider2", false)
+	thisNode.AddService(&Service{ServiceName: serviceName, Type: serviceName, Priority: 10, Weight: 10, Zone: "zone1", Scope: "zone", Streams: []string{}, Status: ServiceStatusReady})
+
+	// selectIn selects an instance, optionally from a requested zone
+	selectIn := func(zoneName *string) *ServiceSelection {
+		t.Helper()
+		serviceSelection := thisTopologyTracker.SelectInstanceOfService(&serviceName, nil, zoneName, nil, nil, nil)
+		if serviceSelection == nil {
+			t.Fatalf("expected an instance for zone %v", zoneName)
+		}
+		return serviceSelection
+	}
+
+	// Without a requested zone the local instance wins from tier 0, even though the remote one has a lower priority
+	remoteEntry.Priority = 1
+	thisTopologyTracker.ProcessPacket(TopologyPacket{"provider2", "update", "service", *remoteEntry.InstanceID, *remoteEntry.Scope, zone2Name, remoteEntry.ToJSON(), 0}, "provider2", false)
+	if serviceSelection := selectIn(nil); *serviceSelection.ServiceEntry.NodeID != "registry1" || serviceSelection.Tier != 0 || serviceSelection.TierZone != "zone1" {
+		t.Fatalf("expected the local instance from tier 0 (zone1), got %s", serviceSelection)
+	}
+
+	// A zone scoped local instance is not visible from another zone
+	if serviceSelection := selectIn(&zone2Name); *serviceSelection.ServiceEntry.NodeID != "provider2" || serviceSelection.Tier != 0 || serviceSelection.TierZone != zone2Name {
+		t.Fatalf("expected the zone2 instance from tier 0, got %s", serviceSelection)
+	}
+
+	// A global local instance is a fallback tier for another zone, so the requested zone's instance still wins
+	thisNode.RemoveService(serviceName)
+	thisNode.AddService(&Service{ServiceName: serviceName, Type: serviceName, Priority: 10, Weight: 10, Zone: "zone1", Scope: "global", Streams: []string{}, Status: ServiceStatusReady})
+	if serviceSelection := selectIn(&zone2Name); *serviceSelection.ServiceEntry.NodeID != "provider2" {
+		t.Fatalf("expected the zone2 instance over a local fallback, got %s", serviceSelection)
+	}
+
+	// Once the requested zone has no instance, the local one is selected and tagged with the tier it matched
+	thisTopologyTracker.ProcessPacket(TopologyPacket{"provider2", "delete", "service", *remoteEntry.InstanceID, *remoteEntry.Scope, zone2Name, remoteEntry.ToJSON(), 0}, "provider2", false)
+	if serviceSelection := selectIn(&zone2Name); *serviceSelection.ServiceEntry.NodeID != "registry1" || serviceSelection.Tier != 1 || serviceSelection.TierZone != ZoneAny {
+		t.Fatalf("expected the local instance from the ZoneAny tier, got %s", serviceSelection)
+	}
+}
@@ -15,7 +15,19 @@ func main() {
 	fmt.Println("Test DRP_Node Instantiation:")
 	//listeningName := "ws://somehost.domain.com:8080"
 	nodeHostname, _ := os.Hostname()
-	ThisNode := drpmesh.CreateNode([]string{"Provider"}, nodeHostname, "mydomain.xyz", "asdfasdf", "MyZone", "global", nil, nil, nil, true)
+	ThisNode, err := drpmesh.CreateNode(drpmesh.NodeOptions{
+		NodeRoles:  []string{"Provider"},
+		HostID:     nodeHostname,
+		DomainName: "mydomain.xyz",
+		MeshKey:    "asdfasdf",
+		Zone:       "MyZone",
+		Scope:      "global",
+		Debug:      true,
+	})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 	ThisNode.Log("Node created", false)
 	//fmt.Printf("%+v\n", thisNode)
 	//thisNode.ConnectToBroker("ws://localhost:8080", nil)
@@ -29,13 +41,13 @@ func main() {
 	*/
 	ThisNode.ConnectToRegistry("ws://localhost:8080", nil, nil)
 
-	TestService2 := &drpmesh.Service{ServiceName: "TestService2", DRPNode: ThisNode, Type: "TestService2", InstanceID: "", Sticky: false, Priority: 10, Weight: 10, Zone: ThisNode.Zone, Scope: "global", Dependencies: []string{}, Streams: []string{}, Status: 1, ClientCmds: make(map[string]drpmesh.EndpointMethod), Classes: nil}
+	TestService2 := &drpmesh.Service{ServiceName: "TestService2", DRPNode: ThisNode, Type: "TestService2", InstanceID: "", Sticky: false, Priority: 10, Weight: 10, Zone: ThisNode.Zone, Scope: "global", Dependencies: []string{}, Streams: []string{}, Status: drpmesh.ServiceStatusReady, ClientCmds: make(map[string]drpmesh.EndpointMethod), Classes: nil}
 	TestService2.ClientCmds = make(map[string]drpmesh.EndpointMethod)
 	TestService2.ClientCmds["testFunc1"] = func(params *drpmesh.CmdParams, callingEndpoint drpmesh.EndpointInterface, token *int) interface{} {
 		return "A static response"
 	}
 
-	ThisNode.AddService(*TestService2)
+	ThisNode.AddService(TestService2)
 
 	//thisNode.ConnectToMesh()
 